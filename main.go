@@ -1,47 +1,182 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/tonyfg/trucker/pkg/logging"
 	"github.com/tonyfg/trucker/pkg/mainroutines"
+	"github.com/tonyfg/trucker/pkg/trucktest"
 )
 
 var version = "undefined"
 
+// command is one of trucker's subcommands. Flags go before the arguments, and
+// the project path is always the last argument (the current directory if it's
+// left out).
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "run [-truck a,b] [-dry-run] [project path]", "backfill and stream changes (the default)", run},
+		{"validate", "validate [project path]", "check trucker.yml and truck.yml without connecting to anything", validate},
+		{"doctor", "doctor [project path]", "check that the databases are set up for trucker", doctor},
+		{"status", "status [-truck a,b] [-json] [project path]", "show the replication slots and how far behind each truck is", status},
+		{"backfill", "backfill [-truck a,b] [-dry-run] [project path]", "reset trucks and backfill them again, then exit", backfill},
+		{"reset", "reset [-truck a,b] [-dry-run] [project path]", "make trucks start over with a backfill on their next run", reset},
+		{"migrate", "migrate <up|status> [project path] | migrate down <connection> [project path]", "manage database migrations", migrate},
+		{"test", "test [-truck a,b] [-junit report.xml] [-timeout 60s] [project path]", "run the trucks' tests", test},
+		{"redrive", "redrive <truck> [project path]", "write a truck's dead letters again", redrive},
+		{"version", "version", "print trucker's version", printVersion},
+		{"help", "help", "show this help", func([]string) { usage(os.Stdout) }},
+	}
+}
+
 func main() {
-	log.Printf("Trucker version %s. Firing up the engine!\n", version)
+	args := os.Args[1:]
+
+	// Without a command, the arguments are run's, like `trucker [project path]`
+	if len(args) > 0 {
+		for _, c := range commands {
+			if c.name == args[0] {
+				c.run(args[1:])
+				return
+			}
+		}
+	}
+
+	run(args)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: trucker <command> [flags] [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w, "\nEvery command but version and help also takes -project <path> and -log-level <level>.")
+	fmt.Fprintln(w, "Run trucker <command> -h for the flags of a command.")
+}
+
+// setUsage makes -h show the usage of the command the flags are for.
+func setUsage(flags *flag.FlagSet) {
+	flags.Usage = func() {
+		for _, c := range commands {
+			if c.name == flags.Name() {
+				fmt.Fprintf(flags.Output(), "Usage: trucker %s\n", c.usage)
+			}
+		}
+		flags.PrintDefaults()
+	}
+}
+
+// parseFlags parses the flags every command has, plus the ones the command
+// added to flags, and returns the options and the arguments after the flags.
+// nargs is the number of arguments before the project path.
+func parseFlags(flags *flag.FlagSet, args []string, nargs int) (mainroutines.Options, []string) {
+	setUsage(flags)
+	projectPath := flags.String("project", "", "path to the trucker project (default: the last argument, or the current directory)")
+	logLevel := flags.String("log-level", "", "log at this level (debug, info, warn or error) instead of the configured ones")
+	flags.Parse(args)
+
+	rest := flags.Args()
+	if len(rest) < nargs || len(rest) > nargs+1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	opts := mainroutines.Options{ProjectPath: *projectPath, LogLevel: *logLevel}
+	if len(rest) > nargs {
+		if opts.ProjectPath != "" {
+			logging.Fatal("The project path can be given with -project or as an argument, but not both")
+		}
+		opts.ProjectPath = rest[nargs]
+	}
+	if opts.ProjectPath == "" {
+		opts.ProjectPath = currentDir()
+	}
+
+	if opts.LogLevel != "" {
+		// Right away, so it applies to loading the configuration too
+		if err := logging.Setup(os.Stderr, "", opts.LogLevel); err != nil {
+			logging.Fatal("Invalid -log-level", logging.Err(err))
+		}
+	}
+
+	return opts, rest[:nargs]
+}
+
+// truckFlag adds the -truck flag, and returns a function that gets the truck
+// names from it once the flags are parsed.
+func truckFlag(flags *flag.FlagSet) func() []string {
+	names := flags.String("truck", "", "comma separated names of the trucks to use (default: all of them)")
+
+	return func() []string {
+		trucks := make([]string, 0)
+		for _, name := range strings.Split(*names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				trucks = append(trucks, name)
+			}
+		}
+		return trucks
+	}
+}
+
+func dryRunFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("dry-run", false, "show what would be done without changing anything")
+}
+
+// run handles `trucker [run] [-truck a,b] [-dry-run] [project path]`
+func run(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	trucks := truckFlag(flags)
+	dryRun := dryRunFlag(flags)
+	opts, _ := parseFlags(flags, args, 0)
+	opts.Trucks = trucks()
+	opts.DryRun = *dryRun
+
+	if opts.DryRun {
+		if err := mainroutines.Plan(opts, os.Stdout); err != nil {
+			logging.Fatal("Unable to plan", logging.Err(err))
+		}
+		return
+	}
+
+	slog.Info("Firing up the engine!", "version", version)
 	sigChan := trapSignals()
-	projectPath := projectPathFromArgsOrCwd()
-	doneChan, truckCfgs, trucksByInputConnection := mainroutines.Start(projectPath)
+	doneChan, truckCfgs, trucksByInputConnection := mainroutines.Start(opts)
 
 	if len(truckCfgs) > 0 {
 	outerLoop:
 		for {
 			select {
 			case <-sigChan:
-				log.Println("Received termination signal. Stopping all trucks...")
-				for _, trucks := range trucksByInputConnection {
-					for _, truck := range trucks {
-						truck.Stop()
-					}
-				}
+				slog.Info("Received termination signal. Stopping all trucks...")
+				mainroutines.Stop(trucksByInputConnection)
 				break outerLoop
 			case exit := <-doneChan:
-				log.Printf("Truck '%s' stopped early: %s\nBailing out...\n", exit.TruckName, exit.Msg)
-				for _, trucks := range trucksByInputConnection {
-					for _, truck := range trucks {
-						truck.Stop()
-					}
-				}
+				slog.Error("Truck stopped early. Bailing out...", "truck", exit.TruckName, "reason", exit.Msg)
+				mainroutines.Stop(trucksByInputConnection)
 				break outerLoop
 			}
 		}
 	}
 
-	log.Println("All trucks stopped. Exiting!")
+	slog.Info("All trucks stopped. Exiting!")
 }
 
 func trapSignals() chan os.Signal {
@@ -50,14 +185,160 @@ func trapSignals() chan os.Signal {
 	return sigChan
 }
 
-func projectPathFromArgsOrCwd() string {
-	if len(os.Args) > 1 {
-		return os.Args[1]
+// validate handles `trucker validate [project path]`
+func validate(args []string) {
+	opts, _ := parseFlags(flag.NewFlagSet("validate", flag.ExitOnError), args, 0)
+
+	if err := mainroutines.Validate(opts, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// doctor handles `trucker doctor [project path]`
+func doctor(args []string) {
+	opts, _ := parseFlags(flag.NewFlagSet("doctor", flag.ExitOnError), args, 0)
+
+	ok, err := mainroutines.Doctor(opts, os.Stdout)
+	if err != nil {
+		logging.Fatal("Unable to run checks", logging.Err(err))
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// status handles `trucker status [-truck a,b] [-json] [project path]`
+func status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	trucks := truckFlag(flags)
+	asJson := flags.Bool("json", false, "print the status as JSON")
+	opts, _ := parseFlags(flags, args, 0)
+	opts.Trucks = trucks()
+
+	ok, err := mainroutines.Status(opts, os.Stdout, *asJson)
+	if err != nil {
+		logging.Fatal("Unable to get status", logging.Err(err))
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// backfill handles `trucker backfill [-truck a,b] [-dry-run] [project path]`
+func backfill(args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	trucks := truckFlag(flags)
+	dryRun := dryRunFlag(flags)
+	opts, _ := parseFlags(flags, args, 0)
+	opts.Trucks = trucks()
+	opts.DryRun = *dryRun
+
+	if err := mainroutines.Backfill(opts, os.Stdout); err != nil {
+		logging.Fatal("Backfill failed", logging.Err(err))
+	}
+}
+
+// reset handles `trucker reset [-truck a,b] [-dry-run] [project path]`
+func reset(args []string) {
+	flags := flag.NewFlagSet("reset", flag.ExitOnError)
+	trucks := truckFlag(flags)
+	dryRun := dryRunFlag(flags)
+	opts, _ := parseFlags(flags, args, 0)
+	opts.Trucks = trucks()
+	opts.DryRun = *dryRun
+
+	if err := mainroutines.Reset(opts, os.Stdout); err != nil {
+		logging.Fatal("Reset failed", logging.Err(err))
+	}
+}
+
+// redrive handles `trucker redrive <truck> [project path]`
+func redrive(args []string) {
+	opts, rest := parseFlags(flag.NewFlagSet("redrive", flag.ExitOnError), args, 1)
+
+	if err := mainroutines.Redrive(opts, rest[0]); err != nil {
+		logging.Fatal("Redrive failed", logging.Err(err))
+	}
+}
+
+// migrate handles `trucker migrate <up|status> [project path]` and
+// `trucker migrate down <connection> [project path]`
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	subcommand := ""
+	if len(args) > 0 {
+		subcommand = args[0]
+	}
+
+	var err error
+	switch subcommand {
+	case "up":
+		opts, _ := parseFlags(flags, args[1:], 0)
+		err = mainroutines.MigrateUp(opts)
+	case "status":
+		opts, _ := parseFlags(flags, args[1:], 0)
+		err = mainroutines.MigrateStatus(opts, os.Stdout)
+	case "down":
+		opts, rest := parseFlags(flags, args[1:], 1)
+		err = mainroutines.MigrateDown(opts, rest[0])
+	default:
+		setUsage(flags)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		logging.Fatal("Migration failed", logging.Err(err))
+	}
+}
+
+// test handles `trucker test [-truck a,b] [-junit report.xml] [-timeout 60s] [project path]`
+func test(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	junitPath := flags.String("junit", "", "write a JUnit XML report to this file")
+	timeout := flags.Duration("timeout", 60*time.Second, "how long each test may take to backfill and catch up")
+	trucks := truckFlag(flags)
+	opts, _ := parseFlags(flags, args, 0)
+	opts.Trucks = trucks()
+
+	results, err := mainroutines.Test(opts, *timeout)
+	if err != nil {
+		logging.Fatal("Unable to run tests", logging.Err(err))
+	}
+
+	trucktest.Print(os.Stdout, results)
+
+	if *junitPath != "" {
+		f, err := os.Create(*junitPath)
+		if err != nil {
+			logging.Fatal("Unable to write JUnit report", logging.Err(err))
+		}
+		err = trucktest.WriteJUnit(f, results)
+		f.Close()
+		if err != nil {
+			logging.Fatal("Unable to write JUnit report", logging.Err(err))
+		}
 	}
 
+	for _, r := range results {
+		if !r.Passed() {
+			os.Exit(1)
+		}
+	}
+}
+
+// printVersion handles `trucker version`
+func printVersion([]string) {
+	fmt.Println(version)
+}
+
+func currentDir() string {
 	dir, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Unable to get the current directory", logging.Err(err))
 	}
 
 	return dir
@@ -0,0 +1,122 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/ch-go"
+	"github.com/ClickHouse/ch-go/proto"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// GetBackfillProgress returns how far the truck's backfills have got, for the
+// input tables it has unfinished backfills of. It's empty once a backfill is
+// complete (or if position tracking isn't set up yet).
+func (w *Writer) GetBackfillProgress() ([]db.BackfillProgress, error) {
+	var inputTable proto.ColStr
+	var snapshotLsn proto.ColUInt64
+	var done proto.ColUInt8
+	lastKey := new(proto.ColStr).Array()
+
+	if err := w.conn.Do(context.Background(), ch.Query{
+		Body: fmt.Sprintf("SELECT input_table, snapshot_lsn, last_key, done FROM %s FINAL ORDER BY input_table", w.backfillTable),
+		Result: proto.Results{
+			{Name: "input_table", Data: &inputTable},
+			{Name: "snapshot_lsn", Data: &snapshotLsn},
+			{Name: "last_key", Data: lastKey},
+			{Name: "done", Data: &done},
+		},
+	}); ch.IsErr(err, proto.ErrUnknownTable) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &db.Error{Op: "get backfill progress", Err: err}
+	}
+
+	progress := make([]db.BackfillProgress, inputTable.Rows())
+	for i := range progress {
+		progress[i] = db.BackfillProgress{
+			Table:       inputTable.Row(i),
+			SnapshotLSN: snapshotLsn.Row(i),
+			Done:        done.Row(i) == 1,
+		}
+		if key := lastKey.Row(i); len(key) > 0 {
+			progress[i].LastKey = key
+		}
+	}
+
+	return progress, nil
+}
+
+// SetBackfillProgress records how far a backfill has got, like before its first
+// chunk is written. ClickHouse can't update rows in place, so it inserts a new
+// version of the table's progress that the ReplacingMergeTree keeps instead.
+func (w *Writer) SetBackfillProgress(progress db.BackfillProgress) error {
+	var inputTable proto.ColStr
+	var snapshotLsn, version proto.ColUInt64
+	var done proto.ColUInt8
+	lastKey := new(proto.ColStr).Array()
+
+	inputTable.Append(progress.Table)
+	snapshotLsn.Append(progress.SnapshotLSN)
+	lastKey.Append(progress.LastKey)
+	version.Append(uint64(time.Now().UnixNano()))
+	if progress.Done {
+		done.Append(1)
+	} else {
+		done.Append(0)
+	}
+
+	input := proto.Input{
+		{Name: "input_table", Data: &inputTable},
+		{Name: "snapshot_lsn", Data: &snapshotLsn},
+		{Name: "last_key", Data: lastKey},
+		{Name: "done", Data: &done},
+		{Name: "version", Data: &version},
+	}
+	err := w.chDo(context.Background(), ch.Query{
+		Body:  input.Into(w.backfillTable),
+		Input: input,
+	})
+	if err != nil {
+		return &db.Error{Op: "set backfill progress", Table: progress.Table, Err: err}
+	}
+
+	return nil
+}
+
+// WriteBackfillChunk writes a chunk of a backfill, and then records the
+// progress it makes. ClickHouse doesn't have transactions, so chunks are only
+// inserted once the ones before them are recorded, and the chunk's inserts get
+// a deduplication token derived from where it ends. If we crash before the
+// progress is recorded and write the chunk again, output tables that have
+// deduplication enabled will ignore it.
+func (w *Writer) WriteBackfillChunk(changeset *db.ChanChangeset, chunk *db.BackfillChunk) (bool, error) {
+	if err := chunk.WaitTurn(); err != nil {
+		changeset.Discard()
+		return false, err
+	}
+
+	dedupToken := fmt.Sprintf("%s:backfill:%s:%d:%s", w.dedupPrefix, chunk.Table, chunk.SnapshotLSN, strings.Join(chunk.End, ","))
+	wrote, err := w.write(changeset, dedupToken)
+	if err != nil {
+		return false, err
+	}
+
+	return wrote, chunk.Commit(w.SetBackfillProgress)
+}
+
+// ClearBackfillProgress forgets about the truck's backfills, once they're
+// complete or when the truck is reset.
+func (w *Writer) ClearBackfillProgress() error {
+	err := w.chDo(context.Background(), ch.Query{
+		Body: fmt.Sprintf("TRUNCATE TABLE IF EXISTS %s", w.backfillTable),
+	})
+	if err != nil {
+		return &db.Error{Op: "clear backfill progress", Err: err}
+	}
+
+	return nil
+}
@@ -6,9 +6,13 @@ import (
 
 	"github.com/ClickHouse/ch-go"
 	"github.com/ClickHouse/ch-go/chpool"
+
+	"github.com/tonyfg/trucker/pkg/db"
 )
 
-func NewConnection(user string, pass string, host string, port uint16, database string) *chpool.Pool {
+// NewConnection returns a pool of connections to the database, once it has
+// made sure the server can be reached.
+func NewConnection(user string, pass string, host string, port uint16, database string) (*chpool.Pool, error) {
 	if port == 0 {
 		port = 9000
 	}
@@ -26,8 +30,8 @@ func NewConnection(user string, pass string, host string, port uint16, database
 		},
 	)
 	if err != nil {
-		panic(err)
+		return nil, &db.Error{Op: "connect to " + host, Err: err}
 	}
 
-	return conn
+	return conn, nil
 }
@@ -0,0 +1,188 @@
+package clickhouse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/ch-go"
+	"github.com/ClickHouse/ch-go/chpool"
+	"github.com/ClickHouse/ch-go/proto"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// DeadLetterTable keeps a truck's dead letters in a table in its output
+// database. ClickHouse can't update rows in place, so resolving a dead letter
+// inserts a new version of it that the ReplacingMergeTree keeps instead.
+type DeadLetterTable struct {
+	table string
+	conn  *chpool.Pool
+}
+
+func NewDeadLetterTable(truckName string, cfg config.Connection, uniqueId string) (*DeadLetterTable, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetterTable{
+		table: fmt.Sprintf(`"%s"."trucker_dead_letters__%s%s"`, cfg.Database, truckName, uniqueId),
+		conn:  conn,
+	}, nil
+}
+
+func (d *DeadLetterTable) Setup() error {
+	err := d.conn.Do(context.Background(), ch.Query{
+		Body: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+id String,
+lsn UInt64,
+input_table String,
+operation String,
+columns String,
+rows String,
+sql String,
+error String,
+created_at DateTime64(3),
+resolved UInt8,
+version UInt64
+)
+ENGINE = ReplacingMergeTree(version)
+ORDER BY (id)`, d.table),
+	})
+	if err != nil {
+		return &db.Error{Op: "setup dead letters", Err: err}
+	}
+
+	return nil
+}
+
+func (d *DeadLetterTable) Send(letter *db.DeadLetter) error {
+	if letter.Id == "" {
+		letter.Id = fmt.Sprintf("%d-%d", letter.Position, time.Now().UnixNano())
+	}
+
+	if err := d.insert(letter, false); err != nil {
+		return &db.Error{Op: "send dead letter", Table: letter.Table, Err: err}
+	}
+
+	return nil
+}
+
+func (d *DeadLetterTable) Pending() ([]*db.DeadLetter, error) {
+	var id, inputTable, operation, columns, rows, sql, errorMsg proto.ColStr
+	var lsn proto.ColUInt64
+	createdAt := new(proto.ColDateTime64).WithPrecision(proto.PrecisionMilli)
+
+	err := d.conn.Do(context.Background(), ch.Query{
+		Body: fmt.Sprintf(`SELECT id, lsn, input_table, operation, columns, rows, sql, error, created_at
+FROM %s FINAL
+WHERE resolved = 0
+ORDER BY created_at, id`, d.table),
+		Result: proto.Results{
+			{Name: "id", Data: &id},
+			{Name: "lsn", Data: &lsn},
+			{Name: "input_table", Data: &inputTable},
+			{Name: "operation", Data: &operation},
+			{Name: "columns", Data: &columns},
+			{Name: "rows", Data: &rows},
+			{Name: "sql", Data: &sql},
+			{Name: "error", Data: &errorMsg},
+			{Name: "created_at", Data: createdAt},
+		},
+	})
+	if err != nil {
+		return nil, &db.Error{Op: "read dead letters", Err: err}
+	}
+
+	letters := make([]*db.DeadLetter, 0, id.Rows())
+	for i := range id.Rows() {
+		letter := &db.DeadLetter{
+			Id:        id.Row(i),
+			Position:  lsn.Row(i),
+			Table:     inputTable.Row(i),
+			Operation: operation.Row(i),
+			Sql:       sql.Row(i),
+			Error:     errorMsg.Row(i),
+			CreatedAt: createdAt.Row(i).UTC(),
+		}
+
+		if err := json.Unmarshal([]byte(columns.Row(i)), &letter.Columns); err != nil {
+			return nil, &db.Error{Op: "read dead letters", Table: letter.Table, Err: err}
+		}
+
+		if letter.Rows, err = db.DecodeJsonRows(letter.Columns, []byte(rows.Row(i))); err != nil {
+			return nil, &db.Error{Op: "read dead letters", Table: letter.Table, Err: err}
+		}
+
+		letters = append(letters, letter)
+	}
+
+	return letters, nil
+}
+
+func (d *DeadLetterTable) Resolve(letter *db.DeadLetter) error {
+	if err := d.insert(letter, true); err != nil {
+		return &db.Error{Op: "resolve dead letter", Table: letter.Table, Err: err}
+	}
+
+	return nil
+}
+
+func (d *DeadLetterTable) Close() {
+	d.conn.Close()
+}
+
+func (d *DeadLetterTable) insert(letter *db.DeadLetter, resolved bool) error {
+	columnsJson, err := json.Marshal(letter.Columns)
+	if err != nil {
+		return err
+	}
+
+	rowsJson, err := json.Marshal(letter.Rows)
+	if err != nil {
+		return err
+	}
+
+	var id, inputTable, operation, columns, rows, sql, errorMsg proto.ColStr
+	var lsn, version proto.ColUInt64
+	var resolvedCol proto.ColUInt8
+	createdAt := new(proto.ColDateTime64).WithPrecision(proto.PrecisionMilli)
+
+	id.Append(letter.Id)
+	lsn.Append(letter.Position)
+	inputTable.Append(letter.Table)
+	operation.Append(letter.Operation)
+	columns.Append(string(columnsJson))
+	rows.Append(string(rowsJson))
+	sql.Append(letter.Sql)
+	errorMsg.Append(letter.Error)
+	createdAt.Append(letter.CreatedAt)
+	version.Append(uint64(time.Now().UnixNano()))
+	if resolved {
+		resolvedCol.Append(1)
+	} else {
+		resolvedCol.Append(0)
+	}
+
+	input := proto.Input{
+		{Name: "id", Data: &id},
+		{Name: "lsn", Data: &lsn},
+		{Name: "input_table", Data: &inputTable},
+		{Name: "operation", Data: &operation},
+		{Name: "columns", Data: &columns},
+		{Name: "rows", Data: &rows},
+		{Name: "sql", Data: &sql},
+		{Name: "error", Data: &errorMsg},
+		{Name: "created_at", Data: createdAt},
+		{Name: "resolved", Data: &resolvedCol},
+		{Name: "version", Data: &version},
+	}
+
+	return d.conn.Do(context.Background(), ch.Query{
+		Body:  input.Into(d.table),
+		Input: input,
+	})
+}
@@ -0,0 +1,91 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/ch-go"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/doctor"
+)
+
+const diagnoseTimeout = 10 * time.Second
+
+// Diagnose checks that the output connection has what trucker needs, without
+// changing anything: the output tables, permission to insert into them, and
+// permission to create and use trucker's own tables (stream positions, dead
+// letters, migrations) in the database. Permissions are checked with CHECK
+// GRANT, which older ClickHouse versions don't have.
+func Diagnose(cfg config.Connection, outputTables []string) []doctor.Check {
+	checks := doctor.NewChecks(cfg.Name)
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+
+	port := cfg.Port
+	if port == 0 {
+		port = 9000
+	}
+	conn, err := ch.Dial(ctx, ch.Options{
+		Address:    fmt.Sprintf("%s:%d", cfg.Host, port),
+		Database:   cfg.Database,
+		User:       cfg.User,
+		Password:   cfg.Pass,
+		ClientName: "trucker",
+	})
+	if err != nil {
+		checks.Add("reachable", doctor.Fail, "%v", err)
+		return checks.List()
+	}
+	defer conn.Close()
+
+	_, rows, err := query(ctx, conn, "SELECT version()")
+	if err != nil {
+		checks.Add("reachable", doctor.Fail, "%v", err)
+		return checks.List()
+	}
+	checks.Add("reachable", doctor.Pass, "ClickHouse %v", rows[0][0])
+
+	granted, err := checkGrant(ctx, conn, fmt.Sprintf("CREATE TABLE, INSERT, SELECT ON `%s`.*", cfg.Database))
+	switch {
+	case err != nil:
+		checks.Add("permissions", doctor.Warn, "unable to check: %v", err)
+	case !granted:
+		checks.Add("permissions", doctor.Fail, "%s needs CREATE TABLE, INSERT and SELECT on %s.* for trucker's own tables", cfg.User, cfg.Database)
+	default:
+		checks.Add("permissions", doctor.Pass, "%s can create and use tables in %s", cfg.User, cfg.Database)
+	}
+
+	for _, table := range outputTables {
+		_, rows, err := query(ctx, conn, "EXISTS TABLE "+table)
+		if err != nil {
+			checks.Add("output table "+table, doctor.Fail, "%v", err)
+			continue
+		} else if fmt.Sprint(rows[0][0]) != "1" {
+			checks.Add("output table "+table, doctor.Fail, "doesn't exist")
+			continue
+		}
+
+		granted, err := checkGrant(ctx, conn, "INSERT ON "+table)
+		switch {
+		case err != nil:
+			checks.Add("output table "+table, doctor.Warn, "exists, but unable to check permissions: %v", err)
+		case !granted:
+			checks.Add("output table "+table, doctor.Fail, "%s can't INSERT into it", cfg.User)
+		default:
+			checks.Add("output table "+table, doctor.Pass, "writable")
+		}
+	}
+
+	return checks.List()
+}
+
+func checkGrant(ctx context.Context, conn *ch.Client, grant string) (bool, error) {
+	_, rows, err := query(ctx, conn, "CHECK GRANT "+grant)
+	if err != nil {
+		return false, err
+	}
+
+	return len(rows) > 0 && fmt.Sprint(rows[0][0]) == "1", nil
+}
@@ -0,0 +1,180 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/ch-go"
+	"github.com/ClickHouse/ch-go/chpool"
+	"github.com/ClickHouse/ch-go/proto"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// Migrator runs migrations one statement at a time, since ClickHouse has
+// neither transactions nor multi-statement queries. A migration that fails
+// halfway through keeps the statements that ran before the failure, and isn't
+// recorded as applied.
+//
+// Like dead letters, applied versions are tracked in a ReplacingMergeTree, and
+// reverting a migration inserts a new version of its row.
+type Migrator struct {
+	table string
+	conn  *chpool.Pool
+}
+
+func NewMigrator(cfg config.Connection, uniqueId string) (*Migrator, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		table: fmt.Sprintf(`"%s"."trucker_schema_migrations%s"`, cfg.Database, uniqueId),
+		conn:  conn,
+	}, nil
+}
+
+func (m *Migrator) Setup() error {
+	err := m.conn.Do(context.Background(), ch.Query{
+		Body: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+version String,
+applied UInt8,
+updated_at DateTime64(9)
+)
+ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY (version)`, m.table),
+	})
+	if err != nil {
+		return &db.Error{Op: "setup migrations", Err: err}
+	}
+
+	return nil
+}
+
+func (m *Migrator) Applied() ([]string, error) {
+	var version proto.ColStr
+
+	err := m.conn.Do(context.Background(), ch.Query{
+		Body:   fmt.Sprintf("SELECT version FROM %s FINAL WHERE applied = 1 ORDER BY version", m.table),
+		Result: proto.Results{{Name: "version", Data: &version}},
+	})
+	if err != nil {
+		return nil, &db.Error{Op: "read migrations", Err: err}
+	}
+
+	versions := make([]string, 0, version.Rows())
+	for i := range version.Rows() {
+		versions = append(versions, version.Row(i))
+	}
+
+	return versions, nil
+}
+
+func (m *Migrator) Up(version string, sql string) error {
+	return m.migrate("migrate up", version, sql, true)
+}
+
+func (m *Migrator) Down(version string, sql string) error {
+	return m.migrate("migrate down", version, sql, false)
+}
+
+func (m *Migrator) Close() {
+	m.conn.Close()
+}
+
+func (m *Migrator) migrate(op string, version string, sql string, applied bool) error {
+	for _, statement := range splitStatements(sql) {
+		if err := m.conn.Do(context.Background(), ch.Query{Body: statement}); err != nil {
+			return &db.Error{Op: op, Query: statement, Err: err}
+		}
+	}
+
+	var versionCol proto.ColStr
+	var appliedCol proto.ColUInt8
+	updatedAt := new(proto.ColDateTime64).WithPrecision(proto.PrecisionNano)
+
+	versionCol.Append(version)
+	if applied {
+		appliedCol.Append(1)
+	} else {
+		appliedCol.Append(0)
+	}
+	updatedAt.Append(time.Now())
+
+	input := proto.Input{
+		{Name: "version", Data: &versionCol},
+		{Name: "applied", Data: &appliedCol},
+		{Name: "updated_at", Data: updatedAt},
+	}
+
+	err := m.conn.Do(context.Background(), ch.Query{
+		Body:  input.Into(m.table),
+		Input: input,
+	})
+	if err != nil {
+		return &db.Error{Op: op, Err: err}
+	}
+
+	return nil
+}
+
+// splitStatements splits sql on the semicolons that aren't inside quotes or
+// comments. Comments are dropped, and so are empty statements.
+func splitStatements(sql string) []string {
+	statements := make([]string, 0, 1)
+	var current strings.Builder
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(sql) && sql[end] != c {
+				if sql[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end, len(sql)-1)
+			current.WriteString(sql[i : end+1])
+			i = end
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end == -1 {
+				i = len(sql)
+			} else {
+				i += end
+				current.WriteByte('\n')
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end == -1 {
+				i = len(sql)
+			} else {
+				i += end + 3
+				current.WriteByte(' ')
+			}
+		case c == ';':
+			statements = appendStatement(statements, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+
+	return appendStatement(statements, current.String())
+}
+
+func appendStatement(statements []string, statement string) []string {
+	statement = strings.TrimSpace(statement)
+	if statement == "" {
+		return statements
+	}
+
+	return append(statements, statement)
+}
@@ -0,0 +1,26 @@
+package clickhouse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	sql := `-- create the table; then fill it
+CREATE TABLE trucker.countries (id Int32, name String) ENGINE = MergeTree ORDER BY id;
+/* a comment; with a semicolon */
+INSERT INTO trucker.countries VALUES (1, 'Scotland; UK'), (2, 'it\'s; quoted');
+
+;
+SELECT "a;b" FROM trucker.countries`
+
+	expected := []string{
+		"CREATE TABLE trucker.countries (id Int32, name String) ENGINE = MergeTree ORDER BY id",
+		`INSERT INTO trucker.countries VALUES (1, 'Scotland; UK'), (2, 'it\'s; quoted')`,
+		`SELECT "a;b" FROM trucker.countries`,
+	}
+
+	if statements := splitStatements(sql); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("Expected %q, got %q", expected, statements)
+	}
+}
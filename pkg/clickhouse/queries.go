@@ -0,0 +1,83 @@
+package clickhouse
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/ClickHouse/ch-go"
+	"github.com/ClickHouse/ch-go/proto"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// Query runs sql on a new connection and returns the names of its columns and
+// every row it returned. Column types are inferred from the result, and
+// NULLs are returned as nil.
+func Query(cfg config.Connection, sql string) ([]string, [][]any, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Database)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	return query(context.Background(), conn, sql)
+}
+
+// doer is what pools and single connections have in common.
+type doer interface {
+	Do(ctx context.Context, q ch.Query) error
+}
+
+func query(ctx context.Context, conn doer, sql string) ([]string, [][]any, error) {
+	var results proto.Results
+	var columns []string
+	values := make([][]any, 0)
+
+	err := conn.Do(ctx, ch.Query{
+		Body:   sql,
+		Result: results.Auto(),
+		OnResult: func(ctx context.Context, block proto.Block) error {
+			if columns == nil {
+				columns = make([]string, 0, len(results))
+				for _, col := range results {
+					columns = append(columns, col.Name)
+				}
+			}
+
+			for i := range results.Rows() {
+				row := make([]any, len(results))
+				for j, col := range results {
+					row[j] = rowValue(col.Data, i)
+				}
+				values = append(values, row)
+			}
+
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, nil, &db.Error{Op: "query", Query: sql, Err: err}
+	}
+
+	return columns, values, nil
+}
+
+// rowValue returns the value of row i in col. Every column type has a Row
+// method, but there's no interface for it since each returns its own type.
+func rowValue(col proto.ColResult, i int) any {
+	row := reflect.ValueOf(col).MethodByName("Row")
+	if !row.IsValid() {
+		return nil
+	}
+
+	value := row.Call([]reflect.Value{reflect.ValueOf(i)})[0]
+	if isSet := value.MethodByName("IsSet"); isSet.IsValid() {
+		if !isSet.Call(nil)[0].Bool() {
+			return nil
+		}
+		return value.FieldByName("Value").Interface()
+	}
+
+	return value.Interface()
+}
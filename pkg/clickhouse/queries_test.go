@@ -0,0 +1,32 @@
+package clickhouse
+
+import (
+	"testing"
+
+	"github.com/ClickHouse/ch-go/proto"
+)
+
+func TestRowValue(t *testing.T) {
+	var ok proto.ColBool
+	ok.Append(true)
+
+	var name proto.ColStr
+	name.Append("Lagavulin")
+
+	age := new(proto.ColUInt8).Nullable()
+	age.Append(proto.Null[uint8]())
+	age.Append(proto.NewNullable[uint8](16))
+
+	if v := rowValue(&ok, 0); v != true {
+		t.Error("Expected true, got", v)
+	}
+	if v := rowValue(&name, 0); v != "Lagavulin" {
+		t.Error("Expected Lagavulin, got", v)
+	}
+	if v := rowValue(age, 0); v != nil {
+		t.Error("Expected NULL to be nil, got", v)
+	}
+	if v := rowValue(age, 1); v != uint8(16) {
+		t.Error("Expected 16, got", v)
+	}
+}
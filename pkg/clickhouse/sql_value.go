@@ -2,7 +2,7 @@ package clickhouse
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 
 	"github.com/tonyfg/trucker/pkg/db"
@@ -92,7 +92,7 @@ func dbTypeToChType(dbType uint8) string {
 	case db.MapStringToStringArray:
 		return "Array(Map(String, String))"
 	default:
-		log.Printf("[Clickhouse SQL Value] Unknown type %d, treating as String...\n", dbType)
+		slog.Warn("Unknown type, treating as String...", "type", dbType)
 		return "String"
 	}
 }
@@ -3,8 +3,10 @@ package clickhouse
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"iter"
+	"log/slog"
 	"strings"
 	"text/template"
 	"time"
@@ -15,37 +17,56 @@ import (
 
 	"github.com/tonyfg/trucker/pkg/config"
 	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/logging"
 )
 
 type Writer struct {
 	currentLsnTable string
+	legacyLsnTable  string
+	backfillTable   string
+	dedupPrefix     string
 	queryTemplate   *template.Template
 	conn            *chpool.Pool
 	maxQuerySize    int
 	cfg             config.Connection
+	deadLetters     db.DeadLetterSink
+	// What to do with truncate changesets, see SetTruncate
+	truncateTemplate *template.Template
+	truncateTables   []string
+	logger           *slog.Logger
 }
 
-func NewWriter(inputConnectionName string, writeQuery string, cfg config.Connection, uniqueId string) *Writer {
+func NewWriter(truckName string, inputConnectionName string, writeQuery string, cfg config.Connection, uniqueId string) (*Writer, error) {
 	tmpl, err := template.New("outputSql").Parse(writeQuery)
 	if err != nil {
-		panic(err)
+		return nil, &db.Error{Op: "parse output SQL", Query: writeQuery, Err: err}
 	}
 
-	conn := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Database)
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Database)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Writer{
-		// FIXME: LSN tracking should be done per-truck, since writing the same
-		// change on multiple trucks can be interruped midway through
-		currentLsnTable: fmt.Sprintf(`"%s"."trucker_current_lsn__%s%s"`, cfg.Database, inputConnectionName, uniqueId),
+		currentLsnTable: fmt.Sprintf(`"%s"."trucker_truck_lsn__%s%s"`, cfg.Database, truckName, uniqueId),
+		legacyLsnTable:  fmt.Sprintf(`"%s"."trucker_current_lsn__%s%s"`, cfg.Database, inputConnectionName, uniqueId),
+		backfillTable:   fmt.Sprintf(`"%s"."trucker_backfill__%s%s"`, cfg.Database, truckName, uniqueId),
+		dedupPrefix:     fmt.Sprintf("trucker:%s%s", truckName, uniqueId),
 		queryTemplate:   tmpl,
 		conn:            conn,
 		cfg:             cfg,
-	}
+		logger:          logging.ForTruck(truckName).With("connection", cfg.Name),
+	}, nil
 }
 
-func (w *Writer) SetupPositionTracking() {
+func (w *Writer) SetupPositionTracking() error {
 	ctx := context.Background()
-	w.chDo(ctx, ch.Query{
+	alreadyExists, err := w.tableExists(ctx, w.currentLsnTable)
+	if err != nil {
+		return &db.Error{Op: "setup position tracking", Err: err}
+	}
+
+	err = w.chDo(ctx, ch.Query{
 		Body: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
 id Boolean DEFAULT true,
 lsn UInt64
@@ -53,43 +74,185 @@ lsn UInt64
 ENGINE = ReplacingMergeTree(lsn)
 ORDER BY (id)`, w.currentLsnTable),
 	})
+	if err != nil {
+		return &db.Error{Op: "setup position tracking", Err: err}
+	}
 
-	w.chDo(ctx, ch.Query{
+	err = w.chDo(ctx, ch.Query{
 		Body: fmt.Sprintf("INSERT INTO %s (lsn) VALUES (0)", w.currentLsnTable),
 	})
+	if err != nil {
+		return &db.Error{Op: "setup position tracking", Err: err}
+	}
+
+	err = w.chDo(ctx, ch.Query{
+		Body: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+input_table String,
+snapshot_lsn UInt64,
+last_key Array(String),
+done UInt8,
+version UInt64
+)
+ENGINE = ReplacingMergeTree(version)
+ORDER BY (input_table)`, w.backfillTable),
+	})
+	if err != nil {
+		return &db.Error{Op: "setup position tracking", Err: err}
+	}
+
+	if !alreadyExists {
+		if err := w.migrateLegacyPosition(ctx); err != nil {
+			return &db.Error{Op: "setup position tracking", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Stream positions used to be tracked per input connection instead of per
+// truck. Pick up from wherever the old table left off, so upgrading doesn't
+// cause a replay. The old table is left alone since other trucks reading from
+// the same connection may still need to migrate from it.
+func (w *Writer) migrateLegacyPosition(ctx context.Context) error {
+	legacyExists, err := w.tableExists(ctx, w.legacyLsnTable)
+	if err != nil || !legacyExists {
+		return err
+	}
+
+	w.logger.Info("Migrating stream position", "from", w.legacyLsnTable, "to", w.currentLsnTable)
+	return w.chDo(ctx, ch.Query{
+		Body: fmt.Sprintf("INSERT INTO %s (lsn) SELECT lsn FROM %s FINAL", w.currentLsnTable, w.legacyLsnTable),
+	})
 }
 
-func (w *Writer) SetCurrentPosition(lsn uint64) {
-	w.chDo(context.Background(), ch.Query{
+func (w *Writer) tableExists(ctx context.Context, table string) (bool, error) {
+	var exists proto.ColUInt8
+	err := w.chDo(ctx, ch.Query{
+		Body:   fmt.Sprintf("EXISTS TABLE %s", table),
+		Result: proto.Results{{Name: "result", Data: &exists}},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return exists.Row(0) == 1, nil
+}
+
+// SetCurrentPosition stores the truck's stream position. The table only ever
+// keeps the highest position it's been given, so going back (like when a
+// truck is reset) empties it first.
+func (w *Writer) SetCurrentPosition(lsn uint64) error {
+	current, err := w.GetCurrentPosition()
+	if err != nil {
+		return err
+	}
+
+	if lsn < current {
+		err := w.chDo(context.Background(), ch.Query{
+			Body: fmt.Sprintf("TRUNCATE TABLE %s", w.currentLsnTable),
+		})
+		if err != nil {
+			return &db.Error{Op: "set position", Err: err}
+		}
+	}
+
+	err = w.chDo(context.Background(), ch.Query{
 		Body: fmt.Sprintf("INSERT INTO %s (lsn) VALUES (%d)", w.currentLsnTable, lsn),
 	})
+	if err != nil {
+		return &db.Error{Op: "set position", Err: err}
+	}
+
+	return nil
+}
+
+// GetCurrentPosition returns the truck's stream position, or 0 if it has none.
+// Until SetupPositionTracking has run, the position is read from the legacy
+// per input connection table, if there is one. Nothing is ever created here.
+func (w *Writer) GetCurrentPosition() (uint64, error) {
+	lsn, found, err := w.readPosition(w.currentLsnTable)
+	if err == nil && !found {
+		lsn, _, err = w.readPosition(w.legacyLsnTable)
+	}
+	if err != nil {
+		return 0, &db.Error{Op: "get position", Err: err}
+	}
+
+	return lsn, nil
 }
 
-func (w *Writer) GetCurrentPosition() uint64 {
+// readPosition returns the lsn stored in table, and whether the table exists.
+func (w *Writer) readPosition(table string) (uint64, bool, error) {
 	var lsn proto.ColUInt64
 
 	if err := w.conn.Do(context.Background(), ch.Query{
-		Body:   fmt.Sprintf("SELECT lsn FROM %s FINAL", w.currentLsnTable),
+		Body:   fmt.Sprintf("SELECT lsn FROM %s FINAL", table),
 		Result: proto.Results{{Name: "lsn", Data: &lsn}},
-	}); err != nil {
-		return 0
+	}); ch.IsErr(err, proto.ErrUnknownTable) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, true, err
 	}
 
-	return lsn.Row(0)
+	if lsn.Rows() == 0 {
+		return 0, true, nil
+	}
+
+	return lsn.Row(0), true, nil
 }
 
-func (w *Writer) Write(changeset *db.ChanChangeset) bool {
+// SetDeadLetterSink makes WriteTransaction send changesets whose output query
+// fails to sink, and carry on with the rest of the transaction.
+func (w *Writer) SetDeadLetterSink(sink db.DeadLetterSink) {
+	w.deadLetters = sink
+}
+
+// SetTruncate makes WriteTransaction handle truncate changesets by truncating
+// tables with TruncateTable and then running sql (a template like output.sql,
+// without rows).
+func (w *Writer) SetTruncate(sql string, tables []string) {
+	w.truncateTables = tables
+	w.truncateTemplate = nil
+	if sql == "" {
+		return
+	}
+
+	tmpl, err := template.New("truncateSql").Parse(sql)
+	if err != nil {
+		panic(err)
+	}
+	w.truncateTemplate = tmpl
+}
+
+func (w *Writer) Write(changeset *db.ChanChangeset) (bool, error) {
+	if changeset.Operation == db.Truncate {
+		return w.writeTruncate(changeset.Table)
+	}
+
+	return w.write(changeset, "")
+}
+
+func (w *Writer) write(changeset *db.ChanChangeset, dedupToken string) (bool, error) {
 	ctx := context.Background()
 	conn, err := w.conn.Acquire(ctx)
 	if err != nil {
-		panic(err)
+		changeset.Discard()
+		return false, &db.Error{Op: "write", Table: changeset.Table, Err: err}
 	}
 	defer conn.Release()
 
-	if !populateTempTable(ctx, conn, changeset) {
-		return false
-	}
 	defer conn.Do(ctx, ch.Query{Body: "DROP TEMPORARY TABLE IF EXISTS r"})
+	populated, err := populateTempTable(ctx, conn, changeset)
+	if err != nil {
+		changeset.Discard()
+		return false, &db.Error{Op: "write", Table: changeset.Table, Err: err}
+	}
+	if changeset.Err != nil {
+		return false, changeset.Err
+	}
+	if !populated {
+		return false, nil
+	}
 
 	tmplVars := map[string]string{
 		"operation":   db.OperationStr(changeset.Operation),
@@ -100,34 +263,139 @@ func (w *Writer) Write(changeset *db.ChanChangeset) bool {
 	sql := new(bytes.Buffer)
 	err = w.queryTemplate.Execute(sql, tmplVars)
 	if err != nil {
-		panic(err)
+		return false, &db.Error{Op: "write", Table: changeset.Table, Err: err}
 	}
 
-	err = conn.Do(ctx, ch.Query{Body: sql.String()})
+	query := ch.Query{Body: sql.String()}
+	if dedupToken != "" {
+		query.Settings = []ch.Setting{{Key: "insert_deduplication_token", Value: dedupToken}}
+	}
+
+	err = conn.Do(ctx, query)
 	if err != nil {
-		panic(err)
+		w.logger.Error("Error running output query", "operation", db.OperationStr(changeset.Operation), "table", changeset.Table, "sql", query.Body, logging.Err(err))
+		return false, &db.Error{Op: "write", Table: changeset.Table, Query: query.Body, Err: err}
 	}
 
-	return true
+	return true, nil
 }
 
-func (w *Writer) TruncateTable(table string) {
-	w.chDo(context.Background(), ch.Query{
+// WriteTransaction writes each changeset in turn, and then the stream position
+// (unless it's 0). Clickhouse doesn't have transactions, so instead every
+// insert gets a deduplication token derived from the stream position. If we
+// crash midway through and replay the transaction, output tables that have
+// deduplication enabled will ignore the inserts they've already seen.
+func (w *Writer) WriteTransaction(position uint64, changesets iter.Seq2[*db.ChanChangeset, error]) (bool, error) {
+	wroteRows := false
+	i := 0
+	for changeset, err := range changesets {
+		if err != nil {
+			return false, err
+		}
+
+		var wrote bool
+		if changeset.Operation == db.Truncate {
+			wrote, err = w.writeTruncate(changeset.Table)
+		} else if w.deadLetters != nil && position != 0 {
+			wrote, err = w.writeOrDeadLetter(changeset, position, i)
+		} else {
+			wrote, err = w.write(changeset, w.dedupToken(position, i))
+		}
+		if err != nil {
+			return false, err
+		}
+		wroteRows = wroteRows || wrote
+		i++
+	}
+
+	if position != 0 {
+		if err := w.SetCurrentPosition(position); err != nil {
+			return false, err
+		}
+	}
+
+	return wroteRows, nil
+}
+
+// writeOrDeadLetter writes the changeset, sending it to the dead letter sink
+// instead if the output query fails.
+func (w *Writer) writeOrDeadLetter(changeset *db.ChanChangeset, position uint64, changesetIdx int) (bool, error) {
+	recorded, recordedRows := changeset.RecordRows()
+
+	wrote, err := w.write(recorded, w.dedupToken(position, changesetIdx))
+	var dbErr *db.Error
+	if err == nil || !errors.As(err, &dbErr) || dbErr.Query == "" {
+		return wrote, err
+	}
+
+	recorded.Discard()
+	w.logger.Warn("Sending changeset to the dead letter sink", "operation", db.OperationStr(changeset.Operation), "table", changeset.Table, logging.LSN(position), logging.Err(dbErr.Err))
+	return false, w.deadLetters.Send(db.NewDeadLetter(position, recorded, recordedRows(), err))
+}
+
+func (w *Writer) dedupToken(position uint64, changesetIdx int) string {
+	if position == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d:%d", w.dedupPrefix, position, changesetIdx)
+}
+
+// writeTruncate does what SetTruncate asked for when an input table is
+// truncated. Failures aren't sent to the dead letter sink, since there are no
+// rows to send and the output wouldn't match the input without them.
+func (w *Writer) writeTruncate(table string) (bool, error) {
+	for _, outputTable := range w.truncateTables {
+		if err := w.TruncateTable(outputTable); err != nil {
+			return false, err
+		}
+	}
+
+	if w.truncateTemplate == nil {
+		return len(w.truncateTables) > 0, nil
+	}
+
+	sql := new(bytes.Buffer)
+	err := w.truncateTemplate.Execute(sql, map[string]string{
+		"operation":   db.OperationStr(db.Truncate),
+		"input_table": table,
+	})
+	if err != nil {
+		return false, &db.Error{Op: "write", Table: table, Err: err}
+	}
+
+	if err := w.conn.Do(context.Background(), ch.Query{Body: sql.String()}); err != nil {
+		w.logger.Error("Error running truncate query", "table", table, "sql", sql.String(), logging.Err(err))
+		return false, &db.Error{Op: "write", Table: table, Query: sql.String(), Err: err}
+	}
+
+	return true, nil
+}
+
+func (w *Writer) TruncateTable(table string) error {
+	err := w.chDo(context.Background(), ch.Query{
 		Body:   fmt.Sprintf("TRUNCATE TABLE %s", table),
 		Result: proto.Results{},
 	})
+	if err != nil {
+		return &db.Error{Op: "truncate", Table: table, Err: err}
+	}
+
+	return nil
 }
 
 func (w *Writer) Close() {
 	w.conn.Close()
 }
 
-func populateTempTable(ctx context.Context, conn *chpool.Client, changeset *db.ChanChangeset) bool {
+func populateTempTable(ctx context.Context, conn *chpool.Client, changeset *db.ChanChangeset) (bool, error) {
 	tableCreated := false
 
 	for batch := range changeset.Rows {
 		if !tableCreated {
-			createTempTable(ctx, conn, changeset)
+			if err := createTempTable(ctx, conn, changeset); err != nil {
+				return false, err
+			}
 			tableCreated = true
 		}
 
@@ -135,7 +403,9 @@ func populateTempTable(ctx context.Context, conn *chpool.Client, changeset *db.C
 
 		for _, row := range batch {
 			for i, col := range changeset.Columns {
-				appendValue(values, col, row, i)
+				if err := appendValue(values, col, row, i); err != nil {
+					return false, err
+				}
 			}
 		}
 
@@ -146,26 +416,25 @@ func populateTempTable(ctx context.Context, conn *chpool.Client, changeset *db.C
 
 		err := conn.Do(ctx, ch.Query{Body: "INSERT INTO r VALUES", Input: block})
 		if err != nil {
-			panic(err)
+			return false, err
 		}
 	}
 
-	return tableCreated
+	return tableCreated, nil
 }
 
-func createTempTable(ctx context.Context, conn *chpool.Client, changeset *db.ChanChangeset) {
+func createTempTable(ctx context.Context, conn *chpool.Client, changeset *db.ChanChangeset) error {
 	sb := strings.Builder{}
 	sb.WriteString("CREATE TEMPORARY TABLE r (")
 	sb.WriteString(makeColumnTypesSql(changeset.Columns).String())
 	sb.WriteByte(')')
 
-	err := conn.Do(ctx, ch.Query{Body: sb.String(), Result: proto.Results{}})
-	if err != nil {
-		panic(err)
-	}
+	return conn.Do(ctx, ch.Query{Body: sb.String(), Result: proto.Results{}})
 }
 
-func appendValue(values map[string]proto.ColInput, col db.Column, row []any, i int) {
+// appendValue appends the row's i-th value to the column it goes in, creating
+// the column first if it's not in values yet.
+func appendValue(values map[string]proto.ColInput, col db.Column, row []any, i int) error {
 	if values[col.Name] == nil {
 		switch col.Type {
 		case db.Int8:
@@ -249,155 +518,128 @@ func appendValue(values map[string]proto.ColInput, col db.Column, row []any, i i
 		}
 	}
 
+	v := row[i]
 	switch col.Type {
 	case db.Int8:
-		values[col.Name].(*proto.ColInt8).Append(row[i].(int8))
+		return appendAs[int8](values[col.Name].(*proto.ColInt8), col, v)
 	case db.Int16:
-		values[col.Name].(*proto.ColInt16).Append(row[i].(int16))
+		return appendAs[int16](values[col.Name].(*proto.ColInt16), col, v)
 	case db.Int32:
-		values[col.Name].(*proto.ColInt32).Append(row[i].(int32))
+		return appendAs[int32](values[col.Name].(*proto.ColInt32), col, v)
 	case db.Int64:
-		values[col.Name].(*proto.ColInt64).Append(row[i].(int64)) // TODO will this really work for int when it's 32 bit?
+		return appendAs[int64](values[col.Name].(*proto.ColInt64), col, v) // TODO will this really work for int when it's 32 bit?
 	case db.UInt8:
-		values[col.Name].(*proto.ColUInt8).Append(row[i].(uint8))
+		return appendAs[uint8](values[col.Name].(*proto.ColUInt8), col, v)
 	case db.UInt16:
-		values[col.Name].(*proto.ColUInt16).Append(row[i].(uint16))
+		return appendAs[uint16](values[col.Name].(*proto.ColUInt16), col, v)
 	case db.UInt32:
-		values[col.Name].(*proto.ColUInt32).Append(row[i].(uint32))
+		return appendAs[uint32](values[col.Name].(*proto.ColUInt32), col, v)
 	case db.UInt64:
-		values[col.Name].(*proto.ColUInt64).Append(row[i].(uint64)) // TODO will this really work for uint when it's 32 bit?
+		return appendAs[uint64](values[col.Name].(*proto.ColUInt64), col, v) // TODO will this really work for uint when it's 32 bit?
 	case db.Numeric:
-		values[col.Name].(*proto.ColDecimal256).Append(row[i].(proto.Decimal256)) // TODO test this! I'm not sure whatever value we're getting is directly convertible to proto.Decimal256
+		return appendAs[proto.Decimal256](values[col.Name].(*proto.ColDecimal256), col, v) // TODO test this! I'm not sure whatever value we're getting is directly convertible to proto.Decimal256
 	case db.Float32:
-		values[col.Name].(*proto.ColFloat32).Append(row[i].(float32))
+		return appendAs[float32](values[col.Name].(*proto.ColFloat32), col, v)
 	case db.Float64:
-		values[col.Name].(*proto.ColFloat64).Append(row[i].(float64))
+		return appendAs[float64](values[col.Name].(*proto.ColFloat64), col, v)
 	case db.Bool:
-		values[col.Name].(*proto.ColBool).Append(row[i].(bool))
+		return appendAs[bool](values[col.Name].(*proto.ColBool), col, v)
 	case db.String:
-		values[col.Name].(*proto.ColStr).Append(row[i].(string))
+		return appendAs[string](values[col.Name].(*proto.ColStr), col, v)
 	case db.Date:
-		values[col.Name].(*proto.ColDate32).Append(row[i].(time.Time))
+		return appendAs[time.Time](values[col.Name].(*proto.ColDate32), col, v)
 	case db.DateTime:
-		values[col.Name].(*proto.ColDateTime64).Append(row[i].(time.Time))
+		return appendAs[time.Time](values[col.Name].(*proto.ColDateTime64), col, v)
 	case db.IPAddr:
-		values[col.Name].(*proto.ColIPv4).Append(row[i].(proto.IPv4)) //FIXME: What about IPv6?
+		return appendAs[proto.IPv4](values[col.Name].(*proto.ColIPv4), col, v) //FIXME: What about IPv6?
 
 	case db.MapStringToString:
-		values[col.Name].(*proto.ColMap[string, string]).Append(row[i].(map[string]string))
+		return appendAs[map[string]string](values[col.Name].(*proto.ColMap[string, string]), col, v)
 
 	case db.Int8Array:
-		slice := make([]int8, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(int8)
-		}
-		values[col.Name].(*proto.ColArr[int8]).Append(slice)
+		return appendArray[int8](values[col.Name].(*proto.ColArr[int8]), col, v)
 	case db.Int16Array:
-		slice := make([]int16, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(int16)
-		}
-		values[col.Name].(*proto.ColArr[int16]).Append(slice)
+		return appendArray[int16](values[col.Name].(*proto.ColArr[int16]), col, v)
 	case db.Int32Array:
-		slice := make([]int32, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(int32)
-		}
-		values[col.Name].(*proto.ColArr[int32]).Append(slice)
+		return appendArray[int32](values[col.Name].(*proto.ColArr[int32]), col, v)
 	case db.Int64Array:
-		slice := make([]int64, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(int64) // TODO will this really work for int when it's 32 bit?
-		}
-		values[col.Name].(*proto.ColArr[int64]).Append(slice)
+		return appendArray[int64](values[col.Name].(*proto.ColArr[int64]), col, v) // TODO will this really work for int when it's 32 bit?
 	case db.UInt8Array:
-		slice := make([]uint8, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(uint8)
-		}
-		values[col.Name].(*proto.ColArr[uint8]).Append(slice)
+		return appendArray[uint8](values[col.Name].(*proto.ColArr[uint8]), col, v)
 	case db.UInt16Array:
-		slice := make([]uint16, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(uint16)
-		}
-		values[col.Name].(*proto.ColArr[uint16]).Append(slice)
+		return appendArray[uint16](values[col.Name].(*proto.ColArr[uint16]), col, v)
 	case db.UInt32Array:
-		slice := make([]uint32, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(uint32)
-		}
-		values[col.Name].(*proto.ColArr[uint32]).Append(slice)
+		return appendArray[uint32](values[col.Name].(*proto.ColArr[uint32]), col, v)
 	case db.UInt64Array:
-		slice := make([]uint64, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(uint64) // TODO will this really work for uint when it's 32 bit?
-		}
-		values[col.Name].(*proto.ColArr[uint64]).Append(slice)
+		return appendArray[uint64](values[col.Name].(*proto.ColArr[uint64]), col, v) // TODO will this really work for uint when it's 32 bit?
 	case db.NumericArray:
-		slice := make([]proto.Decimal256, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(proto.Decimal256) // TODO test this! I'm not sure whatever value we're getting is directly convertible to proto.Decimal256
-		}
-		values[col.Name].(*proto.ColArr[proto.Decimal256]).Append(slice)
+		return appendArray[proto.Decimal256](values[col.Name].(*proto.ColArr[proto.Decimal256]), col, v) // TODO test this! I'm not sure whatever value we're getting is directly convertible to proto.Decimal256
 	case db.Float32Array:
-		slice := make([]float32, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(float32)
-		}
-		values[col.Name].(*proto.ColArr[float32]).Append(slice)
+		return appendArray[float32](values[col.Name].(*proto.ColArr[float32]), col, v)
 	case db.Float64Array:
-		slice := make([]float64, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(float64)
-		}
-		values[col.Name].(*proto.ColArr[float64]).Append(slice)
+		return appendArray[float64](values[col.Name].(*proto.ColArr[float64]), col, v)
 	case db.BoolArray:
-		slice := make([]bool, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(bool)
-		}
-		values[col.Name].(*proto.ColArr[bool]).Append(slice)
+		return appendArray[bool](values[col.Name].(*proto.ColArr[bool]), col, v)
 	case db.StringArray:
-		slice := make([]string, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(string)
-		}
-		values[col.Name].(*proto.ColArr[string]).Append(slice)
+		return appendArray[string](values[col.Name].(*proto.ColArr[string]), col, v)
 	case db.DateArray:
-		slice := make([]time.Time, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(time.Time)
-		}
-		values[col.Name].(*proto.ColArr[time.Time]).Append(slice)
+		return appendArray[time.Time](values[col.Name].(*proto.ColArr[time.Time]), col, v)
 	case db.DateTimeArray:
-		slice := make([]time.Time, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(time.Time)
-		}
-		values[col.Name].(*proto.ColArr[time.Time]).Append(slice)
+		return appendArray[time.Time](values[col.Name].(*proto.ColArr[time.Time]), col, v)
 	case db.IPAddrArray:
-		slice := make([]proto.IPv4, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(proto.IPv4) //FIXME: What about IPv6?
-		}
-		values[col.Name].(*proto.ColArr[proto.IPv4]).Append(slice)
+		return appendArray[proto.IPv4](values[col.Name].(*proto.ColArr[proto.IPv4]), col, v) //FIXME: What about IPv6?
 	case db.MapStringToStringArray:
-		slice := make([]map[string]string, len(row[i].([]any)))
-		for i, v := range row[i].([]any) {
-			slice[i] = v.(map[string]string) // FIXME I think a map assertion isn't going to work
-		}
-		values[col.Name].(*proto.ColArr[map[string]string]).Append(slice)
+		return appendArray[map[string]string](values[col.Name].(*proto.ColArr[map[string]string]), col, v) // FIXME I think a map assertion isn't going to work
 
 	default:
 		// We don't know what it is, so we treat it as a string. Is this reasonable?
-		values[col.Name].(*proto.ColStr).Append(row[i].(string))
+		return appendAs[string](values[col.Name].(*proto.ColStr), col, v)
 	}
 }
 
-func (w *Writer) chDo(ctx context.Context, query ch.Query) {
-	if err := w.conn.Do(ctx, query); err != nil {
-		log.Printf("[Clickhouse Writer] Error executing SQL:\n%s", query.Body)
-		panic(err)
+// appender is a ClickHouse column that values of type T can be appended to.
+type appender[T any] interface {
+	Append(v T)
+}
+
+// appendAs appends v to column, or returns an error if it isn't a T (say,
+// because the input query's results don't match the output table).
+func appendAs[T any](column appender[T], col db.Column, v any) error {
+	value, ok := v.(T)
+	if !ok {
+		return fmt.Errorf("column %s: expected a %T value, got %T", col.Name, value, v)
+	}
+
+	column.Append(value)
+	return nil
+}
+
+// appendArray appends the array v to column, or returns an error if it isn't
+// an array of T.
+func appendArray[T any](column appender[[]T], col db.Column, v any) error {
+	elements, ok := v.([]any)
+	if !ok {
+		return fmt.Errorf("column %s: expected an array, got %T", col.Name, v)
 	}
+
+	slice := make([]T, len(elements))
+	for i, element := range elements {
+		value, ok := element.(T)
+		if !ok {
+			return fmt.Errorf("column %s: expected an array of %T values, got a %T element", col.Name, value, element)
+		}
+		slice[i] = value
+	}
+
+	column.Append(slice)
+	return nil
+}
+
+func (w *Writer) chDo(ctx context.Context, query ch.Query) error {
+	err := w.conn.Do(ctx, query)
+	if err != nil {
+		w.logger.Error("Error executing SQL", "sql", query.Body, logging.Err(err))
+	}
+
+	return err
 }
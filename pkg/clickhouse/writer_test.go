@@ -20,7 +20,7 @@ func TestSetupPositionTracking(t *testing.T) {
 	// It should create the LSN tracking table
 	w.SetupPositionTracking()
 	w.chDo(context.Background(), ch.Query{
-		Body:   "SELECT lsn FROM trucker_current_lsn__test2 LIMIT 1",
+		Body:   "SELECT lsn FROM trucker_truck_lsn__test2 LIMIT 1",
 		Result: proto.AutoResult("lsn"),
 	}) // This will crash if the table doesn't exist
 
@@ -29,7 +29,7 @@ func TestSetupPositionTracking(t *testing.T) {
 
 	var theLsn proto.ColUInt64
 	if err := w.conn.Do(context.Background(), ch.Query{
-		Body:   "SELECT max(lsn) lsn FROM trucker_current_lsn__test2",
+		Body:   "SELECT max(lsn) lsn FROM trucker_truck_lsn__test2",
 		Result: proto.Results{{Name: "lsn", Data: &theLsn}},
 	}); err != nil {
 		t.Error("Failed to query the LSN tracking table", err)
@@ -43,20 +43,19 @@ func TestSetAndGetCurrentPosition(t *testing.T) {
 	w := writerTestSetup()
 	defer w.Close()
 
-	lsn := w.GetCurrentPosition()
-	if lsn != 0 {
-		t.Errorf("Expected LSN to be 0, got %d", lsn)
+	if _, err := w.GetCurrentPosition(); err == nil {
+		t.Error("Expected an error before position tracking is set up")
 	}
 
 	w.SetupPositionTracking()
 
-	lsn = w.GetCurrentPosition()
+	lsn := currentPosition(t, w)
 	if lsn != 0 {
 		t.Errorf("Expected LSN to be 0, got %d", lsn)
 	}
 
 	w.SetCurrentPosition(123)
-	lsn = w.GetCurrentPosition()
+	lsn = currentPosition(t, w)
 	if lsn != 123 {
 		t.Errorf("LSN should be 123, got %d", lsn)
 	}
@@ -70,7 +69,7 @@ func TestWrite(t *testing.T) {
 	rows := make(chan [][]any, 1)
 	rows <- [][]any{{"1", "Green Spot", int32(10), "Single Pot Still", "Ireland"}}
 	close(rows)
-	w.Write(&db.ChanChangeset{
+	_, err := w.Write(&db.ChanChangeset{
 		Operation: db.Insert,
 		Columns: []db.Column{
 			{Name: "id", Type: db.String},
@@ -81,6 +80,9 @@ func TestWrite(t *testing.T) {
 		},
 		Rows: rows,
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var id, name, whiskyType, country proto.ColStr
 	var age proto.ColInt32
@@ -118,6 +120,54 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteTransactionDeduplicatesReplays(t *testing.T) {
+	w := writerTestSetup()
+	defer w.Close()
+	w.SetupPositionTracking()
+
+	writeGreenSpot := func() {
+		rows := make(chan [][]any, 1)
+		rows <- [][]any{{"1", "Green Spot", int32(10), "Single Pot Still", "Ireland"}}
+		close(rows)
+		_, err := w.WriteTransaction(555, helpers.Changesets(&db.ChanChangeset{
+			Operation: db.Insert,
+			Columns: []db.Column{
+				{Name: "id", Type: db.String},
+				{Name: "name", Type: db.String},
+				{Name: "age", Type: db.Int32},
+				{Name: "type", Type: db.String},
+				{Name: "country", Type: db.String},
+			},
+			Rows: rows,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeGreenSpot()
+	writeGreenSpot() // Replaying the same transaction shouldn't insert anything
+
+	var cnt proto.ColUInt64
+	if err := w.conn.Do(context.Background(), ch.Query{
+		Body: "SELECT count(*) AS cnt FROM trucker.whiskies_flat",
+		Result: proto.Results{
+			{Name: "cnt", Data: &cnt},
+		},
+	}); err != nil {
+		t.Error("Failed to query whiskies_flat", err)
+	}
+
+	if cnt.Row(0) != 1 {
+		t.Error("Expected 1 row, got", cnt.Row(0))
+	}
+
+	lsn := currentPosition(t, w)
+	if lsn != 555 {
+		t.Errorf("LSN should be 555, got %d", lsn)
+	}
+}
+
 func TestWriteZeroRows(t *testing.T) {
 	w := writerTestSetup()
 	defer w.Close()
@@ -125,7 +175,7 @@ func TestWriteZeroRows(t *testing.T) {
 
 	rows := make(chan [][]any, 1)
 	close(rows)
-	result := w.Write(&db.ChanChangeset{
+	result, err := w.Write(&db.ChanChangeset{
 		Operation: db.Insert,
 		Columns: []db.Column{
 			{Name: "id", Type: db.String},
@@ -136,6 +186,9 @@ func TestWriteZeroRows(t *testing.T) {
 		},
 		Rows: rows,
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if result != false {
 		t.Error("Expected Write to return false when no rows are written")
@@ -165,5 +218,46 @@ func writerTestSetup() *Writer {
 		panic(err)
 	}
 
-	return NewWriter("test", string(sqlTemplate), helpers.ClickhouseCfg, "2")
+	w, err := NewWriter("test", "legacy", string(sqlTemplate), helpers.ClickhouseCfg, "2")
+	if err != nil {
+		panic(err)
+	}
+
+	return w
+}
+
+func currentPosition(t *testing.T, w *Writer) uint64 {
+	lsn, err := w.GetCurrentPosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lsn
+}
+
+func TestAppendValue(t *testing.T) {
+	values := make(map[string]proto.ColInput)
+	age := db.Column{Name: "age", Type: db.Int32}
+	tags := db.Column{Name: "tags", Type: db.StringArray}
+
+	if err := appendValue(values, age, []any{int32(12)}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendValue(values, tags, []any{[]any{"peated", "islay"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := appendValue(values, age, []any{"12"}, 0); err == nil {
+		t.Error("Expected an error for a string in an Int32 column")
+	}
+	if err := appendValue(values, tags, []any{[]any{"peated", 12}}, 0); err == nil {
+		t.Error("Expected an error for a number in a string array column")
+	}
+	if err := appendValue(values, tags, []any{nil}, 0); err == nil {
+		t.Error("Expected an error for a NULL array")
+	}
+
+	if values["age"].Rows() != 1 || values["tags"].Rows() != 1 {
+		t.Errorf("Expected only the valid values to be appended, got %d ages and %d tags", values["age"].Rows(), values["tags"].Rows())
+	}
 }
@@ -1,15 +1,23 @@
 package config
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
 
 	"path/filepath"
+
+	"github.com/tonyfg/trucker/pkg/logging"
 )
 
-const DefaultSlowQueryThresholdMs = 1000 // Default slow query threshold in milliseconds
+const DefaultSlowQueryThresholdMs = 1000      // Default slow query threshold in milliseconds
+const DefaultPostgresPlugin = "wal2json"      // Default logical decoding plugin for postgres input connections
+const DefaultReconnectInitialBackoffMs = 1000 // Default wait before the first replication reconnection attempt
+const DefaultReconnectMaxBackoffMs = 60000    // Default upper bound for the wait between replication reconnection attempts
+const DefaultLogLevel = "info"                // Default log level for trucker and all trucks
+const DefaultStuckThresholdMs = 300000        // Default time writing a single transaction after which a truck is considered stuck
 
 type connectionYml struct {
 	Name         string `yaml:"name"`
@@ -26,11 +34,41 @@ type connectionYml struct {
 	DatabasePath string `yaml:"database_path"`
 	UserPath     string `yaml:"user_path"`
 	PassPath     string `yaml:"pass_path"`
+	Plugin       string `yaml:"plugin"`
+}
+
+type reconnectYml struct {
+	MaxAttempts      int   `yaml:"max_attempts"`
+	InitialBackoffMs int64 `yaml:"initial_backoff_ms"`
+	MaxBackoffMs     int64 `yaml:"max_backoff_ms"`
+}
+
+type metricsYml struct {
+	Listen string `yaml:"listen"`
+}
+
+type healthYml struct {
+	Listen           string `yaml:"listen"`
+	StuckThresholdMs int64  `yaml:"stuck_threshold_ms"`
+}
+
+type migrateYml struct {
+	Auto bool `yaml:"auto"`
+}
+
+type logYml struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
 }
 
 type configYml struct {
 	UniqueId             string          `yaml:"unique_id"`
 	SlowQueryThresholdMs int64           `yaml:"slow_query_threshold_ms"`
+	Reconnect            reconnectYml    `yaml:"reconnect"`
+	Metrics              metricsYml      `yaml:"metrics"`
+	Log                  logYml          `yaml:"log"`
+	Health               healthYml       `yaml:"health"`
+	Migrate              migrateYml      `yaml:"migrate"`
 	Connections          []connectionYml `yaml:"connections"`
 }
 
@@ -43,47 +81,188 @@ type Connection struct {
 	Ssl      string
 	User     string
 	Pass     string
+	Plugin   string
+}
+
+// Reconnect controls how replication connections are re-established after
+// they drop. MaxAttempts of 0 means retrying forever.
+type Reconnect struct {
+	MaxAttempts      int
+	InitialBackoffMs int64
+	MaxBackoffMs     int64
+}
+
+// Metrics controls the HTTP endpoint serving Prometheus metrics. An empty
+// Listen address disables it.
+type Metrics struct {
+	Listen string
+}
+
+// Health controls the HTTP endpoints serving health checks. An empty Listen
+// address disables them. A truck that has been writing the same transaction
+// for longer than StuckThresholdMs is considered stuck.
+type Health struct {
+	Listen           string
+	StuckThresholdMs int64
+}
+
+// Log controls what gets logged and how. Trucks log at Level unless they set
+// their own log_level.
+type Log struct {
+	Level  string
+	Format string
+}
+
+// Migrate controls database migrations. With Auto set, pending migrations run
+// before any truck starts.
+type Migrate struct {
+	Auto bool
 }
 
 type Config struct {
 	UniqueId             string
 	SlowQueryThresholdMs int64
+	Reconnect            Reconnect
+	Metrics              Metrics
+	Log                  Log
+	Health               Health
+	Migrate              Migrate
 	Connections          map[string]Connection
 }
 
-func Load(path string) Config {
+func Load(path string) (Config, error) {
 	envMap, err := envToMap()
 	if err != nil {
-		log.Fatal(err)
+		return Config{}, err
 	}
 
-	configYml := loadYml(path, configYml{}, envMap)
+	configYml, v, err := loadYml(path, configYml{}, envMap)
+	if err != nil {
+		return Config{}, err
+	}
 
 	config := Config{
 		UniqueId:             configYml.UniqueId,
 		SlowQueryThresholdMs: configYml.SlowQueryThresholdMs,
-		Connections:          make(map[string]Connection),
+		Reconnect: Reconnect{
+			MaxAttempts:      configYml.Reconnect.MaxAttempts,
+			InitialBackoffMs: configYml.Reconnect.InitialBackoffMs,
+			MaxBackoffMs:     configYml.Reconnect.MaxBackoffMs,
+		},
+		Metrics: Metrics{Listen: configYml.Metrics.Listen},
+		Log:     Log{Level: configYml.Log.Level, Format: configYml.Log.Format},
+		Health: Health{
+			Listen:           configYml.Health.Listen,
+			StuckThresholdMs: configYml.Health.StuckThresholdMs,
+		},
+		Migrate:     Migrate{Auto: configYml.Migrate.Auto},
+		Connections: make(map[string]Connection),
+	}
+
+	if config.Log.Level == "" {
+		config.Log.Level = DefaultLogLevel
+	}
+	if _, err := logging.ParseLevel(config.Log.Level); err != nil {
+		v.errorf("log.level", "log.level must be debug, info, warn or error, got %q", config.Log.Level)
+	}
+
+	switch config.Log.Format {
+	case "":
+		config.Log.Format = logging.FormatText
+	case logging.FormatText, logging.FormatJson:
+	default:
+		v.errorf("log.format", "log.format must be %s or %s, got %q", logging.FormatText, logging.FormatJson, config.Log.Format)
+	}
+
+	if config.Health.StuckThresholdMs == 0 {
+		config.Health.StuckThresholdMs = DefaultStuckThresholdMs
 	}
 
 	if config.SlowQueryThresholdMs == 0 {
 		config.SlowQueryThresholdMs = DefaultSlowQueryThresholdMs
-		log.Printf("Using default value of %dms as a threshold to log slow queries...", config.SlowQueryThresholdMs)
+		slog.Info("Using default slow query threshold", "threshold_ms", config.SlowQueryThresholdMs)
+	}
+
+	if config.Reconnect.InitialBackoffMs == 0 {
+		config.Reconnect.InitialBackoffMs = DefaultReconnectInitialBackoffMs
 	}
 
-	// TODO: validations
+	if config.Reconnect.MaxBackoffMs == 0 {
+		config.Reconnect.MaxBackoffMs = DefaultReconnectMaxBackoffMs
+	}
+
+	if config.Reconnect.MaxBackoffMs < config.Reconnect.InitialBackoffMs {
+		config.Reconnect.MaxBackoffMs = config.Reconnect.InitialBackoffMs
+	}
 
 	basePath := filepath.Dir(filepath.Clean(path))
 
-	for _, connYml := range configYml.Connections {
-		connection := connectionYmlToConnection(connYml, basePath)
+	names := make(map[string]bool)
+	for i, connYml := range configYml.Connections {
+		at := fmt.Sprintf("connections.%d", i)
+		if names[connYml.Name] && connYml.Name != "" {
+			v.errorf(at+".name", "connection %s is defined more than once", connYml.Name)
+		}
+		names[connYml.Name] = true
+
+		if !validateConnection(v, at, connYml) {
+			continue
+		}
+
+		connection, err := connectionYmlToConnection(connYml, basePath)
+		if err != nil {
+			v.errorf(at, "connection %s: %v", connYml.Name, err)
+			continue
+		}
 		config.Connections[connection.Name] = connection
 	}
 
-	log.Printf("%d DB connections configured.\n", len(config.Connections))
-	return config
+	if err := v.err(); err != nil {
+		return Config{}, err
+	}
+
+	slog.Info("DB connections configured", "count", len(config.Connections))
+	return config, nil
+}
+
+// validateConnection adds the problems with a connection in trucker.yml to v,
+// and returns false if there were any.
+func validateConnection(v *validation, at string, connYml connectionYml) bool {
+	errCount := len(v.errs)
+
+	name := connYml.Name
+	if name == "" {
+		name = "#" + strings.TrimPrefix(at, "connections.")
+		v.errorf(at, "connection %s: name is required", name)
+	}
+
+	switch connYml.Adapter {
+	case "postgres":
+		switch connYml.Plugin {
+		case "", "wal2json", "pgoutput":
+		default:
+			v.errorf(at+".plugin", "connection %s: plugin must be wal2json or pgoutput, got %q", name, connYml.Plugin)
+		}
+	case "clickhouse":
+		if connYml.Plugin != "" {
+			v.errorf(at+".plugin", "connection %s: plugin is only supported by postgres connections", name)
+		}
+	case "":
+		v.errorf(at, "connection %s: adapter is required, and must be postgres or clickhouse", name)
+	default:
+		v.errorf(at+".adapter", "connection %s: adapter must be postgres or clickhouse, got %q", name, connYml.Adapter)
+	}
+
+	if connYml.Host == "" && connYml.HostPath == "" {
+		v.errorf(at, "connection %s: host or host_path is required", name)
+	}
+
+	return len(v.errs) == errCount
 }
 
-func connectionYmlToConnection(connYml connectionYml, basePath string) Connection {
+func connectionYmlToConnection(connYml connectionYml, basePath string) (Connection, error) {
+	var err error
+
 	connection := Connection{
 		Name:     connYml.Name,
 		Adapter:  connYml.Adapter,
@@ -93,51 +272,69 @@ func connectionYmlToConnection(connYml connectionYml, basePath string) Connectio
 		Database: connYml.Database,
 		User:     connYml.User,
 		Pass:     connYml.Pass,
+		Plugin:   connYml.Plugin,
+	}
+
+	if connection.Adapter == "postgres" && connection.Plugin == "" {
+		connection.Plugin = DefaultPostgresPlugin
 	}
 
 	if connYml.HostPath != "" {
-		connection.Host = readFile(basePath, connYml.HostPath)
+		if connection.Host, err = readFile(basePath, connYml.HostPath); err != nil {
+			return connection, err
+		}
 	}
 
 	if connYml.PortPath != "" {
-		portStr := readFile(basePath, connYml.PortPath)
+		portStr, err := readFile(basePath, connYml.PortPath)
+		if err != nil {
+			return connection, err
+		}
 
 		port, err := strconv.ParseUint(portStr, 10, 16)
 		if err != nil {
-			log.Fatal(err)
+			return connection, err
 		}
 
 		connection.Port = uint16(port)
 	}
 
 	if connYml.SslPath != "" {
-		connection.Ssl = readFile(basePath, connYml.SslPath)
+		if connection.Ssl, err = readFile(basePath, connYml.SslPath); err != nil {
+			return connection, err
+		}
 	}
 
 	if connYml.DatabasePath != "" {
-		connection.Database = readFile(basePath, connYml.DatabasePath)
+		if connection.Database, err = readFile(basePath, connYml.DatabasePath); err != nil {
+			return connection, err
+		}
 	}
 
 	if connYml.UserPath != "" {
-		connection.User = readFile(basePath, connYml.UserPath)
+		if connection.User, err = readFile(basePath, connYml.UserPath); err != nil {
+			return connection, err
+		}
 	}
 
 	if connYml.PassPath != "" {
-		connection.Pass = readFile(basePath, connYml.PassPath)
+		if connection.Pass, err = readFile(basePath, connYml.PassPath); err != nil {
+			return connection, err
+		}
 	}
 
-	return connection
+	return connection, nil
 }
 
-func readFile(basePath string, path string) string {
+func readFile(basePath string, path string) (string, error) {
 	if strings.HasPrefix(path, "/") {
 		basePath = ""
 	}
 
 	data, err := os.ReadFile(filepath.Join(basePath, path))
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	return strings.TrimSpace(string(data))
+	return strings.TrimSpace(string(data)), nil
 }
@@ -1,11 +1,17 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestLoadConfig(t *testing.T) {
-	config := Load("../../test/fixtures/projects/postgres_to_clickhouse/trucker.yml")
+	config, err := Load("../../test/fixtures/projects/postgres_to_clickhouse/trucker.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if config.UniqueId != "2" {
 		t.Error("Expected unique id = 2, got", config.UniqueId)
@@ -15,6 +21,29 @@ func TestLoadConfig(t *testing.T) {
 		t.Error("Expected slow query threshold = 1500, got", config.SlowQueryThresholdMs)
 	}
 
+	expectedReconnect := Reconnect{InitialBackoffMs: DefaultReconnectInitialBackoffMs, MaxBackoffMs: DefaultReconnectMaxBackoffMs}
+	if config.Reconnect != expectedReconnect {
+		t.Error("Expected default reconnect config =", expectedReconnect, "got", config.Reconnect)
+	}
+
+	if config.Metrics.Listen != "" {
+		t.Error("Expected no metrics listen address, got", config.Metrics.Listen)
+	}
+
+	expectedHealth := Health{StuckThresholdMs: DefaultStuckThresholdMs}
+	if config.Health != expectedHealth {
+		t.Error("Expected default health config =", expectedHealth, "got", config.Health)
+	}
+
+	if config.Migrate.Auto {
+		t.Error("Expected migrate.auto = false")
+	}
+
+	expectedLog := Log{Level: DefaultLogLevel, Format: "text"}
+	if config.Log != expectedLog {
+		t.Error("Expected log config =", expectedLog, "got", config.Log)
+	}
+
 	if len(config.Connections) != 2 {
 		t.Error("Expected 2 connections, got", len(config.Connections))
 	}
@@ -53,6 +82,10 @@ func TestLoadConfig(t *testing.T) {
 		t.Error("Expected connection pass = pgpass, got", conn.Pass)
 	}
 
+	if conn.Plugin != "wal2json" {
+		t.Error("Expected connection plugin = wal2json, got", conn.Plugin)
+	}
+
 	conn = config.Connections["chconn"]
 
 	if conn.Name != "chconn" {
@@ -82,4 +115,80 @@ func TestLoadConfig(t *testing.T) {
 	if conn.Pass != "trucker" {
 		t.Error("Expected connection pass = trucker got", conn.Pass)
 	}
+
+	if conn.Plugin != "" {
+		t.Error("Expected no plugin for clickhouse connection, got", conn.Plugin)
+	}
+}
+
+func TestLoadConfigFeatures(t *testing.T) {
+	config, err := Load("../../test/fixtures/projects/reconnect/trucker.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedReconnect := Reconnect{MaxAttempts: 5, InitialBackoffMs: 500, MaxBackoffMs: DefaultReconnectMaxBackoffMs}
+	if config.Reconnect != expectedReconnect {
+		t.Error("Expected reconnect config =", expectedReconnect, "got", config.Reconnect)
+	}
+
+	config, err = Load("../../test/fixtures/projects/metrics_and_health/trucker.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Metrics.Listen != "127.0.0.1:9090" {
+		t.Error("Expected metrics listen address = 127.0.0.1:9090, got", config.Metrics.Listen)
+	}
+	expectedHealth := Health{Listen: "127.0.0.1:9090", StuckThresholdMs: 60000}
+	if config.Health != expectedHealth {
+		t.Error("Expected health config =", expectedHealth, "got", config.Health)
+	}
+
+	config, err = Load("../../test/fixtures/projects/auto_migrate/trucker.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Migrate.Auto {
+		t.Error("Expected migrate.auto = true")
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trucker.yml")
+	configYml := `unique_id: 1
+slow_query_treshold_ms: 100
+connections:
+- name: pgconn
+  adapter: postgres
+  host: localhost
+  plugin: decoderbufs
+- name: pgconn
+  adapter: postgres
+  host: localhost
+- name: mysqlconn
+  adapter: mysql
+  host: localhost
+- adapter: clickhouse
+`
+	if err := os.WriteFile(path, []byte(configYml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	expected := []string{
+		"trucker.yml:2: unknown key slow_query_treshold_ms",
+		"trucker.yml:7: connection pgconn: plugin must be wal2json or pgoutput",
+		"trucker.yml:8: connection pgconn is defined more than once",
+		"trucker.yml:12: connection mysqlconn: adapter must be postgres or clickhouse",
+		"trucker.yml:14: connection #3: name is required",
+		"trucker.yml:14: connection #3: host or host_path is required",
+	}
+	for _, e := range expected {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("Expected error to contain %q, got %q", e, err)
+		}
+	}
 }
@@ -1,85 +1,337 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"slices"
+	"strings"
 
 	"path/filepath"
+	"text/template"
+
+	"github.com/tonyfg/trucker/pkg/logging"
+)
+
+// What to do when a truck fails to process a transaction (on_error in
+// truck.yml)
+const (
+	OnErrorRestart = "restart" // retry the truck with backoff (default)
+	OnErrorDegrade = "degrade" // leave the truck stopped, keep the others running
+	OnErrorStop    = "stop"    // stop all trucks and exit
+)
+
+// What to do when the columns of a truck's input table change while streaming
+// (on_schema_change in truck.yml)
+const (
+	OnSchemaChangeContinue = "continue" // carry on with the new columns (default)
+	OnSchemaChangePause    = "pause"    // stop processing changes until trucker is restarted
+	OnSchemaChangeFail     = "fail"     // stop all trucks and exit
+)
+
+// What to do when one of a truck's input tables is truncated (on_truncate in
+// truck.yml)
+const (
+	OnTruncateIgnore   = "ignore"   // leave the output as it is (default)
+	OnTruncateSql      = "sql"      // run truncate.sql on the output
+	OnTruncateTruncate = "truncate" // truncate output.tables
+	OnTruncateBackfill = "backfill" // truncate output.tables (if any) and backfill every input table again
+)
+
+// Where to keep changesets whose output query fails (dead_letter.type in
+// truck.yml)
+const (
+	DeadLetterTable = "table" // a table in the truck's output database
+	DeadLetterFile  = "file"  // a JSON lines file
+
+	DefaultDeadLetterPath = "dead_letters.jsonl"
+)
+
+// How many rows backfills read and write at a time, unless backfill.chunk_size
+// in truck.yml says otherwise
+const DefaultBackfillChunkSize = 100000
+
+// How long a truck with on_error: restart waits before its first restart, and
+// the most it waits between restarts (the wait doubles after each one), unless
+// restart in truck.yml says otherwise
+const (
+	DefaultRestartInitialBackoffMs = 1000
+	DefaultRestartMaxBackoffMs     = 60000
 )
 
+// How many chunks backfills read and write at once, unless
+// backfill.parallelism in truck.yml says otherwise. Clickhouse outputs only
+// read chunks in parallel, and insert them one at a time, in order.
+const DefaultBackfillParallelism = 1
+
 type Truck struct {
-	Name                 string
-	SlowQueryThresholdMs int64 `yaml:"slow_query_threshold_ms"`
-	Input                struct {
+	Name                 string `yaml:"-"` // the truck's directory
+	SlowQueryThresholdMs int64  `yaml:"slow_query_threshold_ms"`
+	OnError              string `yaml:"on_error"`
+	MaxRestarts          int    `yaml:"max_restarts"`
+	OnSchemaChange       string `yaml:"on_schema_change"`
+	OnTruncate           string `yaml:"on_truncate"`
+	LogLevel             string `yaml:"log_level"`
+	DeadLetter           struct {
+		Type string `yaml:"type"`
+		Path string `yaml:"path"`
+	} `yaml:"dead_letter"`
+	Restart struct {
+		InitialBackoffMs int64 `yaml:"initial_backoff_ms"`
+		MaxBackoffMs     int64 `yaml:"max_backoff_ms"`
+	} `yaml:"restart"`
+	Backfill struct {
+		ChunkSize int `yaml:"chunk_size"`
+		// Chunks in flight at once. Their inserts are still serialized
+		// on Clickhouse outputs, so only reading them is parallel there.
+		Parallelism int `yaml:"parallelism"`
+	} `yaml:"backfill"`
+	Input struct {
 		Connection string   `yaml:"connection"`
 		Table      string   `yaml:"table"`
 		Tables     []string `yaml:"tables"`
-		Sql        string
+		// Only these columns (or all but these) are replicated and
+		// backfilled. At most one of them can be set.
+		OnlyColumns   []string `yaml:"only_columns"`
+		ExceptColumns []string `yaml:"except_columns"`
+		// Only the rows matching the table's SQL condition are replicated
+		// and backfilled, by table name
+		Where map[string]string `yaml:"where"`
+		// Let trucker set REPLICA IDENTITY FULL on input tables when
+		// input.sql or output.sql use old__ values it doesn't cover
+		SetReplicaIdentityFull bool `yaml:"set_replica_identity_full"`
+		// Look up the current values of TOASTed columns that updates
+		// leave out because they didn't change, instead of passing NULLs
+		RefetchUnchangedToast bool   `yaml:"refetch_unchanged_toast"`
+		Sql                   string `yaml:"-"`
 	} `yaml:"input"`
 	Output struct {
 		Connection string `yaml:"connection"`
-		Sql        string
+		// Output tables emptied when an input table is truncated, with
+		// on_truncate: truncate or backfill
+		Tables      []string `yaml:"tables"`
+		Sql         string   `yaml:"-"`
+		TruncateSql string   `yaml:"-"` // truncate.sql, for on_truncate: sql
 	} `yaml:"output"`
 }
 
-func LoadTrucks(projectPath string, cfg Config) []Truck {
+// LoadTrucks loads every truck.yml in the project. Problems with any of them
+// are all returned together, each with the file and line it's on.
+func LoadTrucks(projectPath string, cfg Config) ([]Truck, error) {
 	ymlPaths, err := filepath.Glob(filepath.Join(projectPath, "*", "truck.yml"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	trucks := make([]Truck, 0, 1)
+	errs := make([]error, 0)
+	names := make(map[string]string)
 	for _, ymlPath := range ymlPaths {
-		trucks = append(trucks, loadTruck(ymlPath, cfg))
+		truck, err := loadTruck(ymlPath, cfg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		// Truck names end up in metric labels, file names and dead letter
+		// rows, where Whiskies and whiskies would get mixed up
+		if other, ok := names[strings.ToLower(truck.Name)]; ok {
+			errs = append(errs, fmt.Errorf("%s: truck name %s is already used by %s", ymlPath, truck.Name, other))
+			continue
+		}
+		names[strings.ToLower(truck.Name)] = ymlPath
+
+		trucks = append(trucks, truck)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
-	return trucks
+	return trucks, nil
 }
 
-func loadTruck(path string, cfg Config) Truck {
+func loadTruck(path string, cfg Config) (Truck, error) {
 	envMap, err := envToMap()
 	if err != nil {
-		log.Fatal(err)
+		return Truck{}, err
 	}
 
-	truck := loadYml(path, Truck{}, envMap)
+	truck, v, err := loadYml(path, Truck{}, envMap)
+	if err != nil {
+		return Truck{}, err
+	}
 	dir := filepath.Dir(path)
 	truck.Name = filepath.Base(dir)
 
+	// input.sql is optional, changes go straight to output.sql without it
 	inputSqlPath := filepath.Join(dir, "input.sql")
-	if _, err := os.Stat(inputSqlPath); err == nil {
-		inputSqlBuf, err := os.ReadFile(inputSqlPath)
-		if err == nil {
-			truck.Input.Sql = string(inputSqlBuf)
-		}
+	inputSqlBuf, err := os.ReadFile(inputSqlPath)
+	if err == nil {
+		truck.Input.Sql = string(inputSqlBuf)
+		validateSqlTemplate(v, inputSqlPath, truck.Input.Sql)
+	} else if !os.IsNotExist(err) {
+		return Truck{}, err
 	}
 
-	outputSqlBuf, err := os.ReadFile(filepath.Join(dir, "output.sql"))
+	outputSqlPath := filepath.Join(dir, "output.sql")
+	outputSqlBuf, err := os.ReadFile(outputSqlPath)
 	if err == nil {
 		truck.Output.Sql = string(outputSqlBuf)
+		validateSqlTemplate(v, outputSqlPath, truck.Output.Sql)
+	} else if os.IsNotExist(err) {
+		v.errs = append(v.errs, fmt.Errorf("%s is missing", outputSqlPath))
+	} else {
+		return Truck{}, err
 	}
 
-	if connectionCfg, ok := cfg.Connections[truck.Input.Connection]; ok {
-		cfg.Connections[truck.Input.Connection] = connectionCfg
+	// truncate.sql is only needed with on_truncate: sql
+	truncateSqlPath := filepath.Join(dir, "truncate.sql")
+	truncateSqlBuf, err := os.ReadFile(truncateSqlPath)
+	if err == nil {
+		truck.Output.TruncateSql = string(truncateSqlBuf)
+		validateSqlTemplate(v, truncateSqlPath, truck.Output.TruncateSql)
+	} else if !os.IsNotExist(err) {
+		return Truck{}, err
+	}
+
+	if truck.Input.Connection == "" {
+		v.errorf("input", "input.connection is required")
+	} else if connectionCfg, ok := cfg.Connections[truck.Input.Connection]; !ok {
+		v.errorf("input.connection", "input.connection %s isn't defined in trucker.yml", truck.Input.Connection)
+	} else if connectionCfg.Adapter != "postgres" {
+		v.errorf("input.connection", "input.connection %s uses the %s adapter, only postgres is supported as an input", truck.Input.Connection, connectionCfg.Adapter)
 	}
 
-	if connectionCfg, ok := cfg.Connections[truck.Output.Connection]; ok {
-		cfg.Connections[truck.Output.Connection] = connectionCfg
+	if truck.Output.Connection == "" {
+		v.errorf("output", "output.connection is required")
+	} else if _, ok := cfg.Connections[truck.Output.Connection]; !ok {
+		v.errorf("output.connection", "output.connection %s isn't defined in trucker.yml", truck.Output.Connection)
 	}
 
 	if truck.Input.Table != "" {
 		truck.Input.Tables = append(truck.Input.Tables, truck.Input.Table)
 	}
-	log.Printf("[Truck %s] configured for:\n", truck.Name)
+	if len(truck.Input.Tables) == 0 {
+		v.errorf("input", "input.table or input.tables is required")
+	}
+	for i, table := range truck.Input.Tables {
+		if table == "" {
+			v.errorf(fmt.Sprintf("input.tables.%d", i), "input.tables can't have empty table names")
+		}
+	}
 
-	for _, table := range truck.Input.Tables {
-		log.Printf("- %s:%s -> %s\n", truck.Input.Connection, table, truck.Output.Connection)
+	if len(truck.Input.OnlyColumns) > 0 && len(truck.Input.ExceptColumns) > 0 {
+		v.errorf("input.except_columns", "input.only_columns and input.except_columns can't be used together")
+	}
+
+	for table := range truck.Input.Where {
+		if !slices.Contains(truck.Input.Tables, table) {
+			v.errorf("input.where", "input.where has a condition for %s, which isn't one of the truck's input tables", table)
+		}
 	}
 
 	if truck.SlowQueryThresholdMs == 0 {
 		truck.SlowQueryThresholdMs = cfg.SlowQueryThresholdMs
-		log.Printf("[Truck %s] Using %dms as a threshold to log slow queries from main config...\n", truck.Name, truck.SlowQueryThresholdMs)
+		slog.Debug("Using slow query threshold from main config", "truck", truck.Name, "threshold_ms", truck.SlowQueryThresholdMs)
+	}
+
+	if truck.LogLevel == "" {
+		truck.LogLevel = cfg.Log.Level
+	} else if _, err := logging.ParseLevel(truck.LogLevel); err != nil {
+		v.errorf("log_level", "log_level must be debug, info, warn or error, got %q", truck.LogLevel)
+	}
+
+	switch truck.OnError {
+	case "":
+		truck.OnError = OnErrorRestart
+	case OnErrorRestart, OnErrorDegrade, OnErrorStop:
+	default:
+		v.errorf("on_error", "on_error must be one of %s, %s or %s, got %q", OnErrorRestart, OnErrorDegrade, OnErrorStop, truck.OnError)
+	}
+
+	if truck.Restart.InitialBackoffMs == 0 {
+		truck.Restart.InitialBackoffMs = DefaultRestartInitialBackoffMs
+	} else if truck.Restart.InitialBackoffMs < 0 {
+		v.errorf("restart.initial_backoff_ms", "restart.initial_backoff_ms must be positive, got %d", truck.Restart.InitialBackoffMs)
+	}
+	if truck.Restart.MaxBackoffMs == 0 {
+		truck.Restart.MaxBackoffMs = DefaultRestartMaxBackoffMs
+	} else if truck.Restart.MaxBackoffMs < 0 {
+		v.errorf("restart.max_backoff_ms", "restart.max_backoff_ms must be positive, got %d", truck.Restart.MaxBackoffMs)
+	}
+	if truck.Restart.MaxBackoffMs < truck.Restart.InitialBackoffMs {
+		truck.Restart.MaxBackoffMs = truck.Restart.InitialBackoffMs
+	}
+
+	switch truck.OnSchemaChange {
+	case "":
+		truck.OnSchemaChange = OnSchemaChangeContinue
+	case OnSchemaChangeContinue, OnSchemaChangePause, OnSchemaChangeFail:
+	default:
+		v.errorf("on_schema_change", "on_schema_change must be one of %s, %s or %s, got %q", OnSchemaChangeContinue, OnSchemaChangePause, OnSchemaChangeFail, truck.OnSchemaChange)
+	}
+
+	switch truck.OnTruncate {
+	case "":
+		truck.OnTruncate = OnTruncateIgnore
+	case OnTruncateIgnore, OnTruncateBackfill:
+	case OnTruncateSql:
+		if truck.Output.TruncateSql == "" {
+			v.errorf("on_truncate", "on_truncate is set to sql, but %s is missing", truncateSqlPath)
+		}
+	case OnTruncateTruncate:
+		if len(truck.Output.Tables) == 0 {
+			v.errorf("output", "output.tables is required with on_truncate: truncate")
+		}
+	default:
+		v.errorf("on_truncate", "on_truncate must be one of %s, %s, %s or %s, got %q", OnTruncateIgnore, OnTruncateSql, OnTruncateTruncate, OnTruncateBackfill, truck.OnTruncate)
+	}
+	if len(truck.Output.Tables) > 0 && truck.OnTruncate != OnTruncateTruncate && truck.OnTruncate != OnTruncateBackfill {
+		v.errorf("output.tables", "output.tables is only used with on_truncate: %s or %s", OnTruncateTruncate, OnTruncateBackfill)
+	}
+
+	if truck.Backfill.ChunkSize == 0 {
+		truck.Backfill.ChunkSize = DefaultBackfillChunkSize
+	} else if truck.Backfill.ChunkSize < 0 {
+		v.errorf("backfill.chunk_size", "backfill.chunk_size must be positive, got %d", truck.Backfill.ChunkSize)
+	}
+	if truck.Backfill.Parallelism == 0 {
+		truck.Backfill.Parallelism = DefaultBackfillParallelism
+	} else if truck.Backfill.Parallelism < 0 {
+		v.errorf("backfill.parallelism", "backfill.parallelism must be positive, got %d", truck.Backfill.Parallelism)
+	}
+
+	switch truck.DeadLetter.Type {
+	case "", DeadLetterTable:
+	case DeadLetterFile:
+		if truck.DeadLetter.Path == "" {
+			truck.DeadLetter.Path = DefaultDeadLetterPath
+		}
+		if !filepath.IsAbs(truck.DeadLetter.Path) {
+			truck.DeadLetter.Path = filepath.Join(dir, truck.DeadLetter.Path)
+		}
+	default:
+		v.errorf("dead_letter.type", "dead_letter.type must be %s or %s, got %q", DeadLetterTable, DeadLetterFile, truck.DeadLetter.Type)
 	}
 
-	return truck
+	if err := v.err(); err != nil {
+		return Truck{}, err
+	}
+
+	for _, table := range truck.Input.Tables {
+		slog.Info("Truck configured", "truck", truck.Name, "table", table, "input", truck.Input.Connection, "output", truck.Output.Connection)
+	}
+
+	return truck, nil
+}
+
+// validateSqlTemplate checks that a truck's SQL parses as a template. Parse
+// errors already start with the file and line, since the path is used as the
+// template's name.
+func validateSqlTemplate(v *validation, path string, sql string) {
+	if _, err := template.New(path).Parse(sql); err != nil {
+		v.errs = append(v.errs, err)
+	}
 }
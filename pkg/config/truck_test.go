@@ -2,20 +2,26 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestLoadTrucks(t *testing.T) {
 	globalCfg := Config{
 		Connections: map[string]Connection{
-			"pgconn": Connection{},
+			"pg_input_conn": {Adapter: "postgres"},
+			"chconn":        {Adapter: "clickhouse"},
 		},
 	}
 
-	trucks := LoadTrucks(
+	trucks, err := LoadTrucks(
 		"../../test/fixtures/projects/postgres_to_clickhouse",
 		globalCfg,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(trucks) != 1 {
 		t.Error("Expected 1 trucks, got", len(trucks))
@@ -39,6 +45,32 @@ func TestLoadTrucks(t *testing.T) {
 		t.Error("Expected slow query threshold = 2000, got", truck.SlowQueryThresholdMs)
 	}
 
+	if truck.OnError != OnErrorRestart {
+		t.Error("Expected on_error to default to restart, got", truck.OnError)
+	}
+
+	if truck.OnSchemaChange != OnSchemaChangeContinue {
+		t.Error("Expected on_schema_change to default to continue, got", truck.OnSchemaChange)
+	}
+
+	if truck.OnTruncate != OnTruncateIgnore {
+		t.Error("Expected on_truncate to default to ignore, got", truck.OnTruncate)
+	}
+
+	if truck.Restart.InitialBackoffMs != DefaultRestartInitialBackoffMs {
+		t.Error("Expected restart.initial_backoff_ms to default to", DefaultRestartInitialBackoffMs, "got", truck.Restart.InitialBackoffMs)
+	}
+	if truck.Restart.MaxBackoffMs != DefaultRestartMaxBackoffMs {
+		t.Error("Expected restart.max_backoff_ms to default to", DefaultRestartMaxBackoffMs, "got", truck.Restart.MaxBackoffMs)
+	}
+
+	if truck.Backfill.ChunkSize != DefaultBackfillChunkSize {
+		t.Error("Expected backfill.chunk_size to default to", DefaultBackfillChunkSize, "got", truck.Backfill.ChunkSize)
+	}
+	if truck.Backfill.Parallelism != DefaultBackfillParallelism {
+		t.Error("Expected backfill.parallelism to default to", DefaultBackfillParallelism, "got", truck.Backfill.Parallelism)
+	}
+
 	inputSql, err := os.ReadFile("../../test/fixtures/projects/postgres_to_clickhouse/truck/input.sql")
 	if err != nil {
 		t.Error(err)
@@ -57,3 +89,235 @@ func TestLoadTrucks(t *testing.T) {
 		t.Error("Expected output sql to be ", outputSql, "got", truck.Output.Sql)
 	}
 }
+
+func TestLoadTruckWithoutInputSql(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mirror")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	truckYml := "input:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n"
+	if err := os.WriteFile(filepath.Join(dir, "truck.yml"), []byte(truckYml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "output.sql"), []byte("INSERT INTO whiskies SELECT * FROM {{ .rows }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	truck, err := loadTruck(filepath.Join(dir, "truck.yml"), Config{Connections: map[string]Connection{"pgconn": {Adapter: "postgres"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if truck.Input.Sql != "" {
+		t.Error("Expected no input sql, got", truck.Input.Sql)
+	}
+}
+
+func TestLoadTruckColumnProjection(t *testing.T) {
+	cfg := Config{Connections: map[string]Connection{"pgconn": {Adapter: "postgres"}}}
+
+	truckYml := "input:\n  connection: pgconn\n  table: public.whiskies\n  except_columns: [tasting_notes]\noutput:\n  connection: pgconn\n"
+	ymlPath := writeTruck(t, "narrow", truckYml)
+
+	truck, err := loadTruck(ymlPath, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(truck.Input.ExceptColumns) != 1 || truck.Input.ExceptColumns[0] != "tasting_notes" {
+		t.Error("Expected except_columns to be [tasting_notes], got", truck.Input.ExceptColumns)
+	}
+
+	truckYml = "input:\n  connection: pgconn\n  table: public.whiskies\n  only_columns: [id]\n  except_columns: [tasting_notes]\noutput:\n  connection: pgconn\n"
+	if err := os.WriteFile(ymlPath, []byte(truckYml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadTruck(ymlPath, cfg); err == nil {
+		t.Error("Expected an error when both only_columns and except_columns are set")
+	}
+}
+
+func TestLoadTruckWhere(t *testing.T) {
+	cfg := Config{Connections: map[string]Connection{"pgconn": {Adapter: "postgres"}}}
+
+	truckYml := "input:\n  connection: pgconn\n  table: public.whiskies\n  where:\n    public.whiskies: tenant_id = 42\noutput:\n  connection: pgconn\n"
+	ymlPath := writeTruck(t, "tenant", truckYml)
+
+	truck, err := loadTruck(ymlPath, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truck.Input.Where["public.whiskies"] != "tenant_id = 42" {
+		t.Error("Expected a where condition for public.whiskies, got", truck.Input.Where)
+	}
+
+	truckYml = "input:\n  connection: pgconn\n  table: public.whiskies\n  where:\n    public.countries: id = 1\noutput:\n  connection: pgconn\n"
+	if err := os.WriteFile(ymlPath, []byte(truckYml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadTruck(ymlPath, cfg); err == nil {
+		t.Error("Expected an error for a where condition on a table the truck doesn't read")
+	}
+}
+
+func TestLoadTruckValidation(t *testing.T) {
+	cfg := Config{Connections: map[string]Connection{
+		"pgconn": {Adapter: "postgres"},
+		"chconn": {Adapter: "clickhouse"},
+	}}
+
+	cases := []struct {
+		name     string
+		truckYml string
+		expected []string
+	}{
+		{
+			name:     "unknown key",
+			truckYml: "input:\n  connection: pgconn\n  table: public.whiskies\n  tabels: [public.countries]\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:4: unknown key input.tabels"},
+		},
+		{
+			name:     "missing connection",
+			truckYml: "input:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: nope\n",
+			expected: []string{"truck.yml:5: output.connection nope isn't defined in trucker.yml"},
+		},
+		{
+			name:     "clickhouse input",
+			truckYml: "input:\n  connection: chconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:2: input.connection chconn uses the clickhouse adapter"},
+		},
+		{
+			name:     "no tables",
+			truckYml: "input:\n  connection: pgconn\n  tables: []\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:1: input.table or input.tables is required"},
+		},
+		{
+			name:     "bad on_schema_change",
+			truckYml: "on_schema_change: ignore\ninput:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:1: on_schema_change must be one of continue, pause or fail"},
+		},
+		{
+			name:     "on_truncate sql without truncate.sql",
+			truckYml: "on_truncate: sql\ninput:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:1: on_truncate is set to sql, but", "truncate.sql is missing"},
+		},
+		{
+			name:     "on_truncate truncate without output tables",
+			truckYml: "on_truncate: truncate\ninput:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:5: output.tables is required with on_truncate: truncate"},
+		},
+		{
+			name:     "output tables without on_truncate",
+			truckYml: "input:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n  tables: [whiskies]\n",
+			expected: []string{"truck.yml:6: output.tables is only used with on_truncate: truncate or backfill"},
+		},
+		{
+			name:     "negative backfill chunk size",
+			truckYml: "backfill:\n  chunk_size: -1\ninput:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:2: backfill.chunk_size must be positive, got -1"},
+		},
+		{
+			name:     "negative backfill parallelism",
+			truckYml: "backfill:\n  parallelism: -2\ninput:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:2: backfill.parallelism must be positive, got -2"},
+		},
+		{
+			name:     "negative restart backoff",
+			truckYml: "restart:\n  initial_backoff_ms: -5\ninput:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:2: restart.initial_backoff_ms must be positive, got -5"},
+		},
+		{
+			name:     "several problems",
+			truckYml: "on_error: explode\ninput:\n  table: public.whiskies\noutput:\n  connection: pgconn\n",
+			expected: []string{"truck.yml:1: on_error must be", "truck.yml:2: input.connection is required"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := loadTruck(writeTruck(t, "whiskies", c.truckYml), cfg)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, expected := range c.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected error to contain %q, got %q", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadTruckSqlTemplateErrors(t *testing.T) {
+	cfg := Config{Connections: map[string]Connection{"pgconn": {Adapter: "postgres"}}}
+	ymlPath := writeTruck(t, "whiskies", "input:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n")
+	outputSql := "INSERT INTO whiskies\nSELECT * FROM {{ .rows }\n"
+	if err := os.WriteFile(filepath.Join(filepath.Dir(ymlPath), "output.sql"), []byte(outputSql), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := loadTruck(ymlPath, cfg)
+	if err == nil || !strings.Contains(err.Error(), "output.sql:2:") {
+		t.Error("Expected an error pointing at line 2 of output.sql, got", err)
+	}
+}
+
+func TestLoadTruckTruncateSql(t *testing.T) {
+	cfg := Config{Connections: map[string]Connection{"pgconn": {Adapter: "postgres"}}}
+	ymlPath := writeTruck(t, "whiskies", "on_truncate: sql\ninput:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n")
+	truncateSql := "DELETE FROM whiskies WHERE source = '{{ .input_table }}'"
+	if err := os.WriteFile(filepath.Join(filepath.Dir(ymlPath), "truncate.sql"), []byte(truncateSql), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	truck, err := loadTruck(ymlPath, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truck.OnTruncate != OnTruncateSql || truck.Output.TruncateSql != truncateSql {
+		t.Errorf("Expected on_truncate sql with truncate.sql loaded, got %q and %q", truck.OnTruncate, truck.Output.TruncateSql)
+	}
+}
+
+func TestLoadTrucksDuplicateNames(t *testing.T) {
+	projectPath := t.TempDir()
+	truckYml := "input:\n  connection: pgconn\n  table: public.whiskies\noutput:\n  connection: pgconn\n"
+	for _, name := range []string{"Whiskies", "whiskies"} {
+		dir := filepath.Join(projectPath, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "truck.yml"), []byte(truckYml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "output.sql"), []byte("SELECT 1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := LoadTrucks(projectPath, Config{Connections: map[string]Connection{"pgconn": {Adapter: "postgres"}}})
+	if err == nil || !strings.Contains(err.Error(), "truck name whiskies is already used") {
+		t.Error("Expected a duplicate truck name error, got", err)
+	}
+}
+
+// writeTruck writes a truck.yml and a trivial output.sql to a new truck
+// directory, and returns the truck.yml path.
+func writeTruck(t *testing.T, name string, truckYml string) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "truck.yml"), []byte(truckYml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "output.sql"), []byte("INSERT INTO whiskies SELECT * FROM {{ .rows }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "truck.yml")
+}
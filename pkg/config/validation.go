@@ -0,0 +1,131 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validation collects the problems with a config file, so they can all be
+// reported at once, each pointing at the line it's on.
+type validation struct {
+	path string
+	root *yaml.Node
+	errs []error
+}
+
+// errorf records a problem with the value at a dotted path of map keys and
+// sequence indexes, like connections.0.adapter. If that value isn't in the
+// file, the problem points at the closest one that is, like the section a
+// required key is missing from.
+func (v *validation) errorf(at string, format string, args ...any) {
+	err := fmt.Errorf(format, args...)
+	line := 0
+	node := v.root
+	for _, key := range strings.Split(at, ".") {
+		var keyLine int
+		if node, keyLine = child(node, key); node == nil {
+			break
+		}
+		line = keyLine
+	}
+
+	if line > 0 {
+		v.errs = append(v.errs, fmt.Errorf("%s:%d: %w", v.path, line, err))
+	} else {
+		v.errs = append(v.errs, fmt.Errorf("%s: %w", v.path, err))
+	}
+}
+
+func (v *validation) err() error {
+	return errors.Join(v.errs...)
+}
+
+// child returns the value at key in node, and the line of the key itself
+// (which is where a mapping value starts being defined).
+func child(node *yaml.Node, key string) (*yaml.Node, int) {
+	if node == nil {
+		return nil, 0
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, 0
+		}
+		return child(node.Content[0], key)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1], node.Content[i].Line
+			}
+		}
+	case yaml.SequenceNode:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+			return node.Content[i], node.Content[i].Line
+		}
+	}
+
+	return nil, 0
+}
+
+// checkKeys adds a problem for every key in node that doesn't match a field
+// of t, so typos in config files don't go unnoticed.
+func (v *validation) checkKeys(node *yaml.Node, t reflect.Type, path []string) {
+	if node == nil {
+		return
+	}
+	if node.Kind == yaml.DocumentNode {
+		for _, content := range node.Content {
+			v.checkKeys(content, t, path)
+		}
+		return
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			field, ok := yamlField(t, key.Value)
+			if !ok {
+				v.errs = append(v.errs, fmt.Errorf("%s:%d: unknown key %s", v.path, key.Line, strings.Join(append(path, key.Value), ".")))
+				continue
+			}
+			v.checkKeys(node.Content[i+1], field.Type, append(path, key.Value))
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			v.checkKeys(item, t.Elem(), append(path, strconv.Itoa(i)))
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkKeys(node.Content[i+1], t.Elem(), append(path, node.Content[i].Value))
+		}
+	}
+}
+
+// yamlField returns the struct field a key is decoded into, following the
+// same rules as the yaml package: the name in the yaml tag, or the field's
+// name in lower case without one.
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if name == key && name != "-" && field.IsExported() {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
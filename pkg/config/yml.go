@@ -2,8 +2,9 @@ package config
 
 import (
 	"bytes"
-	"log"
+	"fmt"
 	"os"
+	"reflect"
 	"strings"
 
 	"text/template"
@@ -11,29 +12,41 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func loadYml[Config any](path string, config Config, variables map[string]string) Config {
+// loadYml reads a config file after filling in its template variables. The
+// returned validation has the file's unknown keys, and is where callers add
+// any other problems they find with it.
+func loadYml[Config any](path string, config Config, variables map[string]string) (Config, *validation, error) {
 	dat, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal(err)
+		return config, nil, err
 	}
 
-	tmpl, err := template.New("connectionsConfig").Parse(string(dat))
+	tmpl, err := template.New(path).Parse(string(dat))
 	if err != nil {
-		log.Fatal(err)
+		return config, nil, err
 	}
 
 	buf := new(bytes.Buffer)
 	err = tmpl.Execute(buf, variables)
 	if err != nil {
-		log.Fatal(err)
+		return config, nil, err
 	}
 
-	err = yaml.Unmarshal(buf.Bytes(), &config)
+	var root yaml.Node
+	err = yaml.Unmarshal(buf.Bytes(), &root)
 	if err != nil {
-		log.Fatal(err)
+		return config, nil, fmt.Errorf("%s: %w", path, err)
 	}
 
-	return config
+	err = root.Decode(&config)
+	if err != nil && root.Kind != 0 {
+		return config, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	v := &validation{path: path, root: &root}
+	v.checkKeys(&root, reflect.TypeOf(config), nil)
+
+	return config, v, nil
 }
 
 func envToMap() (map[string]string, error) {
@@ -14,11 +14,14 @@ type testStruct struct {
 const ymlPath = "../../test/fixtures/test.yml"
 
 func TestLoadYmlWithEnv(t *testing.T) {
-	config := loadYml(
+	config, _, err := loadYml(
 		ymlPath,
 		testStruct{},
 		map[string]string{"TEST_ENV_VAR": "some_value"},
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if config.A != "b" {
 		t.Error("Expected a = b, got", config.A)
@@ -38,11 +41,14 @@ func TestLoadYmlWithEnv(t *testing.T) {
 }
 
 func TestLoadYmlEnvDefaults(t *testing.T) {
-	config := loadYml(
+	config, _, err := loadYml(
 		ymlPath,
 		testStruct{},
 		map[string]string{},
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if config.D != "default_value" {
 		t.Error("Expected d = default_value, got", config.D)
@@ -0,0 +1,174 @@
+package db
+
+import "sync"
+
+// BackfillProgress is how far a truck's backfill of an input table has got.
+// Tables are backfilled in chunks, and each chunk ends at a key the next one
+// starts after (a primary key or a page number, in the input database's text
+// format).
+type BackfillProgress struct {
+	Table string
+	// Where the WAL was when the backfill started. Changes since then have to
+	// be streamed to the truck, even if the backfill is resumed from a later
+	// snapshot.
+	SnapshotLSN uint64
+	LastKey     []string // where the last chunk written ends, nil if none was
+	Done        bool
+}
+
+// BackfillTracker keeps track of the chunks of a table's backfill. Several
+// chunks may be read and written at once, but they're committed one after the
+// other from the start of the table, so the progress recorded always covers
+// every chunk written and nothing else.
+type BackfillTracker struct {
+	mu       sync.Mutex
+	turn     *sync.Cond       // broadcast when a chunk begins or is committed, or the backfill is aborted
+	progress BackfillProgress // as last recorded
+	ends     [][]string       // where each chunk ends, in order
+	begun    int              // chunks that have begun, see BackfillChunk.Begin
+	recorded int              // chunks covered by progress
+	err      error            // why the backfill was aborted, if it was
+}
+
+// BackfillChunk is one chunk of a table's backfill, from after the key After
+// (or the start) up to and including the key End (or the end of the table).
+type BackfillChunk struct {
+	Table       string
+	SnapshotLSN uint64
+	After       []string
+	End         []string
+	tracker     *BackfillTracker
+	index       int
+}
+
+// NewBackfillTracker returns a tracker for a backfill that has got as far as
+// progress.
+func NewBackfillTracker(progress BackfillProgress) *BackfillTracker {
+	t := &BackfillTracker{progress: progress}
+	t.turn = sync.NewCond(&t.mu)
+	return t
+}
+
+// Next returns the chunk after the last one, which ends at end (nil if it's
+// the last chunk of the table).
+func (t *BackfillTracker) Next(end []string) *BackfillChunk {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	after := t.progress.LastKey
+	if len(t.ends) > 0 {
+		after = t.ends[len(t.ends)-1]
+	}
+	t.ends = append(t.ends, end)
+
+	return &BackfillChunk{
+		Table:       t.progress.Table,
+		SnapshotLSN: t.progress.SnapshotLSN,
+		After:       after,
+		End:         end,
+		tracker:     t,
+		index:       len(t.ends) - 1,
+	}
+}
+
+// Progress returns how far the backfill has got, as last recorded.
+func (t *BackfillTracker) Progress() BackfillProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.progress
+}
+
+// Progress returns how far the backfill of the chunk's table has got, as last
+// recorded.
+func (c *BackfillChunk) Progress() BackfillProgress {
+	return c.tracker.Progress()
+}
+
+// Begin runs begin (like starting the transaction the chunk is written in) once
+// the chunks before this one have begun, for writers that hold on to a
+// connection until the chunk is committed. Connections are then taken in
+// order, so the chunk whose turn it is to commit never waits for one behind
+// the chunks waiting for it. It returns an error if the backfill is aborted,
+// or begin fails (and the backfill has to be aborted).
+func (c *BackfillChunk) Begin(begin func() error) error {
+	t := c.tracker
+	t.mu.Lock()
+	for t.begun < c.index && t.err == nil {
+		t.turn.Wait()
+	}
+	err := t.err
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Nothing else begins until this chunk has, and begin may wait for a
+	// connection that a chunk before this one is about to give back
+	if err := begin(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.begun++
+	t.turn.Broadcast()
+
+	return nil
+}
+
+// WaitTurn waits until the chunks before this one are committed, for writers
+// that can't hold on to a chunk's rows without committing them. It returns
+// an error if the backfill is aborted in the meantime.
+func (c *BackfillChunk) WaitTurn() error {
+	t := c.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for t.recorded < c.index && t.err == nil {
+		t.turn.Wait()
+	}
+
+	return t.err
+}
+
+// Commit waits until the chunks before this one are committed, and then has
+// record keep how far the backfill has got with it (like in the same
+// transaction as the chunk's rows, which is committed along with it). The
+// chunk isn't committed if record fails, and neither are the ones after it,
+// so the backfill has to be aborted.
+func (c *BackfillChunk) Commit(record func(progress BackfillProgress) error) error {
+	if err := c.WaitTurn(); err != nil {
+		return err
+	}
+
+	// Nothing else changes the progress until this chunk is committed
+	t := c.tracker
+	progress := t.Progress()
+	progress.LastKey = c.End
+	progress.Done = c.End == nil
+	if err := record(progress); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress = progress
+	t.recorded++
+	t.turn.Broadcast()
+
+	return nil
+}
+
+// Abort gives up on the chunk, and on the rest of the table's backfill with
+// it: the chunks after it that are waiting for their turn get err instead.
+func (c *BackfillChunk) Abort(err error) {
+	t := c.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err == nil {
+		t.err = err
+	}
+	t.turn.Broadcast()
+}
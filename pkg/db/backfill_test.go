@@ -0,0 +1,100 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackfillTracker(t *testing.T) {
+	tracker := NewBackfillTracker(BackfillProgress{Table: "public.whiskies", SnapshotLSN: 100, LastKey: []string{"10"}})
+
+	first := tracker.Next([]string{"20"})
+	second := tracker.Next([]string{"30"})
+	last := tracker.Next(nil)
+	if !reflect.DeepEqual(first.After, []string{"10"}) || !reflect.DeepEqual(second.After, []string{"20"}) || !reflect.DeepEqual(last.After, []string{"30"}) {
+		t.Errorf("Expected chunks to start after 10, 20 and 30, got %v, %v and %v", first.After, second.After, last.After)
+	}
+
+	recorded := make(chan BackfillProgress, 3)
+	record := func(progress BackfillProgress) error {
+		recorded <- progress
+		return nil
+	}
+
+	// Chunks written out of order wait for the ones before them
+	secondDone := make(chan error)
+	go func() { secondDone <- second.Commit(record) }()
+	select {
+	case err := <-secondDone:
+		t.Fatal("Expected the second chunk to wait for the first one, got", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := first.Commit(func(BackfillProgress) error { return errors.New("boom") }); err == nil {
+		t.Error("Expected the error from record")
+	}
+	if err := first.Commit(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-secondDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := last.Commit(record); err != nil {
+		t.Fatal(err)
+	}
+
+	close(recorded)
+	got := make([]BackfillProgress, 0)
+	for progress := range recorded {
+		got = append(got, progress)
+	}
+	expected := []BackfillProgress{
+		{Table: "public.whiskies", SnapshotLSN: 100, LastKey: []string{"20"}},
+		{Table: "public.whiskies", SnapshotLSN: 100, LastKey: []string{"30"}},
+		{Table: "public.whiskies", SnapshotLSN: 100, Done: true},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected progress %v, got %v", expected, got)
+	}
+	if progress := tracker.Progress(); !reflect.DeepEqual(progress, expected[2]) {
+		t.Error("Expected the backfill to be done, got", progress)
+	}
+}
+
+func TestBackfillTrackerAbort(t *testing.T) {
+	tracker := NewBackfillTracker(BackfillProgress{Table: "public.whiskies", SnapshotLSN: 100})
+	first := tracker.Next([]string{"20"})
+	second := tracker.Next([]string{"30"})
+	last := tracker.Next(nil)
+
+	if err := first.Begin(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	secondDone := make(chan error)
+	go func() {
+		if err := second.Begin(func() error { return nil }); err != nil {
+			secondDone <- err
+			return
+		}
+		secondDone <- second.Commit(func(BackfillProgress) error { return nil })
+	}()
+
+	boom := errors.New("boom")
+	first.Abort(boom)
+	if err := <-secondDone; err != boom {
+		t.Error("Expected the chunk after the aborted one to get its error, got", err)
+	}
+	if err := last.Begin(func() error { return nil }); err != boom {
+		t.Error("Expected chunks to no longer begin once the backfill is aborted, got", err)
+	}
+	if err := last.WaitTurn(); err != boom {
+		t.Error("Expected chunks to no longer get their turn once the backfill is aborted, got", err)
+	}
+
+	if progress := tracker.Progress(); progress.LastKey != nil || progress.Done {
+		t.Error("Expected no progress, got", progress)
+	}
+}
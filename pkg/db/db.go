@@ -3,53 +3,192 @@ package db
 import (
 	"fmt"
 	"iter"
+	"strings"
+	"time"
 )
 
 const (
 	Insert uint8 = iota
 	Update
 	Delete
+	Truncate // the whole table was emptied, changesets have no rows
 )
 
 type Column struct {
-	Name string
-	Type uint8
+	Name string `json:"name"`
+	Type uint8  `json:"type"`
 }
 
 type Changeset struct {
-	Table          string
-	Operation      uint8 // Insert, Update, or Delete
-	Columns        []Column
-	Rows           [][]any
-	StreamPosition uint64
+	Table     string
+	Operation uint8 // Insert, Update, Delete or Truncate
+	Columns   []Column
+	Rows      [][]any
+	// Unchanged flags, by row and column, the values an update left out
+	// because they're TOASTed and didn't change. They're nil in Rows. nil
+	// when no row has any, and so is a row without any.
+	Unchanged [][]bool
+}
+
+// MarkUnchanged flags the value of a column in a row as left out of an update.
+func (c *Changeset) MarkUnchanged(row int, col int) {
+	for len(c.Unchanged) <= row {
+		c.Unchanged = append(c.Unchanged, nil)
+	}
+	if c.Unchanged[row] == nil {
+		c.Unchanged[row] = make([]bool, len(c.Columns))
+	}
+	c.Unchanged[row][col] = true
+}
+
+// IsUnchanged tells whether the value of a column in a row was left out of an
+// update.
+func (c *Changeset) IsUnchanged(row int, col int) bool {
+	return row < len(c.Unchanged) && col < len(c.Unchanged[row]) && c.Unchanged[row][col]
+}
+
+// UnchangedColumns returns the names of the columns whose values were left out
+// of an update to a row.
+func (c *Changeset) UnchangedColumns(row int) []string {
+	names := make([]string, 0)
+	for col, column := range c.Columns {
+		if c.IsUnchanged(row, col) {
+			names = append(names, column.Name)
+		}
+	}
+
+	return names
 }
 
 type ChanChangeset struct {
 	Table     string
-	Operation uint8 // Insert, Update, or Delete
+	Operation uint8 // Insert, Update, Delete or Truncate
 	Columns   []Column
 	Rows      chan [][]any
+	// Err is set before Rows is closed if something went wrong while reading
+	// them, so it should be checked once Rows has been drained.
+	Err error
+}
+
+// NewTruncateChangeset returns a changeset telling writers that table was
+// truncated. It doesn't have any rows.
+func NewTruncateChangeset(table string) *ChanChangeset {
+	rows := make(chan [][]any)
+	close(rows)
+
+	return &ChanChangeset{Table: table, Operation: Truncate, Rows: rows}
+}
+
+// Discard drains any rows left in the changeset, so that whatever is producing
+// them can finish and release its resources. Writers use it when they bail out
+// on an error halfway through a changeset.
+func (c *ChanChangeset) Discard() {
+	for range c.Rows {
+	}
 }
 
+// RecordRows returns a copy of the changeset that also keeps every row read
+// through it. The rows are all there once the copy's Rows have been drained.
+func (c *ChanChangeset) RecordRows() (*ChanChangeset, func() [][]any) {
+	var rows [][]any
+	recorded := &ChanChangeset{
+		Table:     c.Table,
+		Operation: c.Operation,
+		Columns:   c.Columns,
+		Rows:      make(chan [][]any, cap(c.Rows)),
+	}
+
+	go func() {
+		defer close(recorded.Rows)
+
+		for batch := range c.Rows {
+			rows = append(rows, batch...)
+			recorded.Rows <- batch
+		}
+		recorded.Err = c.Err
+	}()
+
+	return recorded, func() [][]any { return rows }
+}
+
+// Transaction holds every change made by a single source transaction, from
+// BEGIN to COMMIT. StreamPosition is the position right after the commit, so
+// it's safe to resume streaming from it once the transaction is written.
 type Transaction struct {
 	StreamPosition uint64
+	CommitTime     time.Time
 	Changesets     iter.Seq[*Changeset]
+	// Input tables whose columns changed in the stream before (or during)
+	// this transaction
+	SchemaChanges []SchemaChange
+}
+
+// SchemaChange describes how the columns of an input table changed while
+// streaming. Columns are listed by name, and a renamed column shows up as
+// dropped and added.
+type SchemaChange struct {
+	Table   string
+	Added   []string
+	Dropped []string
+	Retyped []string // columns whose type changed
+}
+
+func (c SchemaChange) String() string {
+	changes := make([]string, 0, 3)
+	if len(c.Added) > 0 {
+		changes = append(changes, "added "+strings.Join(c.Added, ", "))
+	}
+	if len(c.Dropped) > 0 {
+		changes = append(changes, "dropped "+strings.Join(c.Dropped, ", "))
+	}
+	if len(c.Retyped) > 0 {
+		changes = append(changes, "changed the type of "+strings.Join(c.Retyped, ", "))
+	}
+
+	return fmt.Sprintf("%s: %s", c.Table, strings.Join(changes, "; "))
 }
 
 type Reader interface {
-	Read(changeset *Changeset) *ChanChangeset
+	Read(changeset *Changeset) (*ChanChangeset, error)
 	Close()
 }
 
+// Writer writes changesets to an output database. WriteTransaction stops at
+// the first error it gets from changesets, and none of the transaction's
+// changes (or its stream position) are kept when the database supports it.
+// Truncate changesets are ignored unless SetTruncate says what to do with
+// them. SetupPositionTracking also sets up backfill progress tracking.
 type Writer interface {
-	SetupPositionTracking()
-	SetCurrentPosition(lsn uint64)
-	GetCurrentPosition() uint64
-	Write(changeset *ChanChangeset) bool
-	TruncateTable(table string)
+	SetupPositionTracking() error
+	SetCurrentPosition(lsn uint64) error
+	GetCurrentPosition() (uint64, error)
+	GetBackfillProgress() ([]BackfillProgress, error)
+	SetBackfillProgress(progress BackfillProgress) error
+	WriteBackfillChunk(changeset *ChanChangeset, chunk *BackfillChunk) (bool, error)
+	ClearBackfillProgress() error
+	Write(changeset *ChanChangeset) (bool, error)
+	WriteTransaction(position uint64, changesets iter.Seq2[*ChanChangeset, error]) (bool, error)
+	TruncateTable(table string) error
+	SetDeadLetterSink(sink DeadLetterSink)
+	SetTruncate(sql string, tables []string)
 	Close()
 }
 
+func ParseOperation(operation string) (uint8, error) {
+	switch operation {
+	case "insert":
+		return Insert, nil
+	case "update":
+		return Update, nil
+	case "delete":
+		return Delete, nil
+	case "truncate":
+		return Truncate, nil
+	default:
+		return 0, fmt.Errorf("unknown operation %q", operation)
+	}
+}
+
 func OperationStr(operation uint8) string {
 	switch operation {
 	case Insert:
@@ -58,6 +197,8 @@ func OperationStr(operation uint8) string {
 		return "update"
 	case Delete:
 		return "delete"
+	case Truncate:
+		return "truncate"
 	default:
 		panic(fmt.Sprintf("Unknown operation %d\n", operation))
 	}
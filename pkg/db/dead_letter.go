@@ -0,0 +1,197 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DeadLetter is a changeset that couldn't be written because the output query
+// failed for it. It holds the rows returned by the input query, so it can be
+// written again later without going back to the input database.
+type DeadLetter struct {
+	Id        string    `json:"id"`
+	Position  uint64    `json:"lsn"`
+	Table     string    `json:"input_table"`
+	Operation string    `json:"operation"`
+	Columns   []Column  `json:"columns"`
+	Rows      [][]any   `json:"rows"`
+	Sql       string    `json:"sql"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeadLetterSink stores dead letters until they're re-driven.
+type DeadLetterSink interface {
+	Setup() error
+	Send(letter *DeadLetter) error
+	// Pending returns the dead letters that haven't been re-driven yet, oldest
+	// first.
+	Pending() ([]*DeadLetter, error)
+	// Resolve marks a dead letter as successfully re-driven.
+	Resolve(letter *DeadLetter) error
+	Close()
+}
+
+func NewDeadLetter(position uint64, changeset *ChanChangeset, rows [][]any, err error) *DeadLetter {
+	letter := &DeadLetter{
+		Position:  position,
+		Table:     changeset.Table,
+		Operation: OperationStr(changeset.Operation),
+		Columns:   changeset.Columns,
+		Rows:      rows,
+		Error:     err.Error(),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var dbErr *Error
+	if errors.As(err, &dbErr) {
+		letter.Sql = dbErr.Query
+	}
+
+	return letter
+}
+
+// Changeset turns the dead letter back into something a writer can write.
+func (d *DeadLetter) Changeset() (*ChanChangeset, error) {
+	operation, err := ParseOperation(d.Operation)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make(chan [][]any, 1)
+	rows <- d.Rows
+	close(rows)
+
+	return &ChanChangeset{
+		Table:     d.Table,
+		Operation: operation,
+		Columns:   d.Columns,
+		Rows:      rows,
+	}, nil
+}
+
+func (d *DeadLetter) UnmarshalJSON(data []byte) error {
+	type deadLetterJson DeadLetter
+	var letter struct {
+		deadLetterJson
+		Rows json.RawMessage `json:"rows"`
+	}
+
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return err
+	}
+
+	*d = DeadLetter(letter.deadLetterJson)
+	rows, err := DecodeJsonRows(d.Columns, letter.Rows)
+	if err != nil {
+		return err
+	}
+	d.Rows = rows
+
+	return nil
+}
+
+// DecodeJsonRows decodes rows that were encoded as JSON arrays, turning each
+// value back into the Go type readers return for its column type. Numeric
+// and IP address values come back as strings.
+func DecodeJsonRows(columns []Column, data []byte) ([][]any, error) {
+	var rawRows [][]json.RawMessage
+	if err := json.Unmarshal(data, &rawRows); err != nil {
+		return nil, err
+	}
+
+	rows := make([][]any, len(rawRows))
+	for i, rawRow := range rawRows {
+		if len(rawRow) != len(columns) {
+			return nil, fmt.Errorf("row %d has %d values, expected %d", i, len(rawRow), len(columns))
+		}
+
+		rows[i] = make([]any, len(columns))
+		for j, col := range columns {
+			value, err := decodeJsonValue(col.Type, rawRow[j])
+			if err != nil {
+				return nil, fmt.Errorf("row %d, column %s: %w", i, col.Name, err)
+			}
+			rows[i][j] = value
+		}
+	}
+
+	return rows, nil
+}
+
+func decodeJsonValue(t uint8, raw json.RawMessage) (any, error) {
+	if string(raw) == "null" {
+		return nil, nil
+	}
+
+	switch t {
+	case Int8:
+		return unmarshalAs[int8](raw)
+	case Int16:
+		return unmarshalAs[int16](raw)
+	case Int32:
+		return unmarshalAs[int32](raw)
+	case Int64:
+		return unmarshalAs[int64](raw)
+	case UInt8:
+		return unmarshalAs[uint8](raw)
+	case UInt16:
+		return unmarshalAs[uint16](raw)
+	case UInt32:
+		return unmarshalAs[uint32](raw)
+	case UInt64:
+		return unmarshalAs[uint64](raw)
+	case Float32:
+		return unmarshalAs[float32](raw)
+	case Float64:
+		return unmarshalAs[float64](raw)
+	case Bool:
+		return unmarshalAs[bool](raw)
+	case Date, DateTime:
+		return unmarshalAs[time.Time](raw)
+	case Numeric:
+		var value json.Number
+		err := json.Unmarshal(raw, &value)
+		return value.String(), err
+	case String, IPAddr:
+		return unmarshalAs[string](raw)
+	case MapStringToString:
+		return unmarshalAs[map[string]any](raw)
+	}
+
+	if elemType, ok := arrayElementType(t); ok {
+		var rawElems []json.RawMessage
+		if err := json.Unmarshal(raw, &rawElems); err != nil {
+			return nil, err
+		}
+
+		elems := make([]any, len(rawElems))
+		for i, rawElem := range rawElems {
+			elem, err := decodeJsonValue(elemType, rawElem)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = elem
+		}
+
+		return elems, nil
+	}
+
+	return unmarshalAs[any](raw)
+}
+
+func unmarshalAs[T any](raw json.RawMessage) (any, error) {
+	var value T
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
+
+func arrayElementType(t uint8) (uint8, bool) {
+	if t >= Int8Array && t <= MapStringToStringArray {
+		return t - Int8Array, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,26 @@
+package db
+
+import "fmt"
+
+// Error is returned by readers and writers when a database operation fails.
+// Op says what was being done (read, write, backfill, ...) and Table is the
+// input table of the changeset involved, if there was one. Query is only set
+// when the input or output query itself failed.
+type Error struct {
+	Op    string
+	Table string
+	Query string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Table, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// OldColumnPrefix is prepended to a column's name for the column holding its
+// value before an update or delete.
+const OldColumnPrefix = "old__"
+
+// UnchangedColumn is the column input.sql can read, as a text array, the names
+// of the columns an update left out of each row because they're TOASTed and
+// didn't change. It's only there for queries that use it.
+const UnchangedColumn = "unchanged__"
+
+// TableFilter is what a truck reads of one of its input tables: the columns
+// its ColumnFilter includes, from the rows its Where clause (a SQL boolean
+// expression on the table's columns) matches. An empty Where matches every row.
+//
+// OldColumns are the columns the truck reads old__ values of. Old values are
+// only replicated for the table's replica identity, so it has to cover them
+// and the columns Where uses, or be set to FULL by trucker if
+// SetReplicaIdentityFull allows it.
+type TableFilter struct {
+	Columns                ColumnFilter
+	Where                  string
+	OldColumns             []string
+	SetReplicaIdentityFull bool
+}
+
+var quotedOldColumnRe = regexp.MustCompile(`"` + OldColumnPrefix + `([^"]+)"`)
+var oldColumnRe = regexp.MustCompile(`(?i)(?:^|[^a-z0-9_$])` + OldColumnPrefix + `([a-z0-9_$]+)`)
+
+// OldColumnReferences returns the columns whose old__ values a SQL query
+// uses, like old__name or "old__Name".
+func OldColumnReferences(sql string) []string {
+	columns := make([]string, 0)
+	add := func(col string) {
+		if !slices.Contains(columns, col) {
+			columns = append(columns, col)
+		}
+	}
+
+	for _, match := range quotedOldColumnRe.FindAllStringSubmatch(sql, -1) {
+		add(match[1])
+	}
+
+	unquoted := quotedOldColumnRe.ReplaceAllString(sql, "")
+	for _, match := range oldColumnRe.FindAllStringSubmatch(unquoted, -1) {
+		add(strings.ToLower(match[1]))
+	}
+
+	return columns
+}
+
+var unchangedColumnRe = regexp.MustCompile(`(?i)(?:^|[^a-z0-9_$])"?` + UnchangedColumn + `(?:$|[^a-z0-9_$])`)
+
+// UsesUnchangedColumn tells whether a SQL query reads the unchanged__ column.
+func UsesUnchangedColumn(sql string) bool {
+	return unchangedColumnRe.MatchString(sql)
+}
+
+// ColumnFilter is the projection a truck applies to its input tables, from
+// only_columns or except_columns in truck.yml. The zero value includes every
+// column.
+type ColumnFilter struct {
+	Only   []string
+	Except []string
+}
+
+func (f ColumnFilter) IsZero() bool {
+	return len(f.Only) == 0 && len(f.Except) == 0
+}
+
+// Includes reports whether the column is part of the projection. old__
+// columns are included along with the column they hold the old value of.
+func (f ColumnFilter) Includes(name string) bool {
+	name = strings.TrimPrefix(name, OldColumnPrefix)
+
+	if len(f.Only) > 0 && !slices.Contains(f.Only, name) {
+		return false
+	}
+
+	return !slices.Contains(f.Except, name)
+}
+
+// Project returns the changeset with only the columns the filter includes.
+// Changesets are shared between the trucks reading a table, so the original
+// is left untouched.
+func (f ColumnFilter) Project(changeset *Changeset) *Changeset {
+	if f.IsZero() {
+		return changeset
+	}
+
+	indexes := make([]int, 0, len(changeset.Columns))
+	for i, col := range changeset.Columns {
+		if f.Includes(col.Name) {
+			indexes = append(indexes, i)
+		}
+	}
+
+	if len(indexes) == len(changeset.Columns) {
+		return changeset
+	}
+
+	projected := &Changeset{
+		Table:     changeset.Table,
+		Operation: changeset.Operation,
+		Columns:   make([]Column, len(indexes)),
+		Rows:      make([][]any, len(changeset.Rows)),
+	}
+	for i, index := range indexes {
+		projected.Columns[i] = changeset.Columns[index]
+	}
+	for i, row := range changeset.Rows {
+		projected.Rows[i] = make([]any, len(indexes))
+		for j, index := range indexes {
+			projected.Rows[i][j] = row[index]
+			if changeset.IsUnchanged(i, index) {
+				projected.MarkUnchanged(i, j)
+			}
+		}
+	}
+
+	return projected
+}
+
+// AnyIncludes reports whether any of the filters includes the column, which
+// is what has to be replicated for a table read by several trucks.
+func AnyIncludes(filters []ColumnFilter, name string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+
+	for _, f := range filters {
+		if f.Includes(name) {
+			return true
+		}
+	}
+
+	return false
+}
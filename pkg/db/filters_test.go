@@ -0,0 +1,94 @@
+package db
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestColumnFilterIncludes(t *testing.T) {
+	only := ColumnFilter{Only: []string{"id", "name"}}
+	if !only.Includes("name") || !only.Includes("old__name") || only.Includes("tasting_notes") {
+		t.Error("Expected only_columns and their old__ columns to be included")
+	}
+
+	except := ColumnFilter{Except: []string{"tasting_notes"}}
+	if !except.Includes("name") || except.Includes("tasting_notes") || except.Includes("old__tasting_notes") {
+		t.Error("Expected everything but except_columns and their old__ columns to be included")
+	}
+
+	if AnyIncludes([]ColumnFilter{only, except}, "tasting_notes") {
+		t.Error("Expected no filter to include tasting_notes")
+	}
+	if !AnyIncludes([]ColumnFilter{only, {}}, "tasting_notes") {
+		t.Error("Expected a zero filter to include every column")
+	}
+}
+
+func TestColumnFilterProject(t *testing.T) {
+	changeset := &Changeset{
+		Table:     "public.whiskies",
+		Operation: Update,
+		Columns:   []Column{{Name: "id"}, {Name: "tasting_notes"}, {Name: "old__id"}, {Name: "old__tasting_notes"}},
+		Rows:      [][]any{{1, "smoky", 1, "peaty"}},
+	}
+
+	projected := ColumnFilter{Except: []string{"tasting_notes"}}.Project(changeset)
+
+	if len(projected.Columns) != 2 || projected.Columns[0].Name != "id" || projected.Columns[1].Name != "old__id" {
+		t.Error("Expected id and old__id columns, got", projected.Columns)
+	}
+	if !slices.Equal(projected.Rows[0], []any{1, 1}) {
+		t.Error("Expected the projected row to be [1 1], got", projected.Rows[0])
+	}
+	if len(changeset.Columns) != 4 || len(changeset.Rows[0]) != 4 {
+		t.Error("Expected the original changeset to be left untouched")
+	}
+
+	if (ColumnFilter{}).Project(changeset) != changeset {
+		t.Error("Expected a zero filter to return the changeset as is")
+	}
+}
+
+func TestColumnFilterProjectUnchanged(t *testing.T) {
+	changeset := &Changeset{
+		Table:     "public.whiskies",
+		Operation: Update,
+		Columns:   []Column{{Name: "id"}, {Name: "tasting_notes"}, {Name: "bio"}, {Name: "old__id"}, {Name: "old__tasting_notes"}, {Name: "old__bio"}},
+		Rows:      [][]any{{1, nil, nil, 1, nil, nil}, {2, "smoky", "Distilled on Islay", 2, nil, nil}},
+	}
+	changeset.MarkUnchanged(0, 1)
+	changeset.MarkUnchanged(0, 2)
+
+	projected := ColumnFilter{Except: []string{"tasting_notes"}}.Project(changeset)
+
+	if !slices.Equal(projected.UnchangedColumns(0), []string{"bio"}) {
+		t.Error("Expected bio to stay unchanged, got", projected.UnchangedColumns(0))
+	}
+	if len(projected.UnchangedColumns(1)) > 0 {
+		t.Error("Expected no unchanged columns in the second row, got", projected.UnchangedColumns(1))
+	}
+}
+
+func TestUsesUnchangedColumn(t *testing.T) {
+	cases := map[string]bool{
+		`SELECT id, 'bio' = ANY(unchanged__) FROM {{ .rows }}`: true,
+		`SELECT r."unchanged__" FROM {{ .rows }}`:              true,
+		`SELECT id, bio FROM {{ .rows }}`:                      false,
+		`SELECT was_unchanged__x FROM {{ .rows }}`:             false,
+	}
+
+	for sql, expected := range cases {
+		if got := UsesUnchangedColumn(sql); got != expected {
+			t.Errorf("Expected UsesUnchangedColumn(%q) to be %t", sql, expected)
+		}
+	}
+}
+
+func TestOldColumnReferences(t *testing.T) {
+	sql := `SELECT id, OLD__Age, r.old__name, "old__Region" FROM {{ .rows }} WHERE name <> old__name AND bold__x IS NULL`
+
+	columns := OldColumnReferences(sql)
+	if !slices.Equal(columns, []string{"Region", "age", "name"}) {
+		t.Error("Expected Region, age and name, got", columns)
+	}
+}
@@ -0,0 +1,17 @@
+package db
+
+// Migrator runs schema migrations on a database, and keeps track of which
+// versions were applied in a table inside it.
+type Migrator interface {
+	// Setup creates the table that tracks applied versions.
+	Setup() error
+	// Applied returns the versions that were applied, oldest first.
+	Applied() ([]string, error)
+	// Up runs sql and records version as applied. Both happen in a single
+	// transaction when the database supports it.
+	Up(version string, sql string) error
+	// Down runs sql and records version as no longer applied. Both happen in a
+	// single transaction when the database supports it.
+	Down(version string, sql string) error
+	Close()
+}
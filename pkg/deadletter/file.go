@@ -0,0 +1,175 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// FileSink keeps dead letters in a JSON lines file, one dead letter per line.
+// Resolving a dead letter removes it from the file.
+type FileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (f *FileSink) Setup() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return &db.Error{Op: "setup dead letters", Err: err}
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return &db.Error{Op: "setup dead letters", Err: err}
+	}
+
+	return file.Close()
+}
+
+func (f *FileSink) Send(letter *db.DeadLetter) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if letter.Id == "" {
+		letter.Id = fmt.Sprintf("%d-%d", letter.Position, time.Now().UnixNano())
+	}
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return &db.Error{Op: "send dead letter", Table: letter.Table, Err: err}
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return &db.Error{Op: "send dead letter", Table: letter.Table, Err: err}
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return &db.Error{Op: "send dead letter", Table: letter.Table, Err: err}
+	}
+
+	if err := file.Sync(); err != nil {
+		return &db.Error{Op: "send dead letter", Table: letter.Table, Err: err}
+	}
+
+	return nil
+}
+
+func (f *FileSink) Pending() ([]*db.DeadLetter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	letters, err := f.read()
+	if err != nil {
+		return nil, &db.Error{Op: "read dead letters", Err: err}
+	}
+
+	return letters, nil
+}
+
+func (f *FileSink) Resolve(letter *db.DeadLetter) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	letters, err := f.read()
+	if err != nil {
+		return &db.Error{Op: "resolve dead letter", Table: letter.Table, Err: err}
+	}
+
+	remaining := make([]*db.DeadLetter, 0, len(letters))
+	for _, l := range letters {
+		if l.Id != letter.Id {
+			remaining = append(remaining, l)
+		}
+	}
+
+	if err := f.rewrite(remaining); err != nil {
+		return &db.Error{Op: "resolve dead letter", Table: letter.Table, Err: err}
+	}
+
+	return nil
+}
+
+func (f *FileSink) Close() {}
+
+func (f *FileSink) read() ([]*db.DeadLetter, error) {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return []*db.DeadLetter{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	letters := make([]*db.DeadLetter, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<30)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		letter := &db.DeadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), letter); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", f.path, lineNo, err)
+		}
+		if letter.Id == "" {
+			// Lines added by hand might not have an id
+			letter.Id = strconv.Itoa(lineNo)
+		}
+
+		letters = append(letters, letter)
+	}
+
+	return letters, scanner.Err()
+}
+
+// rewrite replaces the file with letters, going through a temporary file so
+// a crash never leaves it half written.
+func (f *FileSink) rewrite(letters []*db.DeadLetter) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, letter := range letters {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+
+		writer.Write(append(line, '\n'))
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,111 @@
+package deadletter
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+func TestFileSinkRoundTrip(t *testing.T) {
+	sink := NewFileSink(filepath.Join(t.TempDir(), "truck", "dead_letters.jsonl"))
+	if err := sink.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	columns := []db.Column{
+		{Name: "id", Type: db.Int64},
+		{Name: "name", Type: db.String},
+		{Name: "price", Type: db.Numeric},
+		{Name: "bottled_at", Type: db.DateTime},
+		{Name: "tags", Type: db.StringArray},
+		{Name: "age", Type: db.Int32},
+	}
+	rows := [][]any{
+		{int64(1), "Green Spot", "49.90", createdAt, []any{"irish", "pot still"}, nil},
+	}
+
+	changeset := &db.ChanChangeset{Table: "public.whiskies", Operation: db.Update, Columns: columns}
+	writeErr := &db.Error{Op: "write", Table: "public.whiskies", Query: "INSERT INTO whiskies ...", Err: errors.New("boom")}
+	letter := db.NewDeadLetter(123, changeset, rows, writeErr)
+	letter.CreatedAt = createdAt
+
+	if err := sink.Send(letter); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := sink.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 1 {
+		t.Fatal("Expected 1 pending dead letter, got", len(pending))
+	}
+
+	got := pending[0]
+	if got.Position != 123 || got.Table != "public.whiskies" || got.Operation != "update" {
+		t.Errorf("Unexpected dead letter: %+v", got)
+	}
+
+	if got.Sql != "INSERT INTO whiskies ..." {
+		t.Error("Expected the output SQL to be recorded, got", got.Sql)
+	}
+
+	if !reflect.DeepEqual(got.Rows, rows) {
+		t.Errorf("Expected rows %#v, got %#v", rows, got.Rows)
+	}
+
+	redriven, err := got.Changeset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if redriven.Operation != db.Update {
+		t.Error("Expected an update changeset, got", db.OperationStr(redriven.Operation))
+	}
+}
+
+func TestFileSinkResolve(t *testing.T) {
+	sink := NewFileSink(filepath.Join(t.TempDir(), "dead_letters.jsonl"))
+	if err := sink.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	changeset := &db.ChanChangeset{
+		Table:     "public.whiskies",
+		Operation: db.Insert,
+		Columns:   []db.Column{{Name: "id", Type: db.Int64}},
+	}
+	for i := range 3 {
+		letter := db.NewDeadLetter(uint64(i+1), changeset, [][]any{{int64(i)}}, errors.New("boom"))
+		if err := sink.Send(letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending, err := sink.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resolving dead letters shouldn't change the ids of the others
+	for _, letter := range pending[:2] {
+		if err := sink.Resolve(letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending, err = sink.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 1 || pending[0].Position != 3 {
+		t.Errorf("Expected only the dead letter at position 3 to be pending, got %+v", pending)
+	}
+}
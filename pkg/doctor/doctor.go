@@ -0,0 +1,112 @@
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+type Status uint8
+
+const (
+	Pass Status = iota
+	Warn        // trucker may still work, but couldn't tell or might run into trouble later
+	Fail
+)
+
+func (s Status) String() string {
+	switch s {
+	case Pass:
+		return "PASS"
+	case Warn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// Check is the outcome of checking one thing trucker needs from a connection.
+type Check struct {
+	Connection string
+	Name       string
+	Status     Status
+	Detail     string
+}
+
+// Checks collects the checks for a connection.
+type Checks struct {
+	connection string
+	checks     []Check
+}
+
+func NewChecks(connection string) *Checks {
+	return &Checks{connection: connection}
+}
+
+func (c *Checks) Add(name string, status Status, detail string, args ...any) {
+	c.checks = append(c.checks, Check{
+		Connection: c.connection,
+		Name:       name,
+		Status:     status,
+		Detail:     fmt.Sprintf(detail, args...),
+	})
+}
+
+func (c *Checks) List() []Check {
+	return c.checks
+}
+
+// Failed reports whether any of the checks failed. Warnings don't count.
+func Failed(checks []Check) bool {
+	return slices.ContainsFunc(checks, func(c Check) bool { return c.Status == Fail })
+}
+
+// Print writes a line for each check to w, followed by a summary. Details are
+// squashed into a single line, since some errors span several.
+func Print(w io.Writer, checks []Check) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	counts := make(map[Status]int)
+	for _, c := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Status, c.Connection, c.Name, strings.Join(strings.Fields(c.Detail), " "))
+		counts[c.Status]++
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d checks, %d passed, %d warnings, %d failed\n", len(checks), counts[Pass], counts[Warn], counts[Fail])
+}
+
+const tableNamePattern = "(?:\"[^\"]+\"|`[^`]+`|[\\w$]+)(?:\\.(?:\"[^\"]+\"|`[^`]+`|[\\w$]+))?"
+
+var writtenTableRe = regexp.MustCompile(`(?is)\b(?:insert\s+into(?:\s+table)?|update(?:\s+only)?|delete\s+from(?:\s+only)?|merge\s+into|alter\s+table(?:\s+if\s+exists)?|truncate(?:\s+table)?(?:\s+only)?)\s+(` + tableNamePattern + `)`)
+var createdTableRe = regexp.MustCompile(`(?is)\bcreate\s+(?:(?:temp|temporary|unlogged)\s+)?table\s+(?:if\s+not\s+exists\s+)?(` + tableNamePattern + `)`)
+var templateActionRe = regexp.MustCompile(`(?s){{.*?}}`)
+
+// Words that can follow UPDATE and friends without being a table, like in
+// ON CONFLICT DO UPDATE SET
+var notTables = []string{"set", "function", "of", "skip", "nowait"}
+
+// OutputTables returns the tables an output.sql writes to, leaving out the
+// ones it creates itself (like temporary tables). It only looks for the
+// statements that write to tables, without parsing SQL.
+func OutputTables(sql string) []string {
+	sql = templateActionRe.ReplaceAllString(sql, "")
+
+	created := make([]string, 0)
+	for _, match := range createdTableRe.FindAllStringSubmatch(sql, -1) {
+		created = append(created, match[1])
+	}
+
+	tables := make([]string, 0)
+	for _, match := range writtenTableRe.FindAllStringSubmatch(sql, -1) {
+		table := match[1]
+		if slices.Contains(notTables, strings.ToLower(table)) || slices.Contains(created, table) || slices.Contains(tables, table) {
+			continue
+		}
+		tables = append(tables, table)
+	}
+
+	return tables
+}
@@ -0,0 +1,48 @@
+package doctor
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOutputTables(t *testing.T) {
+	sql := `
+CREATE TEMPORARY TABLE staged AS SELECT * FROM {{ .rows }};
+INSERT INTO staged SELECT 1;
+{{ if eq .operation "delete" }}
+DELETE FROM analytics."Whiskies" w USING staged s WHERE w.id = s.id;
+{{ else }}
+INSERT INTO analytics."Whiskies" (id, name) SELECT id, name FROM staged
+ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name;
+UPDATE ONLY whisky_counts SET total = total + 1;
+{{ end }}
+INSERT INTO TABLE ` + "`events`.`whisky_log`" + ` SELECT * FROM staged;
+`
+
+	tables := OutputTables(sql)
+	expected := []string{`analytics."Whiskies"`, "whisky_counts", "`events`.`whisky_log`"}
+	if !slices.Equal(tables, expected) {
+		t.Errorf("Expected %v, got %v", expected, tables)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	checks := NewChecks("pg")
+	checks.Add("wal_level", Pass, "logical")
+	checks.Add("replication slots", Fail, "%d free, trucker needs %d", 0, 1)
+
+	var buf bytes.Buffer
+	Print(&buf, checks.List())
+
+	if !strings.Contains(buf.String(), "FAIL  pg  replication slots  0 free, trucker needs 1") {
+		t.Error("Expected a line for the failed check, got", buf.String())
+	}
+	if !strings.HasSuffix(buf.String(), "2 checks, 1 passed, 0 warnings, 1 failed\n") {
+		t.Error("Expected a summary, got", buf.String())
+	}
+	if !Failed(checks.List()) {
+		t.Error("Expected the checks to have failed")
+	}
+}
@@ -0,0 +1,129 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tonyfg/trucker/pkg/server"
+)
+
+// Phases an input connection goes through after trucker starts
+const (
+	PhaseStarting    = "starting"
+	PhaseBackfilling = "backfilling"
+	PhaseCatchingUp  = "catching_up"
+	PhaseStreaming   = "streaming"
+	PhaseStopped     = "stopped"
+)
+
+type TruckReport struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Alive tells whether the truck's goroutine is running
+	Alive bool `json:"alive"`
+	// SecondsSinceLastProcessed is null until the truck writes a transaction
+	SecondsSinceLastProcessed *float64 `json:"seconds_since_last_processed"`
+	// BusySeconds is how long the truck has been writing its current
+	// transaction, 0 when it's idle
+	BusySeconds float64 `json:"busy_seconds"`
+	Stuck       bool    `json:"stuck"`
+}
+
+type ConnectionReport struct {
+	Phase  string        `json:"phase"`
+	Trucks []TruckReport `json:"trucks"`
+}
+
+// Healthy is false when a truck should be running but its goroutine died, or
+// when it's stuck writing a transaction.
+func (c ConnectionReport) Healthy() bool {
+	for _, t := range c.Trucks {
+		if t.Stuck || (c.Phase == PhaseStreaming && t.Status == "running" && !t.Alive) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type Report struct {
+	Healthy     bool                        `json:"healthy"`
+	Ready       bool                        `json:"ready"`
+	Connections map[string]ConnectionReport `json:"connections"`
+}
+
+// Source reports on an input connection and its trucks. A truck is stuck if
+// it has been writing the same transaction for longer than stuckThreshold.
+type Source interface {
+	Report(stuckThreshold time.Duration) ConnectionReport
+}
+
+var (
+	mu             sync.RWMutex
+	sources        = make(map[string]Source)
+	stuckThreshold time.Duration
+)
+
+// Register adds an input connection to health reports. Registering the same
+// connection again replaces its source.
+func Register(connection string, source Source) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	sources[connection] = source
+}
+
+// Serve starts serving /healthz and /readyz on addr in the background.
+//
+// /healthz returns 503 when a truck is stuck or its goroutine died. /readyz
+// returns 503 until every input connection is streaming changes, and whenever
+// /healthz would. Both return the full report as JSON.
+func Serve(addr string, threshold time.Duration) error {
+	mu.Lock()
+	stuckThreshold = threshold
+	mu.Unlock()
+
+	if err := server.Handle(addr, "/healthz", reportHandler(func(r Report) bool { return r.Healthy })); err != nil {
+		return err
+	}
+
+	return server.Handle(addr, "/readyz", reportHandler(func(r Report) bool { return r.Ready }))
+}
+
+// Check reports on every registered input connection.
+func Check() Report {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	report := Report{Healthy: true, Ready: true, Connections: make(map[string]ConnectionReport)}
+	for name, source := range sources {
+		conn := source.Report(stuckThreshold)
+		sort.Slice(conn.Trucks, func(i, j int) bool { return conn.Trucks[i].Name < conn.Trucks[j].Name })
+		report.Connections[name] = conn
+
+		if !conn.Healthy() {
+			report.Healthy = false
+		}
+		if conn.Phase != PhaseStreaming {
+			report.Ready = false
+		}
+	}
+	report.Ready = report.Ready && report.Healthy
+
+	return report
+}
+
+func reportHandler(ok func(Report) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Check()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok(report) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,83 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	report ConnectionReport
+}
+
+func (f *fakeSource) Report(stuckThreshold time.Duration) ConnectionReport {
+	return f.report
+}
+
+func TestCheck(t *testing.T) {
+	source := &fakeSource{report: ConnectionReport{
+		Phase:  PhaseCatchingUp,
+		Trucks: []TruckReport{{Name: "whiskies", Status: "running", Alive: true}},
+	}}
+	Register("pg", source)
+
+	report := Check()
+	if !report.Healthy || report.Ready {
+		t.Errorf("Expected healthy but not ready while catching up, got %+v", report)
+	}
+
+	source.report.Phase = PhaseStreaming
+	report = Check()
+	if !report.Healthy || !report.Ready {
+		t.Errorf("Expected healthy and ready while streaming, got %+v", report)
+	}
+
+	source.report.Trucks[0].Alive = false
+	report = Check()
+	if report.Healthy || report.Ready {
+		t.Errorf("Expected unhealthy when a running truck's goroutine died, got %+v", report)
+	}
+
+	source.report.Trucks[0].Alive = true
+	source.report.Trucks[0].Stuck = true
+	report = Check()
+	if report.Healthy || report.Ready {
+		t.Errorf("Expected unhealthy when a truck is stuck, got %+v", report)
+	}
+}
+
+func TestReportHandler(t *testing.T) {
+	Register("pg", &fakeSource{report: ConnectionReport{
+		Phase:  PhaseBackfilling,
+		Trucks: []TruckReport{{Name: "whiskies", Status: "running"}},
+	}})
+
+	tests := []struct {
+		name         string
+		ok           func(Report) bool
+		expectedCode int
+	}{
+		{"healthz", func(r Report) bool { return r.Healthy }, http.StatusOK},
+		{"readyz", func(r Report) bool { return r.Ready }, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		reportHandler(test.ok).ServeHTTP(rec, httptest.NewRequest("GET", "/"+test.name, nil))
+
+		if rec.Code != test.expectedCode {
+			t.Errorf("Expected /%s to return %d, got %d", test.name, test.expectedCode, rec.Code)
+		}
+
+		var report Report
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Connections["pg"].Phase != PhaseBackfilling {
+			t.Errorf("Expected /%s to report the backfilling phase, got %+v", test.name, report)
+		}
+	}
+}
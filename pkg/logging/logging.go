@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// Log formats (log.format in trucker.yml)
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+var (
+	mu          sync.RWMutex
+	base        slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	globalLevel slog.LevelVar
+	truckLevels = make(map[string]*slog.LevelVar)
+)
+
+func init() {
+	slog.SetDefault(slog.New(&levelHandler{level: &globalLevel, inner: base}))
+}
+
+// ParseLevel turns debug, info, warn or error into a slog level.
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(strings.ToUpper(level)))
+	return l, err
+}
+
+// Setup points the default logger at w, in the given format, logging at level
+// and above. Empty values keep the current setting.
+func Setup(w io.Writer, format string, level string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if level != "" {
+		l, err := ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		globalLevel.Set(l)
+	}
+
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case FormatJson:
+		base = slog.NewJSONHandler(w, opts)
+	default:
+		base = slog.NewTextHandler(w, opts)
+	}
+
+	slog.SetDefault(slog.New(&levelHandler{level: &globalLevel, inner: base}))
+	return nil
+}
+
+// SetTruckLevel makes a truck log at its own level instead of the global one.
+func SetTruckLevel(truckName string, level string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := truckLevels[truckName]; !ok {
+		truckLevels[truckName] = &slog.LevelVar{}
+	}
+	truckLevels[truckName].Set(l)
+
+	return nil
+}
+
+// ForTruck returns a logger for everything done on behalf of a truck. It logs
+// at the truck's level if it has one, and adds the truck's name to every
+// message.
+func ForTruck(truckName string) *slog.Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var level slog.Leveler = &globalLevel
+	if truckLevel, ok := truckLevels[truckName]; ok {
+		level = truckLevel
+	}
+
+	return slog.New(&levelHandler{level: level, inner: base}).With("truck", truckName)
+}
+
+// ForConnection returns a logger that adds a connection's name to every
+// message.
+func ForConnection(connectionName string) *slog.Logger {
+	return slog.Default().With("connection", connectionName)
+}
+
+// Fatal logs an error and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// LSN, Duration and Err build the attributes used across trucker for stream
+// positions, timings and errors.
+func LSN(lsn uint64) slog.Attr {
+	return slog.String("lsn", pglogrepl.LSN(lsn).String())
+}
+
+func Duration(d time.Duration) slog.Attr {
+	return slog.Duration("duration", d)
+}
+
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
+
+// levelHandler filters records below its own level before handing them to a
+// handler shared with other loggers.
+type levelHandler struct {
+	level slog.Leveler
+	inner slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.inner.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.inner.Handle(ctx, record)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, inner: h.inner.WithGroup(name)}
+}
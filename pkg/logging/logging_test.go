@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestTruckLevels(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(&buf, FormatText, "warn"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetTruckLevel("chatty", "debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	slog.Info("global info")
+	ForTruck("quiet").Info("quiet info")
+	ForTruck("chatty").Debug("chatty debug")
+
+	out := buf.String()
+	if strings.Contains(out, "global info") || strings.Contains(out, "quiet info") {
+		t.Error("Expected info messages to be filtered out at the global warn level, got:\n", out)
+	}
+
+	if !strings.Contains(out, "chatty debug") || !strings.Contains(out, "truck=chatty") {
+		t.Error("Expected a debug message from the chatty truck, got:\n", out)
+	}
+}
+
+func TestJsonFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(&buf, FormatJson, "info"); err != nil {
+		t.Fatal(err)
+	}
+
+	ForTruck("whiskies").Info("Restarted", LSN(0x16B3748))
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal("Expected a JSON log line, got:", buf.String())
+	}
+
+	if record["truck"] != "whiskies" {
+		t.Error("Expected truck = whiskies, got", record["truck"])
+	}
+
+	if record["lsn"] != "0/16B3748" {
+		t.Error("Expected lsn = 0/16B3748, got", record["lsn"])
+	}
+}
+
+func TestSetupRejectsUnknownLevels(t *testing.T) {
+	if err := Setup(&bytes.Buffer{}, FormatText, "chatty"); err == nil {
+		t.Error("Expected an error for an unknown log level")
+	}
+}
@@ -0,0 +1,73 @@
+package mainroutines
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/tonyfg/trucker/pkg/clickhouse"
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/doctor"
+	"github.com/tonyfg/trucker/pkg/postgres"
+)
+
+// Doctor checks every connection in trucker.yml for what the trucks using it
+// need, and writes a report to w. Nothing is changed on the databases, so no
+// replication slots or publications are created. It returns false if any
+// check failed.
+func Doctor(opts Options, w io.Writer) (bool, error) {
+	cfg, truckCfgs, err := loadConfig(opts)
+	if err != nil {
+		return false, err
+	}
+
+	inputTables := make(map[string][]string)
+	outputTables := make(map[string][]string)
+	for _, truckCfg := range truckCfgs {
+		for _, table := range truckCfg.Input.Tables {
+			if !slices.Contains(inputTables[truckCfg.Input.Connection], table) {
+				inputTables[truckCfg.Input.Connection] = append(inputTables[truckCfg.Input.Connection], table)
+			}
+		}
+
+		for _, table := range doctor.OutputTables(truckCfg.Output.Sql) {
+			if !slices.Contains(outputTables[truckCfg.Output.Connection], table) {
+				outputTables[truckCfg.Output.Connection] = append(outputTables[truckCfg.Output.Connection], table)
+			}
+		}
+	}
+
+	connNames := make([]string, 0, len(cfg.Connections))
+	for connName := range cfg.Connections {
+		connNames = append(connNames, connName)
+	}
+	slices.Sort(connNames)
+
+	checks := make([]doctor.Check, 0)
+	for _, connName := range connNames {
+		checks = append(checks, diagnose(cfg, cfg.Connections[connName], inputTables[connName], outputTables[connName])...)
+	}
+
+	doctor.Print(w, checks)
+	return !doctor.Failed(checks), nil
+}
+
+func diagnose(cfg config.Config, connCfg config.Connection, inputTables []string, outputTables []string) []doctor.Check {
+	switch connCfg.Adapter {
+	case "postgres":
+		return postgres.Diagnose(connCfg, cfg.UniqueId, inputTables, outputTables)
+	case "clickhouse":
+		checks := clickhouse.Diagnose(connCfg, outputTables)
+		if len(inputTables) > 0 {
+			checks = append(checks, doctor.Check{Connection: connCfg.Name, Name: "input", Status: doctor.Fail, Detail: "ClickHouse is not supported as an input source"})
+		}
+		return checks
+	default:
+		return []doctor.Check{{
+			Connection: connCfg.Name,
+			Name:       "adapter",
+			Status:     doctor.Fail,
+			Detail:     fmt.Sprintf("unsupported adapter %q", connCfg.Adapter),
+		}}
+	}
+}
@@ -1,31 +1,127 @@
 package mainroutines
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
 	"path/filepath"
 	"slices"
+	"sync"
+	"time"
 
 	"github.com/jackc/pglogrepl"
 
 	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/health"
+	"github.com/tonyfg/trucker/pkg/logging"
+	"github.com/tonyfg/trucker/pkg/metrics"
 	"github.com/tonyfg/trucker/pkg/postgres"
 	"github.com/tonyfg/trucker/pkg/truck"
 )
 
-func Start(projectPath string) (chan truck.ExitMsg, []config.Truck, map[string][]*truck.Truck) {
-	ymlPath := filepath.Join(projectPath, "trucker.yml")
-	cfg := config.Load(ymlPath)
-	truckCfgs := config.LoadTrucks(projectPath, cfg)
-	doneChan := make(chan truck.ExitMsg, len(truckCfgs))
+// Start launches the trucks selected in the options, or all of them. Trucks
+// that aren't selected keep their tables in the publication, and hold back the
+// replication slot so they don't miss anything by the next time they run.
+func Start(opts Options) (chan truck.ExitMsg, []config.Truck, map[string][]*truck.Truck) {
+	cfg, allTruckCfgs, err := loadConfig(opts)
+	if err != nil {
+		logging.Fatal("Unable to load configuration", logging.Err(err))
+	}
+
+	truckCfgs, err := selectTrucks(opts, allTruckCfgs)
+	if err != nil {
+		logging.Fatal("Unable to select trucks", logging.Err(err))
+	}
+
+	if cfg.Migrate.Auto {
+		if err := runMigrations(opts.ProjectPath, cfg); err != nil {
+			logging.Fatal("Unable to run migrations", logging.Err(err))
+		}
+	}
+
+	if cfg.Metrics.Listen != "" {
+		if err := metrics.Serve(cfg.Metrics.Listen); err != nil {
+			logging.Fatal("Unable to serve metrics", "listen", cfg.Metrics.Listen, logging.Err(err))
+		}
+	}
+
+	if cfg.Health.Listen != "" {
+		stuckThreshold := time.Duration(cfg.Health.StuckThresholdMs) * time.Millisecond
+		if err := health.Serve(cfg.Health.Listen, stuckThreshold); err != nil {
+			logging.Fatal("Unable to serve health checks", "listen", cfg.Health.Listen, logging.Err(err))
+		}
+	}
+
+	p, err := launch(cfg, truckCfgs, unselectedTrucks(allTruckCfgs, truckCfgs))
+	if err != nil {
+		logging.Fatal("Unable to launch trucks", logging.Err(err))
+	}
+
+	return p.doneChan, truckCfgs, p.trucks
+}
+
+// Stop stops the trucks, and the replication clients they read from. Trucks
+// share the replication client of their input connection, so stopping a truck
+// doesn't stop it.
+func Stop(trucksByInputConnection map[string][]*truck.Truck) {
+	for _, trucks := range trucksByInputConnection {
+		for _, t := range trucks {
+			t.Stop()
+		}
+		if len(trucks) > 0 {
+			trucks[0].ReplicationClient.Close()
+		}
+	}
+}
+
+// pipeline is everything launch sets up to move changes for a set of trucks.
+type pipeline struct {
+	doneChan           chan truck.ExitMsg
+	replicationClients map[string]*postgres.ReplicationClient
+	trucks             map[string][]*truck.Truck
+	supervisors        map[string]*supervisor
+}
+
+// launch sets up a replication client and a supervisor for each input
+// connection, and starts backfilling, catching up and then streaming changes
+// to the trucks in the background. The held trucks aren't launched, but still
+// read from some of the same connections: their tables stay published, and
+// replication slots aren't moved past their positions.
+func launch(cfg config.Config, truckCfgs []config.Truck, held []config.Truck) (*pipeline, error) {
+	p, err := newPipeline(cfg, truckCfgs, held)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		backfilledTables, backfillLSNs := backfill(p.replicationClients, p.trucks, p.supervisors)
+		catchup(p.replicationClients, p.trucks, p.supervisors, backfilledTables, backfillLSNs)
+		streamChanges(p.replicationClients, p.trucks, p.supervisors)
+	}()
+
+	return p, nil
+}
+
+// newPipeline sets up everything launch needs, without starting anything.
+func newPipeline(cfg config.Config, truckCfgs []config.Truck, held []config.Truck) (*pipeline, error) {
+	doneChan := make(chan truck.ExitMsg, len(truckCfgs)*2)
 
 	replicatedTablesPerConnection := make(map[string][]string)
+	filtersPerConnection := make(map[string]map[string][]db.TableFilter)
 	for _, truckCfg := range truckCfgs {
 		connName := truckCfg.Input.Connection
 		if _, ok := replicatedTablesPerConnection[connName]; !ok {
 			replicatedTablesPerConnection[connName] = make([]string, 0, 1)
+			filtersPerConnection[connName] = make(map[string][]db.TableFilter)
 		}
 		replicatedTablesPerConnection[connName] =
 			append(replicatedTablesPerConnection[connName], truckCfg.Input.Tables...)
+
+		for _, table := range truckCfg.Input.Tables {
+			filtersPerConnection[connName][table] =
+				append(filtersPerConnection[connName][table], truck.InputFilter(truckCfg, table))
+		}
 	}
 
 	replicationClients := make(map[string]*postgres.ReplicationClient)
@@ -33,53 +129,192 @@ func Start(projectPath string) (chan truck.ExitMsg, []config.Truck, map[string][
 		connName := truckCfg.Input.Connection
 		if _, ok := replicationClients[connName]; !ok {
 			replicatedTables := replicatedTablesPerConnection[connName]
-			replicationClients[connName] = postgres.NewReplicationClient(replicatedTables, cfg.Connections[connName], cfg.UniqueId)
+			rc, err := postgres.NewReplicationClient(replicatedTables, filtersPerConnection[connName], cfg.Connections[connName], cfg.Reconnect, cfg.UniqueId)
+			if err != nil {
+				return nil, fmt.Errorf("connection %s: %w", connName, err)
+			}
+			replicationClients[connName] = rc
 		}
 	}
 
+	keptTablesPerConnection := make(map[string][]string)
+	for _, truckCfg := range held {
+		keptTablesPerConnection[truckCfg.Input.Connection] =
+			append(keptTablesPerConnection[truckCfg.Input.Connection], truckCfg.Input.Tables...)
+	}
+	for connName, rc := range replicationClients {
+		rc.KeepPublished(keptTablesPerConnection[connName])
+	}
+
 	trucksByInputConnection := make(map[string][]*truck.Truck)
 	for _, truckCfg := range truckCfgs {
-		truck := truck.NewTruck(truckCfg, replicationClients[truckCfg.Input.Connection], cfg.Connections, doneChan, cfg.UniqueId)
-		trucksByInputConnection[truckCfg.Input.Connection] = append(trucksByInputConnection[truckCfg.Input.Connection], &truck)
+		t := truck.NewTruck(truckCfg, replicationClients[truckCfg.Input.Connection], cfg.Connections, doneChan, cfg.UniqueId)
+		trucksByInputConnection[truckCfg.Input.Connection] = append(trucksByInputConnection[truckCfg.Input.Connection], t)
 	}
 
-	go func() {
-		backfilledTables, backfillLSNs := backfill(replicationClients, trucksByInputConnection)
-		catchup(replicationClients, trucksByInputConnection, backfilledTables, backfillLSNs)
-		streamChanges(trucksByInputConnection)
-	}()
+	supervisors := make(map[string]*supervisor)
+	for connName, trucks := range trucksByInputConnection {
+		supervisors[connName] = newSupervisor(replicationClients[connName], trucks, doneChan)
+		metrics.RegisterReplication(connName, supervisors[connName])
+		health.Register(connName, supervisors[connName])
+
+		for _, t := range trucks {
+			if err := t.Connect(); err != nil {
+				supervisors[connName].setupFailed(t, err)
+			}
+		}
+	}
 
-	return doneChan, truckCfgs, trucksByInputConnection
+	for _, truckCfg := range held {
+		s, ok := supervisors[truckCfg.Input.Connection]
+		if !ok {
+			continue
+		}
+
+		position, err := heldPosition(cfg, truckCfg)
+		if err != nil {
+			logging.ForTruck(truckCfg.Name).Error("Unable to read the stream position of a truck that isn't running. The replication slot won't move until trucker is restarted.", logging.Err(err))
+			s.holdSlot()
+			continue
+		}
+		s.hold(position)
+	}
+
+	return &pipeline{
+		doneChan:           doneChan,
+		replicationClients: replicationClients,
+		trucks:             trucksByInputConnection,
+		supervisors:        supervisors,
+	}, nil
+}
+
+// unselectedTrucks returns the trucks that aren't selected.
+func unselectedTrucks(truckCfgs []config.Truck, selected []config.Truck) []config.Truck {
+	return slices.DeleteFunc(slices.Clone(truckCfgs), func(truckCfg config.Truck) bool {
+		return slices.ContainsFunc(selected, func(s config.Truck) bool { return s.Name == truckCfg.Name })
+	})
 }
 
-func backfill(replicationClients map[string]*postgres.ReplicationClient, trucks map[string][]*truck.Truck) (map[string][]string, map[string]uint64) {
+// heldPosition returns the stream position of a truck that isn't launched, or
+// 0 if it has never run. It only reads, so trucks that aren't selected don't
+// get position tracking tables created in their output databases.
+func heldPosition(cfg config.Config, truckCfg config.Truck) (uint64, error) {
+	writer, err := truck.NewWriter(truckCfg.Name, truckCfg.Input.Connection, truckCfg.Output.Sql, cfg.Connections[truckCfg.Output.Connection], cfg.UniqueId)
+	if err != nil {
+		return 0, err
+	}
+	defer writer.Close()
+
+	return writer.GetCurrentPosition()
+}
+
+// backfill sets up replication on each connection, and backfills the tables
+// that were just published from the snapshot it creates. Backfills that were
+// interrupted the last time are resumed from it as well, or from a snapshot
+// exported for the occasion when there are no new tables. Their tables aren't
+// among the backfilled tables returned, since the trucks still have to catch
+// up on the changes made since their backfills started.
+//
+// Connections are backfilled at the same time, and so are the trucks on each
+// of them, which all read from the connection's snapshot.
+func backfill(replicationClients map[string]*postgres.ReplicationClient, trucks map[string][]*truck.Truck, supervisors map[string]*supervisor) (map[string][]string, map[string]uint64) {
+	var mu sync.Mutex
 	backfillLSNs := make(map[string]uint64)
 	backfilledTables := make(map[string][]string)
 
+	var wg sync.WaitGroup
 	for connName, rc := range replicationClients {
-		tablesToBackfill, backfillLSN, snapshotName := rc.Setup()
-		defer rc.ResetStreamConn()
-		log.Println("Backfill LSN", pglogrepl.LSN(backfillLSN))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-		for _, truck := range trucks[connName] {
-			truck.Backfill(snapshotName, backfillLSN, tablesToBackfill)
-		}
+			tablesToBackfill, backfillLSN := backfillConnection(connName, rc, trucks[connName], supervisors[connName])
 
-		backfillLSNs[connName] = backfillLSN
-		backfilledTables[connName] = tablesToBackfill
+			mu.Lock()
+			defer mu.Unlock()
+			backfillLSNs[connName] = backfillLSN
+			backfilledTables[connName] = tablesToBackfill
+		}()
 	}
+	wg.Wait()
 
 	return backfilledTables, backfillLSNs
 }
 
-func catchup(replicationClients map[string]*postgres.ReplicationClient, trucks map[string][]*truck.Truck, skipTables map[string][]string, backfillLSNs map[string]uint64) {
-	for connName, rc := range replicationClients {
+// backfillConnection backfills the trucks on one connection, see backfill.
+func backfillConnection(connName string, rc *postgres.ReplicationClient, trucks []*truck.Truck, s *supervisor) ([]string, uint64) {
+	s.setPhase(health.PhaseBackfilling)
+	tablesToBackfill, backfillLSN, snapshotName, err := rc.Setup()
+	defer rc.ResetStreamConn()
+	if err != nil {
+		slog.Error("Unable to set up replication", "connection", connName, logging.Err(err))
+		for _, t := range trucks {
+			s.backfillFailed(t, err)
+		}
+		return nil, 0
+	}
+
+	unfinished := make(map[*truck.Truck][]string)
+	for _, t := range trucks {
+		if t.Status() == truck.Degraded {
+			continue
+		}
+
+		tables, err := t.UnfinishedBackfill()
+		if err != nil {
+			s.backfillFailed(t, err)
+		} else if len(tables) > 0 {
+			t.Logger().Info("Found unfinished backfill, resuming it", "tables", tables)
+			unfinished[t] = tables
+		}
+	}
+
+	if len(unfinished) > 0 && snapshotName == "" {
+		var release func()
+		var err error
+		snapshotName, backfillLSN, release, err = rc.ExportSnapshot()
+		if err != nil {
+			for t := range unfinished {
+				s.backfillFailed(t, err)
+			}
+		} else {
+			defer release()
+		}
+	}
+	slog.Info("Backfill LSN", "connection", connName, logging.LSN(backfillLSN))
+
+	var wg sync.WaitGroup
+	for _, t := range trucks {
+		if t.Status() == truck.Degraded {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := t.Backfill(snapshotName, backfillLSN, tablesToBackfill, unfinished[t]); err != nil {
+				s.backfillFailed(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return tablesToBackfill, backfillLSN
+}
+
+func catchup(replicationClients map[string]*postgres.ReplicationClient, trucks map[string][]*truck.Truck, supervisors map[string]*supervisor, skipTables map[string][]string, backfillLSNs map[string]uint64) {
+	for connName := range replicationClients {
 		var startLSN uint64
 		endLSN := backfillLSNs[connName]
+		supervisors[connName].setPhase(health.PhaseCatchingUp)
+
+		for _, t := range trucks[connName] {
+			if t.Status() != truck.Running {
+				continue
+			}
 
-		for _, truck := range trucks[connName] {
 			needsCatchup := false
-			for _, table := range truck.InputTables {
+			for _, table := range t.InputTables {
 				if !slices.Contains(skipTables[connName], table) {
 					needsCatchup = true
 				}
@@ -89,85 +324,110 @@ func catchup(replicationClients map[string]*postgres.ReplicationClient, trucks m
 				continue
 			}
 
-			log.Printf("[Truck %s] Catching up to latest stream position...\n", truck.Name)
+			t.Logger().Info("Catching up to latest stream position...", "end_lsn", pglogrepl.LSN(endLSN).String())
+
+			supervisors[connName].startTruck(t)
+			if t.Status() != truck.Running {
+				continue
+			}
 
-			truckLSN := truck.Writer.GetCurrentPosition()
+			truckLSN := t.Position()
 			if truckLSN < startLSN || startLSN == 0 {
 				startLSN = truckLSN
 			}
-
-			truck.Start()
 		}
 
 		if startLSN > 0 && endLSN > 0 {
-			changesChan := rc.Start(startLSN, endLSN)
-			for {
-				transaction := <-changesChan
-				if transaction == nil {
-					break
-				}
-
-				for changeset := range transaction.Changesets {
-					changeset.StreamPosition = transaction.StreamPosition
-					for _, truck := range trucks[connName] {
-						if !slices.Contains(skipTables[connName], changeset.Table) &&
-							slices.Contains(truck.InputTables, changeset.Table) {
-							truck.ProcessChangeset(changeset)
-						}
-					}
-				}
-
-				if transaction.StreamPosition > 0 {
-					rc.SetProcessedLSN(transaction.StreamPosition)
-				}
-			}
+			supervisors[connName].run(startLSN, endLSN, skipTables[connName])
 		}
 	}
 }
 
-func streamChanges(trucksByInputConnection map[string][]*truck.Truck) {
-	trucksByRc := make(map[*postgres.ReplicationClient][]*truck.Truck)
-	for _, trucks := range trucksByInputConnection {
-		for _, t := range trucks {
-			if _, ok := trucksByRc[t.ReplicationClient]; !ok {
-				trucksByRc[t.ReplicationClient] = make([]*truck.Truck, 0, 1)
+func streamChanges(replicationClients map[string]*postgres.ReplicationClient, trucksByInputConnection map[string][]*truck.Truck, supervisors map[string]*supervisor) {
+	for connName := range replicationClients {
+		var startLSN uint64
+
+		for _, t := range trucksByInputConnection[connName] {
+			if t.Status() == truck.Degraded {
+				continue
 			}
 
-			trucksByRc[t.ReplicationClient] = append(trucksByRc[t.ReplicationClient], t)
+			supervisors[connName].startTruck(t)
+
+			truckLSN := t.Position()
+			if truckLSN < startLSN || startLSN == 0 {
+				startLSN = truckLSN
+			}
 		}
+
+		supervisors[connName].setPhase(health.PhaseStreaming)
+		go func(s *supervisor) {
+			s.run(startLSN, 0, nil)
+			s.setPhase(health.PhaseStopped)
+		}(supervisors[connName])
 	}
+}
 
-	for rc, trucks := range trucksByRc {
-		var startLSN uint64
+// Options are the command line options shared by trucker's commands.
+type Options struct {
+	ProjectPath string
+	// Overrides the log levels in trucker.yml and truck.yml when set
+	LogLevel string
+	// Only these trucks, or all of them when empty
+	Trucks []string
+	// Show what would be done without changing anything
+	DryRun bool
+}
 
-		for _, t := range trucks {
-			truckLSN := t.Writer.GetCurrentPosition()
+// loadConfig loads trucker.yml and every truck.yml in the project, and sets up
+// logging as they say (unless the options override the log level).
+func loadConfig(opts Options) (config.Config, []config.Truck, error) {
+	cfg, err := config.Load(filepath.Join(opts.ProjectPath, "trucker.yml"))
+	if err != nil {
+		return config.Config{}, nil, err
+	}
 
-			if truckLSN < startLSN || startLSN == 0 {
-				startLSN = truckLSN
-			}
+	if opts.LogLevel != "" {
+		cfg.Log.Level = opts.LogLevel
+	}
+	if err := logging.Setup(os.Stderr, cfg.Log.Format, cfg.Log.Level); err != nil {
+		return config.Config{}, nil, err
+	}
 
-			t.Start()
+	truckCfgs, err := config.LoadTrucks(opts.ProjectPath, cfg)
+	if err != nil {
+		return config.Config{}, nil, err
+	}
+
+	for i := range truckCfgs {
+		if opts.LogLevel != "" {
+			truckCfgs[i].LogLevel = opts.LogLevel
 		}
+		if err := logging.SetTruckLevel(truckCfgs[i].Name, truckCfgs[i].LogLevel); err != nil {
+			return config.Config{}, nil, err
+		}
+	}
 
-		changesChan := rc.Start(startLSN, 0)
-		for {
-			transaction := <-changesChan
+	return cfg, truckCfgs, nil
+}
 
-			if transaction != nil {
-				for changeset := range transaction.Changesets {
-					changeset.StreamPosition = transaction.StreamPosition
-					for _, truck := range trucks {
-						if slices.Contains(truck.InputTables, changeset.Table) {
-							truck.ProcessChangeset(changeset)
-						}
-					}
-				}
+// selectTrucks returns the trucks named in the options, or all of them if none
+// are.
+func selectTrucks(opts Options, truckCfgs []config.Truck) ([]config.Truck, error) {
+	if len(opts.Trucks) == 0 {
+		return truckCfgs, nil
+	}
 
-				if transaction.StreamPosition > 0 {
-					rc.SetProcessedLSN(transaction.StreamPosition)
-				}
-			}
+	selected := make([]config.Truck, 0, len(opts.Trucks))
+	for _, name := range opts.Trucks {
+		i := slices.IndexFunc(truckCfgs, func(truckCfg config.Truck) bool { return truckCfg.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("truck %s not found in %s", name, opts.ProjectPath)
+		}
+		if !slices.ContainsFunc(selected, func(truckCfg config.Truck) bool { return truckCfg.Name == name }) {
+			selected = append(selected, truckCfgs[i])
 		}
 	}
+
+	return selected, nil
 }
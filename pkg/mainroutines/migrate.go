@@ -0,0 +1,149 @@
+package mainroutines
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/tonyfg/trucker/pkg/clickhouse"
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/migrate"
+	"github.com/tonyfg/trucker/pkg/postgres"
+)
+
+// MigrateUp applies the pending migrations of every connection with a
+// directory inside <project>/migrate.
+func MigrateUp(opts Options) error {
+	cfg, _, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	return runMigrations(opts.ProjectPath, cfg)
+}
+
+// MigrateDown reverts the latest applied migration of a connection.
+func MigrateDown(opts Options, connName string) error {
+	cfg, _, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	m, dir, err := setupMigrator(opts.ProjectPath, cfg, connName)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	version, err := migrate.Down(m, dir)
+	if err != nil {
+		return fmt.Errorf("connection %s: %w", connName, err)
+	}
+
+	if version == "" {
+		slog.Info("No migrations to revert", "connection", connName)
+	} else {
+		slog.Info("Reverted migration", "connection", connName, "version", version)
+	}
+
+	return nil
+}
+
+// MigrateStatus writes every migration of every connection to w, and whether
+// it was applied.
+func MigrateStatus(opts Options, w io.Writer) error {
+	cfg, _, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	connNames, err := migrate.Connections(filepath.Join(opts.ProjectPath, "migrate"))
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONNECTION\tVERSION\tSTATUS")
+	for _, connName := range connNames {
+		m, dir, err := setupMigrator(opts.ProjectPath, cfg, connName)
+		if err != nil {
+			return err
+		}
+
+		statuses, err := migrate.Statuses(m, dir)
+		m.Close()
+		if err != nil {
+			return fmt.Errorf("connection %s: %w", connName, err)
+		}
+
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", connName, status.Version, state)
+		}
+	}
+
+	return tw.Flush()
+}
+
+func runMigrations(projectPath string, cfg config.Config) error {
+	connNames, err := migrate.Connections(filepath.Join(projectPath, "migrate"))
+	if err != nil {
+		return err
+	}
+
+	for _, connName := range connNames {
+		m, dir, err := setupMigrator(projectPath, cfg, connName)
+		if err != nil {
+			return err
+		}
+
+		versions, err := migrate.Up(m, dir)
+		m.Close()
+		for _, version := range versions {
+			slog.Info("Applied migration", "connection", connName, "version", version)
+		}
+		if err != nil {
+			return fmt.Errorf("connection %s: %w", connName, err)
+		}
+
+		if len(versions) == 0 {
+			slog.Info("Migrations up to date", "connection", connName)
+		}
+	}
+
+	return nil
+}
+
+func setupMigrator(projectPath string, cfg config.Config, connName string) (db.Migrator, string, error) {
+	connCfg, ok := cfg.Connections[connName]
+	if !ok {
+		return nil, "", fmt.Errorf("migrate/%s: connection %s not found in trucker.yml", connName, connName)
+	}
+
+	var m db.Migrator
+	var err error
+	switch connCfg.Adapter {
+	case "postgres":
+		m, err = postgres.NewMigrator(connCfg, cfg.UniqueId)
+	case "clickhouse":
+		m, err = clickhouse.NewMigrator(connCfg, cfg.UniqueId)
+	default:
+		err = fmt.Errorf("unsupported adapter %q", connCfg.Adapter)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("connection %s: %w", connName, err)
+	}
+
+	if err := m.Setup(); err != nil {
+		m.Close()
+		return nil, "", fmt.Errorf("connection %s: %w", connName, err)
+	}
+
+	return m, filepath.Join(projectPath, "migrate", connName), nil
+}
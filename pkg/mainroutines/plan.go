@@ -0,0 +1,85 @@
+package mainroutines
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/postgres"
+)
+
+// Plan writes what running the trucks selected in the options would do to the
+// publications, without changing anything: which tables would be published and
+// backfilled, taken out of the publication, or streamed.
+func Plan(opts Options, w io.Writer) error {
+	cfg, allTruckCfgs, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	truckCfgs, err := selectTrucks(opts, allTruckCfgs)
+	if err != nil {
+		return err
+	}
+	held := unselectedTrucks(allTruckCfgs, truckCfgs)
+
+	connNames := make([]string, 0)
+	for _, truckCfg := range truckCfgs {
+		if !slices.Contains(connNames, truckCfg.Input.Connection) {
+			connNames = append(connNames, truckCfg.Input.Connection)
+		}
+	}
+	slices.Sort(connNames)
+
+	for _, connName := range connNames {
+		connCfg := cfg.Connections[connName]
+		published, err := postgres.PublishedTables(connCfg, cfg.UniqueId)
+		if err != nil {
+			return fmt.Errorf("connection %s: %w", connName, err)
+		}
+
+		readers := tableReaders(truckCfgs, connName)
+		kept := tableReaders(held, connName)
+		fmt.Fprintf(w, "Connection %s (publication %s):\n", connName, postgres.PublicationName(connCfg, cfg.UniqueId))
+
+		for _, table := range slices.Sorted(maps.Keys(readers)) {
+			if slices.Contains(published, table) {
+				fmt.Fprintf(w, "  Would stream %s to %s\n", table, strings.Join(readers[table], ", "))
+			} else {
+				fmt.Fprintf(w, "  Would publish %s and backfill it into %s\n", table, strings.Join(readers[table], ", "))
+			}
+		}
+
+		for _, table := range published {
+			if _, ok := readers[table]; ok {
+				continue
+			}
+			if _, ok := kept[table]; ok {
+				fmt.Fprintf(w, "  Would keep %s published for %s, which won't run\n", table, strings.Join(kept[table], ", "))
+			} else {
+				fmt.Fprintf(w, "  Would take %s out of the publication\n", table)
+			}
+		}
+	}
+
+	return nil
+}
+
+// tableReaders returns the names of the trucks reading each table of a
+// connection.
+func tableReaders(truckCfgs []config.Truck, connName string) map[string][]string {
+	readers := make(map[string][]string)
+	for _, truckCfg := range truckCfgs {
+		if truckCfg.Input.Connection != connName {
+			continue
+		}
+		for _, table := range truckCfg.Input.Tables {
+			readers[table] = append(readers[table], truckCfg.Name)
+		}
+	}
+
+	return readers
+}
@@ -0,0 +1,80 @@
+package mainroutines
+
+import (
+	"fmt"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/logging"
+	"github.com/tonyfg/trucker/pkg/truck"
+)
+
+// Redrive writes a truck's pending dead letters again, oldest first, with the
+// truck's current output.sql. Dead letters that are written successfully are
+// resolved, the rest stay pending.
+func Redrive(opts Options, truckName string) error {
+	cfg, truckCfgs, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	var truckCfg *config.Truck
+	for i := range truckCfgs {
+		if truckCfgs[i].Name == truckName {
+			truckCfg = &truckCfgs[i]
+		}
+	}
+	if truckCfg == nil {
+		return fmt.Errorf("truck %s not found in %s", truckName, opts.ProjectPath)
+	}
+
+	outputCfg := cfg.Connections[truckCfg.Output.Connection]
+	sink, err := truck.NewDeadLetterSink(*truckCfg, outputCfg, cfg.UniqueId)
+	if err != nil {
+		return err
+	}
+	if sink == nil {
+		return fmt.Errorf("truck %s has no dead_letter sink configured", truckName)
+	}
+	defer sink.Close()
+
+	if err := sink.Setup(); err != nil {
+		return err
+	}
+
+	writer, err := truck.NewWriter(truckCfg.Name, truckCfg.Input.Connection, truckCfg.Output.Sql, outputCfg, cfg.UniqueId)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	letters, err := sink.Pending()
+	if err != nil {
+		return err
+	}
+	logger := logging.ForTruck(truckName)
+	logger.Info("Re-driving dead letters", "count", len(letters))
+
+	failed := 0
+	for _, letter := range letters {
+		changeset, err := letter.Changeset()
+		if err == nil {
+			_, err = writer.Write(changeset)
+		}
+		if err != nil {
+			logger.Error("Dead letter failed again", "id", letter.Id, "operation", letter.Operation, "table", letter.Table, logging.LSN(letter.Position), logging.Err(err))
+			failed++
+			continue
+		}
+
+		if err := sink.Resolve(letter); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Re-drove dead letters", "count", len(letters)-failed, "pending", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d dead letters couldn't be re-driven", failed)
+	}
+
+	return nil
+}
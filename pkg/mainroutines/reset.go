@@ -0,0 +1,182 @@
+package mainroutines
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/postgres"
+	"github.com/tonyfg/trucker/pkg/truck"
+)
+
+// step is something a command changes, described so it can be shown instead
+// of done for dry runs.
+type step struct {
+	description string
+	run         func() error
+}
+
+// runSteps runs the steps in order, or just writes them to w for dry runs.
+func runSteps(steps []step, dryRun bool, w io.Writer) error {
+	for _, s := range steps {
+		if dryRun {
+			fmt.Fprintln(w, "Would "+s.description)
+			continue
+		}
+
+		slog.Info(strings.ToUpper(s.description[:1]) + s.description[1:])
+		if err := s.run(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reset makes the trucks selected in the options (or all of them) start over:
+// their stream positions are forgotten, and their input tables are taken out
+// of the publication, so the next run backfills them again. When every truck
+// reading from a connection is reset, its replication slot and publication are
+// dropped altogether. Output tables are left as they are.
+func Reset(opts Options, w io.Writer) error {
+	cfg, allTruckCfgs, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	truckCfgs, err := selectTrucks(opts, allTruckCfgs)
+	if err != nil {
+		return err
+	}
+
+	steps, err := resetSteps(cfg, truckCfgs, unselectedTrucks(allTruckCfgs, truckCfgs))
+	if err != nil {
+		return err
+	}
+
+	return runSteps(steps, opts.DryRun, w)
+}
+
+// Backfill resets the trucks selected in the options (or all of them), and
+// backfills them again right away. It exits once the backfill is done: the
+// replication slot keeps the changes made since then for the next run.
+func Backfill(opts Options, w io.Writer) error {
+	cfg, allTruckCfgs, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	truckCfgs, err := selectTrucks(opts, allTruckCfgs)
+	if err != nil {
+		return err
+	}
+	held := unselectedTrucks(allTruckCfgs, truckCfgs)
+
+	steps, err := resetSteps(cfg, truckCfgs, held)
+	if err != nil {
+		return err
+	}
+	if err := runSteps(steps, opts.DryRun, w); err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		for _, truckCfg := range truckCfgs {
+			fmt.Fprintf(w, "Would backfill %s from %s\n", truckCfg.Name, strings.Join(truckCfg.Input.Tables, ", "))
+		}
+		return nil
+	}
+
+	p, err := newPipeline(cfg, truckCfgs, held)
+	if err != nil {
+		return err
+	}
+	backfill(p.replicationClients, p.trucks, p.supervisors)
+
+	errs := make([]error, 0)
+	for connName, trucks := range p.trucks {
+		for _, t := range trucks {
+			if t.Status() == truck.Degraded {
+				errs = append(errs, fmt.Errorf("truck %s failed to backfill", t.Name))
+			}
+			t.Stop()
+		}
+		p.replicationClients[connName].Close()
+	}
+
+	select {
+	case exit := <-p.doneChan:
+		errs = append(errs, fmt.Errorf("truck %s failed to backfill: %s", exit.TruckName, exit.Msg))
+	default:
+	}
+
+	return errors.Join(errs...)
+}
+
+// resetSteps returns the steps that reset the trucks. Tables the trucks share
+// with held trucks can't be reset on their own, since taking them out of the
+// publication would backfill the held trucks again too.
+func resetSteps(cfg config.Config, truckCfgs []config.Truck, held []config.Truck) ([]step, error) {
+	connNames := make([]string, 0)
+	for _, truckCfg := range truckCfgs {
+		if !slices.Contains(connNames, truckCfg.Input.Connection) {
+			connNames = append(connNames, truckCfg.Input.Connection)
+		}
+
+		for _, heldCfg := range held {
+			if heldCfg.Input.Connection != truckCfg.Input.Connection {
+				continue
+			}
+			for _, table := range truckCfg.Input.Tables {
+				if slices.Contains(heldCfg.Input.Tables, table) {
+					return nil, fmt.Errorf("truck %s reads %s like truck %s, which would be backfilled again too, so they have to be reset together", truckCfg.Name, table, heldCfg.Name)
+				}
+			}
+		}
+	}
+	slices.Sort(connNames)
+
+	steps := make([]step, 0)
+	for _, connName := range connNames {
+		connCfg := cfg.Connections[connName]
+		publicationName := postgres.PublicationName(connCfg, cfg.UniqueId)
+
+		if !slices.ContainsFunc(held, func(heldCfg config.Truck) bool { return heldCfg.Input.Connection == connName }) {
+			steps = append(steps, step{
+				description: fmt.Sprintf("drop replication slot and publication %s on %s", publicationName, connName),
+				run: func() error {
+					rc, err := postgres.NewReplicationClient(nil, nil, connCfg, cfg.Reconnect, cfg.UniqueId)
+					if err != nil {
+						return err
+					}
+					return rc.Drop()
+				},
+			})
+			continue
+		}
+
+		tables := make([]string, 0)
+		for _, truckCfg := range truckCfgs {
+			if truckCfg.Input.Connection == connName {
+				tables = append(tables, truckCfg.Input.Tables...)
+			}
+		}
+		steps = append(steps, step{
+			description: fmt.Sprintf("take %s out of publication %s on %s", strings.Join(tables, ", "), publicationName, connName),
+			run:         func() error { return postgres.Unpublish(connCfg, cfg.UniqueId, tables) },
+		})
+	}
+
+	for _, truckCfg := range truckCfgs {
+		steps = append(steps, step{
+			description: fmt.Sprintf("forget the stream position and backfill progress of %s", truckCfg.Name),
+			run:         func() error { return resetPosition(cfg, truckCfg) },
+		})
+	}
+
+	return steps, nil
+}
@@ -0,0 +1,119 @@
+package mainroutines
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tonyfg/trucker/pkg/config"
+)
+
+func resetTestTrucks() (config.Config, []config.Truck) {
+	cfg := config.Config{
+		UniqueId: "1",
+		Connections: map[string]config.Connection{
+			"pg":    {Name: "pg", Adapter: "postgres", Database: "shop"},
+			"other": {Name: "other", Adapter: "postgres", Database: "crm"},
+		},
+	}
+
+	truckCfgs := make([]config.Truck, 3)
+	truckCfgs[0].Name = "orders"
+	truckCfgs[0].Input.Connection = "pg"
+	truckCfgs[0].Input.Tables = []string{"public.orders"}
+	truckCfgs[1].Name = "order_stats"
+	truckCfgs[1].Input.Connection = "pg"
+	truckCfgs[1].Input.Tables = []string{"public.orders", "public.customers"}
+	truckCfgs[2].Name = "contacts"
+	truckCfgs[2].Input.Connection = "other"
+	truckCfgs[2].Input.Tables = []string{"public.contacts"}
+
+	return cfg, truckCfgs
+}
+
+func TestSelectTrucks(t *testing.T) {
+	_, truckCfgs := resetTestTrucks()
+
+	selected, err := selectTrucks(Options{}, truckCfgs)
+	if err != nil || len(selected) != 3 {
+		t.Error("Expected every truck without a selection, got", selected, err)
+	}
+
+	selected, err = selectTrucks(Options{Trucks: []string{"contacts", "orders", "contacts"}}, truckCfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Name != "contacts" || selected[1].Name != "orders" {
+		t.Error("Expected contacts and orders, got", selected)
+	}
+
+	held := unselectedTrucks(truckCfgs, selected)
+	if len(held) != 1 || held[0].Name != "order_stats" {
+		t.Error("Expected order_stats to be held, got", held)
+	}
+
+	if _, err := selectTrucks(Options{Trucks: []string{"nope"}}, truckCfgs); err == nil {
+		t.Error("Expected an error for a truck that doesn't exist")
+	}
+}
+
+func TestResetSteps(t *testing.T) {
+	cfg, truckCfgs := resetTestTrucks()
+
+	steps, err := resetSteps(cfg, truckCfgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"drop replication slot and publication trucker_crm1 on other",
+		"drop replication slot and publication trucker_shop1 on pg",
+		"forget the stream position and backfill progress of orders",
+		"forget the stream position and backfill progress of order_stats",
+		"forget the stream position and backfill progress of contacts",
+	}
+	if got := stepDescriptions(steps); !slices.Equal(got, expected) {
+		t.Errorf("Expected steps %q, got %q", expected, got)
+	}
+
+	steps, err = resetSteps(cfg, truckCfgs[2:], truckCfgs[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"drop replication slot and publication trucker_crm1 on other",
+		"forget the stream position and backfill progress of contacts",
+	}
+	if got := stepDescriptions(steps); !slices.Equal(got, expected) {
+		t.Errorf("Expected steps %q, got %q", expected, got)
+	}
+
+	truckCfgs[1].Input.Tables = []string{"public.customers"}
+	steps, err = resetSteps(cfg, truckCfgs[1:2], []config.Truck{truckCfgs[0], truckCfgs[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"take public.customers out of publication trucker_shop1 on pg",
+		"forget the stream position and backfill progress of order_stats",
+	}
+	if got := stepDescriptions(steps); !slices.Equal(got, expected) {
+		t.Errorf("Expected steps %q, got %q", expected, got)
+	}
+}
+
+func TestResetStepsSharedTable(t *testing.T) {
+	cfg, truckCfgs := resetTestTrucks()
+
+	_, err := resetSteps(cfg, truckCfgs[:1], truckCfgs[1:])
+	if err == nil || !strings.Contains(err.Error(), "truck orders reads public.orders like truck order_stats") {
+		t.Error("Expected an error about public.orders being read by order_stats too, got", err)
+	}
+}
+
+func stepDescriptions(steps []step) []string {
+	descriptions := make([]string, len(steps))
+	for i, s := range steps {
+		descriptions[i] = s.description
+	}
+	return descriptions
+}
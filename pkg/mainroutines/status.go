@@ -0,0 +1,206 @@
+package mainroutines
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jackc/pglogrepl"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/postgres"
+	"github.com/tonyfg/trucker/pkg/truck"
+)
+
+type connectionStatus struct {
+	Connection        string        `json:"connection"`
+	Slot              string        `json:"slot"`
+	SlotExists        bool          `json:"slot_exists"`
+	Active            bool          `json:"active"`
+	ActivePid         int32         `json:"active_pid,omitempty"`
+	RestartLSN        string        `json:"restart_lsn,omitempty"`
+	ConfirmedFlushLSN string        `json:"confirmed_flush_lsn,omitempty"`
+	CurrentLSN        string        `json:"current_lsn,omitempty"`
+	RetainedWALBytes  int64         `json:"retained_wal_bytes"`
+	PublishedTables   []string      `json:"published_tables"`
+	Trucks            []truckStatus `json:"trucks"`
+	Error             string        `json:"error,omitempty"`
+}
+
+type truckStatus struct {
+	Name     string `json:"name"`
+	Position string `json:"position,omitempty"` // empty if the truck has never run
+	LagBytes uint64 `json:"lag_bytes"`          // how far the position is behind the end of the WAL
+	Error    string `json:"error,omitempty"`
+}
+
+// Status writes where each input connection's replication slot and each
+// truck reading from it are, as text or JSON. Only the trucks selected in the
+// options are shown, if any are. Nothing is changed on the databases. It
+// returns false if anything couldn't be looked up.
+func Status(opts Options, w io.Writer, asJson bool) (bool, error) {
+	cfg, allTruckCfgs, err := loadConfig(opts)
+	if err != nil {
+		return false, err
+	}
+
+	truckCfgs, err := selectTrucks(opts, allTruckCfgs)
+	if err != nil {
+		return false, err
+	}
+
+	connNames := make([]string, 0)
+	for _, truckCfg := range truckCfgs {
+		if !slices.Contains(connNames, truckCfg.Input.Connection) {
+			connNames = append(connNames, truckCfg.Input.Connection)
+		}
+	}
+	slices.Sort(connNames)
+
+	ok := true
+	statuses := make([]connectionStatus, 0, len(connNames))
+	for _, connName := range connNames {
+		status := getConnectionStatus(cfg, connName, truckCfgs)
+		ok = ok && status.Error == "" && !slices.ContainsFunc(status.Trucks, func(t truckStatus) bool { return t.Error != "" })
+		statuses = append(statuses, status)
+	}
+
+	if asJson {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return ok, encoder.Encode(statuses)
+	}
+
+	printStatus(w, statuses)
+	return ok, nil
+}
+
+func getConnectionStatus(cfg config.Config, connName string, truckCfgs []config.Truck) connectionStatus {
+	connCfg := cfg.Connections[connName]
+	status := connectionStatus{
+		Connection:      connName,
+		Slot:            postgres.PublicationName(connCfg, cfg.UniqueId),
+		PublishedTables: make([]string, 0),
+		Trucks:          make([]truckStatus, 0),
+	}
+
+	slot, err := postgres.ReplicationStatus(connCfg, cfg.UniqueId)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.SlotExists = slot.Exists
+	status.Active = slot.Active
+	status.ActivePid = slot.ActivePid
+	status.RestartLSN = lsnString(slot.RestartLSN)
+	status.ConfirmedFlushLSN = lsnString(slot.ConfirmedFlushLSN)
+	status.CurrentLSN = lsnString(slot.CurrentLSN)
+	status.RetainedWALBytes = slot.RetainedWALBytes
+
+	if status.PublishedTables, err = postgres.PublishedTables(connCfg, cfg.UniqueId); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	for _, truckCfg := range truckCfgs {
+		if truckCfg.Input.Connection != connName {
+			continue
+		}
+
+		status.Trucks = append(status.Trucks, getTruckStatus(cfg, truckCfg, slot.CurrentLSN))
+	}
+
+	return status
+}
+
+// getTruckStatus looks up the truck's stream position in its output database,
+// and how far it is behind currentLSN. An output database that can't be
+// reached is reported as the truck's error.
+func getTruckStatus(cfg config.Config, truckCfg config.Truck, currentLSN uint64) truckStatus {
+	ts := truckStatus{Name: truckCfg.Name}
+
+	writer, err := truck.NewWriter(truckCfg.Name, truckCfg.Input.Connection, truckCfg.Output.Sql, cfg.Connections[truckCfg.Output.Connection], cfg.UniqueId)
+	if err != nil {
+		ts.Error = err.Error()
+		return ts
+	}
+	defer writer.Close()
+
+	position, err := writer.GetCurrentPosition()
+	switch {
+	case err != nil:
+		ts.Error = err.Error()
+	case position > 0:
+		ts.Position = lsnString(position)
+		if currentLSN > position {
+			ts.LagBytes = currentLSN - position
+		}
+	}
+
+	return ts
+}
+
+func printStatus(w io.Writer, statuses []connectionStatus) {
+	for i, status := range statuses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Connection %s\n", status.Connection)
+		if status.Error != "" {
+			fmt.Fprintf(w, "  Error: %s\n", status.Error)
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		switch {
+		case !status.SlotExists:
+			fmt.Fprintf(tw, "  Slot:\t%s (doesn't exist yet)\n", status.Slot)
+		case status.Active:
+			fmt.Fprintf(tw, "  Slot:\t%s (active, pid %d)\n", status.Slot, status.ActivePid)
+		default:
+			fmt.Fprintf(tw, "  Slot:\t%s (inactive)\n", status.Slot)
+		}
+		if status.SlotExists {
+			fmt.Fprintf(tw, "  Restart LSN:\t%s\n", orNone(status.RestartLSN))
+			fmt.Fprintf(tw, "  Confirmed flush LSN:\t%s\n", orNone(status.ConfirmedFlushLSN))
+			fmt.Fprintf(tw, "  Retained WAL:\t%d bytes\n", status.RetainedWALBytes)
+		}
+		fmt.Fprintf(tw, "  Current WAL LSN:\t%s\n", status.CurrentLSN)
+		fmt.Fprintf(tw, "  Published tables:\t%s\n", orNone(strings.Join(status.PublishedTables, ", ")))
+		tw.Flush()
+
+		fmt.Fprintln(w, "  Trucks:")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "    NAME\tPOSITION\tLAG BYTES")
+		for _, t := range status.Trucks {
+			switch {
+			case t.Error != "":
+				fmt.Fprintf(tw, "    %s\terror: %s\t\n", t.Name, strings.Join(strings.Fields(t.Error), " "))
+			case t.Position == "":
+				fmt.Fprintf(tw, "    %s\tnever ran\t\n", t.Name)
+			default:
+				fmt.Fprintf(tw, "    %s\t%s\t%d\n", t.Name, t.Position, t.LagBytes)
+			}
+		}
+		tw.Flush()
+	}
+}
+
+func lsnString(lsn uint64) string {
+	if lsn == 0 {
+		return ""
+	}
+
+	return pglogrepl.LSN(lsn).String()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+
+	return s
+}
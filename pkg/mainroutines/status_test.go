@@ -0,0 +1,84 @@
+package mainroutines
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tonyfg/trucker/pkg/config"
+)
+
+func TestPrintStatus(t *testing.T) {
+	statuses := []connectionStatus{
+		{
+			Connection:        "pg",
+			Slot:              "trucker_shop1",
+			SlotExists:        true,
+			Active:            true,
+			ActivePid:         4242,
+			RestartLSN:        "0/16B3748",
+			ConfirmedFlushLSN: "0/16B3780",
+			CurrentLSN:        "0/16B4000",
+			RetainedWALBytes:  2232,
+			PublishedTables:   []string{"public.customers", "public.orders"},
+			Trucks: []truckStatus{
+				{Name: "orders", Position: "0/16B3780", LagBytes: 2176},
+				{Name: "order_stats"},
+				{Name: "broken", Error: "get position:\n  connection refused"},
+			},
+		},
+		{Connection: "other", Slot: "trucker_crm1", CurrentLSN: "0/1000000"},
+		{Connection: "down", Error: "connection refused"},
+	}
+
+	var out bytes.Buffer
+	printStatus(&out, statuses)
+
+	expected := []string{
+		"Connection pg",
+		"Slot:                 trucker_shop1 (active, pid 4242)",
+		"Restart LSN:          0/16B3748",
+		"Confirmed flush LSN:  0/16B3780",
+		"Retained WAL:         2232 bytes",
+		"Published tables:     public.customers, public.orders",
+		"orders       0/16B3780",
+		"order_stats  never ran",
+		"broken       error: get position: connection refused",
+		"Slot:              trucker_crm1 (doesn't exist yet)",
+		"Published tables:  none",
+		"Connection down\n  Error: connection refused",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected status to contain %q, got:\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "Restart LSN:          \n") {
+		t.Error("Expected no restart LSN for a slot that doesn't exist, got:\n", out.String())
+	}
+}
+
+func TestLsnString(t *testing.T) {
+	if got := lsnString(0); got != "" {
+		t.Errorf("Expected no LSN for 0, got %q", got)
+	}
+	if got := lsnString(0x16B3780); got != "0/16B3780" {
+		t.Errorf("Expected 0/16B3780, got %q", got)
+	}
+}
+
+func TestGetTruckStatusUnreachableOutput(t *testing.T) {
+	for _, adapter := range []string{"postgres", "clickhouse"} {
+		cfg := config.Config{Connections: map[string]config.Connection{
+			"out": {Name: "out", Adapter: adapter, Host: "127.0.0.1", Port: 1, Database: "trucker", User: "trucker"},
+		}}
+		truckCfg := config.Truck{Name: "orders"}
+		truckCfg.Input.Connection = "pg"
+		truckCfg.Output.Connection = "out"
+
+		ts := getTruckStatus(cfg, truckCfg, 0x16B4000)
+		if ts.Name != "orders" || ts.Error == "" || ts.Position != "" {
+			t.Errorf("Expected an unreachable %s output to be reported as the truck's error, got %+v", adapter, ts)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package mainroutines
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/health"
+	"github.com/tonyfg/trucker/pkg/logging"
+	"github.com/tonyfg/trucker/pkg/metrics"
+	"github.com/tonyfg/trucker/pkg/postgres"
+	"github.com/tonyfg/trucker/pkg/truck"
+)
+
+// supervisor hands transactions from a replication client over to its trucks,
+// and applies each truck's on_error policy when it fails:
+//
+//   - restart: the truck stops getting transactions and is restarted after its
+//     restart backoff. The replication stream is then rewound to the truck's position
+//     so it gets everything it missed.
+//   - degrade: the truck stops getting transactions for good.
+//   - stop: every truck is stopped and trucker exits.
+//
+// When the columns of one of a truck's input tables change, its
+// on_schema_change policy applies:
+//
+//   - continue: the truck carries on with the new columns.
+//   - pause: the truck stops getting transactions until trucker is restarted.
+//   - fail: every truck is stopped and trucker exits.
+//
+// When one of a truck's input tables is truncated and its on_truncate is
+// backfill, every one of the truck's input tables is backfilled again once it
+// has written the truncate (output.tables, which it truncates, hold rows from
+// all of them), from a snapshot exported for the occasion. The backfill runs
+// on its own, so the other trucks carry on meanwhile. Its output then has
+// every change in the snapshot, so the truck's position moves up to it, and it
+// gets the transactions after that once it's done.
+//
+// When the replication stream fails and can't be resumed (see the reconnect
+// settings), every running truck's on_error policy applies to the failure.
+// Once the trucks being restarted are due, the stream is started again from
+// the earliest of their positions.
+//
+// Failed and paused trucks hold back the position confirmed to the replication
+// slot, so Postgres keeps the WAL they still need. So do trucks reading from
+// the same connection that weren't started at all (when only some trucks run).
+type supervisor struct {
+	rc        *postgres.ReplicationClient
+	trucks    []*truck.Truck
+	doneChan  chan truck.ExitMsg
+	restarts  map[*truck.Truck]int
+	restartAt map[*truck.Truck]time.Time
+	// Trucks that are done backfilling again after a truncate
+	backfilled chan *truck.Truck
+	// Position of the last transaction dispatched, or where the stream started
+	streamPosition uint64
+	// Position of the trucks that weren't started, 0 if there are none or
+	// they've never run
+	heldPosition uint64
+	// Set when the position of a truck that wasn't started is unknown, so
+	// nothing can be confirmed to the replication slot
+	slotHeld bool
+	// Commit time (unix nanoseconds) of the last transaction every truck has
+	// processed
+	processedCommitTime atomic.Int64
+	phase               atomic.Value // string, one of the health.Phase* constants
+}
+
+func newSupervisor(rc *postgres.ReplicationClient, trucks []*truck.Truck, doneChan chan truck.ExitMsg) *supervisor {
+	s := &supervisor{
+		rc:         rc,
+		trucks:     trucks,
+		doneChan:   doneChan,
+		restarts:   make(map[*truck.Truck]int),
+		restartAt:  make(map[*truck.Truck]time.Time),
+		backfilled: make(chan *truck.Truck, len(trucks)),
+	}
+	s.setPhase(health.PhaseStarting)
+
+	return s
+}
+
+// hold keeps the position confirmed to the replication slot at or before
+// position, for a truck that isn't started.
+func (s *supervisor) hold(position uint64) {
+	if position > 0 && (s.heldPosition == 0 || position < s.heldPosition) {
+		s.heldPosition = position
+	}
+}
+
+// holdSlot keeps the position confirmed to the replication slot where it is,
+// for a truck that isn't started and whose position can't be read.
+func (s *supervisor) holdSlot() {
+	s.slotHeld = true
+}
+
+func (s *supervisor) setPhase(phase string) {
+	s.phase.Store(phase)
+}
+
+// Report describes the replication phase and each truck's state for health
+// checks.
+func (s *supervisor) Report(stuckThreshold time.Duration) health.ConnectionReport {
+	report := health.ConnectionReport{
+		Phase:  s.phase.Load().(string),
+		Trucks: make([]health.TruckReport, 0, len(s.trucks)),
+	}
+
+	for _, t := range s.trucks {
+		truckReport := health.TruckReport{
+			Name:   t.Name,
+			Status: t.Status().String(),
+			Alive:  t.Alive(),
+		}
+
+		if lastProcessedAt := t.LastProcessedAt(); !lastProcessedAt.IsZero() {
+			since := time.Since(lastProcessedAt).Seconds()
+			truckReport.SecondsSinceLastProcessed = &since
+		}
+
+		if busySince := t.BusySince(); !busySince.IsZero() {
+			truckReport.BusySeconds = time.Since(busySince).Seconds()
+			truckReport.Stuck = time.Since(busySince) > stuckThreshold
+		}
+
+		report.Trucks = append(report.Trucks, truckReport)
+	}
+
+	return report
+}
+
+// startTruck starts a truck's goroutine, applying its on_error policy if it
+// can't even read its stream position.
+func (s *supervisor) startTruck(t *truck.Truck) {
+	if err := t.Start(); err != nil {
+		s.fail(t, err)
+	}
+}
+
+// setupFailed applies a truck's on_error policy when it can't connect to its
+// databases at startup. Like after a failed backfill, the truck would miss
+// the backfill of its new tables if it was restarted later, so it's degraded
+// instead.
+func (s *supervisor) setupFailed(t *truck.Truck, err error) {
+	t.Logger().Error("Setup failed", logging.Err(err))
+	s.failForGood(t, err)
+}
+
+// backfillFailed applies a truck's on_error policy to a failed backfill. The
+// snapshot backfills read from doesn't outlive the backfill, so restarting
+// isn't possible and the truck is degraded instead.
+func (s *supervisor) backfillFailed(t *truck.Truck, err error) {
+	t.Logger().Error("Backfill failed", logging.Err(err))
+	s.failForGood(t, err)
+}
+
+// failForGood stops every truck if t's on_error is stop, and degrades t
+// otherwise.
+func (s *supervisor) failForGood(t *truck.Truck, err error) {
+	metrics.Errors.WithLabelValues(t.Name).Inc()
+
+	if t.OnError == config.OnErrorStop {
+		s.stopAll(t, err)
+		return
+	}
+
+	t.Logger().Warn("Degraded. It won't process any changes until trucker is restarted.")
+	t.SetStatus(truck.Degraded)
+}
+
+// dispatch hands each running truck the part of a source transaction that
+// touches its input tables, as a single transaction, and waits for all of
+// them to write it. Changes to skipTables are left out, and trucks with
+// nothing to do don't get anything.
+func (s *supervisor) dispatch(transaction *db.Transaction, skipTables []string) {
+	s.schemaChanged(transaction, skipTables)
+
+	changesets := slices.Collect(transaction.Changesets)
+	busyTrucks := make([]*truck.Truck, 0, len(s.trucks))
+	truncated := make(map[*truck.Truck][]string)
+	s.streamPosition = transaction.StreamPosition
+
+	for _, t := range s.trucks {
+		if t.Status() != truck.Running {
+			continue
+		}
+
+		truckChangesets := make([]*db.Changeset, 0, len(changesets))
+		for _, changeset := range changesets {
+			if !slices.Contains(skipTables, changeset.Table) && slices.Contains(t.InputTables, changeset.Table) {
+				truckChangesets = append(truckChangesets, changeset)
+			}
+		}
+
+		if len(truckChangesets) == 0 {
+			continue
+		}
+
+		if t.OnTruncate == config.OnTruncateBackfill && transaction.StreamPosition > t.Position() {
+			for _, changeset := range truckChangesets {
+				if changeset.Operation == db.Truncate && !slices.Contains(truncated[t], changeset.Table) {
+					truncated[t] = append(truncated[t], changeset.Table)
+				}
+			}
+		}
+
+		sent := t.ProcessTransaction(&db.Transaction{
+			StreamPosition: transaction.StreamPosition,
+			CommitTime:     transaction.CommitTime,
+			Changesets:     slices.Values(truckChangesets),
+		})
+		if sent {
+			busyTrucks = append(busyTrucks, t)
+		}
+	}
+
+	for _, t := range busyTrucks {
+		if err := t.TransactionResult(); err != nil {
+			t.Logger().Error("Failed to process transaction", logging.LSN(transaction.StreamPosition), logging.Err(err))
+			s.fail(t, err)
+		}
+	}
+
+	for t, tables := range truncated {
+		if t.Status() == truck.Running {
+			t.Logger().Info("Input tables truncated, backfilling all input tables again...", "truncated", tables)
+			t.SetStatus(truck.Backfilling)
+			go s.backfillTruncated(t)
+		}
+	}
+
+	s.confirm(transaction)
+}
+
+// backfillTruncated backfills every one of the truck's input tables again, on
+// its own goroutine, and hands the truck over to the stream once it's done.
+func (s *supervisor) backfillTruncated(t *truck.Truck) {
+	snapshotName, snapshotLSN, release, err := s.rc.ExportSnapshot()
+	if err != nil {
+		s.backfillFailed(t, err)
+		return
+	}
+	defer release()
+
+	if err := t.Backfill(snapshotName, snapshotLSN, t.InputTables, nil); err != nil {
+		s.backfillFailed(t, err)
+		return
+	}
+
+	s.backfilled <- t
+}
+
+// resumeBackfilled has a truck that's done backfilling get transactions again,
+// rewinding the stream if it's already past the truck's new position.
+func (s *supervisor) resumeBackfilled(t *truck.Truck) {
+	t.SetStatus(truck.Running)
+	if t.Position() < s.streamPosition {
+		s.rc.Rewind(t.Position())
+	}
+}
+
+// schemaChanged applies the on_schema_change policy of each running truck that
+// reads a table whose columns changed, unless it has already written the
+// transaction (a rewound stream sends it again).
+func (s *supervisor) schemaChanged(transaction *db.Transaction, skipTables []string) {
+	for _, change := range transaction.SchemaChanges {
+		if slices.Contains(skipTables, change.Table) {
+			continue
+		}
+
+		for _, t := range s.trucks {
+			if t.Status() != truck.Running || !slices.Contains(t.InputTables, change.Table) || transaction.StreamPosition <= t.Position() {
+				continue
+			}
+
+			metrics.SchemaChanges.WithLabelValues(t.Name).Inc()
+			logger := t.Logger().With("table", change.Table, "change", change.String(), logging.LSN(transaction.StreamPosition))
+
+			switch t.OnSchemaChange {
+			case config.OnSchemaChangePause:
+				logger.Error("Input table schema changed. Paused until trucker is restarted.")
+				t.SetStatus(truck.Paused)
+			case config.OnSchemaChangeFail:
+				logger.Error("Input table schema changed. on_schema_change is set to fail. Stopping all trucks...")
+				t.SetStatus(truck.Paused)
+				err := fmt.Errorf("input table schema changed (%s)", change)
+				s.doneChan <- truck.ExitMsg{TruckName: t.Name, Msg: err.Error(), Err: err}
+			default:
+				logger.Warn("Input table schema changed, carrying on with the new columns")
+			}
+		}
+	}
+}
+
+// confirm tells the replication client that the transaction has been
+// processed, but never goes past the position of a truck that failed or wasn't
+// started.
+func (s *supervisor) confirm(transaction *db.Transaction) {
+	position := transaction.StreamPosition
+	for _, t := range s.trucks {
+		if t.Status() != truck.Running && t.Position() < position {
+			position = t.Position()
+		}
+	}
+	if s.heldPosition > 0 && s.heldPosition < position {
+		position = s.heldPosition
+	}
+
+	if position == transaction.StreamPosition && !transaction.CommitTime.IsZero() {
+		s.processedCommitTime.Store(transaction.CommitTime.UnixNano())
+	}
+
+	if position > 0 && !s.slotHeld {
+		s.rc.SetProcessedLSN(position)
+	}
+}
+
+// LagBytes, LagSeconds and Reconnects report on the replication stream for
+// metrics.
+func (s *supervisor) LagBytes() uint64 {
+	return s.rc.LagBytes()
+}
+
+func (s *supervisor) LagSeconds() float64 {
+	commitTime := s.processedCommitTime.Load()
+	if commitTime == 0 || s.rc.LagBytes() == 0 {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, commitTime)).Seconds()
+}
+
+func (s *supervisor) Reconnects() uint64 {
+	return s.rc.Reconnects()
+}
+
+func (s *supervisor) fail(t *truck.Truck, err error) {
+	metrics.Errors.WithLabelValues(t.Name).Inc()
+
+	switch t.OnError {
+	case config.OnErrorStop:
+		s.stopAll(t, err)
+	case config.OnErrorDegrade:
+		t.Logger().Warn("Degraded. It won't process any changes until trucker is restarted.")
+		t.SetStatus(truck.Degraded)
+	default:
+		s.restarts[t]++
+		if t.MaxRestarts > 0 && s.restarts[t] > t.MaxRestarts {
+			t.Logger().Warn("Giving up on restarts. Degraded until trucker is restarted.", "restarts", t.MaxRestarts)
+			t.SetStatus(truck.Degraded)
+			return
+		}
+
+		backoff := restartBackoff(t, s.restarts[t])
+		t.Logger().Warn("Restarting after backoff...", "backoff", backoff, "attempt", s.restarts[t])
+		s.restartAt[t] = time.Now().Add(backoff)
+		t.SetStatus(truck.Restarting)
+	}
+}
+
+// restartBackoff is how long t waits before its attempt-th restart in a row.
+func restartBackoff(t *truck.Truck, attempt int) time.Duration {
+	backoff := time.Duration(t.RestartBackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(t.RestartMaxBackoffMs) * time.Millisecond
+
+	for range attempt - 1 {
+		backoff = min(backoff*2, maxBackoff)
+	}
+
+	return backoff
+}
+
+// restartDueTrucks restarts trucks whose backoff has expired, and rewinds the
+// replication stream to the earliest of their positions.
+func (s *supervisor) restartDueTrucks() {
+	var rewindTo uint64
+	restarted := false
+
+	for _, t := range s.trucks {
+		if t.Status() != truck.Restarting || time.Now().Before(s.restartAt[t]) {
+			continue
+		}
+
+		if err := t.Restart(); err != nil {
+			t.Logger().Error("Failed to restart", logging.Err(err))
+			s.fail(t, err)
+			continue
+		}
+
+		if !restarted || t.Position() < rewindTo {
+			rewindTo = t.Position()
+		}
+		restarted = true
+	}
+
+	if restarted && rewindTo > 0 {
+		s.rc.Rewind(rewindTo)
+	}
+}
+
+// run streams changes from startLSN up to endLSN (for good, if it's 0) and
+// dispatches them, starting the stream again if it fails and some trucks are
+// to be restarted. It returns once the stream reaches endLSN or is stopped, or
+// when it fails and there are no trucks left to restart.
+func (s *supervisor) run(startLSN uint64, endLSN uint64, skipTables []string) {
+	for {
+		s.streamPosition = startLSN
+		changes, err := s.rc.Start(startLSN, endLSN)
+		if err == nil {
+			s.stream(changes, skipTables)
+			if err = s.rc.Err(); err == nil {
+				return
+			}
+		}
+
+		s.streamFailed(err)
+
+		var ok bool
+		startLSN, ok = s.awaitRestarts()
+		if !ok || (endLSN > 0 && startLSN >= endLSN) {
+			return
+		}
+	}
+}
+
+// stream dispatches every transaction from changes until the channel is
+// closed, restarting failed trucks as their backoffs expire.
+func (s *supervisor) stream(changes chan *db.Transaction, skipTables []string) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case transaction := <-changes:
+			if transaction == nil {
+				return
+			}
+
+			s.dispatch(transaction, skipTables)
+		case t := <-s.backfilled:
+			s.resumeBackfilled(t)
+		case <-ticker.C:
+			s.restartDueTrucks()
+		}
+	}
+}
+
+// streamFailed applies the on_error policy of every running truck to a
+// replication stream that failed for good.
+func (s *supervisor) streamFailed(err error) {
+	for _, t := range s.trucks {
+		if t.Status() != truck.Running {
+			continue
+		}
+
+		t.Logger().Error("Replication stream failed", logging.Err(err))
+		s.fail(t, err)
+	}
+}
+
+// awaitRestarts waits for the trucks being restarted to be due, and restarts
+// them, or for a truck to be done backfilling. It returns the earliest
+// position of the running trucks then, or false if none are left to restart
+// or backfilling.
+func (s *supervisor) awaitRestarts() (uint64, bool) {
+	for {
+		var due time.Time
+		backfilling := false
+		for _, t := range s.trucks {
+			if t.Status() == truck.Restarting && (due.IsZero() || s.restartAt[t].Before(due)) {
+				due = s.restartAt[t]
+			}
+			backfilling = backfilling || t.Status() == truck.Backfilling
+		}
+		if due.IsZero() && !backfilling {
+			return 0, false
+		}
+
+		var restartDue <-chan time.Time
+		if !due.IsZero() {
+			restartDue = time.After(time.Until(due))
+		}
+
+		select {
+		case <-restartDue:
+			s.restartDueTrucks()
+		case t := <-s.backfilled:
+			// The stream isn't running, it starts from the truck's position
+			t.SetStatus(truck.Running)
+		}
+
+		var startLSN uint64
+		running := false
+		for _, t := range s.trucks {
+			if t.Status() != truck.Running {
+				continue
+			}
+
+			running = true
+			if truckLSN := t.Position(); truckLSN < startLSN || startLSN == 0 {
+				startLSN = truckLSN
+			}
+		}
+		if running {
+			return startLSN, true
+		}
+	}
+}
+
+func (s *supervisor) stopAll(t *truck.Truck, err error) {
+	t.Logger().Error("on_error is set to stop. Stopping all trucks...")
+	s.doneChan <- truck.ExitMsg{TruckName: t.Name, Msg: err.Error(), Err: err}
+}
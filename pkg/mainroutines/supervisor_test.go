@@ -0,0 +1,54 @@
+package mainroutines
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tonyfg/trucker/pkg/truck"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	tr := &truck.Truck{RestartBackoffMs: 1000, RestartMaxBackoffMs: 5000}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, backoff := range expected {
+		if got := restartBackoff(tr, i+1); got != backoff {
+			t.Errorf("Expected backoff for attempt %d to be %s, got %s", i+1, backoff, got)
+		}
+	}
+}
+
+func TestSupervisorHold(t *testing.T) {
+	s := newSupervisor(nil, nil, nil)
+
+	s.hold(0)
+	if s.heldPosition != 0 {
+		t.Error("Expected trucks that never ran not to hold anything back, got", s.heldPosition)
+	}
+
+	s.hold(300)
+	s.hold(100)
+	s.hold(0)
+	s.hold(200)
+	if s.heldPosition != 100 {
+		t.Error("Expected the lowest position to be held, got", s.heldPosition)
+	}
+}
+
+func TestSupervisorAwaitBackfill(t *testing.T) {
+	tr := &truck.Truck{}
+	s := newSupervisor(nil, []*truck.Truck{tr}, nil)
+
+	if _, ok := s.awaitRestarts(); ok {
+		t.Error("Expected nothing to wait for when no truck is restarting or backfilling")
+	}
+
+	tr.SetStatus(truck.Backfilling)
+	s.backfilled <- tr
+	if _, ok := s.awaitRestarts(); !ok {
+		t.Error("Expected the stream to start again once the truck is done backfilling")
+	}
+	if tr.Status() != truck.Running {
+		t.Error("Expected the truck to be running again, got", tr.Status())
+	}
+}
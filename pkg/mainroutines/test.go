@@ -0,0 +1,238 @@
+package mainroutines
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/tonyfg/trucker/pkg/clickhouse"
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/health"
+	"github.com/tonyfg/trucker/pkg/logging"
+	"github.com/tonyfg/trucker/pkg/postgres"
+	"github.com/tonyfg/trucker/pkg/truck"
+	"github.com/tonyfg/trucker/pkg/trucktest"
+)
+
+// Tests get their own replication slot, publication and stream position
+// tracking, so they don't interfere with trucker running on the same
+// databases.
+const testUniqueIdSuffix = "_test"
+
+const testPollInterval = 100 * time.Millisecond
+
+// Test runs the tests of every truck in the project, one at a time. Each test
+// prepares the input database with backfill.sql, empties the truck's
+// output.tables, starts its truck, runs stream.sql once the truck is
+// streaming, waits for the truck to catch up, and checks the output database
+// with test.sql. Pending migrations are applied
+// first, so tests can rely on them for output tables.
+//
+// A test that doesn't catch up within timeout fails with an error. Only the
+// tests of the trucks selected in the options run, if any are.
+func Test(opts Options, timeout time.Duration) ([]trucktest.Result, error) {
+	cfg, allTruckCfgs, err := loadConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	truckCfgs, err := selectTrucks(opts, allTruckCfgs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runMigrations(opts.ProjectPath, cfg); err != nil {
+		return nil, err
+	}
+
+	testCfg := cfg
+	testCfg.UniqueId = cfg.UniqueId + testUniqueIdSuffix
+
+	results := make([]trucktest.Result, 0)
+	for _, truckCfg := range truckCfgs {
+		cases, err := trucktest.Load(truckCfg.Name, filepath.Join(opts.ProjectPath, truckCfg.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range cases {
+			logger := logging.ForTruck(truckCfg.Name).With("test", c.Name)
+			logger.Info("Running test")
+
+			start := time.Now()
+			failure, err := runTest(testCfg, truckCfg, c, timeout)
+			result := trucktest.Result{Case: c, Duration: time.Since(start), Failure: failure, Error: err}
+
+			if result.Passed() {
+				logger.Info("Test passed", logging.Duration(result.Duration))
+			} else {
+				logger.Warn("Test failed", logging.Duration(result.Duration))
+			}
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+func runTest(cfg config.Config, truckCfg config.Truck, c trucktest.Case, timeout time.Duration) (string, error) {
+	inputCfg := cfg.Connections[truckCfg.Input.Connection]
+	outputCfg := cfg.Connections[truckCfg.Output.Connection]
+
+	// Start from scratch, in case a previous run was interrupted
+	rc, err := postgres.NewReplicationClient(truckCfg.Input.Tables, nil, inputCfg, cfg.Reconnect, cfg.UniqueId)
+	if err != nil {
+		return "", err
+	}
+	if err := rc.Drop(); err != nil {
+		return "", err
+	}
+
+	if c.BackfillSql != "" {
+		if err := postgres.Exec(inputCfg, c.BackfillSql); err != nil {
+			return "", fmt.Errorf("backfill.sql: %w", err)
+		}
+	}
+
+	if err := resetPosition(cfg, truckCfg); err != nil {
+		return "", err
+	}
+
+	if err := clearOutput(cfg, truckCfg); err != nil {
+		return "", err
+	}
+
+	p, err := launch(cfg, []config.Truck{truckCfg}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer stopTest(p)
+
+	s := p.supervisors[truckCfg.Input.Connection]
+	rc = p.replicationClients[truckCfg.Input.Connection]
+	deadline := time.Now().Add(timeout)
+
+	streaming := func() bool { return s.phase.Load() == health.PhaseStreaming }
+	if err := waitForTest(p, deadline, streaming); err != nil {
+		return "", fmt.Errorf("waiting for backfill: %w", err)
+	}
+
+	lsn, err := postgres.CurrentLSN(inputCfg)
+	if err != nil {
+		return "", err
+	}
+
+	if c.StreamSql != "" {
+		if err := postgres.Exec(inputCfg, c.StreamSql); err != nil {
+			return "", fmt.Errorf("stream.sql: %w", err)
+		}
+
+		if lsn, err = postgres.CurrentLSN(inputCfg); err != nil {
+			return "", err
+		}
+	}
+
+	caughtUp := func() bool { return rc.CaughtUp(lsn) }
+	if err := waitForTest(p, deadline, caughtUp); err != nil {
+		return "", fmt.Errorf("waiting to catch up with stream.sql: %w", err)
+	}
+
+	var columns []string
+	var rows [][]any
+	switch outputCfg.Adapter {
+	case "postgres":
+		columns, rows, err = postgres.Query(outputCfg, c.TestSql)
+	case "clickhouse":
+		columns, rows, err = clickhouse.Query(outputCfg, c.TestSql)
+	default:
+		err = fmt.Errorf("unsupported adapter %s for connection %s", outputCfg.Adapter, outputCfg.Name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("test.sql: %w", err)
+	}
+
+	return trucktest.Evaluate(columns, rows), nil
+}
+
+// resetPosition forgets the truck's stream position from previous runs, and
+// how far any unfinished backfill got, so it's backfilled again from scratch.
+func resetPosition(cfg config.Config, truckCfg config.Truck) error {
+	outputCfg := cfg.Connections[truckCfg.Output.Connection]
+	writer, err := truck.NewWriter(truckCfg.Name, truckCfg.Input.Connection, truckCfg.Output.Sql, outputCfg, cfg.UniqueId)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	if err := writer.SetupPositionTracking(); err != nil {
+		return err
+	}
+
+	if err := writer.ClearBackfillProgress(); err != nil {
+		return err
+	}
+
+	return writer.SetCurrentPosition(0)
+}
+
+// clearOutput truncates the truck's output.tables, so rows written by earlier
+// tests don't leak into this one's test.sql.
+func clearOutput(cfg config.Config, truckCfg config.Truck) error {
+	if len(truckCfg.Output.Tables) == 0 {
+		return nil
+	}
+
+	outputCfg := cfg.Connections[truckCfg.Output.Connection]
+	writer, err := truck.NewWriter(truckCfg.Name, truckCfg.Input.Connection, truckCfg.Output.Sql, outputCfg, cfg.UniqueId)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	for _, table := range truckCfg.Output.Tables {
+		if err := writer.TruncateTable(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForTest waits until done returns true. It gives up when the deadline
+// passes, or when a truck stops, is degraded or is paused.
+func waitForTest(p *pipeline, deadline time.Time, done func() bool) error {
+	for !done() {
+		select {
+		case exit := <-p.doneChan:
+			return fmt.Errorf("truck %s stopped: %s", exit.TruckName, exit.Msg)
+		default:
+		}
+
+		for _, trucks := range p.trucks {
+			for _, t := range trucks {
+				if status := t.Status(); status == truck.Degraded || status == truck.Paused {
+					return fmt.Errorf("truck %s is %s", t.Name, status)
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out")
+		}
+		time.Sleep(testPollInterval)
+	}
+
+	return nil
+}
+
+// stopTest stops the test's trucks and replication client, and drops its
+// replication slot and publication.
+func stopTest(p *pipeline) {
+	Stop(p.trucks)
+
+	for connName, rc := range p.replicationClients {
+		if err := rc.Drop(); err != nil {
+			slog.Warn("Unable to clean up after test", "connection", connName, logging.Err(err))
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package mainroutines
+
+import (
+	"fmt"
+	"io"
+)
+
+// Validate checks trucker.yml, every truck.yml and the trucks' SQL templates
+// without connecting to any database, so it can run in CI. It returns all the
+// problems it finds, each with the file and line it's on.
+func Validate(opts Options, w io.Writer) error {
+	cfg, truckCfgs, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d connections and %d trucks are valid\n", len(cfg.Connections), len(truckCfgs))
+	return nil
+}
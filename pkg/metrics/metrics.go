@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/tonyfg/trucker/pkg/server"
+)
+
+// Registry holds every trucker metric, along with the usual Go runtime and
+// process metrics.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	Changesets = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "trucker_changesets_total",
+		Help: "Changesets written by each truck, by operation.",
+	}, []string{"truck", "operation"})
+
+	Rows = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "trucker_rows_total",
+		Help: "Changed source rows written by each truck, by operation.",
+	}, []string{"truck", "operation"})
+
+	InputQueryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trucker_input_query_duration_seconds",
+		Help:    "Time spent running the input query for a changeset.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"truck"})
+
+	OutputQueryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trucker_output_query_duration_seconds",
+		Help:    "Time spent writing a transaction to the output database.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"truck"})
+
+	Errors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "trucker_errors_total",
+		Help: "Failed backfills and transactions for each truck.",
+	}, []string{"truck"})
+
+	SchemaChanges = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "trucker_schema_changes_total",
+		Help: "Changes to the columns of each truck's input tables noticed while streaming.",
+	}, []string{"truck"})
+
+	BackfillTables = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trucker_backfill_tables",
+		Help: "Tables each truck has to backfill.",
+	}, []string{"truck"})
+
+	BackfillTablesDone = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trucker_backfill_tables_done",
+		Help: "Tables each truck has finished backfilling.",
+	}, []string{"truck"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// ReplicationSource is what gets reported about each input connection's
+// replication stream.
+type ReplicationSource interface {
+	// LagBytes is how far the processed position is behind the server's WAL.
+	LagBytes() uint64
+	// LagSeconds is how long ago the last processed transaction was
+	// committed, or 0 when there's nothing left to process.
+	LagSeconds() float64
+	Reconnects() uint64
+}
+
+var (
+	mu                 sync.Mutex
+	replicationMetrics = make(map[string][]prometheus.Collector)
+)
+
+// RegisterReplication exports replication lag and reconnects for an input
+// connection. They're read from source whenever metrics are scraped.
+// Registering the same connection again replaces its source.
+func RegisterReplication(connection string, source ReplicationSource) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, collector := range replicationMetrics[connection] {
+		Registry.Unregister(collector)
+	}
+
+	labels := prometheus.Labels{"connection": connection}
+	lagBytes := factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "trucker_replication_lag_bytes",
+		Help:        "Bytes of WAL the server has written past the last processed transaction.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(source.LagBytes()) })
+
+	lagSeconds := factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "trucker_replication_lag_seconds",
+		Help:        "Seconds since the last processed transaction was committed, while there are changes left to process.",
+		ConstLabels: labels,
+	}, source.LagSeconds)
+
+	reconnects := factory.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "trucker_replication_reconnects_total",
+		Help:        "Times the replication connection was re-established.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(source.Reconnects()) })
+
+	replicationMetrics[connection] = []prometheus.Collector{lagBytes, lagSeconds, reconnects}
+}
+
+// Serve starts serving /metrics on addr in the background.
+func Serve(addr string) error {
+	return server.Handle(addr, "/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry}))
+}
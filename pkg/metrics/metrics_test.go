@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeReplication struct {
+	lagBytes   uint64
+	lagSeconds float64
+	reconnects uint64
+}
+
+func (f *fakeReplication) LagBytes() uint64    { return f.lagBytes }
+func (f *fakeReplication) LagSeconds() float64 { return f.lagSeconds }
+func (f *fakeReplication) Reconnects() uint64  { return f.reconnects }
+
+func TestRegisterReplication(t *testing.T) {
+	RegisterReplication("pg", &fakeReplication{lagBytes: 1, lagSeconds: 1, reconnects: 1})
+	// Registering the connection again replaces the old source
+	RegisterReplication("pg", &fakeReplication{lagBytes: 2048, lagSeconds: 1.5, reconnects: 3})
+
+	expected := `
+# HELP trucker_replication_lag_bytes Bytes of WAL the server has written past the last processed transaction.
+# TYPE trucker_replication_lag_bytes gauge
+trucker_replication_lag_bytes{connection="pg"} 2048
+# HELP trucker_replication_lag_seconds Seconds since the last processed transaction was committed, while there are changes left to process.
+# TYPE trucker_replication_lag_seconds gauge
+trucker_replication_lag_seconds{connection="pg"} 1.5
+# HELP trucker_replication_reconnects_total Times the replication connection was re-established.
+# TYPE trucker_replication_reconnects_total counter
+trucker_replication_reconnects_total{connection="pg"} 3
+`
+	err := testutil.GatherAndCompare(
+		Registry,
+		strings.NewReader(expected),
+		"trucker_replication_lag_bytes",
+		"trucker_replication_lag_seconds",
+		"trucker_replication_reconnects_total",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTruckMetrics(t *testing.T) {
+	Changesets.WithLabelValues("whiskies", "insert").Add(2)
+	Rows.WithLabelValues("whiskies", "insert").Add(10)
+
+	if got := testutil.ToFloat64(Changesets.WithLabelValues("whiskies", "insert")); got != 2 {
+		t.Error("Expected 2 changesets, got", got)
+	}
+
+	if got := testutil.ToFloat64(Rows.WithLabelValues("whiskies", "insert")); got != 10 {
+		t.Error("Expected 10 rows, got", got)
+	}
+}
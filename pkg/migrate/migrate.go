@@ -0,0 +1,182 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+const upSuffix = "_up.sql"
+const downSuffix = "_down.sql"
+
+// Migration is a pair of <version>_up.sql and <version>_down.sql files.
+// Versions are applied in lexical order, so they should be timestamps like
+// 2024-12-25T17:31:54. DownPath is empty if there's no down file.
+type Migration struct {
+	Version  string
+	UpPath   string
+	DownPath string
+}
+
+// Status tells whether a migration was applied to its database.
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// Connections returns the names of the connections with a migrations directory
+// inside dir, sorted by name. It returns no connections if dir doesn't exist.
+func Connections(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	connections := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			connections = append(connections, entry.Name())
+		}
+	}
+
+	return connections, nil
+}
+
+// Load returns the migrations in dir, oldest first.
+func Load(dir string) ([]Migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[string]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		var version string
+		var down bool
+		switch {
+		case strings.HasSuffix(name, upSuffix):
+			version = strings.TrimSuffix(name, upSuffix)
+		case strings.HasSuffix(name, downSuffix):
+			version = strings.TrimSuffix(name, downSuffix)
+			down = true
+		default:
+			return nil, fmt.Errorf("%s: migration files must be named <version>%s or <version>%s", filepath.Join(dir, name), upSuffix, downSuffix)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+
+		if down {
+			m.DownPath = filepath.Join(dir, name)
+		} else {
+			m.UpPath = filepath.Join(dir, name)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.UpPath == "" {
+			return nil, fmt.Errorf("%s: migration %s has no %s file", dir, m.Version, upSuffix)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return strings.Compare(a.Version, b.Version) })
+
+	return migrations, nil
+}
+
+// Statuses returns every migration in dir, and whether it was applied. Applied
+// versions that don't have migration files anymore are left out.
+func Statuses(m db.Migrator, dir string) ([]Status, error) {
+	migrations, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, len(migrations))
+	for i, migration := range migrations {
+		statuses[i] = Status{Migration: migration, Applied: slices.Contains(applied, migration.Version)}
+	}
+
+	return statuses, nil
+}
+
+// Up applies every pending migration in dir, oldest first, and returns the
+// versions it applied. It stops at the first migration that fails.
+func Up(m db.Migrator, dir string) ([]string, error) {
+	statuses, err := Statuses(m, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for _, status := range statuses {
+		if status.Applied {
+			continue
+		}
+
+		sql, err := os.ReadFile(status.UpPath)
+		if err != nil {
+			return done, err
+		}
+
+		if err := m.Up(status.Version, string(sql)); err != nil {
+			return done, fmt.Errorf("migration %s: %w", status.Version, err)
+		}
+		done = append(done, status.Version)
+	}
+
+	return done, nil
+}
+
+// Down reverts the latest applied migration in dir and returns its version. It
+// returns an empty version if there's nothing to revert.
+func Down(m db.Migrator, dir string) (string, error) {
+	statuses, err := Statuses(m, dir)
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(statuses) - 1; i >= 0; i-- {
+		status := statuses[i]
+		if !status.Applied {
+			continue
+		}
+
+		if status.DownPath == "" {
+			return "", fmt.Errorf("migration %s has no %s file", status.Version, downSuffix)
+		}
+
+		sql, err := os.ReadFile(status.DownPath)
+		if err != nil {
+			return "", err
+		}
+
+		if err := m.Down(status.Version, string(sql)); err != nil {
+			return "", fmt.Errorf("migration %s: %w", status.Version, err)
+		}
+
+		return status.Version, nil
+	}
+
+	return "", nil
+}
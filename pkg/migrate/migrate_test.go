@@ -0,0 +1,132 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+type fakeMigrator struct {
+	applied []string
+	ran     []string
+	failOn  string
+}
+
+func (f *fakeMigrator) Setup() error               { return nil }
+func (f *fakeMigrator) Applied() ([]string, error) { return f.applied, nil }
+func (f *fakeMigrator) Close()                     {}
+
+func (f *fakeMigrator) Up(version string, sql string) error {
+	if version == f.failOn {
+		return errors.New("boom")
+	}
+	f.ran = append(f.ran, sql)
+	f.applied = append(f.applied, version)
+	return nil
+}
+
+func (f *fakeMigrator) Down(version string, sql string) error {
+	f.ran = append(f.ran, sql)
+	f.applied = slices.DeleteFunc(f.applied, func(v string) bool { return v == version })
+	return nil
+}
+
+func writeMigrations(t *testing.T, files ...string) string {
+	dir := t.TempDir()
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := writeMigrations(t,
+		"2025-01-05T11:01:05_up.sql",
+		"2024-12-25T17:31:54_down.sql",
+		"2024-12-25T17:31:54_up.sql",
+		"README.md",
+	)
+
+	migrations, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Migration{
+		{
+			Version:  "2024-12-25T17:31:54",
+			UpPath:   filepath.Join(dir, "2024-12-25T17:31:54_up.sql"),
+			DownPath: filepath.Join(dir, "2024-12-25T17:31:54_down.sql"),
+		},
+		{
+			Version: "2025-01-05T11:01:05",
+			UpPath:  filepath.Join(dir, "2025-01-05T11:01:05_up.sql"),
+		},
+	}
+	if !reflect.DeepEqual(migrations, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, migrations)
+	}
+}
+
+func TestLoadRejectsBadFiles(t *testing.T) {
+	tests := map[string][]string{
+		"missing up file": {"2024-12-25T17:31:54_down.sql"},
+		"unknown suffix":  {"2024-12-25T17:31:54.sql"},
+	}
+
+	for name, files := range tests {
+		if _, err := Load(writeMigrations(t, files...)); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestUpAndDown(t *testing.T) {
+	dir := writeMigrations(t,
+		"1_up.sql", "1_down.sql",
+		"2_up.sql", "2_down.sql",
+		"3_up.sql", "3_down.sql",
+	)
+	m := &fakeMigrator{applied: []string{"1"}, failOn: "3"}
+
+	done, err := Up(m, dir)
+	if err == nil {
+		t.Error("Expected migration 3 to fail")
+	}
+	if !reflect.DeepEqual(done, []string{"2"}) {
+		t.Errorf("Expected only migration 2 to be applied, got %v", done)
+	}
+
+	m.failOn = ""
+	if done, err = Up(m, dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(done, []string{"3"}) {
+		t.Errorf("Expected migration 3 to be applied, got %v", done)
+	}
+
+	version, err := Down(m, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "3" || !reflect.DeepEqual(m.applied, []string{"1", "2"}) {
+		t.Errorf("Expected migration 3 to be reverted, got %s with %v still applied", version, m.applied)
+	}
+
+	expectedSql := []string{"2_up.sql", "3_up.sql", "3_down.sql"}
+	if !reflect.DeepEqual(m.ran, expectedSql) {
+		t.Errorf("Expected %v to run, got %v", expectedSql, m.ran)
+	}
+}
+
+func TestConnectionsWithoutMigrateDir(t *testing.T) {
+	connections, err := Connections(filepath.Join(t.TempDir(), "migrate"))
+	if err != nil || len(connections) > 0 {
+		t.Errorf("Expected no connections and no error, got %v, %v", connections, err)
+	}
+}
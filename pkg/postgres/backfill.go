@@ -3,21 +3,110 @@ package postgres
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
 	"text/template"
 
 	"github.com/jackc/pgx/v5"
 
 	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/logging"
 )
 
 const channelSize = 3
 const batchSize = 2000000
 
-func (rc *ReplicationClient) ReadBackfillData(table string, snapshotName string, readQuery string) *db.ChanChangeset {
-	var schema, tblName, nullFields string
+// The first server_version_num with TID range scans, which chunks by ctid need
+const tidRangeScanVersion = 140000
+
+// SnapshotReader reads input tables from an exported snapshot for backfills,
+// on a connection of its own. Several of them can read from the same snapshot
+// at once, and they all see the same rows.
+//
+// Tables are read in chunks by primary key, or in ranges of pages by ctid for
+// tables without one. Partitioned tables without a primary key, and any table
+// without one before PostgreSQL 14, can only be read all at once.
+type SnapshotReader struct {
+	rc           *ReplicationClient
+	conn         *pgx.Conn
+	snapshotName string
+}
+
+// NewSnapshotReader connects to the input database to read from the snapshot.
+func (rc *ReplicationClient) NewSnapshotReader(snapshotName string) (*SnapshotReader, error) {
+	conn, err := rc.tryConnect(false)
+	if err != nil {
+		return nil, &db.Error{Op: "backfill", Err: err}
+	}
+
+	return &SnapshotReader{rc: rc, conn: conn, snapshotName: snapshotName}, nil
+}
+
+func (r *SnapshotReader) Close() {
+	r.conn.Close(context.Background())
+}
+
+// begin starts a transaction that sees the snapshot.
+func (r *SnapshotReader) begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := r.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", r.snapshotName))
+	if err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// ChunkEnd returns the key the chunk of the table's rows matching the filter
+// after the key after (or from the start, if it's nil) ends at, so that it
+// has chunkSize rows. Ranges of pages are sized by how many rows a page holds
+// on average. It returns nil if the chunk is the last one, which is always the
+// case when chunkSize is 0.
+func (r *SnapshotReader) ChunkEnd(table string, filter db.TableFilter, after []string, chunkSize int) ([]string, error) {
+	if chunkSize <= 0 {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
+	}
+	defer tx.Rollback(ctx)
+
+	key, err := primaryKeyColumns(ctx, tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var end []string
+	if len(key) > 0 {
+		end, err = keyChunkEnd(ctx, tx, table, key, filter, after, chunkSize)
+	} else {
+		end, err = pageChunkEnd(ctx, tx, table, after, chunkSize)
+	}
+	if err != nil {
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
+	}
+
+	return end, nil
+}
+
+// ReadChunk reads the table's rows matching the filter from the snapshot
+// through the input query, after the key after (or from the start, if it's
+// nil) up to and including the key end (or to the end, if it's nil). Only the
+// columns included by the filter are selected, along with a NULL old__ column
+// for each of them (and an empty unchanged__ column, if the query uses it),
+// like an insert from the stream.
+func (r *SnapshotReader) ReadChunk(table string, readQuery string, filter db.TableFilter, after []string, end []string) (*db.ChanChangeset, error) {
+	var schema, tblName string
 	schemaAndTable := strings.Split(table, ".")
 	if len(schemaAndTable) < 2 {
 		schema = "public"
@@ -27,56 +116,97 @@ func (rc *ReplicationClient) ReadBackfillData(table string, snapshotName string,
 		tblName = schemaAndTable[1]
 	}
 
+	if strings.TrimSpace(readQuery) == "" {
+		readQuery = passThroughSql
+	}
+
+	tmpl, err := template.New("inputSql").Parse(readQuery)
+	if err != nil {
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
+	}
+
 	ctx := context.Background()
-	row := rc.conn.QueryRow(
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
+	}
+
+	columnRows, err := tx.Query(
 		ctx,
-		`SELECT string_agg(
+		`SELECT column_name,
   CASE WHEN data_type = 'ARRAY' THEN
-    'NULL::' || substr(udt_name, 2) || '[] old__' || column_name
+    substr(udt_name, 2) || '[]'
   WHEN data_type = 'USER-DEFINED' THEN
-	'NULL::' || udt_name || ' old__' || column_name
+    udt_name
   ELSE
-    'NULL::' || data_type || ' old__' || column_name
-  END,
-  ', '
-)
+    data_type
+  END
 FROM information_schema.columns
 WHERE table_schema = $1
-  AND table_name = $2`,
+  AND table_name = $2
+ORDER BY ordinal_position`,
 		schema,
 		tblName,
 	)
-	err := row.Scan(&nullFields)
 	if err != nil {
-		panic(err)
+		tx.Rollback(ctx)
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
 	}
 
-	tmpl, err := template.New("inputSql").Parse(readQuery)
+	var columnName, columnType string
+	selectFields := make([]string, 0)
+	nullFields := make([]string, 0)
+	_, err = pgx.ForEachRow(columnRows, []any{&columnName, &columnType}, func() error {
+		if filter.Columns.Includes(columnName) {
+			selectFields = append(selectFields, pgx.Identifier{columnName}.Sanitize())
+			nullFields = append(nullFields, fmt.Sprintf("NULL::%s %s", columnType, pgx.Identifier{db.OldColumnPrefix + columnName}.Sanitize()))
+		}
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		tx.Rollback(ctx)
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
+	}
+	if len(selectFields) == 0 {
+		tx.Rollback(ctx)
+		return nil, &db.Error{Op: "backfill", Table: table, Err: fmt.Errorf("no columns left to backfill, check that the table exists and its only_columns/except_columns")}
 	}
+
+	if db.UsesUnchangedColumn(readQuery) {
+		// Backfilled rows have all of their values
+		nullFields = append(nullFields, fmt.Sprintf("'{}'::text[] %s", db.UnchangedColumn))
+	}
+
+	conditions := filterConditions(filter)
+	chunkConditions, params, err := chunkConditions(ctx, tx, table, after, end)
+	if err != nil {
+		tx.Rollback(ctx)
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
+	}
+	conditions = append(conditions, chunkConditions...)
+
+	rowsSql := fmt.Sprintf("SELECT %s, %s FROM %s", strings.Join(selectFields, ", "), strings.Join(nullFields, ", "), table)
+	if len(conditions) > 0 {
+		rowsSql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
 	tmplVars := map[string]string{
 		"operation":   "insert",
 		"input_table": table,
-		"rows":        fmt.Sprintf("(SELECT *, %s FROM %s) r", nullFields, table),
+		"rows":        fmt.Sprintf("(%s) r", rowsSql),
 	}
 	sql := new(bytes.Buffer)
 	err = tmpl.Execute(sql, tmplVars)
-
-	tx, err := rc.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = tx.Exec(context.Background(), fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", snapshotName))
 	if err != nil {
-		panic(err)
+		tx.Rollback(ctx)
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
 	}
 
-	rows, err := tx.Query(context.Background(), sql.String())
+	rows, err := tx.Query(ctx, sql.String(), params...)
 	if err != nil {
-		log.Printf("[Postgres Backfiller] Error running query:\n%s\n", sql.String())
-		panic(err)
+		r.rc.logger.Error("Error running backfill query", "table", table, "sql", sql.String(), logging.Err(err))
+		tx.Rollback(ctx)
+		return nil, &db.Error{Op: "backfill", Table: table, Err: err}
 	}
 
 	fields := rows.FieldDescriptions()
@@ -89,46 +219,205 @@ WHERE table_schema = $1
 		}
 	}
 
-	rowChan := make(chan [][]any, channelSize)
+	result := &db.ChanChangeset{
+		Operation: db.Insert,
+		Table:     table,
+		Columns:   columns,
+		Rows:      make(chan [][]any, channelSize),
+	}
 
 	// TODO This go routine is basically the same between reader and backfill. Refactor to avoid dups
 	go func() {
+		// The connection is free for the next chunk once Rows is closed
+		defer close(result.Rows)
 		defer func() {
 			err := tx.Rollback(ctx)
-			if err != nil && rc.running {
-				panic(err)
+			if err != nil && r.rc.running {
+				r.rc.logger.Warn("Error rolling back backfill transaction", "table", table, logging.Err(err))
 			}
 		}()
 		defer rows.Close()
-		defer func() {
-			close(rowChan)
-		}()
 
 		rowBatch := make([][]any, 0, batchSize/len(columns))
 
 		for rows.Next() {
 			row, err := rows.Values()
 			if err != nil {
-				panic(err)
+				result.Err = &db.Error{Op: "backfill", Table: table, Err: err}
+				return
 			}
 
 			rowBatch = append(rowBatch, row)
 
 			if len(rowBatch) >= batchSize/len(columns) {
-				rowChan <- rowBatch
+				result.Rows <- rowBatch
 				rowBatch = make([][]any, 0, batchSize)
 			}
 		}
 
+		if err := rows.Err(); err != nil {
+			result.Err = &db.Error{Op: "backfill", Table: table, Err: err}
+			return
+		}
+
 		if len(rowBatch) > 0 {
-			rowChan <- rowBatch
+			result.Rows <- rowBatch
 		}
 	}()
 
-	return &db.ChanChangeset{
-		Operation: db.Insert,
-		Table:     table,
-		Columns:   columns,
-		Rows:      rowChan,
+	return result, nil
+}
+
+func filterConditions(filter db.TableFilter) []string {
+	if strings.TrimSpace(filter.Where) == "" {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("(%s)", filter.Where)}
+}
+
+// keyList returns the key's columns as a list for row comparisons, and
+// placeholders for a key's values as text cast to the columns' types,
+// numbered from the first parameter after params.
+func keyList(key []sourceColumn, params []any, values []string) (string, string, []any) {
+	names := make([]string, len(key))
+	placeholders := make([]string, len(key))
+	for i, col := range key {
+		names[i] = pgx.Identifier{col.name}.Sanitize()
+		if values != nil {
+			params = append(params, values[i])
+			placeholders[i] = fmt.Sprintf("$%d::text::%s", len(params), col.typeName)
+		}
 	}
+
+	return strings.Join(names, ", "), strings.Join(placeholders, ", "), params
+}
+
+// keyChunkEnd returns the primary key of the chunkSize-th row after the key
+// after, or nil if there aren't that many rows left.
+func keyChunkEnd(ctx context.Context, tx pgx.Tx, table string, key []sourceColumn, filter db.TableFilter, after []string, chunkSize int) ([]string, error) {
+	names, placeholders, params := keyList(key, nil, after)
+	conditions := filterConditions(filter)
+	if after != nil {
+		conditions = append(conditions, fmt.Sprintf("(%s) > (%s)", names, placeholders))
+	}
+
+	texts := make([]string, len(key))
+	for i, col := range key {
+		texts[i] = pgx.Identifier{col.name}.Sanitize() + "::text"
+	}
+	sql := fmt.Sprintf("SELECT %s FROM %s", strings.Join(texts, ", "), table)
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += fmt.Sprintf(" ORDER BY %s OFFSET %d LIMIT 1", names, chunkSize-1)
+
+	end := make([]string, len(key))
+	dest := make([]any, len(key))
+	for i := range end {
+		dest[i] = &end[i]
+	}
+	err := tx.QueryRow(ctx, sql, params...).Scan(dest...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+
+	return end, err
+}
+
+// pageChunkEnd returns the page that's about chunkSize rows after the page
+// after, or nil if that's past the end of the table. Only ordinary tables have
+// pages to go by, and only from PostgreSQL 14 on: older servers can't scan a
+// range of ctids, so every chunk would read the whole table.
+func pageChunkEnd(ctx context.Context, tx pgx.Tx, table string, after []string, chunkSize int) ([]string, error) {
+	var relkind string
+	var pages, relpages int64
+	var reltuples float64
+	var serverVersion int
+	err := tx.QueryRow(
+		ctx,
+		`SELECT relkind, pg_relation_size(oid) / current_setting('block_size')::int, relpages, reltuples,
+  current_setting('server_version_num')::int
+FROM pg_class
+WHERE oid = $1::regclass`,
+		pgx.Identifier(strings.Split(table, ".")).Sanitize(),
+	).Scan(&relkind, &pages, &relpages, &reltuples, &serverVersion)
+	if err != nil || relkind != "r" || serverVersion < tidRangeScanVersion {
+		return nil, err
+	}
+
+	rowsPerPage := 100.0 // until the table has been analyzed
+	if relpages > 0 && reltuples > 0 {
+		rowsPerPage = reltuples / float64(relpages)
+	}
+
+	start, err := pageNumber(after)
+	if err != nil {
+		return nil, err
+	}
+
+	end := start + max(1, int64(float64(chunkSize)/rowsPerPage))
+	if end >= pages {
+		return nil, nil
+	}
+
+	return []string{strconv.FormatInt(end, 10)}, nil
+}
+
+// chunkConditions returns the conditions, and their parameters, that narrow a
+// table's rows down to the ones after the key after and up to the key end.
+func chunkConditions(ctx context.Context, tx pgx.Tx, table string, after []string, end []string) ([]string, []any, error) {
+	if after == nil && end == nil {
+		return nil, nil, nil
+	}
+
+	key, err := primaryKeyColumns(ctx, tx, table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conditions := make([]string, 0, 2)
+	if len(key) == 0 {
+		// Pages, from the one a chunk starts at to the one the next starts at
+		if after != nil {
+			start, err := pageNumber(after)
+			if err != nil {
+				return nil, nil, err
+			}
+			conditions = append(conditions, fmt.Sprintf("ctid >= '(%d,0)'::tid", start))
+		}
+		if end != nil {
+			start, err := pageNumber(end)
+			if err != nil {
+				return nil, nil, err
+			}
+			conditions = append(conditions, fmt.Sprintf("ctid < '(%d,0)'::tid", start))
+		}
+		return conditions, nil, nil
+	}
+
+	var params []any
+	if after != nil {
+		names, placeholders, afterParams := keyList(key, params, after)
+		conditions = append(conditions, fmt.Sprintf("(%s) > (%s)", names, placeholders))
+		params = afterParams
+	}
+	if end != nil {
+		names, placeholders, endParams := keyList(key, params, end)
+		conditions = append(conditions, fmt.Sprintf("(%s) <= (%s)", names, placeholders))
+		params = endParams
+	}
+
+	return conditions, params, nil
+}
+
+func pageNumber(key []string) (int64, error) {
+	if key == nil {
+		return 0, nil
+	}
+	if len(key) != 1 {
+		return 0, fmt.Errorf("expected a page number, got %v", key)
+	}
+
+	return strconv.ParseInt(key[0], 10, 64)
 }
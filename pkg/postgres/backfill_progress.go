@@ -0,0 +1,115 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// GetBackfillProgress returns how far the truck's backfills have got, for the
+// input tables it has unfinished backfills of. It's empty once a backfill is
+// complete (or if position tracking isn't set up yet).
+func (w *Writer) GetBackfillProgress() ([]db.BackfillProgress, error) {
+	rows, err := w.conn.Query(
+		context.Background(),
+		fmt.Sprintf("SELECT input_table, snapshot_lsn, last_key, done FROM %s ORDER BY input_table", w.backfillTable),
+	)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42P01" { // undefined_table
+			return nil, nil
+		}
+		return nil, &db.Error{Op: "get backfill progress", Err: err}
+	}
+
+	progress, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (db.BackfillProgress, error) {
+		var p db.BackfillProgress
+		err := row.Scan(&p.Table, &p.SnapshotLSN, &p.LastKey, &p.Done)
+		return p, err
+	})
+	if err != nil {
+		return nil, &db.Error{Op: "get backfill progress", Err: err}
+	}
+
+	return progress, nil
+}
+
+// SetBackfillProgress records how far a backfill has got, like before its first
+// chunk is written.
+func (w *Writer) SetBackfillProgress(progress db.BackfillProgress) error {
+	_, err := w.conn.Exec(context.Background(), w.setBackfillProgressSql(), backfillProgressArgs(progress)...)
+	if err != nil {
+		return &db.Error{Op: "set backfill progress", Table: progress.Table, Err: err}
+	}
+
+	return nil
+}
+
+// WriteBackfillChunk writes a chunk of a backfill, and records the progress it
+// makes in the same transaction. The transaction isn't committed until the
+// chunks before it are, so the progress recorded covers every chunk written.
+func (w *Writer) WriteBackfillChunk(changeset *db.ChanChangeset, chunk *db.BackfillChunk) (bool, error) {
+	ctx := context.Background()
+	var tx pgx.Tx
+	err := chunk.Begin(func() (err error) {
+		tx, err = w.conn.Begin(ctx)
+		if err != nil {
+			return &db.Error{Op: "write", Table: changeset.Table, Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		changeset.Discard()
+		return false, err
+	}
+	// Does nothing once the transaction is committed
+	defer tx.Rollback(ctx)
+
+	wrote, err := w.writeChangeset(ctx, tx, changeset)
+	if err != nil {
+		changeset.Discard()
+		return false, err
+	}
+
+	err = chunk.Commit(func(progress db.BackfillProgress) error {
+		if _, err := tx.Exec(ctx, w.setBackfillProgressSql(), backfillProgressArgs(progress)...); err != nil {
+			return &db.Error{Op: "set backfill progress", Table: progress.Table, Err: err}
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return &db.Error{Op: "write", Table: changeset.Table, Err: err}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return wrote, nil
+}
+
+// ClearBackfillProgress forgets about the truck's backfills, once they're
+// complete or when the truck is reset.
+func (w *Writer) ClearBackfillProgress() error {
+	_, err := w.conn.Exec(context.Background(), fmt.Sprintf("DELETE FROM %s", w.backfillTable))
+	if err != nil {
+		return &db.Error{Op: "clear backfill progress", Err: err}
+	}
+
+	return nil
+}
+
+func (w *Writer) setBackfillProgressSql() string {
+	return fmt.Sprintf(`INSERT INTO %s (input_table, snapshot_lsn, last_key, done) VALUES ($1, $2, $3, $4)
+ON CONFLICT (input_table) DO UPDATE SET snapshot_lsn = $2, last_key = $3, done = $4`, w.backfillTable)
+}
+
+func backfillProgressArgs(progress db.BackfillProgress) []any {
+	return []any{progress.Table, progress.SnapshotLSN, progress.LastKey, progress.Done}
+}
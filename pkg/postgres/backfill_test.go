@@ -14,18 +14,30 @@ func TestStreamBackfillData(t *testing.T) {
 	defer conn.Close(context.Background())
 	defer rc.Close()
 
-	_, _, snapshotName := rc.Setup()
+	_, _, snapshotName, err := rc.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Jamaica isn't supposed to show up in the backfill, since it was added
 	// after the snapshot was created
-	_, err := conn.Exec(
+	_, err = conn.Exec(
 		context.Background(),
 		"INSERT INTO public.countries (name) VALUES ('Jamaica')")
 	if err != nil {
 		t.Error(err)
 	}
 
-	changeset := rc.ReadBackfillData("public.countries", snapshotName, "SELECT * FROM {{ .rows }}")
+	reader, err := rc.NewSnapshotReader(snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	changeset, err := reader.ReadChunk("public.countries", "SELECT * FROM {{ .rows }}", db.TableFilter{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	expectedInsertCols := []db.Column{
 		{Name: "id", Type: db.Int32},
@@ -62,3 +74,58 @@ func TestStreamBackfillData(t *testing.T) {
 		t.Error("Reading from channel took too long...")
 	}
 }
+
+func TestReadBackfillChunks(t *testing.T) {
+	conn, rc := replicationTestSetup("public.countries")
+	defer conn.Close(context.Background())
+	defer rc.Close()
+
+	_, _, snapshotName, err := rc.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := rc.NewSnapshotReader(snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	filter := db.TableFilter{Where: "name <> 'Japan'"}
+	ids := make([][]any, 0)
+	ends := make([][]string, 0)
+	var after []string
+	for {
+		end, err := reader.ChunkEnd("public.countries", filter, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changeset, err := reader.ReadChunk("public.countries", "SELECT id FROM {{ .rows }}", filter, after, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunk := make([]any, 0)
+		for rows := range changeset.Rows {
+			for _, row := range rows {
+				chunk = append(chunk, row[0])
+			}
+		}
+		ids = append(ids, chunk)
+		ends = append(ends, end)
+
+		if end == nil {
+			break
+		}
+		after = end
+	}
+
+	expectedIds := [][]any{{int32(1), int32(2)}, {int32(3), int32(5)}, {}}
+	if !reflect.DeepEqual(ids, expectedIds) {
+		t.Errorf("Expected chunks %v, got %v", expectedIds, ids)
+	}
+	expectedEnds := [][]string{{"2"}, {"5"}, nil}
+	if !reflect.DeepEqual(ends, expectedEnds) {
+		t.Errorf("Expected chunks to end at %v, got %v", expectedEnds, ends)
+	}
+}
@@ -3,17 +3,21 @@ package postgres
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/url"
 	"strings"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tonyfg/trucker/pkg/db"
 )
 
 const defaultSliceCapacity = 32
 const minimumPoolSize = 2
 
-func NewConnection(user string, pass string, host string, port uint16, ssl string, database string, replication bool) *pgxpool.Pool {
+// NewConnection returns a pool of connections to the database. Connections are
+// only made as they're needed, so an unreachable server shows up as errors
+// when the pool is used.
+func NewConnection(user string, pass string, host string, port uint16, ssl string, database string, replication bool) (*pgxpool.Pool, error) {
 	if port == 0 {
 		port = 5432
 	}
@@ -39,13 +43,13 @@ func NewConnection(user string, pass string, host string, port uint16, ssl strin
 
 	config, err := pgxpool.ParseConfig(connString)
 	if err != nil {
-		log.Fatalln("Unable to parse connection string:", err)
+		return nil, &db.Error{Op: "connect to " + host, Err: err}
 	}
 
 	conn, err := pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
-		log.Fatalln("Unable to connect to postgres server:", err)
+		return nil, &db.Error{Op: "connect to " + host, Err: err}
 	}
 
-	return conn
+	return conn, nil
 }
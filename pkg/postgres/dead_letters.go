@@ -0,0 +1,144 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// DeadLetterTable keeps a truck's dead letters in a table in its output
+// database.
+type DeadLetterTable struct {
+	table string
+	conn  *pgxpool.Pool
+}
+
+func NewDeadLetterTable(truckName string, cfg config.Connection, uniqueId string) (*DeadLetterTable, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetterTable{
+		table: fmt.Sprintf(`"trucker_dead_letters__%s%s"`, truckName, uniqueId),
+		conn:  conn,
+	}, nil
+}
+
+func (d *DeadLetterTable) Setup() error {
+	_, err := d.conn.Exec(context.Background(), fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+  id bigserial PRIMARY KEY,
+  lsn bigint NOT NULL,
+  input_table text NOT NULL,
+  operation text NOT NULL,
+  columns jsonb NOT NULL,
+  rows jsonb NOT NULL,
+  sql text NOT NULL,
+  error text NOT NULL,
+  created_at timestamptz NOT NULL,
+  resolved_at timestamptz
+)`, d.table))
+
+	if err != nil {
+		return &db.Error{Op: "setup dead letters", Err: err}
+	}
+
+	return nil
+}
+
+func (d *DeadLetterTable) Send(letter *db.DeadLetter) error {
+	columns, err := json.Marshal(letter.Columns)
+	if err != nil {
+		return &db.Error{Op: "send dead letter", Table: letter.Table, Err: err}
+	}
+
+	rows, err := json.Marshal(letter.Rows)
+	if err != nil {
+		return &db.Error{Op: "send dead letter", Table: letter.Table, Err: err}
+	}
+
+	_, err = d.conn.Exec(
+		context.Background(),
+		fmt.Sprintf(`INSERT INTO %s (lsn, input_table, operation, columns, rows, sql, error, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, d.table),
+		letter.Position,
+		letter.Table,
+		letter.Operation,
+		string(columns),
+		string(rows),
+		letter.Sql,
+		letter.Error,
+		letter.CreatedAt,
+	)
+	if err != nil {
+		return &db.Error{Op: "send dead letter", Table: letter.Table, Err: err}
+	}
+
+	return nil
+}
+
+func (d *DeadLetterTable) Pending() ([]*db.DeadLetter, error) {
+	rows, err := d.conn.Query(
+		context.Background(),
+		fmt.Sprintf(`SELECT id, lsn, input_table, operation, columns::text, rows::text, sql, error, created_at
+FROM %s
+WHERE resolved_at IS NULL
+ORDER BY id`, d.table),
+	)
+	if err != nil {
+		return nil, &db.Error{Op: "read dead letters", Err: err}
+	}
+	defer rows.Close()
+
+	letters := make([]*db.DeadLetter, 0)
+	for rows.Next() {
+		var id int64
+		var columnsJson, rowsJson string
+		letter := &db.DeadLetter{}
+
+		err := rows.Scan(&id, &letter.Position, &letter.Table, &letter.Operation, &columnsJson, &rowsJson, &letter.Sql, &letter.Error, &letter.CreatedAt)
+		if err != nil {
+			return nil, &db.Error{Op: "read dead letters", Err: err}
+		}
+		letter.Id = strconv.FormatInt(id, 10)
+
+		if err := json.Unmarshal([]byte(columnsJson), &letter.Columns); err != nil {
+			return nil, &db.Error{Op: "read dead letters", Table: letter.Table, Err: err}
+		}
+
+		if letter.Rows, err = db.DecodeJsonRows(letter.Columns, []byte(rowsJson)); err != nil {
+			return nil, &db.Error{Op: "read dead letters", Table: letter.Table, Err: err}
+		}
+
+		letters = append(letters, letter)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, &db.Error{Op: "read dead letters", Err: err}
+	}
+
+	return letters, nil
+}
+
+func (d *DeadLetterTable) Resolve(letter *db.DeadLetter) error {
+	_, err := d.conn.Exec(
+		context.Background(),
+		fmt.Sprintf("UPDATE %s SET resolved_at = now() WHERE id = $1", d.table),
+		letter.Id,
+	)
+	if err != nil {
+		return &db.Error{Op: "resolve dead letter", Table: letter.Table, Err: err}
+	}
+
+	return nil
+}
+
+func (d *DeadLetterTable) Close() {
+	d.conn.Close()
+}
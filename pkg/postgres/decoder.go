@@ -0,0 +1,144 @@
+package postgres
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// walDecoder turns the XLogData messages sent by a logical decoding output
+// plugin into transactions. decode returns nil while it's still waiting for
+// the rest of a transaction, and an error for messages it can't make sense
+// of. reset throws away any partially received transaction, since the server
+// sends it again from the start after a reconnection. Decoders report the tables whose columns changed in the
+// transactions they return, and update the columns replicated for them.
+type walDecoder interface {
+	plugin() string
+	pluginArgs() []string
+	decode(xld pglogrepl.XLogData) (*db.Transaction, error)
+	reset()
+}
+
+func newWalDecoder(plugin string, publicationName string, tables []string, columnsCache *columnsCache, schemas *tableSchemas) (walDecoder, error) {
+	switch plugin {
+	case "", "wal2json":
+		return &wal2jsonDecoder{tables: tables, columnsCache: columnsCache, schemas: schemas}, nil
+	case "pgoutput":
+		return newPgoutputDecoder(publicationName, columnsCache, schemas), nil
+	default:
+		return nil, fmt.Errorf("unsupported logical decoding plugin %q", plugin)
+	}
+}
+
+type wal2jsonDecoder struct {
+	tables       []string
+	columnsCache *columnsCache
+	schemas      *tableSchemas
+}
+
+func (d *wal2jsonDecoder) plugin() string {
+	return "wal2json"
+}
+
+func (d *wal2jsonDecoder) pluginArgs() []string {
+	configuredTables := ""
+	for i, table := range d.tables {
+		if i > 0 {
+			configuredTables += ","
+		}
+		configuredTables += escapeWal2JsonTableName(table)
+	}
+
+	return []string{
+		fmt.Sprintf("\"add-tables\" '%s'", configuredTables),
+		"\"include-timestamp\" '1'",
+		// Format version 1 leaves truncates out unless asked for them
+		"\"actions\" 'insert,update,delete,truncate'",
+	}
+}
+
+func (d *wal2jsonDecoder) reset() {}
+
+// wal2json (format version 1) sends each transaction as a single message, so
+// every XLogData is a whole transaction. Changesets are made from a copy of the
+// columns, since the next transaction may refresh them while they're read.
+func (d *wal2jsonDecoder) decode(xld pglogrepl.XLogData) (*db.Transaction, error) {
+	data, err := decodeWal2Json(xld.WALData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal wal2json payload at %s: %w", xld.WALStart, err)
+	}
+
+	for _, change := range data.Changes {
+		switch change.Kind {
+		case "insert", "update", "delete", "truncate":
+		default:
+			return nil, fmt.Errorf("unknown wal2json operation %q on %s.%s at %s", change.Kind, change.Schema, change.Table, xld.WALStart)
+		}
+	}
+
+	schemaChanges := d.checkSchemas(data, uint64(xld.WALStart))
+
+	return &db.Transaction{
+		StreamPosition: uint64(xld.WALStart),
+		CommitTime:     parseWal2JsonTimestamp(data.Timestamp),
+		Changesets:     makeChangesets(data, d.columnsCache.all()),
+		SchemaChanges:  schemaChanges,
+	}, nil
+}
+
+// checkSchemas compares the columns of every inserted and updated row with
+// the ones its table had before. Updates leave out unchanged TOASTed values,
+// and deletes only have the replica identity, so neither tells whether
+// columns were dropped. Truncates don't have any columns.
+func (d *wal2jsonDecoder) checkSchemas(data WalData, lsn uint64) []db.SchemaChange {
+	var schemaChanges []db.SchemaChange
+
+	for _, change := range data.Changes {
+		table := fmt.Sprintf("%s.%s", change.Schema, change.Table)
+		if _, ok := d.columnsCache.get(table); !ok || change.Kind == "delete" || change.Kind == "truncate" {
+			continue
+		}
+
+		columns := make([]sourceColumn, len(change.ColumnNames))
+		for i, name := range change.ColumnNames {
+			columns[i] = sourceColumn{name: name}
+			if i < len(change.ColumnTypes) {
+				columns[i].typeName = change.ColumnTypes[i]
+			}
+		}
+
+		if schemaChange := d.schemas.check(table, lsn, columns, change.Kind == "update"); schemaChange != nil {
+			schemaChanges = append(schemaChanges, *schemaChange)
+		}
+	}
+
+	return schemaChanges
+}
+
+// wal2json formats commit timestamps with timestamptz_to_str, so the offset
+// may or may not include minutes depending on the server's timezone.
+func parseWal2JsonTimestamp(timestamp string) time.Time {
+	if timestamp == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04:05.999999-07", "2006-01-02 15:04:05.999999-07:00"} {
+		if t, err := time.Parse(layout, timestamp); err == nil {
+			return t
+		}
+	}
+
+	slog.Warn("Failed to parse wal2json commit timestamp, ignoring...", "timestamp", timestamp)
+	return time.Time{}
+}
+
+// space, single quote, comma, period, asterisk need to be escaped with \
+// https://github.com/eulerto/wal2json/blob/master/README.md#parameters
+func escapeWal2JsonTableName(table string) string {
+	return strings.NewReplacer(" ", `\ `, "'", `\'`, ",", `\,`, "*", `\*`).Replace(table)
+}
@@ -0,0 +1,31 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWal2JsonTimestamp(t *testing.T) {
+	expected := time.Date(2025, 3, 4, 17, 31, 54, 806671000, time.UTC)
+
+	for _, timestamp := range []string{
+		"2025-03-04 17:31:54.806671+00",
+		"2025-03-04 18:31:54.806671+01",
+		"2025-03-04 23:01:54.806671+05:30",
+	} {
+		parsed := parseWal2JsonTimestamp(timestamp)
+		if !parsed.Equal(expected) {
+			t.Errorf("Expected %s to be parsed as %v, got %v", timestamp, expected, parsed)
+		}
+	}
+
+	if !parseWal2JsonTimestamp("").IsZero() {
+		t.Error("Expected an empty timestamp to be parsed as the zero time")
+	}
+}
+
+func TestNewWalDecoderUnsupportedPlugin(t *testing.T) {
+	if _, err := newWalDecoder("decoderbufs", "trucker_test", nil, newColumnsCache(nil), newTableSchemas()); err == nil {
+		t.Error("Expected an error for an unsupported plugin")
+	}
+}
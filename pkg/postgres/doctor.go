@@ -0,0 +1,202 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/doctor"
+)
+
+const diagnoseTimeout = 10 * time.Second
+
+// Diagnose checks that the connection has what trucker needs, without changing
+// anything. Input connections need logical replication, a free replication
+// slot and WAL sender, the decoding plugin, the REPLICATION privilege and
+// access to the input tables. Output connections need the output tables.
+func Diagnose(cfg config.Connection, uniqueId string, inputTables []string, outputTables []string) []doctor.Check {
+	checks := doctor.NewChecks(cfg.Name)
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+
+	conn, err := diagnoseConnect(ctx, cfg)
+	if err != nil {
+		checks.Add("reachable", doctor.Fail, "%v", err)
+		return checks.List()
+	}
+	defer conn.Close(context.Background())
+
+	var serverVersion string
+	if err := conn.QueryRow(ctx, "SHOW server_version").Scan(&serverVersion); err != nil {
+		checks.Add("reachable", doctor.Fail, "%v", err)
+		return checks.List()
+	}
+	checks.Add("reachable", doctor.Pass, "Postgres %s", serverVersion)
+
+	if len(inputTables) > 0 {
+		diagnoseInput(ctx, conn, cfg, uniqueId, inputTables, checks)
+	}
+
+	for _, table := range outputTables {
+		var exists bool
+		err := conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+		switch {
+		case err != nil:
+			checks.Add("output table "+table, doctor.Fail, "%v", err)
+		case !exists:
+			checks.Add("output table "+table, doctor.Fail, "doesn't exist")
+		default:
+			checks.Add("output table "+table, doctor.Pass, "exists")
+		}
+	}
+
+	return checks.List()
+}
+
+func diagnoseInput(ctx context.Context, conn *pgx.Conn, cfg config.Connection, uniqueId string, tables []string, checks *doctor.Checks) {
+	var walLevel string
+	if err := conn.QueryRow(ctx, "SHOW wal_level").Scan(&walLevel); err != nil {
+		checks.Add("wal_level", doctor.Fail, "%v", err)
+	} else if walLevel != "logical" {
+		checks.Add("wal_level", doctor.Fail, "is %s, logical replication needs wal_level = logical", walLevel)
+	} else {
+		checks.Add("wal_level", doctor.Pass, "logical")
+	}
+
+	slotName := PublicationName(cfg, uniqueId)
+	var freeSlots int
+	var slotExists bool
+	err := conn.QueryRow(
+		ctx,
+		`SELECT current_setting('max_replication_slots')::int - (SELECT count(*) FROM pg_replication_slots),
+  EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`,
+		slotName,
+	).Scan(&freeSlots, &slotExists)
+	switch {
+	case err != nil:
+		checks.Add("replication slots", doctor.Fail, "%v", err)
+	case !slotExists && freeSlots < 1:
+		checks.Add("replication slots", doctor.Fail, "none free, raise max_replication_slots")
+	case slotExists && freeSlots < 1:
+		checks.Add("replication slots", doctor.Warn, "slot %s exists, but none are free for the temporary slot used to backfill new tables", slotName)
+	case slotExists:
+		checks.Add("replication slots", doctor.Pass, "slot %s exists, %d free", slotName, freeSlots)
+	default:
+		checks.Add("replication slots", doctor.Pass, "%d free", freeSlots)
+	}
+
+	var freeSenders int
+	err = conn.QueryRow(ctx, "SELECT current_setting('max_wal_senders')::int - (SELECT count(*) FROM pg_stat_replication)").Scan(&freeSenders)
+	switch {
+	case err != nil:
+		checks.Add("wal senders", doctor.Fail, "%v", err)
+	case freeSenders < 1:
+		checks.Add("wal senders", doctor.Fail, "none free, raise max_wal_senders")
+	default:
+		checks.Add("wal senders", doctor.Pass, "%d free", freeSenders)
+	}
+
+	diagnosePlugin(ctx, conn, cfg.Plugin, checks)
+
+	var canReplicate bool
+	err = conn.QueryRow(
+		ctx,
+		`SELECT rolsuper OR rolreplication OR EXISTS (
+  SELECT 1 FROM pg_roles r WHERE r.rolname = 'rds_replication' AND pg_has_role(current_user, r.oid, 'member')
+)
+FROM pg_roles WHERE rolname = current_user`,
+	).Scan(&canReplicate)
+	switch {
+	case err != nil:
+		checks.Add("replication privilege", doctor.Fail, "%v", err)
+	case !canReplicate:
+		checks.Add("replication privilege", doctor.Fail, "%s needs the REPLICATION attribute (ALTER ROLE %s REPLICATION)", cfg.User, cfg.User)
+	default:
+		checks.Add("replication privilege", doctor.Pass, "%s can replicate", cfg.User)
+	}
+
+	for _, table := range tables {
+		var exists, canSelect, owns bool
+		err := conn.QueryRow(
+			ctx,
+			`SELECT to_regclass($1) IS NOT NULL,
+  to_regclass($1) IS NOT NULL AND has_table_privilege(to_regclass($1), 'SELECT'),
+  EXISTS (
+    SELECT 1 FROM pg_class c WHERE c.oid = to_regclass($1)
+      AND (pg_has_role(current_user, c.relowner, 'USAGE') OR (SELECT rolsuper FROM pg_roles WHERE rolname = current_user))
+  )`,
+			table,
+		).Scan(&exists, &canSelect, &owns)
+		switch {
+		case err != nil:
+			checks.Add("input table "+table, doctor.Fail, "%v", err)
+		case !exists:
+			checks.Add("input table "+table, doctor.Fail, "doesn't exist")
+		case !canSelect:
+			checks.Add("input table "+table, doctor.Fail, "%s can't SELECT from it", cfg.User)
+		case !owns:
+			checks.Add("input table "+table, doctor.Fail, "%s has to own it to add it to the publication", cfg.User)
+		default:
+			checks.Add("input table "+table, doctor.Pass, "readable")
+		}
+	}
+}
+
+// diagnosePlugin checks that the decoding plugin is installed. pgoutput is
+// built into Postgres, but wal2json is a separate library, which can only be
+// found by listing Postgres' library directory (which needs extra privileges)
+// or by finding a slot that already uses it.
+func diagnosePlugin(ctx context.Context, conn *pgx.Conn, plugin string, checks *doctor.Checks) {
+	if plugin != "wal2json" {
+		checks.Add("plugin", doctor.Pass, "%s is built in", plugin)
+		return
+	}
+
+	var inUse bool
+	err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE plugin = 'wal2json')").Scan(&inUse)
+	if err == nil && inUse {
+		checks.Add("plugin", doctor.Pass, "wal2json is used by a replication slot")
+		return
+	}
+
+	var installed bool
+	err = conn.QueryRow(
+		ctx,
+		`SELECT EXISTS (
+  SELECT 1 FROM pg_ls_dir((SELECT setting FROM pg_config WHERE name = 'PKGLIBDIR')) f WHERE f LIKE 'wal2json%'
+)`,
+	).Scan(&installed)
+	switch {
+	case err != nil:
+		checks.Add("plugin", doctor.Warn, "unable to tell if wal2json is installed: %v", err)
+	case !installed:
+		checks.Add("plugin", doctor.Fail, "wal2json isn't installed, install it or use plugin: pgoutput")
+	default:
+		checks.Add("plugin", doctor.Pass, "wal2json is installed")
+	}
+}
+
+func diagnoseConnect(ctx context.Context, cfg config.Connection) (*pgx.Conn, error) {
+	port := cfg.Port
+	if port == 0 {
+		port = 5432
+	}
+
+	connString := fmt.Sprintf(
+		"postgres://%s:%s@%s:%d/%s",
+		url.QueryEscape(cfg.User),
+		url.QueryEscape(cfg.Pass),
+		url.QueryEscape(cfg.Host),
+		port,
+		url.QueryEscape(cfg.Database),
+	)
+	if cfg.Ssl != "" {
+		connString += "?sslmode=" + url.QueryEscape(cfg.Ssl)
+	}
+
+	return pgx.Connect(ctx, connString)
+}
@@ -0,0 +1,104 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// Migrator runs each migration and records its version in a single
+// transaction, so a failed migration leaves no changes behind.
+type Migrator struct {
+	table string
+	conn  *pgxpool.Pool
+}
+
+func NewMigrator(cfg config.Connection, uniqueId string) (*Migrator, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		table: fmt.Sprintf(`"trucker_schema_migrations%s"`, uniqueId),
+		conn:  conn,
+	}, nil
+}
+
+func (m *Migrator) Setup() error {
+	_, err := m.conn.Exec(context.Background(), fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+  version text PRIMARY KEY,
+  applied_at timestamptz NOT NULL DEFAULT now()
+)`, m.table))
+
+	if err != nil {
+		return &db.Error{Op: "setup migrations", Err: err}
+	}
+
+	return nil
+}
+
+func (m *Migrator) Applied() ([]string, error) {
+	rows, err := m.conn.Query(context.Background(), fmt.Sprintf("SELECT version FROM %s ORDER BY version", m.table))
+	if err != nil {
+		return nil, &db.Error{Op: "read migrations", Err: err}
+	}
+	defer rows.Close()
+
+	versions := make([]string, 0)
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, &db.Error{Op: "read migrations", Err: err}
+		}
+		versions = append(versions, version)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, &db.Error{Op: "read migrations", Err: err}
+	}
+
+	return versions, nil
+}
+
+func (m *Migrator) Up(version string, sql string) error {
+	return m.migrate("migrate up", sql, fmt.Sprintf("INSERT INTO %s (version) VALUES ($1)", m.table), version)
+}
+
+func (m *Migrator) Down(version string, sql string) error {
+	return m.migrate("migrate down", sql, fmt.Sprintf("DELETE FROM %s WHERE version = $1", m.table), version)
+}
+
+func (m *Migrator) Close() {
+	m.conn.Close()
+}
+
+func (m *Migrator) migrate(op string, sql string, trackingSql string, version string) error {
+	ctx := context.Background()
+
+	tx, err := m.conn.Begin(ctx)
+	if err != nil {
+		return &db.Error{Op: op, Err: err}
+	}
+	defer tx.Rollback(ctx)
+
+	// Without arguments pgx uses the simple protocol, which allows a migration
+	// to have several statements.
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return &db.Error{Op: op, Query: sql, Err: err}
+	}
+
+	if _, err := tx.Exec(ctx, trackingSql, version); err != nil {
+		return &db.Error{Op: op, Err: err}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return &db.Error{Op: op, Err: err}
+	}
+
+	return nil
+}
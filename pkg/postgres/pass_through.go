@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/logging"
+)
+
+// passThroughSql is what a truck without an input.sql backfills with.
+const passThroughSql = "SELECT * FROM {{ .rows }}"
+
+// PassThroughReader is the reader for trucks without an input.sql. It hands
+// changesets over to the writer as they came from the replication stream,
+// old__* columns included, without a round trip to the input database.
+//
+// wal2json sends most values as text (and numbers as JSON numbers), so they're
+// decoded into the same Go types an input query would have returned.
+type PassThroughReader struct {
+	typeMap *pgtype.Map
+	logger  *slog.Logger
+}
+
+func NewPassThroughReader(truckName string) *PassThroughReader {
+	logger := logging.ForTruck(truckName)
+	logger.Info("No input.sql, passing changes straight to output.sql")
+
+	return &PassThroughReader{typeMap: pgtype.NewMap(), logger: logger}
+}
+
+func (r *PassThroughReader) Read(changeset *db.Changeset) (*db.ChanChangeset, error) {
+	if len(changeset.Columns) == 0 || len(changeset.Rows) == 0 {
+		return nil, nil
+	}
+
+	rows := make([][]any, len(changeset.Rows))
+	for i, row := range changeset.Rows {
+		rows[i] = make([]any, len(row))
+
+		for j, value := range row {
+			decoded, err := r.decodeValue(changeset.Columns[j], value)
+			if err != nil {
+				return nil, &db.Error{Op: "read", Table: changeset.Table, Err: fmt.Errorf("column %s: %w", changeset.Columns[j].Name, err)}
+			}
+			rows[i][j] = decoded
+		}
+	}
+
+	result := &db.ChanChangeset{
+		Operation: changeset.Operation,
+		Table:     changeset.Table,
+		Columns:   changeset.Columns,
+		Rows:      make(chan [][]any, 1),
+	}
+	result.Rows <- rows
+	close(result.Rows)
+
+	return result, nil
+}
+
+func (r *PassThroughReader) Close() {}
+
+func (r *PassThroughReader) decodeValue(col db.Column, value any) (any, error) {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case json.Number:
+		text = v.String()
+	default:
+		// NULLs, booleans, and values pgoutput already decoded
+		return value, nil
+	}
+
+	typeNames := []string{dbTypeToPgType(col.Type)}
+	if col.Type == db.DateTime {
+		// The column could be a timestamp or a timestamptz, and only the
+		// latter's text has a time zone
+		typeNames = []string{"timestamptz", "timestamp"}
+	}
+
+	var err error
+	for _, typeName := range typeNames {
+		// pgx knows array types by their internal names, like _text for text[]
+		if elem, isArray := strings.CutSuffix(typeName, "[]"); isArray {
+			typeName = "_" + elem
+		}
+
+		pgType, ok := r.typeMap.TypeForName(typeName)
+		if !ok {
+			return text, nil
+		}
+
+		var decoded any
+		decoded, err = pgType.Codec.DecodeValue(r.typeMap, pgType.OID, pgtype.TextFormatCode, []byte(text))
+		if err == nil {
+			return decoded, nil
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,79 @@
+package postgres
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+func TestPassThroughReader(t *testing.T) {
+	reader := NewPassThroughReader("whiskies")
+	columns := changesetCols([]db.Column{
+		{Name: "id", Type: db.Int32},
+		{Name: "name", Type: db.String},
+		{Name: "bottled_at", Type: db.DateTime},
+		{Name: "tags", Type: db.StringArray},
+	})
+
+	// The way wal2json sends an update with REPLICA IDENTITY DEFAULT
+	changeset := &db.Changeset{
+		Table:     "public.whiskies",
+		Operation: db.Update,
+		Columns:   columns,
+		Rows: [][]any{
+			{json.Number("7"), "Talisker", "2024-05-01 12:30:00+00", "{islay,peated}", json.Number("7"), nil, nil, nil},
+		},
+	}
+
+	result, err := reader.Read(changeset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Table != "public.whiskies" || result.Operation != db.Update || len(result.Columns) != 8 {
+		t.Errorf("Expected the changeset's table, operation and old__* columns, got %+v", result)
+	}
+
+	var rows [][]any
+	for batch := range result.Rows {
+		rows = append(rows, batch...)
+	}
+	if len(rows) != 1 {
+		t.Fatal("Expected 1 row, got", len(rows))
+	}
+	row := rows[0]
+
+	if row[0] != int32(7) || row[4] != int32(7) {
+		t.Errorf("Expected id and old__id to be int32(7), got %#v and %#v", row[0], row[4])
+	}
+
+	if row[1] != "Talisker" || row[5] != nil {
+		t.Errorf("Expected name = Talisker and old__name = nil, got %#v and %#v", row[1], row[5])
+	}
+
+	bottledAt, ok := row[2].(time.Time)
+	if !ok || !bottledAt.Equal(time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected bottled_at to be decoded as a time, got %#v", row[2])
+	}
+
+	tags, ok := row[3].([]any)
+	if !ok || len(tags) != 2 || tags[0] != "islay" || tags[1] != "peated" {
+		t.Errorf("Expected tags to be decoded as an array, got %#v", row[3])
+	}
+}
+
+func TestPassThroughReaderRejectsBadValues(t *testing.T) {
+	reader := NewPassThroughReader("whiskies")
+	changeset := &db.Changeset{
+		Table:     "public.whiskies",
+		Operation: db.Insert,
+		Columns:   []db.Column{{Name: "age", Type: db.Int32}},
+		Rows:      [][]any{{"twelve"}},
+	}
+
+	if _, err := reader.Read(changeset); err == nil {
+		t.Error("Expected an error for a value that isn't an int4")
+	}
+}
@@ -0,0 +1,295 @@
+package postgres
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+const pgoutputKeyColumnFlag = 1
+
+// pgoutputDecoder assembles the per-message stream sent by the pgoutput plugin
+// (BEGIN, RELATION, INSERT/UPDATE/DELETE/TRUNCATE..., COMMIT) into whole
+// transactions.
+type pgoutputDecoder struct {
+	publicationName string
+	columnsCache    *columnsCache
+	schemas         *tableSchemas
+	schemaChanges   []db.SchemaChange
+	relations       map[uint32]*pglogrepl.RelationMessage
+	// By relation, where each of the replicated columns of its table is in
+	// the relation's tuples (-1 if it isn't there)
+	columnIdxs    map[uint32][]int
+	typeMap       *pgtype.Map
+	changesets    []*db.Changeset
+	inTransaction bool
+}
+
+func newPgoutputDecoder(publicationName string, columnsCache *columnsCache, schemas *tableSchemas) *pgoutputDecoder {
+	return &pgoutputDecoder{
+		publicationName: publicationName,
+		columnsCache:    columnsCache,
+		schemas:         schemas,
+		relations:       make(map[uint32]*pglogrepl.RelationMessage),
+		columnIdxs:      make(map[uint32][]int),
+		typeMap:         pgtype.NewMap(),
+	}
+}
+
+func (d *pgoutputDecoder) plugin() string {
+	return "pgoutput"
+}
+
+func (d *pgoutputDecoder) pluginArgs() []string {
+	return []string{
+		"proto_version '1'",
+		fmt.Sprintf("publication_names '\"%s\"'", d.publicationName),
+	}
+}
+
+// reset keeps the schema changes the partial transaction had, since they
+// won't show up as changes when the server sends its relation messages again.
+func (d *pgoutputDecoder) reset() {
+	d.inTransaction = false
+	d.changesets = nil
+}
+
+func (d *pgoutputDecoder) decode(xld pglogrepl.XLogData) (*db.Transaction, error) {
+	msg, err := pglogrepl.Parse(xld.WALData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pgoutput message at %s: %w", xld.WALStart, err)
+	}
+
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		d.relations[msg.RelationID] = msg
+		d.checkSchema(msg, uint64(xld.WALStart))
+		d.mapColumns(msg)
+	case *pglogrepl.BeginMessage:
+		d.inTransaction = true
+		d.changesets = make([]*db.Changeset, 0, 1)
+	case *pglogrepl.InsertMessage:
+		err = d.appendRow(msg.RelationID, db.Insert, msg.Tuple, nil)
+	case *pglogrepl.UpdateMessage:
+		oldTuple := msg.OldTuple
+		if oldTuple == nil {
+			// The key didn't change, so pgoutput didn't bother sending it. Use
+			// the key columns from the new tuple to keep old__* key columns
+			// populated like wal2json does.
+			oldTuple = d.keyTuple(msg.RelationID, msg.NewTuple)
+		}
+		err = d.appendRow(msg.RelationID, db.Update, msg.NewTuple, oldTuple)
+	case *pglogrepl.DeleteMessage:
+		err = d.appendRow(msg.RelationID, db.Delete, nil, msg.OldTuple)
+	case *pglogrepl.TruncateMessage:
+		for _, relationID := range msg.RelationIDs {
+			if err = d.appendTruncate(relationID); err != nil {
+				break
+			}
+		}
+	case *pglogrepl.CommitMessage:
+		if !d.inTransaction {
+			return nil, fmt.Errorf("received pgoutput COMMIT at %s without a matching BEGIN", msg.CommitLSN)
+		}
+
+		transaction := &db.Transaction{
+			StreamPosition: uint64(xld.WALStart),
+			CommitTime:     msg.CommitTime,
+			Changesets:     slices.Values(d.changesets),
+			SchemaChanges:  d.schemaChanges,
+		}
+		d.inTransaction = false
+		d.changesets = nil
+		d.schemaChanges = nil
+
+		return transaction, nil
+	default:
+		// TYPE, ORIGIN and logical decoding messages aren't replicated to
+		// trucks.
+	}
+
+	return nil, err
+}
+
+// mapColumns works out where the replicated columns of a relation's table are
+// in its tuples, once for every relation message rather than for every row.
+// The replicated columns are refreshed before this when the relation message
+// comes with a schema change.
+func (d *pgoutputDecoder) mapColumns(rel *pglogrepl.RelationMessage) {
+	table := fmt.Sprintf("%s.%s", rel.Namespace, rel.RelationName)
+	tableCols, ok := d.columnsCache.get(table)
+	if !ok {
+		delete(d.columnIdxs, rel.RelationID)
+		return
+	}
+
+	idxs := make([]int, len(tableCols))
+	for i, col := range tableCols {
+		idxs[i] = slices.IndexFunc(rel.Columns, func(c *pglogrepl.RelationMessageColumn) bool {
+			return c.Name == col.Name
+		})
+	}
+	d.columnIdxs[rel.RelationID] = idxs
+}
+
+func (d *pgoutputDecoder) appendRow(relationID uint32, operation uint8, newTuple *pglogrepl.TupleData, oldTuple *pglogrepl.TupleData) error {
+	rel, ok := d.relations[relationID]
+	if !ok {
+		return fmt.Errorf("received pgoutput change for unknown relation %d", relationID)
+	}
+
+	table := fmt.Sprintf("%s.%s", rel.Namespace, rel.RelationName)
+	tableCols, ok := d.columnsCache.get(table)
+	if !ok {
+		// Published for trucks that aren't running
+		return nil
+	}
+	numCols := len(tableCols)
+
+	columnIdxs := d.columnIdxs[relationID]
+	if len(columnIdxs) != numCols {
+		// The replicated columns changed since the relation message
+		d.mapColumns(rel)
+		columnIdxs = d.columnIdxs[relationID]
+	}
+
+	var changeset *db.Changeset
+	if len(d.changesets) > 0 {
+		changeset = d.changesets[len(d.changesets)-1]
+	}
+
+	// The table's columns may have changed since the last changeset started
+	if changeset == nil || changeset.Table != table || changeset.Operation != operation ||
+		len(changeset.Columns) != numCols*2 || !slices.Equal(changeset.Columns[:numCols], tableCols) {
+		changeset = &db.Changeset{
+			Table:     table,
+			Operation: operation,
+			Columns:   changesetCols(tableCols),
+			Rows:      make([][]any, 0, 1),
+		}
+		d.changesets = append(d.changesets, changeset)
+	}
+
+	row := make([]any, numCols*2)
+
+	for i, relColIdx := range columnIdxs {
+		if relColIdx < 0 {
+			continue
+		}
+
+		var err error
+		dataType := rel.Columns[relColIdx].DataType
+		if newTuple != nil && relColIdx < len(newTuple.Columns) {
+			if row[i], err = d.decodeColumn(newTuple.Columns[relColIdx], dataType); err != nil {
+				return fmt.Errorf("%s.%s: %w", table, tableCols[i].Name, err)
+			}
+		}
+		if oldTuple != nil && relColIdx < len(oldTuple.Columns) {
+			if row[i+numCols], err = d.decodeColumn(oldTuple.Columns[relColIdx], dataType); err != nil {
+				return fmt.Errorf("%s.%s: %w", table, tableCols[i].Name, err)
+			}
+		}
+
+		// Updates leave out TOASTed values that didn't change. With REPLICA
+		// IDENTITY FULL the old value is there to stand in.
+		if newTuple != nil && relColIdx < len(newTuple.Columns) && newTuple.Columns[relColIdx].DataType == pglogrepl.TupleDataTypeToast {
+			if oldTuple != nil && relColIdx < len(oldTuple.Columns) && oldTuple.Columns[relColIdx].DataType == pglogrepl.TupleDataTypeText {
+				row[i] = row[i+numCols]
+			} else {
+				changeset.MarkUnchanged(len(changeset.Rows), i)
+			}
+		}
+	}
+
+	changeset.Rows = append(changeset.Rows, row)
+	return nil
+}
+
+// appendTruncate adds a changeset without rows for a truncated table. A
+// single TRUNCATE can empty several tables, and the server sends a relation
+// message for each of them first.
+func (d *pgoutputDecoder) appendTruncate(relationID uint32) error {
+	rel, ok := d.relations[relationID]
+	if !ok {
+		return fmt.Errorf("received pgoutput truncate for unknown relation %d", relationID)
+	}
+
+	table := fmt.Sprintf("%s.%s", rel.Namespace, rel.RelationName)
+	tableCols, ok := d.columnsCache.get(table)
+	if !ok {
+		// Published for trucks that aren't running
+		return nil
+	}
+
+	d.changesets = append(d.changesets, &db.Changeset{
+		Table:     table,
+		Operation: db.Truncate,
+		Columns:   changesetCols(tableCols),
+		Rows:      make([][]any, 0),
+	})
+	return nil
+}
+
+// checkSchema compares the columns in a relation message with the ones the
+// table had before. The server sends one before the first change to a table
+// after connecting, and again whenever the table changes.
+func (d *pgoutputDecoder) checkSchema(rel *pglogrepl.RelationMessage, lsn uint64) {
+	table := fmt.Sprintf("%s.%s", rel.Namespace, rel.RelationName)
+	if _, ok := d.columnsCache.get(table); !ok {
+		return
+	}
+
+	columns := make([]sourceColumn, len(rel.Columns))
+	for i, col := range rel.Columns {
+		columns[i] = sourceColumn{name: col.Name, typeOid: col.DataType, typeMod: col.TypeModifier}
+	}
+
+	if change := d.schemas.check(table, lsn, columns, false); change != nil {
+		d.schemaChanges = append(d.schemaChanges, *change)
+	}
+}
+
+func (d *pgoutputDecoder) keyTuple(relationID uint32, tuple *pglogrepl.TupleData) *pglogrepl.TupleData {
+	rel, ok := d.relations[relationID]
+	if !ok || tuple == nil {
+		return nil
+	}
+
+	keyTuple := &pglogrepl.TupleData{
+		ColumnNum: tuple.ColumnNum,
+		Columns:   make([]*pglogrepl.TupleDataColumn, len(tuple.Columns)),
+	}
+
+	for i, col := range tuple.Columns {
+		if i < len(rel.Columns) && rel.Columns[i].Flags&pgoutputKeyColumnFlag != 0 {
+			keyTuple.Columns[i] = col
+		} else {
+			keyTuple.Columns[i] = &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeNull}
+		}
+	}
+
+	return keyTuple
+}
+
+func (d *pgoutputDecoder) decodeColumn(col *pglogrepl.TupleDataColumn, dataType uint32) (any, error) {
+	switch col.DataType {
+	case pglogrepl.TupleDataTypeText:
+		if pgType, ok := d.typeMap.TypeForOID(dataType); ok {
+			value, err := pgType.Codec.DecodeValue(d.typeMap, dataType, pgtype.TextFormatCode, col.Data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode pgoutput value %q of type %d: %w", col.Data, dataType, err)
+			}
+			return value, nil
+		}
+
+		// Unknown types (enums, extension types, etc) go through as text
+		return string(col.Data), nil
+	default:
+		// NULL, or unchanged TOASTed values that pgoutput doesn't send
+		return nil, nil
+	}
+}
@@ -0,0 +1,291 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+func TestPgoutputDecode(t *testing.T) {
+	d := pgoutputTestSetup()
+
+	if tx := mustDecode(t, d, pgoutputBegin(100)); tx != nil {
+		t.Fatal("Expected no transaction after BEGIN, got", tx)
+	}
+	mustDecode(t, d, pgoutputRelation())
+	mustDecode(t, d, pgoutputChange('I', 16384, 'N', [][]byte{[]byte("6"), []byte("Jamaica")}))
+	mustDecode(t, d, pgoutputChange('I', 16384, 'N', [][]byte{[]byte("7"), []byte("Japan")}))
+	mustDecode(t, d, pgoutputChange('D', 16384, 'K', [][]byte{[]byte("1"), nil}))
+
+	tx := mustDecode(t, d, pgoutputCommit(200))
+	if tx == nil {
+		t.Fatal("Expected a transaction after COMMIT")
+	}
+
+	if tx.StreamPosition != 200 {
+		t.Errorf("Expected stream position to be 200, got %d", tx.StreamPosition)
+	}
+
+	expectedCommitTime := time.Date(2000, 1, 1, 0, 0, 1, 0, time.UTC)
+	if !tx.CommitTime.Equal(expectedCommitTime) {
+		t.Errorf("Expected commit time to be %v, got %v", expectedCommitTime, tx.CommitTime)
+	}
+
+	changesets := make([]*db.Changeset, 0, 2)
+	for changeset := range tx.Changesets {
+		changesets = append(changesets, changeset)
+	}
+
+	if len(changesets) != 2 {
+		t.Fatal("Expected 2 changesets, got", len(changesets))
+	}
+
+	expectedCols := []db.Column{
+		{Name: "id", Type: db.Int32},
+		{Name: "name", Type: db.String},
+		{Name: "old__id", Type: db.Int32},
+		{Name: "old__name", Type: db.String},
+	}
+
+	insert := changesets[0]
+	if insert.Table != "public.countries" || insert.Operation != db.Insert {
+		t.Errorf("Expected insert on public.countries, got %s on %s", db.OperationStr(insert.Operation), insert.Table)
+	}
+	if !reflect.DeepEqual(insert.Columns, expectedCols) {
+		t.Errorf("Expected columns to be %v but got %v", expectedCols, insert.Columns)
+	}
+	expectedRows := [][]any{
+		{int32(6), "Jamaica", nil, nil},
+		{int32(7), "Japan", nil, nil},
+	}
+	if !reflect.DeepEqual(insert.Rows, expectedRows) {
+		t.Errorf("Expected rows to be %v but got %v", expectedRows, insert.Rows)
+	}
+
+	del := changesets[1]
+	if del.Operation != db.Delete {
+		t.Errorf("Expected delete, got %s", db.OperationStr(del.Operation))
+	}
+	expectedRows = [][]any{{nil, nil, int32(1), nil}}
+	if !reflect.DeepEqual(del.Rows, expectedRows) {
+		t.Errorf("Expected rows to be %v but got %v", expectedRows, del.Rows)
+	}
+}
+
+func TestPgoutputDecodeUpdateWithoutOldTuple(t *testing.T) {
+	d := pgoutputTestSetup()
+
+	mustDecode(t, d, pgoutputBegin(100))
+	mustDecode(t, d, pgoutputRelation())
+	mustDecode(t, d, pgoutputChange('U', 16384, 'N', [][]byte{[]byte("6"), []byte("Jameca")}))
+	tx := mustDecode(t, d, pgoutputCommit(200))
+
+	for changeset := range tx.Changesets {
+		expectedRows := [][]any{{int32(6), "Jameca", int32(6), nil}}
+		if !reflect.DeepEqual(changeset.Rows, expectedRows) {
+			t.Errorf("Expected rows to be %v but got %v", expectedRows, changeset.Rows)
+		}
+	}
+}
+
+func TestPgoutputDecodeUnchangedToast(t *testing.T) {
+	d := pgoutputTestSetup()
+
+	mustDecode(t, d, pgoutputBegin(100))
+	mustDecode(t, d, pgoutputRelation())
+	mustDecode(t, d, pgoutputToastUpdate(false))
+	mustDecode(t, d, pgoutputToastUpdate(true))
+	tx := mustDecode(t, d, pgoutputCommit(200))
+
+	for changeset := range tx.Changesets {
+		expectedRows := [][]any{
+			{int32(6), nil, int32(6), nil},
+			{int32(6), "Jamaica", int32(6), "Jamaica"},
+		}
+		if !reflect.DeepEqual(changeset.Rows, expectedRows) {
+			t.Errorf("Expected rows to be %v but got %v", expectedRows, changeset.Rows)
+		}
+
+		// With REPLICA IDENTITY FULL the old value stands in for the new one
+		if !changeset.IsUnchanged(0, 1) || changeset.IsUnchanged(1, 1) {
+			t.Errorf("Expected only the first row's name to be unchanged, got %v", changeset.Unchanged)
+		}
+	}
+}
+
+func TestPgoutputDecodeTruncate(t *testing.T) {
+	d := pgoutputTestSetup()
+
+	mustDecode(t, d, pgoutputBegin(100))
+	mustDecode(t, d, pgoutputRelation())
+	mustDecode(t, d, pgoutputTruncate(16384))
+	mustDecode(t, d, pgoutputChange('I', 16384, 'N', [][]byte{[]byte("6"), []byte("Jamaica")}))
+	tx := mustDecode(t, d, pgoutputCommit(200))
+
+	changesets := make([]*db.Changeset, 0, 2)
+	for changeset := range tx.Changesets {
+		changesets = append(changesets, changeset)
+	}
+
+	if len(changesets) != 2 {
+		t.Fatal("Expected 2 changesets, got", len(changesets))
+	}
+	if truncate := changesets[0]; truncate.Table != "public.countries" || truncate.Operation != db.Truncate || len(truncate.Rows) > 0 {
+		t.Errorf("Expected truncate of public.countries without rows, got %s on %s with %d rows", db.OperationStr(truncate.Operation), truncate.Table, len(truncate.Rows))
+	}
+	if insert := changesets[1]; insert.Operation != db.Insert || len(insert.Rows) != 1 {
+		t.Errorf("Expected insert with 1 row after the truncate, got %s with %d rows", db.OperationStr(insert.Operation), len(insert.Rows))
+	}
+}
+
+func TestPgoutputResetDiscardsPartialTransaction(t *testing.T) {
+	d := pgoutputTestSetup()
+
+	mustDecode(t, d, pgoutputBegin(100))
+	mustDecode(t, d, pgoutputRelation())
+	mustDecode(t, d, pgoutputChange('I', 16384, 'N', [][]byte{[]byte("6"), []byte("Jamaica")}))
+	d.reset()
+
+	// After reconnecting the server sends the whole transaction again
+	mustDecode(t, d, pgoutputBegin(100))
+	mustDecode(t, d, pgoutputChange('I', 16384, 'N', [][]byte{[]byte("6"), []byte("Jamaica")}))
+	tx := mustDecode(t, d, pgoutputCommit(200))
+
+	rows := 0
+	for changeset := range tx.Changesets {
+		rows += len(changeset.Rows)
+	}
+	if rows != 1 {
+		t.Error("Expected 1 row after reset, got", rows)
+	}
+}
+
+func TestPgoutputDecodeErrors(t *testing.T) {
+	d := pgoutputTestSetup()
+
+	if _, err := d.decode(pglogrepl.XLogData{WALStart: 100, WALData: []byte{'?'}}); err == nil {
+		t.Error("Expected an error for a message pgoutput doesn't send")
+	}
+
+	mustDecode(t, d, pgoutputBegin(100))
+	if _, err := d.decode(pgoutputChange('I', 16384, 'N', [][]byte{[]byte("6"), []byte("Jamaica")})); err == nil {
+		t.Error("Expected an error for a change to a relation the server didn't describe")
+	}
+
+	mustDecode(t, d, pgoutputRelation())
+	if _, err := d.decode(pgoutputChange('I', 16384, 'N', [][]byte{[]byte("six"), []byte("Jamaica")})); err == nil {
+		t.Error("Expected an error for a value that doesn't decode as its type")
+	}
+}
+
+func pgoutputTestSetup() *pgoutputDecoder {
+	return newPgoutputDecoder("trucker_test", newColumnsCache(map[string][]db.Column{
+		"public.countries": {
+			{Name: "id", Type: db.Int32},
+			{Name: "name", Type: db.String},
+		},
+	}), newTableSchemas())
+}
+
+// mustDecode decodes a message, failing the test if the decoder can't.
+func mustDecode(t *testing.T, d walDecoder, xld pglogrepl.XLogData) *db.Transaction {
+	t.Helper()
+	tx, err := d.decode(xld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func pgoutputBegin(finalLSN uint64) pglogrepl.XLogData {
+	buf := []byte{'B'}
+	buf = binary.BigEndian.AppendUint64(buf, finalLSN)
+	buf = binary.BigEndian.AppendUint64(buf, 0)
+	buf = binary.BigEndian.AppendUint32(buf, 1)
+	return pglogrepl.XLogData{WALStart: pglogrepl.LSN(finalLSN), WALData: buf}
+}
+
+func pgoutputCommit(commitLSN uint64) pglogrepl.XLogData {
+	buf := []byte{'C', 0}
+	buf = binary.BigEndian.AppendUint64(buf, commitLSN)
+	buf = binary.BigEndian.AppendUint64(buf, commitLSN+1)
+	buf = binary.BigEndian.AppendUint64(buf, 1000000) // microseconds since 2000-01-01
+	return pglogrepl.XLogData{WALStart: pglogrepl.LSN(commitLSN), WALData: buf}
+}
+
+func pgoutputRelation() pglogrepl.XLogData {
+	buf := []byte{'R'}
+	buf = binary.BigEndian.AppendUint32(buf, 16384)
+	buf = append(buf, "public\x00countries\x00"...)
+	buf = append(buf, 'd')
+	buf = binary.BigEndian.AppendUint16(buf, 2)
+	buf = append(buf, pgoutputKeyColumnFlag)
+	buf = append(buf, "id\x00"...)
+	buf = binary.BigEndian.AppendUint32(buf, pgtype.Int4OID)
+	buf = binary.BigEndian.AppendUint32(buf, 0xffffffff)
+	buf = append(buf, 0)
+	buf = append(buf, "name\x00"...)
+	buf = binary.BigEndian.AppendUint32(buf, pgtype.TextOID)
+	buf = binary.BigEndian.AppendUint32(buf, 0xffffffff)
+	return pglogrepl.XLogData{WALData: buf}
+}
+
+// pgoutputToastUpdate builds an UPDATE that leaves the name out as an
+// unchanged TOASTed value, with the whole old row (like with REPLICA IDENTITY
+// FULL) or without it.
+func pgoutputToastUpdate(withOldTuple bool) pglogrepl.XLogData {
+	buf := []byte{'U'}
+	buf = binary.BigEndian.AppendUint32(buf, 16384)
+	if withOldTuple {
+		buf = append(buf, 'O')
+		buf = binary.BigEndian.AppendUint16(buf, 2)
+		buf = append(buf, 't')
+		buf = binary.BigEndian.AppendUint32(buf, 1)
+		buf = append(buf, '6')
+		buf = append(buf, 't')
+		buf = binary.BigEndian.AppendUint32(buf, 7)
+		buf = append(buf, "Jamaica"...)
+	}
+	buf = append(buf, 'N')
+	buf = binary.BigEndian.AppendUint16(buf, 2)
+	buf = append(buf, 't')
+	buf = binary.BigEndian.AppendUint32(buf, 1)
+	buf = append(buf, '6')
+	buf = append(buf, 'u')
+	return pglogrepl.XLogData{WALData: buf}
+}
+
+func pgoutputTruncate(relationIDs ...uint32) pglogrepl.XLogData {
+	buf := []byte{'T'}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(relationIDs)))
+	buf = append(buf, 0)
+	for _, relationID := range relationIDs {
+		buf = binary.BigEndian.AppendUint32(buf, relationID)
+	}
+	return pglogrepl.XLogData{WALData: buf}
+}
+
+// pgoutputChange builds an INSERT/UPDATE/DELETE message with a single tuple.
+// nil values are encoded as NULLs.
+func pgoutputChange(msgType byte, relationID uint32, tupleType byte, values [][]byte) pglogrepl.XLogData {
+	buf := []byte{msgType}
+	buf = binary.BigEndian.AppendUint32(buf, relationID)
+	buf = append(buf, tupleType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			buf = append(buf, 'n')
+			continue
+		}
+		buf = append(buf, 't')
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+		buf = append(buf, value...)
+	}
+	return pglogrepl.XLogData{WALData: buf}
+}
@@ -0,0 +1,257 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tonyfg/trucker/pkg/logging"
+)
+
+// Publication column lists and row filters need Postgres 15
+const publicationFiltersMinVersion = 150000
+
+// publicationTable is how a table should be published: with a column list
+// (nil for every column) and a row filter (empty for every row).
+type publicationTable struct {
+	columns []string
+	where   string
+}
+
+// publicationTables returns how each table should be published, so that
+// columns and rows no truck reads never leave the server. Postgres refuses to
+// publish updates and deletes for a table whose column list leaves out part of
+// its replica identity, or whose row filter uses columns outside of it, so
+// those are only pushed down when they don't. Either way, trucks still filter
+// changes after decoding.
+//
+// Column lists and row filters only apply to pgoutput and Postgres 15+, which
+// is what the second return value reports.
+func (rc *ReplicationClient) publicationTables() (map[string]publicationTable, bool) {
+	if rc.decoder.plugin() != "pgoutput" {
+		return nil, false
+	}
+
+	var serverVersion int
+	err := rc.query1("select current_setting('server_version_num')::int").Scan(&serverVersion)
+	if err != nil {
+		rc.logger.Warn("Unable to look up server version, publishing every column and row", logging.Err(err))
+		return nil, false
+	}
+	if serverVersion < publicationFiltersMinVersion {
+		return nil, false
+	}
+
+	publicationTables := make(map[string]publicationTable)
+	for _, table := range rc.tables {
+		replicated, _ := rc.columnsCache.get(table)
+		columns := make([]string, len(replicated))
+		for i, col := range replicated {
+			columns[i] = col.Name
+		}
+
+		_, identityColumns, tableColumns, err := rc.replicaIdentity(table)
+		if err != nil {
+			rc.logger.Warn("Unable to look up replica identity, publishing every column and row", "table", table, logging.Err(err))
+			continue
+		}
+
+		var pt publicationTable
+
+		if len(columns) < len(tableColumns) {
+			missing := slices.DeleteFunc(slices.Clone(identityColumns), func(col string) bool { return slices.Contains(columns, col) })
+			if len(missing) == 0 {
+				pt.columns = columns
+			} else {
+				rc.logger.Info("Replica identity columns aren't replicated, publishing every column", "table", table, "columns", missing)
+			}
+		}
+
+		if where := rc.combinedWhere(table); where != "" {
+			missing := slices.DeleteFunc(referencedColumns(where, tableColumns), func(col string) bool { return slices.Contains(identityColumns, col) })
+			if len(missing) == 0 {
+				pt.where = where
+			} else {
+				rc.logger.Info("Row filter uses columns outside of the replica identity, publishing every row", "table", table, "columns", missing)
+			}
+		}
+
+		publicationTables[table] = pt
+	}
+
+	return publicationTables, true
+}
+
+// combinedWhere returns the row filter matching the rows of the table that any
+// truck reads, or an empty string if a truck reads all of them.
+func (rc *ReplicationClient) combinedWhere(table string) string {
+	conditions := make([]string, 0, len(rc.filters[table]))
+	for _, filter := range rc.filters[table] {
+		where := strings.TrimSpace(filter.Where)
+		if where == "" {
+			return ""
+		}
+		if !slices.Contains(conditions, where) {
+			conditions = append(conditions, where)
+		}
+	}
+
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+
+	for i, where := range conditions {
+		conditions[i] = "(" + where + ")"
+	}
+	return strings.Join(conditions, " or ")
+}
+
+// PublishedWhere returns the row filter the table is published with, or an
+// empty string if every row is published. Only set once Setup is done.
+func (rc *ReplicationClient) PublishedWhere(table string) string {
+	return rc.rowFilters[table]
+}
+
+// updatePublicationTable publishes an already published table again when its
+// column list or row filter isn't the one it should be. Row filters can't be
+// compared with the ones Postgres keeps (which are reformatted), so tables
+// with one are always published again.
+func (rc *ReplicationClient) updatePublicationTable(table string, pt publicationTable) error {
+	var hasList, hasFilter bool
+	var published []string
+	err := rc.query1(
+		`select pr.prattrs is not null,
+  pr.prqual is not null,
+  coalesce((select array_agg(a.attname::text order by a.attnum) from pg_attribute a
+    where a.attrelid = pr.prrelid and a.attnum = any(pr.prattrs)), '{}')
+from pg_publication_rel pr
+join pg_publication p on p.oid = pr.prpubid
+where p.pubname = $1 and pr.prrelid = $2::regclass`,
+		rc.publicationName,
+		table,
+	).Scan(&hasList, &hasFilter, &published)
+	if err != nil {
+		return fmt.Errorf("look up publication table %s: %w", table, err)
+	}
+
+	if hasList == (pt.columns != nil) && sameColumns(published, pt.columns) && !hasFilter && pt.where == "" {
+		rc.columnLists[table] = pt.columns
+		return nil
+	}
+
+	return rc.publishTable(table, pt, true)
+}
+
+// publishTable adds the table to the publication with its column list and row
+// filter. A table that's already published is dropped from the publication and
+// added back in the same transaction, so no changes are missed in between.
+// Postgres only accepts simple row filters (no user defined functions, for
+// example), so if it refuses one, the table is published with every row
+// instead.
+func (rc *ReplicationClient) publishTable(table string, pt publicationTable, republish bool) error {
+	err := pgx.BeginFunc(context.Background(), rc.conn, func(tx pgx.Tx) error {
+		if republish {
+			_, err := tx.Exec(context.Background(), fmt.Sprintf("alter publication \"%s\" drop table %s", rc.publicationName, table))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(context.Background(), fmt.Sprintf("alter publication \"%s\" add table %s", rc.publicationName, publicationTableSpec(table, pt)))
+		return err
+	})
+
+	if err != nil && pt.where != "" {
+		rc.logger.Warn("Unable to push row filter down into the publication, publishing every row", "table", table, "where", pt.where, logging.Err(err))
+		pt.where = ""
+		return rc.publishTable(table, pt, republish)
+	} else if err != nil {
+		return fmt.Errorf("add table %s to publication: %w", table, err)
+	}
+
+	rc.rowFilters[table] = pt.where
+	rc.columnLists[table] = pt.columns
+	if pt.columns != nil || pt.where != "" {
+		rc.logger.Info("Table published", "table", table, "columns", pt.columns, "where", pt.where)
+	}
+	return nil
+}
+
+// publicationTableSpec returns the table as it goes in ALTER PUBLICATION ...
+// ADD TABLE, with its column list and row filter if it has them.
+func publicationTableSpec(table string, pt publicationTable) string {
+	spec := table
+
+	if pt.columns != nil {
+		quoted := make([]string, len(pt.columns))
+		for i, col := range pt.columns {
+			quoted[i] = pgx.Identifier{col}.Sanitize()
+		}
+		spec += fmt.Sprintf(" (%s)", strings.Join(quoted, ", "))
+	}
+
+	if pt.where != "" {
+		spec += fmt.Sprintf(" where (%s)", pt.where)
+	}
+
+	return spec
+}
+
+func sameColumns(a []string, b []string) bool {
+	return len(a) == len(b) && !slices.ContainsFunc(a, func(col string) bool { return !slices.Contains(b, col) })
+}
+
+// referencedColumns returns the columns that show up as identifiers in a SQL
+// expression. It doesn't parse SQL, so it might find columns that aren't
+// really used (like a column named after a function), but it doesn't miss any.
+func referencedColumns(expression string, columns []string) []string {
+	referenced := make([]string, 0)
+	add := func(identifier string) {
+		if slices.Contains(columns, identifier) && !slices.Contains(referenced, identifier) {
+			referenced = append(referenced, identifier)
+		}
+	}
+
+	runes := []rune(expression)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '\'':
+			// string literal, with '' as an escaped quote
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\'' && (i+1 >= len(runes) || runes[i+1] != '\'') {
+					break
+				} else if runes[i] == '\'' {
+					i++
+				}
+			}
+		case r == '"':
+			var sb strings.Builder
+			for i++; i < len(runes); i++ {
+				if runes[i] == '"' && (i+1 >= len(runes) || runes[i+1] != '"') {
+					break
+				} else if runes[i] == '"' {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			add(sb.String())
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i+1 < len(runes) && (unicode.IsLetter(runes[i+1]) || unicode.IsDigit(runes[i+1]) || runes[i+1] == '_' || runes[i+1] == '$') {
+				i++
+			}
+			add(strings.ToLower(string(runes[start : i+1])))
+		case unicode.IsDigit(r):
+			// skip numbers so 1e5 isn't taken for a column named e5
+			for i+1 < len(runes) && (unicode.IsLetter(runes[i+1]) || unicode.IsDigit(runes[i+1]) || runes[i+1] == '.') {
+				i++
+			}
+		}
+	}
+
+	return referenced
+}
@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+func TestPublicationTableSpec(t *testing.T) {
+	if spec := publicationTableSpec("public.whiskies", publicationTable{}); spec != "public.whiskies" {
+		t.Error("Expected no column list or row filter, got", spec)
+	}
+
+	spec := publicationTableSpec("public.whiskies", publicationTable{columns: []string{"id", "Name"}})
+	if spec != `public.whiskies ("id", "Name")` {
+		t.Error("Expected a quoted column list, got", spec)
+	}
+
+	spec = publicationTableSpec("public.whiskies", publicationTable{columns: []string{"id"}, where: "id > 10"})
+	if spec != `public.whiskies ("id") where (id > 10)` {
+		t.Error("Expected a column list and a row filter, got", spec)
+	}
+}
+
+func TestSameColumns(t *testing.T) {
+	if !sameColumns([]string{"id", "name"}, []string{"name", "id"}) {
+		t.Error("Expected the order of columns not to matter")
+	}
+	if sameColumns([]string{"id"}, []string{"id", "name"}) {
+		t.Error("Expected different column lists not to match")
+	}
+}
+
+func TestCombinedWhere(t *testing.T) {
+	rc := &ReplicationClient{filters: map[string][]db.TableFilter{
+		"public.whiskies":  {{Where: "age > 10"}, {Where: "age > 10"}},
+		"public.countries": {{Where: "id = 1"}, {Where: "id = 2"}},
+		"public.regions":   {{Where: "id = 1"}, {}},
+	}}
+
+	if where := rc.combinedWhere("public.whiskies"); where != "age > 10" {
+		t.Error("Expected the trucks' shared condition, got", where)
+	}
+	if where := rc.combinedWhere("public.countries"); where != "(id = 1) or (id = 2)" {
+		t.Error("Expected either truck's condition, got", where)
+	}
+	if where := rc.combinedWhere("public.regions"); where != "" {
+		t.Error("Expected no condition when a truck reads every row, got", where)
+	}
+}
+
+func TestReferencedColumns(t *testing.T) {
+	columns := []string{"id", "tenant_id", "Name", "deleted_at", "e5"}
+
+	referenced := referencedColumns(`tenant_id = 42 AND "Name" <> 'id''s' AND deleted_at IS NULL AND 1e5 > 0`, columns)
+	if !slices.Equal(referenced, []string{"tenant_id", "Name", "deleted_at"}) {
+		t.Error("Expected tenant_id, Name and deleted_at, got", referenced)
+	}
+
+	if referenced := referencedColumns("NAME = 'x'", columns); len(referenced) != 0 {
+		t.Error("Expected unquoted identifiers to be folded to lower case, got", referenced)
+	}
+}
@@ -0,0 +1,130 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// Exec runs sql on a new connection. Without arguments pgx uses the simple
+// protocol, so sql can have several statements.
+func Exec(cfg config.Connection, sql string) error {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Exec(context.Background(), sql); err != nil {
+		return &db.Error{Op: "exec", Query: sql, Err: err}
+	}
+
+	return nil
+}
+
+// CurrentLSN returns the position of the end of the server's WAL.
+func CurrentLSN(cfg config.Connection) (uint64, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var lsn string
+	if err := conn.QueryRow(context.Background(), "SELECT pg_current_wal_lsn()::text").Scan(&lsn); err != nil {
+		return 0, &db.Error{Op: "get current LSN", Err: err}
+	}
+
+	position, err := pglogrepl.ParseLSN(lsn)
+	if err != nil {
+		return 0, &db.Error{Op: "get current LSN", Err: err}
+	}
+
+	return uint64(position), nil
+}
+
+// Query runs sql on a new connection and returns the names of its columns and
+// every row it returned.
+func Query(cfg config.Connection, sql string) ([]string, [][]any, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query(context.Background(), sql)
+	if err != nil {
+		return nil, nil, &db.Error{Op: "query", Query: sql, Err: err}
+	}
+	defer rows.Close()
+
+	columns := make([]string, 0, len(rows.FieldDescriptions()))
+	for _, field := range rows.FieldDescriptions() {
+		columns = append(columns, field.Name)
+	}
+
+	values := make([][]any, 0)
+	for rows.Next() {
+		row, err := rows.Values()
+		if err != nil {
+			return nil, nil, &db.Error{Op: "query", Query: sql, Err: err}
+		}
+		values = append(values, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, &db.Error{Op: "query", Query: sql, Err: err}
+	}
+
+	return columns, values, nil
+}
+
+// PublishedTables returns the tables in trucker's publication for the
+// connection, or none if it doesn't exist yet.
+func PublishedTables(cfg config.Connection, uniqueId string) ([]string, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query(
+		context.Background(),
+		"SELECT schemaname || '.' || tablename FROM pg_publication_tables WHERE pubname = $1 ORDER BY 1",
+		PublicationName(cfg, uniqueId),
+	)
+	if err != nil {
+		return nil, &db.Error{Op: "get published tables", Err: err}
+	}
+
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, &db.Error{Op: "get published tables", Err: err}
+	}
+
+	return tables, nil
+}
+
+// Unpublish takes tables out of trucker's publication for the connection, so
+// they're backfilled again the next time they're published. Tables that
+// aren't published are left alone.
+func Unpublish(cfg config.Connection, uniqueId string, tables []string) error {
+	published, err := PublishedTables(cfg, uniqueId)
+	if err != nil {
+		return err
+	}
+
+	tables = slices.DeleteFunc(slices.Clone(tables), func(table string) bool { return !slices.Contains(published, table) })
+	if len(tables) == 0 {
+		return nil
+	}
+
+	return Exec(cfg, fmt.Sprintf(`ALTER PUBLICATION "%s" DROP TABLE %s`, PublicationName(cfg, uniqueId), strings.Join(tables, ", ")))
+}
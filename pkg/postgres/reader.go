@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"slices"
 	"strings"
 	"text/template"
@@ -13,28 +13,67 @@ import (
 
 	"github.com/tonyfg/trucker/pkg/config"
 	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/logging"
 )
 
 type Reader struct {
 	queryTemplate *template.Template
 	conn          *pgxpool.Pool
+	// The input query reads the unchanged__ column
+	withUnchanged bool
+	refetch       bool
+	primaryKeys   map[string][]string // by table, for refetching unchanged values
+	logger        *slog.Logger
 }
 
-func NewReader(readQuery string, cfg config.Connection) *Reader {
+// NewReader returns a reader running readQuery on each changeset, or passing
+// the changed rows through the input database as they are without one.
+func NewReader(truckName string, readQuery string, cfg config.Connection) (*Reader, error) {
+	logger := logging.ForTruck(truckName).With("connection", cfg.Name)
+
+	if strings.TrimSpace(readQuery) == "" {
+		readQuery = passThroughSql
+	}
+
 	tmpl, err := template.New("inputSql").Parse(readQuery)
 	if err != nil {
-		log.Println("Error parsing input SQL template:\n", readQuery)
-		panic(err)
+		return nil, &db.Error{Op: "parse input SQL", Query: readQuery, Err: err}
 	}
 
-	conn := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		queryTemplate: tmpl,
+		conn:          conn,
+		withUnchanged: db.UsesUnchangedColumn(readQuery),
+		primaryKeys:   make(map[string][]string),
+		logger:        logger,
+	}, nil
+}
 
-	return &Reader{queryTemplate: tmpl, conn: conn}
+// RefetchUnchanged makes Read look up the current values of TOASTed columns
+// that updates left out because they didn't change, instead of leaving them
+// NULL.
+func (r *Reader) RefetchUnchanged() {
+	r.refetch = true
 }
 
-func (r *Reader) Read(changeset *db.Changeset) *db.ChanChangeset {
+func (r *Reader) Read(changeset *db.Changeset) (*db.ChanChangeset, error) {
 	if len(changeset.Columns) == 0 || len(changeset.Rows) == 0 {
-		return nil
+		return nil, nil
+	}
+
+	if r.refetch && changeset.Unchanged != nil {
+		var err error
+		if changeset, err = r.refetchUnchanged(changeset); err != nil {
+			return nil, err
+		}
+	}
+	if r.withUnchanged {
+		changeset = withUnchangedColumn(changeset)
 	}
 
 	// We need to hold on to a specific connection to be able to create and
@@ -42,7 +81,7 @@ func (r *Reader) Read(changeset *db.Changeset) *db.ChanChangeset {
 	// VALUES list)
 	conn, err := r.conn.Acquire(context.Background())
 	if err != nil {
-		panic(err)
+		return nil, &db.Error{Op: "read", Table: changeset.Table, Err: err}
 	}
 
 	var flatValues []any
@@ -67,27 +106,32 @@ func (r *Reader) Read(changeset *db.Changeset) *db.ChanChangeset {
 		// Load in batches to a temporary table instead of using a VALUES list
 		// since we're over the maximum number of parameters supported by PG for
 		// a SQL query.
-		log.Printf(
-			"[Postgres Reader] Reading changeset with more than 32k parameters for %s on table %s. Using temporary table for %d rows\n",
-			db.OperationStr(changeset.Operation),
-			changeset.Table,
-			len(changeset.Rows),
+		r.logger.Debug(
+			"Reading changeset with more than 32k parameters. Using temporary table...",
+			"operation", db.OperationStr(changeset.Operation),
+			"table", changeset.Table,
+			"rows", len(changeset.Rows),
 		)
 		tmplVars["rows"] = "r"
-		r.prepareTempTable(conn, changeset, columnsLiteral, changeset.Rows)
+		if err := r.prepareTempTable(conn, changeset, columnsLiteral, changeset.Rows); err != nil {
+			releaseWithTempTable(conn)
+			return nil, &db.Error{Op: "read", Table: changeset.Table, Err: err}
+		}
 	}
 
 	sql := new(bytes.Buffer)
 	err = r.queryTemplate.Execute(sql, tmplVars)
 	if err != nil {
-		panic(err)
+		releaseWithTempTable(conn)
+		return nil, &db.Error{Op: "read", Table: changeset.Table, Err: err}
 	}
 
 	rows, err := conn.Query(context.Background(), sql.String(), flatValues...)
 	if err != nil {
-		log.Printf("[Postgres Reader] Error running query:\n%s\n", sql.String())
-		log.Printf("[Postgres Reader] Query values:\n%v\n", flatValues)
-		panic(err)
+		r.logger.Error("Error running input query", "table", changeset.Table, "operation", db.OperationStr(changeset.Operation), "sql", sql.String(), logging.Err(err))
+		r.logger.Debug("Input query values", "table", changeset.Table, "values", flatValues)
+		releaseWithTempTable(conn)
+		return nil, &db.Error{Op: "read", Table: changeset.Table, Query: sql.String(), Err: err}
 	}
 
 	fields := rows.FieldDescriptions()
@@ -99,49 +143,59 @@ func (r *Reader) Read(changeset *db.Changeset) *db.ChanChangeset {
 		}
 	}
 
-	rowChan := make(chan [][]any, channelSize)
+	result := &db.ChanChangeset{
+		Operation: changeset.Operation,
+		Table:     changeset.Table,
+		Columns:   cols,
+		Rows:      make(chan [][]any, channelSize),
+	}
 
 	// TODO This go routine is basically the same between reader and backfill. Refactor to avoid dups
 	go func() {
-		defer conn.Release()
-		defer conn.Exec(context.Background(), "DROP TABLE IF EXISTS r")
+		defer releaseWithTempTable(conn)
 		defer rows.Close()
-		defer close(rowChan)
+		defer close(result.Rows)
 
 		rowBatch := make([][]any, 0, batchSize)
 
 		for rows.Next() {
 			row, err := rows.Values()
 			if err != nil {
-				panic(err)
+				result.Err = &db.Error{Op: "read", Table: changeset.Table, Err: err}
+				return
 			}
 
 			rowBatch = append(rowBatch, row)
 
 			if len(rowBatch) == batchSize {
-				rowChan <- rowBatch
+				result.Rows <- rowBatch
 				rowBatch = make([][]any, 0, batchSize)
 			}
 		}
 
+		if err := rows.Err(); err != nil {
+			result.Err = &db.Error{Op: "read", Table: changeset.Table, Err: err}
+			return
+		}
+
 		if len(rowBatch) > 0 {
-			rowChan <- rowBatch
+			result.Rows <- rowBatch
 		}
 	}()
 
-	return &db.ChanChangeset{
-		Operation: changeset.Operation,
-		Table:     changeset.Table,
-		Columns:   cols,
-		Rows:      rowChan,
-	}
+	return result, nil
+}
+
+func releaseWithTempTable(conn *pgxpool.Conn) {
+	conn.Exec(context.Background(), "DROP TABLE IF EXISTS r")
+	conn.Release()
 }
 
 func (r *Reader) Close() {
 	r.conn.Close()
 }
 
-func (r *Reader) prepareTempTable(conn *pgxpool.Conn, changeset *db.Changeset, columnsLiteral string, rows [][]any) {
+func (r *Reader) prepareTempTable(conn *pgxpool.Conn, changeset *db.Changeset, columnsLiteral string, rows [][]any) error {
 	// Create a temporary table to store the rows
 	sb := strings.Builder{}
 	sb.WriteString("CREATE TEMPORARY TABLE r (")
@@ -155,8 +209,8 @@ func (r *Reader) prepareTempTable(conn *pgxpool.Conn, changeset *db.Changeset, c
 
 	_, err := conn.Exec(context.Background(), sb.String())
 	if err != nil {
-		log.Printf("[Postgres Reader] Error executing SQL:\n%s", sb.String())
-		panic(err)
+		r.logger.Error("Error creating temporary table", "table", changeset.Table, "sql", sb.String(), logging.Err(err))
+		return err
 	}
 
 	baseSql := fmt.Sprintf("INSERT INTO r (%s) VALUES ", columnsLiteral)
@@ -172,7 +226,9 @@ func (r *Reader) prepareTempTable(conn *pgxpool.Conn, changeset *db.Changeset, c
 
 		_, err = conn.Exec(context.Background(), sb.String(), flatValues...)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
+
+	return nil
 }
@@ -33,7 +33,10 @@ JOIN whisky_types t ON t.id = r.whisky_type_id`)
 		},
 	}
 
-	result := r.Read(changeset)
+	result, err := r.Read(changeset)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if result.Operation != db.Insert {
 		t.Errorf("Expected operation to be Insert, got %s", db.OperationStr(result.Operation))
@@ -114,7 +117,10 @@ WHERE table_schema = 'public'
 		Rows:      rowValues,
 	}
 
-	result := r.Read(changeset)
+	result, err := r.Read(changeset)
+	if err != nil {
+		t.Fatal(err)
+	}
 	resultRows := <-result.Rows
 
 	expectedReadCols := []db.Column{
@@ -195,7 +201,10 @@ WHERE false`)
 		},
 	}
 
-	result := r.Read(changeset)
+	result, err := r.Read(changeset)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	resultRows := <-result.Rows
 	if resultRows != nil {
@@ -205,5 +214,10 @@ WHERE false`)
 
 func readerTestSetup(inputSql string) *Reader {
 	helpers.PreparePostgresTestDb().Close(context.Background())
-	return NewReader(inputSql, helpers.PostgresCfg)
+	r, err := NewReader("test", inputSql, helpers.PostgresCfg)
+	if err != nil {
+		panic(err)
+	}
+
+	return r
 }
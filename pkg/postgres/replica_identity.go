@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// pg_class.relreplident for REPLICA IDENTITY FULL. The others are d for the
+// primary key (the default), i for a unique index and n for nothing.
+const replicaIdentityFull = "f"
+
+// replicaIdentity returns the table's replica identity setting, the columns it
+// covers (the old values Postgres sends along with updates and deletes), and
+// every column in the table.
+func (rc *ReplicationClient) replicaIdentity(table string) (string, []string, []string, error) {
+	var identity string
+	var identityColumns, tableColumns []string
+	err := rc.query1(
+		`select c.relreplident::text,
+  coalesce(array_agg(a.attname::text) filter (where a.attname is not null), '{}'),
+  array(select attname::text from pg_attribute where attrelid = c.oid and attnum > 0 and not attisdropped)
+from pg_class c
+left join pg_index i on i.indrelid = c.oid
+  and ((c.relreplident = 'd' and i.indisprimary) or (c.relreplident = 'i' and i.indisreplident))
+left join pg_attribute a on a.attrelid = c.oid and a.attnum = any(i.indkey)
+where c.oid = $1::regclass
+group by c.oid, c.relreplident`,
+		table,
+	).Scan(&identity, &identityColumns, &tableColumns)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if identity == replicaIdentityFull {
+		identityColumns = tableColumns
+	}
+
+	return identity, identityColumns, tableColumns, nil
+}
+
+// checkReplicaIdentities makes sure the old values trucks need are actually
+// replicated: the ones of the old__ columns they use, and the ones their where
+// conditions are evaluated on to tell whether an updated or deleted row
+// matched before. Without REPLICA IDENTITY FULL, Postgres only sends the old
+// values of the replica identity columns, so the others would silently be
+// NULL. When a truck reading the table allows it, the table is set to REPLICA
+// IDENTITY FULL. Otherwise it returns an error, since the trucks' output would
+// be wrong.
+func (rc *ReplicationClient) checkReplicaIdentities() error {
+	for _, table := range rc.tables {
+		needsOldValues := false
+		setFull := false
+		for _, filter := range rc.filters[table] {
+			needsOldValues = needsOldValues || len(filter.OldColumns) > 0 || strings.TrimSpace(filter.Where) != ""
+			setFull = setFull || filter.SetReplicaIdentityFull
+		}
+		if !needsOldValues {
+			continue
+		}
+
+		identity, identityColumns, tableColumns, err := rc.replicaIdentity(table)
+		if err != nil {
+			return fmt.Errorf("look up replica identity of %s: %w", table, err)
+		}
+
+		missing := uncoveredColumns(rc.filters[table], identityColumns, tableColumns)
+		if len(missing) == 0 {
+			continue
+		}
+
+		if !setFull {
+			return fmt.Errorf(
+				"trucks use old__ values or where conditions on columns of %s that its replica identity (%s) doesn't cover, so their old values would always be NULL: %s. Run ALTER TABLE ... REPLICA IDENTITY FULL on the table, or set input.set_replica_identity_full in truck.yml to let trucker do it",
+				table, identity, strings.Join(missing, ", "))
+		}
+
+		rc.logger.Warn("Setting REPLICA IDENTITY FULL, since trucks use old values the table's replica identity doesn't cover", "table", table, "replica_identity", identity, "columns", missing)
+		if err := rc.exec(fmt.Sprintf("alter table %s replica identity full", table)); err != nil {
+			return fmt.Errorf("set replica identity full on %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// uncoveredColumns returns the table's columns whose old values the filters
+// need (for old__ columns or where conditions) but the replica identity
+// doesn't cover.
+func uncoveredColumns(filters []db.TableFilter, identityColumns []string, tableColumns []string) []string {
+	missing := make([]string, 0)
+	for _, filter := range filters {
+		columns := filter.OldColumns
+		if where := strings.TrimSpace(filter.Where); where != "" {
+			columns = append(slices.Clone(columns), referencedColumns(where, tableColumns)...)
+		}
+
+		for _, col := range columns {
+			if slices.Contains(tableColumns, col) && !slices.Contains(identityColumns, col) && !slices.Contains(missing, col) {
+				missing = append(missing, col)
+			}
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,30 @@
+package postgres
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+func TestUncoveredColumns(t *testing.T) {
+	tableColumns := []string{"id", "name", "age", "deleted_at"}
+	filters := []db.TableFilter{
+		{Where: "deleted_at IS NULL and id > 10"},
+		{OldColumns: []string{"name", "id", "missing"}},
+		{Where: "age > 10", OldColumns: []string{"age"}},
+	}
+
+	missing := uncoveredColumns(filters, []string{"id"}, tableColumns)
+	if !slices.Equal(missing, []string{"deleted_at", "name", "age"}) {
+		t.Error("Expected the where and old__ columns outside the replica identity, got", missing)
+	}
+
+	if missing := uncoveredColumns(filters, tableColumns, tableColumns); len(missing) != 0 {
+		t.Error("Expected REPLICA IDENTITY FULL to cover every column, got", missing)
+	}
+
+	if missing := uncoveredColumns([]db.TableFilter{{Where: "id = 1"}, {}}, []string{"id"}, tableColumns); len(missing) != 0 {
+		t.Error("Expected a condition on the primary key to be covered, got", missing)
+	}
+}
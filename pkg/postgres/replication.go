@@ -2,10 +2,13 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/url"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pglogrepl"
@@ -15,228 +18,520 @@ import (
 
 	"github.com/tonyfg/trucker/pkg/config"
 	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/logging"
 )
 
 type ReplicationClient struct {
 	publicationName  string
 	tables           []string
+	keptTables       []string                    // tables that stay published for trucks that aren't running
+	filters          map[string][]db.TableFilter // by table, one for each truck reading it
+	rowFilters       map[string]string           // by table, the where clauses pushed down into the publication
+	columnLists      map[string][]string         // by table, the columns published (nil for all of them)
 	connCfg          config.Connection
 	conn             *pgx.Conn
 	streamConn       *pgx.Conn
-	processingLSN    pglogrepl.LSN
-	lastProcessedLSN pglogrepl.LSN
+	processingLSN    atomic.Uint64
+	lastProcessedLSN atomic.Uint64
+	serverWALEnd     atomic.Uint64
+	decoding         atomic.Bool // a transaction is being received and hasn't been handed over yet
 	running          bool
 	done             chan bool
-	columnsCache     map[string][]db.Column
+	columnsCache     *columnsCache
+	schemas          *tableSchemas
+	decoder          walDecoder
+	reconnectCfg     config.Reconnect
+	reconnects       atomic.Uint64
+	snapshots        atomic.Uint64 // exported by ExportSnapshot, to name their slots
+	rewinds          chan pglogrepl.LSN
+	streamDone       chan struct{}
+	streamErr        error // why the last stream failed, set before its channel is closed
+	logger           *slog.Logger
 }
 
-func NewReplicationClient(tables []string, connCfg config.Connection, uniqueId string) *ReplicationClient {
-	return &ReplicationClient{
-		publicationName: fmt.Sprintf("trucker_%s%s", connCfg.Database, uniqueId),
+// errStopped is returned by reconnect when replication is stopped while
+// reconnecting.
+var errStopped = errors.New("replication stopped")
+
+// rewindRequest is returned by stream when someone asked for the stream to
+// start over from an earlier position.
+type rewindRequest struct {
+	lsn pglogrepl.LSN
+}
+
+func (r *rewindRequest) Error() string {
+	return fmt.Sprintf("rewind to %s requested", r.lsn)
+}
+
+// NewReplicationClient returns a client replicating the tables. Only the
+// columns included by at least one of a table's filters are replicated, and a
+// table without filters is replicated whole. It fails if the connection's
+// logical decoding plugin isn't supported.
+func NewReplicationClient(tables []string, filters map[string][]db.TableFilter, connCfg config.Connection, reconnectCfg config.Reconnect, uniqueId string) (*ReplicationClient, error) {
+	publicationName := PublicationName(connCfg, uniqueId)
+	columnsCache := newColumnsCache(make(map[string][]db.Column))
+	schemas := newTableSchemas()
+	decoder, err := newWalDecoder(connCfg.Plugin, publicationName, tables, columnsCache, schemas)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &ReplicationClient{
+		publicationName: publicationName,
 		tables:          tables,
+		filters:         filters,
+		rowFilters:      make(map[string]string),
+		columnLists:     make(map[string][]string),
 		connCfg:         connCfg,
 		running:         false,
 		done:            make(chan bool, 1),
-		columnsCache:    make(map[string][]db.Column),
+		columnsCache:    columnsCache,
+		schemas:         schemas,
+		decoder:         decoder,
+		reconnectCfg:    reconnectCfg,
+		rewinds:         make(chan pglogrepl.LSN),
+		logger:          logging.ForConnection(connCfg.Name),
 	}
+	schemas.refresh = rc.refreshColumns
+
+	return rc, nil
+}
+
+// KeepPublished leaves tables in the publication even though they aren't
+// replicated, because they belong to trucks that aren't running right now.
+// Otherwise they'd be taken out of the publication, and backfilled again
+// when those trucks run.
+func (rc *ReplicationClient) KeepPublished(tables []string) {
+	rc.keptTables = tables
 }
 
-func (rc *ReplicationClient) Setup() ([]string, uint64, string) {
-	rc.conn = rc.connect(false) // TODO: check that this connection gets closed once we no longer need it
-	rc.streamConn = rc.connect(true)
+// PublicationName returns the name of the publication trucker uses for an
+// input connection, which is also the name of its replication slot.
+func PublicationName(connCfg config.Connection, uniqueId string) string {
+	return fmt.Sprintf("trucker_%s%s", connCfg.Database, uniqueId)
+}
+
+// Setup makes sure the publication and replication slot are in place, and
+// returns the tables that still need to be backfilled, along with the position
+// and snapshot to backfill them from. It returns an error instead if any of it
+// fails, leaving it to the trucks' on_error policies.
+func (rc *ReplicationClient) Setup() ([]string, uint64, string, error) {
+	newTables, backfillLSN, snapshotName, err := rc.setup()
+	if err != nil {
+		return nil, 0, "", &db.Error{Op: "set up replication", Err: err}
+	}
+
+	return newTables, backfillLSN, snapshotName, nil
+}
+
+func (rc *ReplicationClient) setup() ([]string, uint64, string, error) {
+	var err error
+	rc.conn, err = rc.tryConnect(false) // TODO: check that this connection gets closed once we no longer need it
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("connect: %w", err)
+	}
+	rc.streamConn, err = rc.tryConnect(true)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("connect for replication: %w", err)
+	}
 	// we need to keep the connection open so that the other connection can use
 	// the repliaction slot snapshot for backfills
 	// defer client.streamConn.Close(context.Background())
 
+	sourceColumns := make(map[string][]sourceColumn)
 	for _, table := range rc.tables {
-		rc.columnsCache[table] = make([]db.Column, 0, 1)
-
-		schemaAndTable := strings.Split(table, ".")
-		rows := rc.query(
-			`SELECT column_name, data_type, udt_name FROM information_schema.columns
-WHERE table_schema = $1 AND table_name = $2
-ORDER BY ordinal_position`,
-			schemaAndTable[0],
-			schemaAndTable[1],
-		)
+		tableColumns, columns, err := loadTableColumns(rc.conn, table)
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("look up columns of %s: %w", table, err)
+		}
 
-		var columnName, dataType, udtName string
-		for rows.Next() {
-			rows.Scan(&columnName, &dataType, &udtName)
+		rc.columnsCache.set(table, rc.replicatedColumns(table, tableColumns))
+		sourceColumns[table] = columns
+	}
 
-			if dataType == "ARRAY" {
-				udtName = fmt.Sprintf("%s[]", udtName[1:])
-			}
+	var loadedLSN pglogrepl.LSN
+	if err := rc.query1("select pg_current_wal_lsn()").Scan(&loadedLSN); err != nil {
+		return nil, 0, "", fmt.Errorf("get current WAL position: %w", err)
+	}
+	rc.schemas.loadedLSN = uint64(loadedLSN)
 
-			rc.columnsCache[table] = append(
-				rc.columnsCache[table],
-				db.Column{Name: columnName, Type: pgTypeToDbType(udtName)},
-			)
+	if err := rc.checkReplicaIdentities(); err != nil {
+		return nil, 0, "", err
+	}
+
+	newTables, err := rc.setupPublication()
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	// With a column list, pgoutput only sends the published columns
+	for table, columns := range sourceColumns {
+		if columnList := rc.columnLists[table]; columnList != nil {
+			columns = slices.DeleteFunc(columns, func(col sourceColumn) bool { return !slices.Contains(columnList, col.name) })
 		}
+		rc.schemas.columns[table] = columns
 	}
 
-	newTables := rc.setupPublication()
-	currentLSN, backfillLSN, snapshotName := rc.setupReplicationSlot(len(newTables) > 0)
+	currentLSN, backfillLSN, snapshotName, err := rc.setupReplicationSlot(len(newTables) > 0)
+	if err != nil {
+		return nil, 0, "", err
+	}
 
-	log.Println("Current LSN:", currentLSN, "Backfill LSN:", backfillLSN, "Snapshot name:", snapshotName)
+	rc.logger.Info("Replication set up", "current_lsn", currentLSN.String(), "backfill_lsn", backfillLSN.String(), "snapshot", snapshotName)
 
-	return newTables, uint64(backfillLSN), snapshotName
+	return newTables, uint64(backfillLSN), snapshotName, nil
 }
 
-func (rc *ReplicationClient) Start(startPosition uint64, endPosition uint64) chan *db.Transaction {
+// Start streams transactions from startPosition until endPosition (or for
+// good, if it's 0) on the channel it returns, which is closed once the stream
+// ends. If the stream fails and can't be resumed, the channel is closed as
+// well and Err tells why. Start can be called again after that.
+func (rc *ReplicationClient) Start(startPosition uint64, endPosition uint64) (chan *db.Transaction, error) {
 	if rc.running {
-		log.Fatalln("Replication is already running")
+		return nil, &db.Error{Op: "start replication", Err: errors.New("replication is already running")}
 	}
 
 	startLSN := pglogrepl.LSN(startPosition)
 	endLSN := pglogrepl.LSN(endPosition)
-	log.Println("Replicating startLSN:", startPosition, startLSN)
-	log.Println("Replicating endLSN:", endPosition, endLSN)
-
-	conn := rc.streamConn.PgConn()
+	rc.logger.Info("Starting replication", "start_lsn", startLSN.String(), "end_lsn", endLSN.String())
 
-	configuredTables := ""
-	for i, table := range rc.tables {
-		if i > 0 {
-			configuredTables += ","
+	if rc.streamConn == nil || rc.streamConn.IsClosed() {
+		conn, err := rc.tryConnect(true)
+		if err != nil {
+			return nil, &db.Error{Op: "start replication", Err: err}
 		}
-		configuredTables += escapeWal2JsonTableName(table)
+		rc.streamConn = conn
+		rc.decoder.reset()
 	}
 
-	pluginArguments := []string{fmt.Sprintf("\"add-tables\" '%s'", configuredTables)}
-	err := pglogrepl.StartReplication(
-		context.Background(),
-		conn,
-		rc.publicationName,
-		startLSN,
-		pglogrepl.StartReplicationOptions{PluginArgs: pluginArguments},
-	)
-	if err != nil {
-		log.Fatalln("StartReplication failed:", err)
+	if err := rc.startReplication(startLSN); err != nil {
+		return nil, &db.Error{Op: "start replication", Err: err}
 	}
-	log.Println("Logical replication started on slot", rc.publicationName)
 
 	changes := make(chan *db.Transaction)
+	streamDone := make(chan struct{})
+	rc.streamDone = streamDone
+	rc.streamErr = nil
 	rc.running = true
 
 	go func() {
-		log.Println("Goroutine started to read from replication stream")
+		defer close(streamDone)
+		rc.logger.Debug("Goroutine started to read from replication stream")
 
 		clientXLogPos := startLSN
-		standbyMessageTimeout := time.Second * 10
-		nextStandbyMessageDeadline := time.Now().Add(standbyMessageTimeout)
 
-	Out:
 		for {
-			select {
-			case <-rc.done:
-				log.Println("Received done signal. Stopping replication...")
-				rc.streamConn.Close(context.Background())
-				break Out
-			default:
-				// keep running
+			reachedEnd, err := rc.stream(changes, &clientXLogPos, endLSN)
+			if reachedEnd {
+				rc.logger.Info("Reached end LSN. Stopping replication...", logging.LSN(uint64(endLSN)))
+				rc.running = false
+				rc.ResetStreamConn()
+				close(changes)
+				return
 			}
 
-			if time.Now().After(nextStandbyMessageDeadline) {
-				var confirmLSN pglogrepl.LSN
-
-				if rc.processingLSN == rc.lastProcessedLSN && rc.processingLSN > 0 {
-					// we're up to date so we can move the replication slot forward freely
-					confirmLSN = clientXLogPos
-				} else {
-					// we still haven't finished writing some stuff, so let's move the replication slot only up to the latest confirmed write
-					confirmLSN = rc.lastProcessedLSN
-				}
+			if err == nil || !rc.running {
+				break
+			}
 
-				err = pglogrepl.SendStandbyStatusUpdate(
-					context.Background(),
-					conn,
-					pglogrepl.StandbyStatusUpdate{WALWritePosition: confirmLSN},
-				)
-				if err != nil {
-					log.Fatalln("SendStandbyStatusUpdate failed:", err)
+			var rewind *rewindRequest
+			if errors.As(err, &rewind) {
+				rc.logger.Info("Rewinding replication stream", logging.LSN(uint64(rewind.lsn)))
+				if err = rc.restartStream(rewind.lsn); err == nil {
+					clientXLogPos = rewind.lsn
+					continue
 				}
-				nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
 			}
 
-			ctx, cancel := context.WithDeadline(context.Background(), nextStandbyMessageDeadline)
-			rawMsg, err := conn.ReceiveMessage(ctx)
-			cancel()
+			rc.logger.Error("Replication stream failed", logging.Err(err))
+			resumeLSN, err := rc.reconnect(startLSN, err)
+			if errors.Is(err, errStopped) {
+				break
+			}
 			if err != nil {
-				if !rc.running {
-					log.Println("No longer running. Stopping replication...")
-					break Out
-				}
+				// Whoever reads the stream decides what happens next
+				rc.logger.Error("Unable to resume replication stream", logging.Err(err))
+				rc.running = false
+				rc.streamErr = err
+				rc.ResetStreamConn()
+				close(changes)
+				return
+			}
+			clientXLogPos = resumeLSN
+		}
 
-				if pgconn.Timeout(err) {
-					continue
-				}
-				log.Fatalln("ReceiveMessage failed:", err)
+		rc.logger.Info("Replication stream exiting...")
+		rc.streamConn.Close(context.Background())
+		close(changes)
+		rc.Close()
+	}()
+
+	return changes, nil
+}
+
+// Err returns why the last stream failed, once its channel is closed. It's nil
+// if the stream reached its end or was stopped.
+func (rc *ReplicationClient) Err() error {
+	return rc.streamErr
+}
+
+func (rc *ReplicationClient) startReplication(startLSN pglogrepl.LSN) error {
+	err := pglogrepl.StartReplication(
+		context.Background(),
+		rc.streamConn.PgConn(),
+		rc.publicationName,
+		startLSN,
+		pglogrepl.StartReplicationOptions{PluginArgs: rc.decoder.pluginArgs()},
+	)
+	if err != nil {
+		return err
+	}
+
+	rc.logger.Info("Logical replication started", "slot", rc.publicationName, "plugin", rc.decoder.plugin(), logging.LSN(uint64(startLSN)))
+	return nil
+}
+
+// stream reads from the replication connection and sends transactions to
+// changes until it reaches endLSN (if it isn't 0), replication is stopped, or
+// something goes wrong with the connection.
+func (rc *ReplicationClient) stream(changes chan *db.Transaction, clientXLogPos *pglogrepl.LSN, endLSN pglogrepl.LSN) (reachedEnd bool, err error) {
+	conn := rc.streamConn.PgConn()
+	standbyMessageTimeout := time.Second * 10
+	nextStandbyMessageDeadline := time.Now().Add(standbyMessageTimeout)
+
+	for {
+		select {
+		case <-rc.done:
+			rc.logger.Info("Received done signal. Stopping replication...")
+			return false, nil
+		case lsn := <-rc.rewinds:
+			return false, &rewindRequest{lsn}
+		default:
+			// keep running
+		}
+
+		if time.Now().After(nextStandbyMessageDeadline) {
+			var confirmLSN pglogrepl.LSN
+
+			if rc.processingLSN.Load() == rc.lastProcessedLSN.Load() && rc.processingLSN.Load() > 0 {
+				// we're up to date so we can move the replication slot forward freely
+				confirmLSN = *clientXLogPos
+			} else {
+				// we still haven't finished writing some stuff, so let's move the replication slot only up to the latest confirmed write
+				confirmLSN = pglogrepl.LSN(rc.lastProcessedLSN.Load())
+			}
+
+			err = pglogrepl.SendStandbyStatusUpdate(
+				context.Background(),
+				conn,
+				pglogrepl.StandbyStatusUpdate{WALWritePosition: confirmLSN},
+			)
+			if err != nil {
+				return false, fmt.Errorf("SendStandbyStatusUpdate failed: %w", err)
 			}
+			nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
+		}
 
-			if errMsg, ok := rawMsg.(*pgproto3.ErrorResponse); ok {
-				log.Fatalf("received Postgres WAL error: %+v", errMsg)
+		ctx, cancel := context.WithDeadline(context.Background(), nextStandbyMessageDeadline)
+		rawMsg, err := conn.ReceiveMessage(ctx)
+		cancel()
+		if err != nil {
+			if !rc.running {
+				rc.logger.Info("No longer running. Stopping replication...")
+				return false, nil
 			}
 
-			msg, ok := rawMsg.(*pgproto3.CopyData)
-			if !ok {
-				// log.Printf("Received unexpected message: %T\n", rawMsg)
-				// This is fine... Usually happens when a trigger or other plsql code sends a NOTICE.
-				// Let's not print anything to avoid log spam.
+			if pgconn.Timeout(err) {
 				continue
 			}
+			return false, fmt.Errorf("ReceiveMessage failed: %w", err)
+		}
 
-			switch msg.Data[0] {
-			case pglogrepl.PrimaryKeepaliveMessageByteID:
-				pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
-				if err != nil {
-					log.Fatalln("ParsePrimaryKeepaliveMessage failed:", err)
-				}
-				// log.Println("Primary Keepalive Message =>", "ServerWALEnd:", pkm.ServerWALEnd, "ServerTime:", pkm.ServerTime, "ReplyRequested:", pkm.ReplyRequested)
-				if pkm.ServerWALEnd > clientXLogPos {
-					clientXLogPos = pkm.ServerWALEnd
-				}
-				if pkm.ReplyRequested {
-					nextStandbyMessageDeadline = time.Time{}
-				}
+		if errMsg, ok := rawMsg.(*pgproto3.ErrorResponse); ok {
+			return false, fmt.Errorf("received Postgres WAL error: %+v", errMsg)
+		}
 
-			case pglogrepl.XLogDataByteID:
-				xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
-				if err != nil {
-					log.Fatalln("ParseXLogData failed:", err)
-				}
+		msg, ok := rawMsg.(*pgproto3.CopyData)
+		if !ok {
+			// This is fine... Usually happens when a trigger or other plsql code sends a NOTICE.
+			rc.logger.Debug("Ignoring unexpected message", "type", fmt.Sprintf("%T", rawMsg))
+			continue
+		}
 
-				changes <- &db.Transaction{
-					StreamPosition: uint64(xld.WALStart),
-					Changesets:     makeChangesets(xld.WALData, rc.columnsCache),
-				}
-				rc.processingLSN = xld.WALStart
+		switch msg.Data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+			if err != nil {
+				return false, fmt.Errorf("ParsePrimaryKeepaliveMessage failed: %w", err)
+			}
+			rc.logger.Debug("Primary keepalive", "server_wal_end", pkm.ServerWALEnd.String(), "server_time", pkm.ServerTime, "reply_requested", pkm.ReplyRequested)
+			rc.serverWALEnd.Store(uint64(pkm.ServerWALEnd))
+			if pkm.ServerWALEnd > *clientXLogPos {
+				*clientXLogPos = pkm.ServerWALEnd
+			}
+			if pkm.ReplyRequested {
+				nextStandbyMessageDeadline = time.Time{}
+			}
 
-				if xld.WALStart > clientXLogPos {
-					clientXLogPos = xld.WALStart
-				}
+		case pglogrepl.XLogDataByteID:
+			xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+			if err != nil {
+				return false, fmt.Errorf("ParseXLogData failed: %w", err)
+			}
 
-				if endLSN != 0 && xld.WALStart >= endLSN {
-					log.Println("Reached end LSN. Stopping replication...")
-					rc.running = false
-					rc.ResetStreamConn()
-					close(changes)
-					return
-				}
+			rc.decoding.Store(true)
+			rc.serverWALEnd.Store(uint64(xld.ServerWALEnd))
+
+			transaction, err := rc.decoder.decode(xld)
+			if err != nil {
+				return false, err
+			}
+			if transaction == nil {
+				// Still in the middle of a transaction
+				continue
+			}
+
+			select {
+			case changes <- transaction:
+			case lsn := <-rc.rewinds:
+				return false, &rewindRequest{lsn}
+			}
+			rc.processingLSN.Store(uint64(xld.WALStart))
+			rc.decoding.Store(false)
+
+			if xld.WALStart > *clientXLogPos {
+				*clientXLogPos = xld.WALStart
 			}
+
+			if endLSN != 0 && xld.WALStart >= endLSN {
+				return true, nil
+			}
+		}
+	}
+}
+
+// reconnect re-opens the replication connection, backing off exponentially
+// between attempts, and resumes streaming right after the last transaction
+// that was handed over to trucks (or from fallbackLSN if there isn't one yet).
+// Trucks skip transactions they've already written, so anything that gets
+// sent twice is harmless. It gives up after reconnect.max_attempts, returning
+// the last error (cause, if no attempt got that far), and returns errStopped
+// if replication was stopped while reconnecting.
+func (rc *ReplicationClient) reconnect(fallbackLSN pglogrepl.LSN, cause error) (pglogrepl.LSN, error) {
+	backoff := time.Duration(rc.reconnectCfg.InitialBackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(rc.reconnectCfg.MaxBackoffMs) * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		if rc.reconnectCfg.MaxAttempts > 0 && attempt > rc.reconnectCfg.MaxAttempts {
+			return 0, fmt.Errorf("giving up on replication slot %s after %d attempts: %w", rc.publicationName, rc.reconnectCfg.MaxAttempts, cause)
+		}
+
+		rc.logger.Warn("Reconnecting to replication slot", "slot", rc.publicationName, "backoff", backoff, "attempt", attempt)
+		if !rc.waitToReconnect(backoff) {
+			return 0, errStopped
 		}
+		backoff = min(backoff*2, maxBackoff)
 
-		log.Println("Replication stream exiting...")
+		resumeLSN := pglogrepl.LSN(rc.lastProcessedLSN.Load())
+		if resumeLSN == 0 {
+			resumeLSN = fallbackLSN
+		}
+
+		if err := rc.restartStream(resumeLSN); err != nil {
+			rc.logger.Error("Unable to restart replication", logging.Err(err))
+			cause = err
+			continue
+		}
+
+		rc.reconnects.Add(1)
+		rc.logger.Info("Reconnected to replication slot", "slot", rc.publicationName, "attempt", attempt, logging.LSN(uint64(resumeLSN)))
+		return resumeLSN, nil
+	}
+}
+
+// waitToReconnect sleeps for the given duration. Rewind requests that come in
+// meanwhile are accepted and dropped, since reconnecting resumes from the last
+// processed position anyway, which trucks that need a rewind hold back.
+// Returns false if replication was stopped while waiting.
+func (rc *ReplicationClient) waitToReconnect(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-rc.done:
+			return false
+		case <-rc.rewinds:
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// restartStream opens a new replication connection and starts streaming from
+// startLSN. Anything the decoder had buffered from the old connection is
+// thrown away.
+func (rc *ReplicationClient) restartStream(startLSN pglogrepl.LSN) error {
+	if rc.streamConn != nil {
 		rc.streamConn.Close(context.Background())
-		close(changes)
-		rc.Close()
-	}()
+	}
+	conn, err := rc.tryConnect(true)
+	if err != nil {
+		return err
+	}
+	rc.streamConn = conn
+	rc.decoder.reset()
+
+	return rc.startReplication(startLSN)
+}
+
+// Rewind makes the replication stream start over from lsn, so that trucks
+// which were restarted get the transactions they missed. Every transaction
+// received after Rewind returns comes from the new position. It does nothing
+// if the stream isn't running.
+func (rc *ReplicationClient) Rewind(lsn uint64) {
+	if rc.streamDone == nil {
+		return
+	}
+
+	select {
+	case rc.rewinds <- pglogrepl.LSN(lsn):
+	case <-rc.streamDone:
+	case <-rc.done:
+	}
+}
 
-	return changes
+// Reconnects returns how many times the replication connection has been
+// re-established since the client was created.
+func (rc *ReplicationClient) Reconnects() uint64 {
+	return rc.reconnects.Load()
+}
+
+// LagBytes returns how far the last processed transaction is behind the end
+// of the server's WAL. It's 0 when every transaction handed over to trucks has
+// been processed, since the rest of the WAL has nothing for us.
+func (rc *ReplicationClient) LagBytes() uint64 {
+	processed := rc.lastProcessedLSN.Load()
+	walEnd := rc.serverWALEnd.Load()
+
+	if rc.processingLSN.Load() == processed || walEnd <= processed {
+		return 0
+	}
+
+	return walEnd - processed
+}
+
+// CaughtUp tells whether every change in the WAL up to lsn has been processed.
+// The server has to report a WAL end at or past lsn first, so any transactions
+// that committed before lsn have been received by then.
+func (rc *ReplicationClient) CaughtUp(lsn uint64) bool {
+	return !rc.decoding.Load() &&
+		rc.serverWALEnd.Load() >= lsn &&
+		rc.processingLSN.Load() == rc.lastProcessedLSN.Load()
 }
 
 func (rc *ReplicationClient) SetProcessedLSN(lsn uint64) {
-	rc.lastProcessedLSN = pglogrepl.LSN(lsn)
+	rc.lastProcessedLSN.Store(lsn)
 }
 
 func (rc *ReplicationClient) Close() {
@@ -247,11 +542,49 @@ func (rc *ReplicationClient) Close() {
 	}
 
 	rc.running = false
-	rc.streamConn.Close(context.Background())
-	rc.conn.Close(context.Background())
+	if rc.streamConn != nil {
+		rc.streamConn.Close(context.Background())
+	}
+	if rc.conn != nil {
+		rc.conn.Close(context.Background())
+	}
+}
+
+// Drop removes the replication slot and publication, so the server stops
+// keeping WAL around for them. Replication has to be stopped first, but the
+// server may take a moment to notice, so dropping the slot is retried for a
+// few seconds.
+func (rc *ReplicationClient) Drop() error {
+	conn, err := rc.tryConnect(false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	for attempt := 1; ; attempt++ {
+		_, err = conn.Exec(
+			context.Background(),
+			"SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1",
+			rc.publicationName,
+		)
+		if err == nil || attempt == 10 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("drop replication slot %s: %w", rc.publicationName, err)
+	}
+
+	_, err = conn.Exec(context.Background(), fmt.Sprintf(`DROP PUBLICATION IF EXISTS "%s"`, rc.publicationName))
+	if err != nil {
+		return fmt.Errorf("drop publication %s: %w", rc.publicationName, err)
+	}
+
+	return nil
 }
 
-func (rc *ReplicationClient) setupPublication() []string {
+func (rc *ReplicationClient) setupPublication() ([]string, error) {
 	var pubCount int
 	row := rc.query1(
 		"select count(*) from pg_publication where pubname = $1",
@@ -259,16 +592,22 @@ func (rc *ReplicationClient) setupPublication() []string {
 
 	err := row.Scan(&pubCount)
 	if err != nil {
-		log.Fatalf("Query \"select count(*) from pg_publication where pubname = $1\" failed: %v\n", err)
+		return nil, fmt.Errorf("look up publication %s: %w", rc.publicationName, err)
 	}
 
 	if pubCount < 1 {
-		rc.exec(fmt.Sprintf("create publication \"%s\" with (publish_via_partition_root = true)", rc.publicationName))
+		err := rc.exec(fmt.Sprintf("create publication \"%s\" with (publish_via_partition_root = true)", rc.publicationName))
+		if err != nil {
+			return nil, fmt.Errorf("create publication %s: %w", rc.publicationName, err)
+		}
 	}
 
-	rows := rc.query(
+	rows, err := rc.query(
 		"select schemaname || '.' || tablename from pg_publication_tables where pubname = $1",
 		rc.publicationName)
+	if err != nil {
+		return nil, fmt.Errorf("look up published tables: %w", err)
+	}
 	defer rows.Close()
 
 	var table string
@@ -285,69 +624,95 @@ func (rc *ReplicationClient) setupPublication() []string {
 
 	tablesToUnpublish := make([]string, 0)
 	for table := range publishedTables {
-		if !configuredTables[table] {
+		if !configuredTables[table] && !slices.Contains(rc.keptTables, table) {
 			tablesToUnpublish = append(tablesToUnpublish, table)
 		}
 	}
 
 	if len(tablesToUnpublish) > 0 {
-		rc.exec(fmt.Sprintf(
+		err := rc.exec(fmt.Sprintf(
 			"alter publication \"%s\" drop table %s",
 			rc.publicationName,
 			strings.Join(tablesToUnpublish, ",")))
+		if err != nil {
+			return nil, fmt.Errorf("unpublish tables: %w", err)
+		}
 	}
 
+	publicationTables, filtersSupported := rc.publicationTables()
+
 	tablesToPublish := make([]string, 0)
 	for table := range configuredTables {
 		if !publishedTables[table] {
 			tablesToPublish = append(tablesToPublish, table)
+		} else if filtersSupported {
+			if err := rc.updatePublicationTable(table, publicationTables[table]); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	// FIXME: This will go to shit if a backfill fails midway through...
-	//        We should actually only add the tables to the publication after the
-	//        backfill is done, and right before starting to stream
-	if len(tablesToPublish) > 0 {
-		rc.exec(fmt.Sprintf(
-			"alter publication \"%s\" add table %s;",
-			rc.publicationName,
-			strings.Join(tablesToPublish, ",")))
+	// Tables are published before they're backfilled. If a backfill is
+	// interrupted, trucks keep track of how far it got in their output
+	// databases, and resume it after the last chunk written the next time
+	// around, streaming the changes made since it started.
+	for _, table := range tablesToPublish {
+		if err := rc.publishTable(table, publicationTables[table], false); err != nil {
+			return nil, err
+		}
 	}
 
-	log.Println("Publication is set-up:", rc.publicationName)
-	return tablesToPublish
+	rc.logger.Info("Publication is set up", "publication", rc.publicationName)
+	return tablesToPublish, nil
 }
 
-func (rc *ReplicationClient) setupReplicationSlot(createBackfillSnapshot bool) (pglogrepl.LSN, pglogrepl.LSN, string) {
+func (rc *ReplicationClient) setupReplicationSlot(createBackfillSnapshot bool) (pglogrepl.LSN, pglogrepl.LSN, string, error) {
 	row := rc.query1(
-		"select count(*) from pg_replication_slots where slot_name = $1 and database = $2;",
+		"select count(*), min(plugin) from pg_replication_slots where slot_name = $1 and database = $2;",
 		rc.publicationName,
 		rc.connCfg.Database)
 
 	var slotCount int
-	err := row.Scan(&slotCount)
+	var slotPlugin *string
+	err := row.Scan(&slotCount, &slotPlugin)
 	if err != nil {
-		log.Fatalf("Query \"select count(*) from pg_replication_slots where slot_name = $1 and database = $2;\" failed: %v\n", err)
+		return 0, 0, "", fmt.Errorf("look up replication slot %s: %w", rc.publicationName, err)
 	}
 
 	if slotCount > 1 {
-		log.Fatalf("More than one replication slot with name %s found", rc.publicationName)
+		return 0, 0, "", fmt.Errorf("more than one replication slot named %s", rc.publicationName)
+	}
+
+	if slotPlugin != nil && *slotPlugin != rc.decoder.plugin() {
+		return 0, 0, "", fmt.Errorf(
+			"replication slot %s uses the %s plugin, but the connection is configured to use %s. Drop the slot or change the connection's plugin",
+			rc.publicationName, *slotPlugin, rc.decoder.plugin())
 	}
 
 	var snapshotName string
 	var currentLSN pglogrepl.LSN
 	var backfillLSN pglogrepl.LSN
 
-	if slotCount < 1 {
-		log.Println("Replication slot doesn't exit yet. Creating...")
-		backfillLSN = rc.identifySystem().XLogPos
-		snapshotName = rc.createReplicationSlot(false)
-	} else if createBackfillSnapshot {
-		log.Println("Replication slot already exists. Creating temporary slot for backfill...")
-		backfillLSN = rc.identifySystem().XLogPos
-		snapshotName = rc.createReplicationSlot(true)
+	if slotCount < 1 || createBackfillSnapshot {
+		temporary := slotCount > 0
+		if temporary {
+			rc.logger.Info("Replication slot already exists. Creating temporary slot for backfill...", "slot", rc.publicationName)
+		} else {
+			rc.logger.Info("Replication slot doesn't exist yet. Creating...", "slot", rc.publicationName)
+		}
+
+		sysident, err := rc.identifySystem()
+		if err != nil {
+			return 0, 0, "", err
+		}
+		backfillLSN = sysident.XLogPos
+
+		snapshotName, err = rc.createReplicationSlot(temporary)
+		if err != nil {
+			return 0, 0, "", err
+		}
 	} else {
-		log.Println("Replication slot already exists and no backfill needed... Getting current LSN")
+		rc.logger.Info("Replication slot already exists and no backfill needed... Getting current LSN", "slot", rc.publicationName)
 		row := rc.query1(
 			"select restart_lsn from pg_replication_slots where slot_name = $1 and database = $2;",
 			rc.publicationName,
@@ -355,25 +720,25 @@ func (rc *ReplicationClient) setupReplicationSlot(createBackfillSnapshot bool) (
 
 		err := row.Scan(&currentLSN)
 		if err != nil {
-			log.Fatalf("Query \"select restart_lsn from pg_replication_slots where slot_name = $1 and database = $2;\" failed: %v\n", err)
+			return 0, 0, "", fmt.Errorf("get restart LSN of replication slot %s: %w", rc.publicationName, err)
 		}
 	}
 
-	log.Println("Replication slot is up:", rc.publicationName)
-	return currentLSN, backfillLSN, snapshotName
+	rc.logger.Info("Replication slot is up", "slot", rc.publicationName)
+	return currentLSN, backfillLSN, snapshotName, nil
 }
 
-func (rc *ReplicationClient) identifySystem() pglogrepl.IdentifySystemResult {
+func (rc *ReplicationClient) identifySystem() (pglogrepl.IdentifySystemResult, error) {
 	sysident, err := pglogrepl.IdentifySystem(context.Background(), rc.streamConn.PgConn())
 	if err != nil {
-		log.Fatalln("IdentifySystem failed:", err)
+		return sysident, fmt.Errorf("identify system: %w", err)
 	}
-	log.Println("SystemID:", sysident.SystemID, "Timeline:", sysident.Timeline, "XLogPos:", sysident.XLogPos, "DBName:", sysident.DBName)
+	rc.logger.Info("Identified system", "system_id", sysident.SystemID, "timeline", sysident.Timeline, "xlog_pos", sysident.XLogPos.String(), "database", sysident.DBName)
 
-	return sysident
+	return sysident, nil
 }
 
-func (rc *ReplicationClient) createReplicationSlot(temporary bool) string {
+func (rc *ReplicationClient) createReplicationSlot(temporary bool) (string, error) {
 	slotName := rc.publicationName
 	if temporary {
 		slotName = fmt.Sprintf("%s_temp", rc.publicationName)
@@ -386,7 +751,9 @@ func (rc *ReplicationClient) createReplicationSlot(temporary bool) string {
 
 		if pid > 0 {
 			// FIXME: This is a hack and we should be using advisory locks instead
-			rc.exec("select pg_terminate_backend($1)", pid)
+			if err := rc.exec("select pg_terminate_backend($1)", pid); err != nil {
+				return "", fmt.Errorf("terminate backend using replication slot %s: %w", slotName, err)
+			}
 		}
 
 		pglogrepl.DropReplicationSlot(
@@ -401,25 +768,64 @@ func (rc *ReplicationClient) createReplicationSlot(temporary bool) string {
 		context.Background(),
 		rc.streamConn.PgConn(),
 		fmt.Sprintf("\"%s\"", slotName),
-		"wal2json",
+		rc.decoder.plugin(),
 		pglogrepl.CreateReplicationSlotOptions{
 			Temporary:      temporary,
 			SnapshotAction: "EXPORT_SNAPSHOT",
 		})
 
 	if err != nil {
-		log.Fatalln("CreateReplicationSlot failed:", err)
+		return "", fmt.Errorf("create replication slot %s: %w", slotName, err)
 	}
 
-	return result.SnapshotName
+	return result.SnapshotName, nil
 }
 
+// ExportSnapshot creates a temporary replication slot on a connection of its
+// own, to backfill tables again while streaming. The snapshot has every
+// transaction committed before the returned position, and lasts until release
+// is called. Each call gets a slot of its own, so snapshots can overlap.
+func (rc *ReplicationClient) ExportSnapshot() (snapshotName string, lsn uint64, release func(), err error) {
+	ctx := context.Background()
+	conn, err := rc.tryConnect(true)
+	if err != nil {
+		return "", 0, nil, &db.Error{Op: "export snapshot", Err: err}
+	}
+
+	result, err := pglogrepl.CreateReplicationSlot(
+		ctx,
+		conn.PgConn(),
+		fmt.Sprintf("\"%s_rebackfill_%d\"", rc.publicationName, rc.snapshots.Add(1)),
+		rc.decoder.plugin(),
+		pglogrepl.CreateReplicationSlotOptions{
+			Temporary:      true,
+			SnapshotAction: "EXPORT_SNAPSHOT",
+		})
+	if err != nil {
+		conn.Close(ctx)
+		return "", 0, nil, &db.Error{Op: "export snapshot", Err: err}
+	}
+
+	consistentPoint, err := pglogrepl.ParseLSN(result.ConsistentPoint)
+	if err != nil {
+		conn.Close(ctx)
+		return "", 0, nil, &db.Error{Op: "export snapshot", Err: err}
+	}
+
+	rc.logger.Info("Exported snapshot for backfill", "snapshot", result.SnapshotName, logging.LSN(uint64(consistentPoint)))
+	return result.SnapshotName, uint64(consistentPoint), func() { conn.Close(ctx) }, nil
+}
+
+// ResetStreamConn closes the replication connection, which also releases the
+// snapshot exported when the replication slot was created. The next Start
+// opens a new one.
 func (rc *ReplicationClient) ResetStreamConn() {
-	rc.streamConn.Close(context.Background())
-	rc.streamConn = rc.connect(true)
+	if rc.streamConn != nil {
+		rc.streamConn.Close(context.Background())
+	}
 }
 
-func (rc *ReplicationClient) connect(replication bool) *pgx.Conn {
+func (rc *ReplicationClient) tryConnect(replication bool) (*pgx.Conn, error) {
 	port := rc.connCfg.Port
 	if port == 0 {
 		port = 5432
@@ -441,36 +847,21 @@ func (rc *ReplicationClient) connect(replication bool) *pgx.Conn {
 
 	config, err := pgx.ParseConfig(connString)
 	if err != nil {
-		log.Fatalln("Unable to parse connection string:", err)
+		return nil, err
 	}
 
-	conn, err := pgx.ConnectConfig(context.Background(), config)
-	if err != nil {
-		log.Fatalln("Unable to connect to postgres server:", err)
-	}
-
-	return conn
+	return pgx.ConnectConfig(context.Background(), config)
 }
 
-func (rc *ReplicationClient) query(sql string, values ...any) pgx.Rows {
-	rows, err := rc.conn.Query(context.Background(), sql, values...)
-	if err != nil {
-		log.Fatalf("Query \"%s\" failed: %v\n", sql, err)
-	}
-
-	return rows
+func (rc *ReplicationClient) query(sql string, values ...any) (pgx.Rows, error) {
+	return rc.conn.Query(context.Background(), sql, values...)
 }
 
 func (rc *ReplicationClient) query1(sql string, values ...any) pgx.Row {
 	return rc.conn.QueryRow(context.Background(), sql, values...)
 }
 
-func (rc *ReplicationClient) exec(sql string, values ...any) {
-	rc.query(sql, values...).Close()
-}
-
-// space, single quote, comma, period, asterisk need to be escaped with \
-// https://github.com/eulerto/wal2json/blob/master/README.md#parameters
-func escapeWal2JsonTableName(table string) string {
-	return strings.NewReplacer(" ", `\ `, "'", `\'`, ",", `\,`, "*", `\*`).Replace(table)
+func (rc *ReplicationClient) exec(sql string, values ...any) error {
+	_, err := rc.conn.Exec(context.Background(), sql, values...)
+	return err
 }
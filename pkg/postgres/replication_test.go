@@ -3,6 +3,7 @@ package postgres
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"reflect"
 	"strings"
 	"testing"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/jackc/pgx/v5"
 
+	"github.com/tonyfg/trucker/pkg/config"
 	"github.com/tonyfg/trucker/pkg/db"
 	"github.com/tonyfg/trucker/test/helpers"
 )
@@ -19,7 +21,10 @@ func TestSetup(t *testing.T) {
 	defer conn.Close(context.Background())
 	defer rc.Close()
 
-	tablesToBackfill, backfillLSN, snapshotName := rc.Setup()
+	tablesToBackfill, backfillLSN, snapshotName, err := rc.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(tablesToBackfill) != 1 {
 		t.Error("Expected to backfill 1 table, but got", len(tablesToBackfill))
 	}
@@ -39,18 +44,24 @@ func TestStart(t *testing.T) {
 	defer conn.Close(context.Background())
 	defer rc.Close()
 
-	_, backfillLSN, _ := rc.Setup()
+	_, backfillLSN, _, err := rc.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Only Jamaica should show up in the replication stream, since everything
 	// else is from before the snapthot
-	_, err := conn.Exec(
+	_, err = conn.Exec(
 		context.Background(),
 		"INSERT INTO public.countries (name) VALUES ('Jamaica')")
 	if err != nil {
 		t.Error(err)
 	}
 
-	changesChan := rc.Start(backfillLSN, 0)
+	changesChan, err := rc.Start(backfillLSN, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	select {
 	case res := <-changesChan:
@@ -186,9 +197,12 @@ func TestStartWithWeirdTypes(t *testing.T) {
 	defer conn.Close(context.Background())
 	defer rc.Close()
 
-	_, backfillLSN, _ := rc.Setup()
+	_, backfillLSN, _, err := rc.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	_, err := conn.Exec(
+	_, err = conn.Exec(
 		context.Background(),
 		`INSERT INTO public.weird_types (a_number, a_bool, a_date, an_ip_addr, a_jsonb, a_ts, a_text_array)
 VALUES (33, false, '2013-12-11', '193.137.213.0/24', '{"some": "thing"}', '2032-10-01T00:00:22Z', '{yo, yo, ma}')`)
@@ -196,7 +210,10 @@ VALUES (33, false, '2013-12-11', '193.137.213.0/24', '{"some": "thing"}', '2032-
 		t.Error(err)
 	}
 
-	changesChan := rc.Start(backfillLSN, 0)
+	changesChan, err := rc.Start(backfillLSN, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	select {
 	case res := <-changesChan:
@@ -258,9 +275,31 @@ got: %v`, expectedInsertCols, change.Columns)
 	}
 }
 
+func TestReconnectGivesUp(t *testing.T) {
+	connCfg := config.Connection{Name: "unreachable", Host: "127.0.0.1", Port: 1, Database: "trucker", User: "trucker"}
+	reconnectCfg := config.Reconnect{MaxAttempts: 2, InitialBackoffMs: 1, MaxBackoffMs: 1}
+	rc, err := NewReplicationClient([]string{"public.countries"}, nil, connCfg, reconnectCfg, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cause := errors.New("connection lost")
+	if _, err := rc.reconnect(0, cause); err == nil || errors.Is(err, errStopped) {
+		t.Error("Expected reconnecting to an unreachable server to give up, got", err)
+	}
+
+	rc.Close()
+	if _, err := rc.reconnect(0, cause); !errors.Is(err, errStopped) {
+		t.Error("Expected reconnecting after replication was stopped to stop, got", err)
+	}
+}
+
 func replicationTestSetup(table string) (*pgx.Conn, *ReplicationClient) {
 	conn := helpers.PreparePostgresTestDb()
-	replicationClient := NewReplicationClient([]string{table}, helpers.PostgresCfg, "2")
+	replicationClient, err := NewReplicationClient([]string{table}, nil, helpers.PostgresCfg, helpers.ReconnectCfg, "2")
+	if err != nil {
+		panic(err)
+	}
 
 	return conn, replicationClient
 }
@@ -0,0 +1,190 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/logging"
+)
+
+// RowFilter drops the streamed changes that don't match a truck's where
+// conditions, for tables whose condition wasn't pushed down into the
+// publication (before Postgres 15, for example). The conditions are evaluated
+// by the input database, on the changed rows' values. That's a round trip per
+// changeset (two for updates, for the new and old values), on top of the
+// truck's input query.
+type RowFilter struct {
+	where  map[string]string
+	rc     *ReplicationClient
+	conn   *pgxpool.Pool
+	logger *slog.Logger
+}
+
+func NewRowFilter(truckName string, where map[string]string, rc *ReplicationClient, cfg config.Connection) (*RowFilter, error) {
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RowFilter{
+		where:  where,
+		rc:     rc,
+		conn:   conn,
+		logger: logging.ForTruck(truckName).With("connection", cfg.Name),
+	}, nil
+}
+
+// Filter returns the changes in the changeset that match the table's where
+// condition. Like Postgres does with publication row filters, an update to a
+// row that stops matching becomes a delete, and an update to a row that starts
+// matching becomes an insert. Setup makes sure the replica identity covers the
+// columns the condition uses, so old values are there to evaluate it on. Rows
+// the condition is NULL for don't match, except for deletes, which go through
+// unless the row is known not to match.
+func (f *RowFilter) Filter(changeset *db.Changeset) ([]*db.Changeset, error) {
+	where := strings.TrimSpace(f.where[changeset.Table])
+	if where == "" || where == f.rc.PublishedWhere(changeset.Table) || len(changeset.Rows) == 0 {
+		return []*db.Changeset{changeset}, nil
+	}
+
+	numCols := len(changeset.Columns) / 2
+	columns := changeset.Columns[:numCols]
+
+	var newMatches, oldMatches []*bool
+	var err error
+	if changeset.Operation != db.Delete {
+		newMatches, err = f.matches(changeset.Table, columns, where, changeset.Rows, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if changeset.Operation != db.Insert {
+		oldMatches, err = f.matches(changeset.Table, columns, where, changeset.Rows, numCols)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filtered := make([]*db.Changeset, 0, 1)
+	// Rows keep the unchanged values flagged at index i of the changeset,
+	// except when they become deletes, which only have old values
+	appendRow := func(operation uint8, row []any, i int) {
+		if len(filtered) == 0 || filtered[len(filtered)-1].Operation != operation {
+			filtered = append(filtered, &db.Changeset{
+				Table:     changeset.Table,
+				Operation: operation,
+				Columns:   changeset.Columns,
+				Rows:      make([][]any, 0, 1),
+			})
+		}
+		last := filtered[len(filtered)-1]
+		if operation != db.Delete {
+			for col := range numCols {
+				if changeset.IsUnchanged(i, col) {
+					last.MarkUnchanged(len(last.Rows), col)
+				}
+			}
+		}
+		last.Rows = append(last.Rows, row)
+	}
+
+	for i, row := range changeset.Rows {
+		switch changeset.Operation {
+		case db.Insert:
+			if isTrue(newMatches[i]) {
+				appendRow(db.Insert, row, i)
+			}
+		case db.Delete:
+			if !isFalse(oldMatches[i]) {
+				appendRow(db.Delete, row, i)
+			}
+		case db.Update:
+			if isTrue(newMatches[i]) && isFalse(oldMatches[i]) {
+				appendRow(db.Insert, asInsert(row, numCols), i)
+			} else if isTrue(newMatches[i]) {
+				appendRow(db.Update, row, i)
+			} else if isTrue(oldMatches[i]) {
+				appendRow(db.Delete, asDelete(row, numCols), i)
+			}
+		}
+	}
+
+	return filtered, nil
+}
+
+func (f *RowFilter) Close() {
+	f.conn.Close()
+}
+
+// matches evaluates the condition for the values starting at offset in each
+// row (0 for new values, and the number of columns for old ones). Results are
+// nil where the condition is NULL.
+func (f *RowFilter) matches(table string, columns []db.Column, where string, rows [][]any, offset int) ([]*bool, error) {
+	results := make([]*bool, 0, len(rows))
+	columnsLiteral := makeColumnsList(columns).String()
+
+	for chunk := range slices.Chunk(rows, maxPreparedStatementArgs/len(columns)) {
+		values := make([][]any, len(chunk))
+		for i, row := range chunk {
+			values[i] = row[offset : offset+len(columns)]
+		}
+
+		valuesList, params := makeValuesList(columns, values, true)
+		sql := fmt.Sprintf("SELECT (%s)::boolean FROM (VALUES %s) AS r (%s)", where, valuesList.String(), columnsLiteral)
+
+		rows, err := f.conn.Query(context.Background(), sql, params...)
+		if err != nil {
+			f.logger.Error("Error evaluating where condition", "table", table, "where", where, logging.Err(err))
+			return nil, &db.Error{Op: "filter", Table: table, Query: sql, Err: err}
+		}
+
+		for rows.Next() {
+			var match *bool
+			if err := rows.Scan(&match); err != nil {
+				rows.Close()
+				return nil, &db.Error{Op: "filter", Table: table, Query: sql, Err: err}
+			}
+			results = append(results, match)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, &db.Error{Op: "filter", Table: table, Query: sql, Err: err}
+		}
+	}
+
+	return results, nil
+}
+
+func isTrue(match *bool) bool {
+	return match != nil && *match
+}
+
+func isFalse(match *bool) bool {
+	return match != nil && !*match
+}
+
+// asInsert turns an update's row into an insert's, without old values.
+func asInsert(row []any, numCols int) []any {
+	insert := make([]any, len(row))
+	copy(insert, row[:numCols])
+	return insert
+}
+
+// asDelete turns an update's row into a delete's, with the new values standing
+// in for the old values that weren't sent.
+func asDelete(row []any, numCols int) []any {
+	del := make([]any, len(row))
+	for i := range numCols {
+		del[i+numCols] = row[i+numCols]
+		if del[i+numCols] == nil {
+			del[i+numCols] = row[i]
+		}
+	}
+	return del
+}
@@ -0,0 +1,19 @@
+package postgres
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAsInsertAndAsDelete(t *testing.T) {
+	// id, tenant_id, old__id, old__tenant_id, with only the old key sent
+	row := []any{1, 43, 1, nil}
+
+	if insert := asInsert(row, 2); !slices.Equal(insert, []any{1, 43, nil, nil}) {
+		t.Error("Expected the new values without old ones, got", insert)
+	}
+
+	if del := asDelete(row, 2); !slices.Equal(del, []any{nil, nil, 1, 43}) {
+		t.Error("Expected the old values, filled in with new ones, got", del)
+	}
+}
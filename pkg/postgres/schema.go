@@ -0,0 +1,290 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/logging"
+)
+
+// sourceColumn is a column of an input table as the server describes it.
+// pgoutput describes types by OID and type modifier, and wal2json by name, so
+// columns from the stream only have one or the other.
+type sourceColumn struct {
+	name     string
+	typeOid  uint32
+	typeMod  int32
+	typeName string // as format_type() puts it, which is how wal2json does
+}
+
+// sameType tells whether two descriptions of a column have the same type,
+// comparing whatever both of them have.
+func (c sourceColumn) sameType(other sourceColumn) bool {
+	if c.typeOid != 0 && other.typeOid != 0 {
+		return c.typeOid == other.typeOid && c.typeMod == other.typeMod
+	}
+	if c.typeName != "" && other.typeName != "" {
+		return c.typeName == other.typeName
+	}
+
+	return true
+}
+
+// tableSchemas keeps track of the columns each replicated table has in the
+// stream, so decoders notice when a table's schema changes. It starts out with
+// the columns looked up in the catalog when replication was set up. The
+// stream may begin further back, with changes made while a table still had
+// other columns: those are taken as they come, and only changes to the
+// columns from then on count as schema changes.
+type tableSchemas struct {
+	columns   map[string][]sourceColumn // by table
+	loadedLSN uint64                    // where the WAL was when the columns were looked up
+	// Updates the columns replicated for a table to the ones it has in the
+	// stream. nil when there's nothing to update.
+	refresh func(table string, columns []string)
+}
+
+func newTableSchemas() *tableSchemas {
+	return &tableSchemas{columns: make(map[string][]sourceColumn)}
+}
+
+// check compares the columns a table has in the stream at lsn with the ones it
+// had before, and refreshes the columns replicated for it if they've changed.
+// partial means columns may be left out without having been dropped. It
+// returns the change, or nil if there's none (or it happened before the
+// columns were looked up).
+func (s *tableSchemas) check(table string, lsn uint64, columns []sourceColumn, partial bool) *db.SchemaChange {
+	known, ok := s.columns[table]
+	if !ok {
+		s.columns[table] = columns
+		return nil
+	}
+
+	if partial {
+		for _, col := range known {
+			if !slices.ContainsFunc(columns, func(c sourceColumn) bool { return c.name == col.name }) {
+				columns = append(columns, col)
+			}
+		}
+	}
+
+	change := diffColumns(table, known, columns)
+	if change == nil {
+		return nil
+	}
+
+	s.columns[table] = columns
+	if s.refresh != nil {
+		names := make([]string, len(columns))
+		for i, col := range columns {
+			names[i] = col.name
+		}
+		s.refresh(table, names)
+	}
+
+	if lsn < s.loadedLSN {
+		return nil
+	}
+
+	return change
+}
+
+// diffColumns returns how a table's columns went from before to after, or nil
+// if they didn't change.
+func diffColumns(table string, before []sourceColumn, after []sourceColumn) *db.SchemaChange {
+	change := db.SchemaChange{Table: table}
+
+	for _, col := range after {
+		i := slices.IndexFunc(before, func(c sourceColumn) bool { return c.name == col.name })
+		if i < 0 {
+			change.Added = append(change.Added, col.name)
+		} else if !before[i].sameType(col) {
+			change.Retyped = append(change.Retyped, col.name)
+		}
+	}
+
+	for _, col := range before {
+		if !slices.ContainsFunc(after, func(c sourceColumn) bool { return c.name == col.name }) {
+			change.Dropped = append(change.Dropped, col.name)
+		}
+	}
+
+	if len(change.Added) == 0 && len(change.Dropped) == 0 && len(change.Retyped) == 0 {
+		return nil
+	}
+
+	return &change
+}
+
+// loadTableColumns looks up the columns of a table in the catalog, in order,
+// both as trucker replicates them and as the server describes them.
+func loadTableColumns(conn *pgx.Conn, table string) ([]db.Column, []sourceColumn, error) {
+	schemaAndTable := strings.Split(table, ".")
+	rows, err := conn.Query(
+		context.Background(),
+		`SELECT c.column_name, c.data_type, c.udt_name, a.atttypid, a.atttypmod, format_type(a.atttypid, a.atttypmod)
+FROM information_schema.columns c
+JOIN pg_attribute a ON a.attrelid = format('%I.%I', c.table_schema, c.table_name)::regclass AND a.attname = c.column_name
+WHERE c.table_schema = $1 AND c.table_name = $2
+ORDER BY c.ordinal_position`,
+		schemaAndTable[0],
+		schemaAndTable[1],
+	)
+	if err != nil {
+		return nil, nil, &db.Error{Op: "look up columns", Err: err}
+	}
+	defer rows.Close()
+
+	columns := make([]db.Column, 0, 1)
+	sourceColumns := make([]sourceColumn, 0, 1)
+	for rows.Next() {
+		var dataType, udtName string
+		var col sourceColumn
+		if err := rows.Scan(&col.name, &dataType, &udtName, &col.typeOid, &col.typeMod, &col.typeName); err != nil {
+			return nil, nil, &db.Error{Op: "look up columns", Err: err}
+		}
+
+		if dataType == "ARRAY" {
+			udtName = fmt.Sprintf("%s[]", udtName[1:])
+		}
+
+		columns = append(columns, db.Column{Name: col.name, Type: pgTypeToDbType(udtName)})
+		sourceColumns = append(sourceColumns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, &db.Error{Op: "look up columns", Err: err}
+	}
+
+	return columns, sourceColumns, nil
+}
+
+// queryer is what primaryKeyColumns needs to run its query: a connection, a
+// pool or a transaction.
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// primaryKeyColumns looks up the columns of a table's primary key in the
+// catalog, in order, with their names and types. It's empty if the table
+// doesn't have one.
+func primaryKeyColumns(ctx context.Context, q queryer, table string) ([]sourceColumn, error) {
+	rows, err := q.Query(
+		ctx,
+		`SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+FROM pg_index i
+JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+WHERE i.indrelid = $1::regclass AND i.indisprimary
+ORDER BY array_position(i.indkey::int2[], a.attnum)`,
+		pgx.Identifier(strings.Split(table, ".")).Sanitize(),
+	)
+	if err != nil {
+		return nil, &db.Error{Op: "look up primary key", Table: table, Err: err}
+	}
+
+	columns, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (sourceColumn, error) {
+		var col sourceColumn
+		err := row.Scan(&col.name, &col.typeName)
+		return col, err
+	})
+	if err != nil {
+		return nil, &db.Error{Op: "look up primary key", Table: table, Err: err}
+	}
+
+	return columns, nil
+}
+
+// replicatedColumns returns the columns of a table that at least one truck
+// reads. Columns used in where conditions are replicated even if the trucks
+// don't read them, since changes are filtered before projecting them.
+func (rc *ReplicationClient) replicatedColumns(table string, tableColumns []db.Column) []db.Column {
+	columnNames := make([]string, len(tableColumns))
+	for i, col := range tableColumns {
+		columnNames[i] = col.Name
+	}
+
+	columnFilters := make([]db.ColumnFilter, len(rc.filters[table]))
+	for i, filter := range rc.filters[table] {
+		columnFilters[i] = filter.Columns
+		if filter.Where != "" && len(filter.Columns.Only) > 0 {
+			columnFilters[i].Only = append(slices.Clone(filter.Columns.Only), referencedColumns(filter.Where, columnNames)...)
+		} else if filter.Where != "" {
+			referenced := referencedColumns(filter.Where, columnNames)
+			columnFilters[i].Except = slices.DeleteFunc(slices.Clone(filter.Columns.Except), func(col string) bool { return slices.Contains(referenced, col) })
+		}
+	}
+
+	return slices.DeleteFunc(slices.Clone(tableColumns), func(col db.Column) bool {
+		return !db.AnyIncludes(columnFilters, col.Name)
+	})
+}
+
+// refreshColumns looks a table's columns up again after its schema changed in
+// the stream, and replaces the ones replicated for it. Only the columns the
+// table has in the stream are kept, since it may have changed again since. If
+// the lookup fails, the columns that are left keep being replicated.
+//
+// The lookup goes through the connection Setup opened, which nothing else
+// uses while streaming. It's opened again if it was closed in the meantime.
+func (rc *ReplicationClient) refreshColumns(table string, columnNames []string) {
+	var tableColumns []db.Column
+	var err error
+	if rc.conn == nil || rc.conn.IsClosed() {
+		rc.conn, err = rc.tryConnect(false)
+	}
+	if err == nil {
+		tableColumns, _, err = loadTableColumns(rc.conn, table)
+	}
+	if err != nil {
+		rc.logger.Error("Unable to look up columns after schema change, replicating the ones that are left", "table", table, logging.Err(err))
+		tableColumns, _ = rc.columnsCache.get(table)
+	}
+
+	tableColumns = slices.DeleteFunc(slices.Clone(tableColumns), func(col db.Column) bool {
+		return !slices.Contains(columnNames, col.Name)
+	})
+	replicated := rc.replicatedColumns(table, tableColumns)
+	rc.columnsCache.set(table, replicated)
+
+	rc.logger.Info("Refreshed replicated columns after schema change", "table", table, "columns", len(replicated))
+}
+
+// columnsCache holds the columns replicated for each table. Decoders read it
+// while changesets handed over earlier may still be using what they got, so
+// the map is never written to once it's stored: set swaps in an updated copy.
+type columnsCache struct {
+	mu     sync.Mutex // serializes set
+	tables atomic.Pointer[map[string][]db.Column]
+}
+
+func newColumnsCache(tables map[string][]db.Column) *columnsCache {
+	c := &columnsCache{}
+	c.tables.Store(&tables)
+	return c
+}
+
+func (c *columnsCache) get(table string) ([]db.Column, bool) {
+	columns, ok := (*c.tables.Load())[table]
+	return columns, ok
+}
+
+// all returns the columns of every table. The map must not be modified.
+func (c *columnsCache) all() map[string][]db.Column {
+	return *c.tables.Load()
+}
+
+func (c *columnsCache) set(table string, columns []db.Column) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tables := maps.Clone(*c.tables.Load())
+	tables[table] = columns
+	c.tables.Store(&tables)
+}
@@ -0,0 +1,190 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+func TestDiffColumns(t *testing.T) {
+	before := []sourceColumn{
+		{name: "id", typeOid: pgtype.Int4OID, typeMod: -1},
+		{name: "name", typeOid: pgtype.VarcharOID, typeMod: 14},
+		{name: "age", typeOid: pgtype.Int4OID, typeMod: -1},
+	}
+
+	if change := diffColumns("public.whiskies", before, slices.Clone(before)); change != nil {
+		t.Error("Expected no change for the same columns, got", change)
+	}
+
+	after := []sourceColumn{
+		{name: "id", typeOid: pgtype.Int8OID, typeMod: -1},
+		{name: "name", typeOid: pgtype.VarcharOID, typeMod: 104},
+		{name: "distillery", typeOid: pgtype.TextOID, typeMod: -1},
+	}
+	expected := &db.SchemaChange{
+		Table:   "public.whiskies",
+		Added:   []string{"distillery"},
+		Dropped: []string{"age"},
+		Retyped: []string{"id", "name"},
+	}
+	if change := diffColumns("public.whiskies", before, after); !reflect.DeepEqual(change, expected) {
+		t.Errorf("Expected %v, got %v", expected, change)
+	}
+
+	expectedStr := "public.whiskies: added distillery; dropped age; changed the type of id, name"
+	if got := expected.String(); got != expectedStr {
+		t.Errorf("Expected %q, got %q", expectedStr, got)
+	}
+}
+
+func TestSameType(t *testing.T) {
+	catalog := sourceColumn{name: "name", typeOid: pgtype.VarcharOID, typeMod: 14, typeName: "character varying(10)"}
+
+	cases := []struct {
+		column   sourceColumn
+		expected bool
+	}{
+		{sourceColumn{name: "name", typeOid: pgtype.VarcharOID, typeMod: 14}, true},
+		{sourceColumn{name: "name", typeOid: pgtype.VarcharOID, typeMod: 24}, false},
+		{sourceColumn{name: "name", typeOid: pgtype.TextOID, typeMod: -1}, false},
+		{sourceColumn{name: "name", typeName: "character varying(10)"}, true},
+		{sourceColumn{name: "name", typeName: "text"}, false},
+		{sourceColumn{name: "name"}, true},
+	}
+
+	for _, c := range cases {
+		if got := catalog.sameType(c.column); got != c.expected {
+			t.Errorf("Expected sameType(%+v) to be %t", c.column, c.expected)
+		}
+	}
+}
+
+func TestTableSchemasCheck(t *testing.T) {
+	schemas := newTableSchemas()
+	schemas.loadedLSN = 100
+	schemas.columns["public.whiskies"] = []sourceColumn{{name: "id"}, {name: "name"}}
+
+	refreshed := make([][]string, 0)
+	schemas.refresh = func(table string, columns []string) {
+		refreshed = append(refreshed, columns)
+	}
+
+	// Changes from before the columns were looked up are taken as they come
+	if change := schemas.check("public.whiskies", 50, []sourceColumn{{name: "id"}}, false); change != nil {
+		t.Error("Expected no schema change before the columns were looked up, got", change)
+	}
+
+	change := schemas.check("public.whiskies", 150, []sourceColumn{{name: "id"}, {name: "name"}}, false)
+	if change == nil || !slices.Equal(change.Added, []string{"name"}) {
+		t.Error("Expected name to be added, got", change)
+	}
+
+	if change := schemas.check("public.whiskies", 160, []sourceColumn{{name: "id"}, {name: "name"}}, false); change != nil {
+		t.Error("Expected no schema change for the same columns, got", change)
+	}
+
+	// Partial rows don't tell whether columns were dropped
+	change = schemas.check("public.whiskies", 170, []sourceColumn{{name: "id"}, {name: "age"}}, true)
+	if change == nil || !slices.Equal(change.Added, []string{"age"}) || len(change.Dropped) > 0 {
+		t.Error("Expected only age to be added, got", change)
+	}
+
+	expected := [][]string{{"id"}, {"id", "name"}, {"id", "age", "name"}}
+	if !reflect.DeepEqual(refreshed, expected) {
+		t.Errorf("Expected columns to be refreshed to %v, got %v", expected, refreshed)
+	}
+
+	// Tables that haven't been looked up start out with the first columns seen
+	if change := schemas.check("public.countries", 200, []sourceColumn{{name: "id"}}, false); change != nil {
+		t.Error("Expected no schema change for a table seen for the first time, got", change)
+	}
+}
+
+func TestPgoutputSchemaChange(t *testing.T) {
+	d := pgoutputTestSetup()
+	d.schemas.refresh = func(table string, columns []string) {
+		replicated, _ := d.columnsCache.get(table)
+		d.columnsCache.set(table, append(slices.Clone(replicated), db.Column{Name: "capital", Type: db.String}))
+	}
+
+	mustDecode(t, d, pgoutputBegin(100))
+	mustDecode(t, d, pgoutputRelation())
+	mustDecode(t, d, pgoutputChange('I', 16384, 'N', [][]byte{[]byte("6"), []byte("Jamaica")}))
+	if tx := mustDecode(t, d, pgoutputCommit(200)); len(tx.SchemaChanges) > 0 {
+		t.Error("Expected no schema changes, got", tx.SchemaChanges)
+	}
+
+	mustDecode(t, d, pgoutputBegin(300))
+	mustDecode(t, d, pgoutputRelationWithCapital())
+	mustDecode(t, d, pgoutputChange('I', 16384, 'N', [][]byte{[]byte("7"), []byte("Japan"), []byte("Tokyo")}))
+	tx := mustDecode(t, d, pgoutputCommit(400))
+
+	expected := []db.SchemaChange{{Table: "public.countries", Added: []string{"capital"}}}
+	if !reflect.DeepEqual(tx.SchemaChanges, expected) {
+		t.Errorf("Expected schema changes %v, got %v", expected, tx.SchemaChanges)
+	}
+
+	for changeset := range tx.Changesets {
+		expectedRows := [][]any{{int32(7), "Japan", "Tokyo", nil, nil, nil}}
+		if !reflect.DeepEqual(changeset.Rows, expectedRows) {
+			t.Errorf("Expected rows to be %v but got %v", expectedRows, changeset.Rows)
+		}
+	}
+}
+
+func TestWal2JsonSchemaChange(t *testing.T) {
+	columnsCache := newColumnsCache(map[string][]db.Column{
+		"public.whiskies": {{Name: "id", Type: db.Int32}, {Name: "name", Type: db.String}},
+	})
+	schemas := newTableSchemas()
+	schemas.columns["public.whiskies"] = []sourceColumn{{name: "id", typeName: "integer"}, {name: "name", typeName: "text"}}
+	d := &wal2jsonDecoder{tables: []string{"public.whiskies"}, columnsCache: columnsCache, schemas: schemas}
+
+	wal2json := `{"change": [
+{"kind":"update","schema":"public","table":"whiskies","columnnames":["id"],"columntypes":["integer"],"columnvalues":[1]},
+{"kind":"delete","schema":"public","table":"whiskies","oldkeys":{"keynames":["id"],"keytypes":["integer"],"keyvalues":[1]}},
+{"kind":"insert","schema":"public","table":"whiskies","columnnames":["id","name"],"columntypes":["bigint","text"],"columnvalues":[2,"a"]}
+]}`
+	tx := mustDecode(t, d, pglogrepl.XLogData{WALStart: 100, WALData: []byte(wal2json)})
+
+	expected := []db.SchemaChange{{Table: "public.whiskies", Retyped: []string{"id"}}}
+	if !reflect.DeepEqual(tx.SchemaChanges, expected) {
+		t.Errorf("Expected schema changes %v, got %v", expected, tx.SchemaChanges)
+	}
+}
+
+func TestColumnsCacheSet(t *testing.T) {
+	c := newColumnsCache(map[string][]db.Column{"public.countries": {{Name: "id", Type: db.Int32}}})
+	before := c.all()
+
+	c.set("public.countries", []db.Column{{Name: "id", Type: db.Int32}, {Name: "name", Type: db.String}})
+	c.set("public.whiskies", []db.Column{{Name: "id", Type: db.Int32}})
+
+	if len(before) != 1 || len(before["public.countries"]) != 1 {
+		t.Error("Expected the columns handed out before to stay the same, got", before)
+	}
+	if columns, ok := c.get("public.countries"); !ok || len(columns) != 2 {
+		t.Error("Expected the new columns, got", columns)
+	}
+	if _, ok := c.get("public.whiskies"); !ok {
+		t.Error("Expected the new table to be cached")
+	}
+}
+
+// pgoutputRelationWithCapital is pgoutputRelation after adding a capital column.
+func pgoutputRelationWithCapital() pglogrepl.XLogData {
+	xld := pgoutputRelation()
+	binary.BigEndian.PutUint16(xld.WALData[23:], 3)
+	xld.WALData = append(xld.WALData, 0)
+	xld.WALData = append(xld.WALData, "capital\x00"...)
+	xld.WALData = binary.BigEndian.AppendUint32(xld.WALData, pgtype.TextOID)
+	xld.WALData = binary.BigEndian.AppendUint32(xld.WALData, 0xffffffff)
+	return xld
+}
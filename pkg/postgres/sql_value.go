@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"iter"
-	"log"
+	"log/slog"
 	"slices"
 	"strings"
 
@@ -17,14 +17,16 @@ import (
 type sqlValue string
 
 type WalData struct {
-	Changes []WalChange `json:"change"`
+	Timestamp string      `json:"timestamp"`
+	Changes   []WalChange `json:"change"`
 }
 
 type WalChange struct {
-	Kind         string   `json:"kind"` // insert, update, delete
+	Kind         string   `json:"kind"` // insert, update, delete, truncate
 	Schema       string   `json:"schema"`
 	Table        string   `json:"table"`
 	ColumnNames  []string `json:"columnnames"`
+	ColumnTypes  []string `json:"columntypes"`
 	ColumnValues []any    `json:"columnvalues"`
 	OldKeys      struct {
 		KeyNames  []string `json:"keynames"`
@@ -34,14 +36,16 @@ type WalChange struct {
 
 const maxPreparedStatementArgs = 32767
 
-func makeChangesets(wal2jsonChanges []byte, columnsCache map[string][]db.Column) iter.Seq[*db.Changeset] {
+func decodeWal2Json(wal2jsonChanges []byte) (WalData, error) {
 	data := WalData{}
 	d := json.NewDecoder(bytes.NewReader(wal2jsonChanges))
 	d.UseNumber()
-	if err := d.Decode(&data); err != nil {
-		log.Fatalf("Failed to unmarshal wal2json payload: %v\n", err)
-	}
+	err := d.Decode(&data)
+
+	return data, err
+}
 
+func makeChangesets(data WalData, columnsCache map[string][]db.Column) iter.Seq[*db.Changeset] {
 	return func(yield func(*db.Changeset) bool) {
 		var changeset *db.Changeset = nil
 
@@ -65,8 +69,12 @@ func makeChangesets(wal2jsonChanges []byte, columnsCache map[string][]db.Column)
 					operation = db.Update
 				case "delete":
 					operation = db.Delete
+				case "truncate":
+					operation = db.Truncate
 				default:
-					log.Fatalf("Unknown operation: %s\n", change.Kind)
+					// The decoder doesn't let them through
+					changeset = nil
+					continue
 				}
 
 				changeset = &db.Changeset{
@@ -77,6 +85,10 @@ func makeChangesets(wal2jsonChanges []byte, columnsCache map[string][]db.Column)
 				}
 			}
 
+			if changeset.Operation == db.Truncate {
+				continue
+			}
+
 			row := make([]any, numCols*2)
 
 			for i, col := range tableCols {
@@ -89,9 +101,8 @@ func makeChangesets(wal2jsonChanges []byte, columnsCache map[string][]db.Column)
 						//       by changing change.ColumnValues[i] to
 						//       change.ColumnValues[valueIdx] a couple of lines
 						//       above.
-						log.Printf("Column %s not found in change data for table %s, skipping...\n", col.Name, table)
-						log.Printf("Column names: %v\n", change.ColumnNames)
-						log.Printf("Column values: %v\n", change.ColumnValues)
+						slog.Warn("Column not found in change data, skipping...", "table", table, "column", col.Name)
+						slog.Debug("Change data", "table", table, "column_names", change.ColumnNames, "column_values", change.ColumnValues)
 					}
 				}
 
@@ -99,6 +110,16 @@ func makeChangesets(wal2jsonChanges []byte, columnsCache map[string][]db.Column)
 				if oldValueIdx > -1 {
 					row[i+numCols] = change.OldKeys.KeyValues[oldValueIdx]
 				}
+
+				// Updates leave out TOASTed values that didn't change. With
+				// REPLICA IDENTITY FULL the old value is there to stand in.
+				if valueIdx < 0 && changeset.Operation == db.Update {
+					if oldValueIdx > -1 {
+						row[i] = row[i+numCols]
+					} else {
+						changeset.MarkUnchanged(len(changeset.Rows), i)
+					}
+				}
 			}
 
 			changeset.Rows = append(changeset.Rows, row)
@@ -114,7 +135,7 @@ func changesetCols(columns []db.Column) []db.Column {
 	cols := make([]db.Column, len(columns)*2)
 	for i, col := range columns {
 		cols[i] = col
-		cols[i+len(columns)] = db.Column{Name: "old__" + col.Name, Type: col.Type}
+		cols[i+len(columns)] = db.Column{Name: db.OldColumnPrefix + col.Name, Type: col.Type}
 	}
 	return cols
 }
@@ -241,7 +262,7 @@ func oidToDbType(oid uint32) uint8 {
 	case pgtype.JSONArrayOID, pgtype.JSONBArrayOID: // TODO: hstore doesn't have a stable OID since it's an extension. can we get it from pg_types to use here?
 		return db.MapStringToStringArray
 	default:
-		log.Printf("[Postgres SQL Value] Unknown OID %d, treating as string...\n", oid)
+		slog.Warn("Unknown type OID, treating as string...", "type_oid", oid)
 		return db.String
 	}
 }
@@ -297,7 +318,7 @@ func pgTypeToDbType(pgType string) uint8 {
 	case "hstore[]", "json[]", "jsonb[]":
 		return db.MapStringToStringArray
 	default:
-		log.Printf("[Postgres SQL Value] Unknown type %s, treating as string...\n", pgType)
+		slog.Warn("Unknown Postgres type, treating as string...", "type", pgType)
 		return db.String
 	}
 }
@@ -353,7 +374,7 @@ func dbTypeToPgType(dbType uint8) string {
 	case db.MapStringToStringArray:
 		return "jsonb[]"
 	default:
-		log.Printf("[Postgres SQL Value] Unknown type %d, treating as text...\n", dbType)
+		slog.Warn("Unknown type, treating as text...", "type", dbType)
 		return "text"
 	}
 }
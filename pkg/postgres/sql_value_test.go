@@ -43,7 +43,7 @@ func TestMakeChangesets(t *testing.T) {
 	}
 
 	changesets := make([]*db.Changeset, 0, 8)
-	for changeset := range makeChangesets([]byte(wal2json), columnsCache) {
+	for changeset := range makeChangesets(mustDecodeWal2Json(t, wal2json), columnsCache) {
 		changesets = append(changesets, changeset)
 	}
 
@@ -240,6 +240,52 @@ got %v`, expectedDeleteVals, change7.Rows)
 	}
 }
 
+func TestMakeChangesetsUnchangedToast(t *testing.T) {
+	wal2json := `{"change": [
+{"kind":"update","schema":"public","table":"whiskies","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[1,"a"],"oldkeys":{"keynames":["id"],"keytypes":["integer"],"keyvalues":[1]}},
+{"kind":"update","schema":"public","table":"whiskies","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[2,"b"],"oldkeys":{"keynames":["id"],"keytypes":["integer"],"keyvalues":[2]}},
+{"kind":"update","schema":"public","table":"whiskies","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[3,"c"],"oldkeys":{"keynames":["id","name","notes"],"keytypes":["integer","text","text"],"keyvalues":[3,"c","smoky"]}}
+]}`
+	columnsCache := map[string][]db.Column{
+		"public.whiskies": {{Name: "id", Type: db.Int32}, {Name: "name", Type: db.String}, {Name: "notes", Type: db.String}},
+	}
+
+	for changeset := range makeChangesets(mustDecodeWal2Json(t, wal2json), columnsCache) {
+		if !reflect.DeepEqual(changeset.UnchangedColumns(0), []string{"notes"}) || !reflect.DeepEqual(changeset.UnchangedColumns(1), []string{"notes"}) {
+			t.Errorf("Expected notes to be unchanged in the first two rows, got %v", changeset.Unchanged)
+		}
+
+		// With REPLICA IDENTITY FULL the old value stands in for the new one
+		if len(changeset.UnchangedColumns(2)) > 0 || changeset.Rows[2][2] != "smoky" {
+			t.Errorf("Expected the old notes in the last row, got %v", changeset.Rows[2])
+		}
+	}
+}
+
+func TestMakeChangesetsTruncate(t *testing.T) {
+	wal2json := `{"change": [
+{"kind":"insert","schema":"public","table":"whiskies","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[1,"a"]},
+{"kind":"truncate","schema":"public","table":"whiskies"},
+{"kind":"insert","schema":"public","table":"whiskies","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[2,"b"]}
+]}`
+	columnsCache := map[string][]db.Column{
+		"public.whiskies": {{Name: "id", Type: db.Int32}, {Name: "name", Type: db.String}},
+	}
+
+	operations := make([]string, 0, 3)
+	for changeset := range makeChangesets(mustDecodeWal2Json(t, wal2json), columnsCache) {
+		operations = append(operations, db.OperationStr(changeset.Operation))
+		if changeset.Operation == db.Truncate && len(changeset.Rows) > 0 {
+			t.Errorf("Expected truncate without rows, got %v", changeset.Rows)
+		}
+	}
+
+	expected := []string{"insert", "truncate", "insert"}
+	if !reflect.DeepEqual(operations, expected) {
+		t.Errorf("Expected changesets %v, got %v", expected, operations)
+	}
+}
+
 func TestMakeValuesListFromRowChan(t *testing.T) {
 	columns := []db.Column{
 		{Name: "a", Type: db.Int32}, {Name: "b", Type: db.Int32}, {Name: "c", Type: db.Int32},
@@ -498,3 +544,12 @@ func TestMakeValuesListFromRowChan(t *testing.T) {
 		t.Error("Expected rowChan to have 4000 rows, but it had", len(unreadRows))
 	}
 }
+
+func mustDecodeWal2Json(t *testing.T, wal2json string) WalData {
+	t.Helper()
+	data, err := decodeWal2Json([]byte(wal2json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,86 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// SlotStatus describes trucker's replication slot on an input connection.
+// LSNs are 0 when the server doesn't have them (like a slot that has never
+// been confirmed).
+type SlotStatus struct {
+	Name              string
+	Exists            bool
+	Active            bool
+	ActivePid         int32 // 0 when inactive
+	RestartLSN        uint64
+	ConfirmedFlushLSN uint64
+	CurrentLSN        uint64 // end of the server's WAL
+	RetainedWALBytes  int64  // WAL the server keeps around for the slot
+}
+
+// ReplicationStatus looks up trucker's replication slot on the connection,
+// along with the current end of the WAL.
+func ReplicationStatus(cfg config.Connection, uniqueId string) (SlotStatus, error) {
+	status := SlotStatus{Name: PublicationName(cfg, uniqueId)}
+
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return status, err
+	}
+	defer conn.Close()
+
+	var currentLSN string
+	if err := conn.QueryRow(context.Background(), "SELECT pg_current_wal_lsn()::text").Scan(&currentLSN); err != nil {
+		return status, &db.Error{Op: "get replication status", Err: err}
+	}
+
+	var activePid *int32
+	var restartLSN, confirmedFlushLSN *string
+	var retained *int64
+	err = conn.QueryRow(
+		context.Background(),
+		`SELECT active, active_pid, restart_lsn::text, confirmed_flush_lsn::text,
+  pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn)::bigint
+FROM pg_replication_slots WHERE slot_name = $1`,
+		status.Name,
+	).Scan(&status.Active, &activePid, &restartLSN, &confirmedFlushLSN, &retained)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return status, &db.Error{Op: "get replication status", Err: err}
+	}
+	status.Exists = err == nil
+
+	lsns := []struct {
+		text   *string
+		parsed *uint64
+	}{
+		{&currentLSN, &status.CurrentLSN},
+		{restartLSN, &status.RestartLSN},
+		{confirmedFlushLSN, &status.ConfirmedFlushLSN},
+	}
+	for _, lsn := range lsns {
+		if lsn.text == nil {
+			continue
+		}
+		parsed, err := pglogrepl.ParseLSN(*lsn.text)
+		if err != nil {
+			return status, &db.Error{Op: "get replication status", Err: err}
+		}
+		*lsn.parsed = uint64(parsed)
+	}
+
+	if activePid != nil {
+		status.ActivePid = *activePid
+	}
+	if retained != nil {
+		status.RetainedWALBytes = *retained
+	}
+
+	return status, nil
+}
@@ -0,0 +1,169 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+// refetchUnchanged fills in the values updates left out because they're
+// TOASTed and didn't change, with the rows' current values in the input table.
+// Those may already be from a later change, which is on its way anyway. Rows
+// are looked up by the table's primary key, so it has to be among the
+// changeset's columns. Values of rows that are gone stay flagged as unchanged.
+// Changesets are shared between the trucks reading a table, so the original
+// is left untouched.
+func (r *Reader) refetchUnchanged(changeset *db.Changeset) (*db.Changeset, error) {
+	numCols := len(changeset.Columns) / 2
+	columns := changeset.Columns[:numCols]
+
+	unchangedCols := make([]int, 0)
+	rowIdxs := make([]int, 0)
+	for i := range changeset.Rows {
+		for col := range numCols {
+			if !changeset.IsUnchanged(i, col) {
+				continue
+			}
+			if !slices.Contains(unchangedCols, col) {
+				unchangedCols = append(unchangedCols, col)
+			}
+			if !slices.Contains(rowIdxs, i) {
+				rowIdxs = append(rowIdxs, i)
+			}
+		}
+	}
+	if len(rowIdxs) == 0 {
+		return changeset, nil
+	}
+
+	key, err := r.primaryKey(changeset.Table)
+	if err != nil {
+		return nil, err
+	}
+	keyIdxs := make([]int, len(key))
+	for i, name := range key {
+		keyIdxs[i] = slices.IndexFunc(columns, func(c db.Column) bool { return c.Name == name })
+	}
+	if len(key) == 0 || slices.Contains(keyIdxs, -1) {
+		r.logger.Warn("Can't refetch unchanged TOASTed values without the table's primary key, leaving them NULL", "table", changeset.Table, "primary_key", key)
+		return changeset, nil
+	}
+
+	refetched := &db.Changeset{
+		Table:     changeset.Table,
+		Operation: changeset.Operation,
+		Columns:   changeset.Columns,
+		Rows:      slices.Clone(changeset.Rows),
+		Unchanged: make([][]bool, len(changeset.Unchanged)),
+	}
+	for i, unchanged := range changeset.Unchanged {
+		refetched.Unchanged[i] = slices.Clone(unchanged)
+	}
+	for _, i := range rowIdxs {
+		refetched.Rows[i] = slices.Clone(changeset.Rows[i])
+	}
+
+	// Each key goes along with the index of its row in the changeset
+	keyColumns := make([]db.Column, 0, len(key)+1)
+	for _, idx := range keyIdxs {
+		keyColumns = append(keyColumns, columns[idx])
+	}
+	keyColumns = append(keyColumns, db.Column{Name: "row__", Type: db.Int32})
+
+	selectList := make([]string, len(unchangedCols))
+	for i, col := range unchangedCols {
+		selectList[i] = "t." + pgx.Identifier{columns[col].Name}.Sanitize()
+	}
+	tableName := pgx.Identifier(strings.Split(changeset.Table, ".")).Sanitize()
+
+	for chunk := range slices.Chunk(rowIdxs, maxPreparedStatementArgs/len(keyColumns)) {
+		keys := make([][]any, len(chunk))
+		for i, rowIdx := range chunk {
+			keys[i] = make([]any, 0, len(keyColumns))
+			for _, idx := range keyIdxs {
+				keys[i] = append(keys[i], changeset.Rows[rowIdx][idx])
+			}
+			keys[i] = append(keys[i], int32(rowIdx))
+		}
+
+		valuesList, params := makeValuesList(keyColumns, keys, true)
+		sql := fmt.Sprintf(
+			"SELECT k.row__, %s FROM %s t JOIN (VALUES %s) AS k (%s) USING (%s)",
+			strings.Join(selectList, ", "),
+			tableName,
+			valuesList.String(),
+			makeColumnsList(keyColumns).String(),
+			makeColumnsList(keyColumns[:len(key)]).String(),
+		)
+
+		rows, err := r.conn.Query(context.Background(), sql, params...)
+		if err != nil {
+			return nil, &db.Error{Op: "refetch unchanged values", Table: changeset.Table, Query: sql, Err: err}
+		}
+
+		for rows.Next() {
+			values, err := rows.Values()
+			if err != nil {
+				rows.Close()
+				return nil, &db.Error{Op: "refetch unchanged values", Table: changeset.Table, Query: sql, Err: err}
+			}
+
+			rowIdx := int(values[0].(int32))
+			for i, col := range unchangedCols {
+				if refetched.IsUnchanged(rowIdx, col) {
+					refetched.Rows[rowIdx][col] = values[i+1]
+					refetched.Unchanged[rowIdx][col] = false
+				}
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, &db.Error{Op: "refetch unchanged values", Table: changeset.Table, Query: sql, Err: err}
+		}
+	}
+
+	return refetched, nil
+}
+
+// primaryKey returns the columns of a table's primary key, in order. They're
+// looked up once per table.
+func (r *Reader) primaryKey(table string) ([]string, error) {
+	if key, ok := r.primaryKeys[table]; ok {
+		return key, nil
+	}
+
+	columns, err := primaryKeyColumns(context.Background(), r.conn, table)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]string, len(columns))
+	for i, col := range columns {
+		key[i] = col.name
+	}
+
+	r.primaryKeys[table] = key
+	return key, nil
+}
+
+// withUnchangedColumn returns the changeset with an unchanged__ column added
+// to every row, holding the names of the columns its update left out.
+func withUnchangedColumn(changeset *db.Changeset) *db.Changeset {
+	result := &db.Changeset{
+		Table:     changeset.Table,
+		Operation: changeset.Operation,
+		Columns:   append(slices.Clone(changeset.Columns), db.Column{Name: db.UnchangedColumn, Type: db.StringArray}),
+		Rows:      make([][]any, len(changeset.Rows)),
+		Unchanged: changeset.Unchanged,
+	}
+
+	for i, row := range changeset.Rows {
+		result.Rows[i] = append(slices.Clone(row), changeset.UnchangedColumns(i))
+	}
+
+	return result
+}
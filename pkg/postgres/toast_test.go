@@ -0,0 +1,31 @@
+package postgres
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tonyfg/trucker/pkg/db"
+)
+
+func TestWithUnchangedColumn(t *testing.T) {
+	changeset := &db.Changeset{
+		Table:     "public.whiskies",
+		Operation: db.Update,
+		Columns:   []db.Column{{Name: "id", Type: db.Int32}, {Name: "notes", Type: db.String}, {Name: "old__id", Type: db.Int32}, {Name: "old__notes", Type: db.String}},
+		Rows:      [][]any{{1, nil, 1, nil}, {2, "smoky", 2, nil}},
+	}
+	changeset.MarkUnchanged(0, 1)
+
+	result := withUnchangedColumn(changeset)
+
+	if last := result.Columns[len(result.Columns)-1]; last.Name != db.UnchangedColumn || last.Type != db.StringArray {
+		t.Errorf("Expected an unchanged__ text array column last, got %v", last)
+	}
+	expectedRows := [][]any{{1, nil, 1, nil, []string{"notes"}}, {2, "smoky", 2, nil, []string{}}}
+	if !reflect.DeepEqual(result.Rows, expectedRows) {
+		t.Errorf("Expected rows to be %v, got %v", expectedRows, result.Rows)
+	}
+	if len(changeset.Columns) != 4 || len(changeset.Rows[0]) != 4 {
+		t.Error("Expected the original changeset to be left untouched")
+	}
+}
@@ -3,42 +3,65 @@ package postgres
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"iter"
+	"log/slog"
 	"strings"
 	"text/template"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/tonyfg/trucker/pkg/config"
 	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/logging"
 )
 
 type Writer struct {
 	currentLsnTable string
+	legacyLsnTable  string
+	backfillTable   string
 	queryTemplate   *template.Template
 	conn            *pgxpool.Pool
+	deadLetters     db.DeadLetterSink
+	// What to do with truncate changesets, see SetTruncate
+	truncateTemplate *template.Template
+	truncateTables   []string
+	logger           *slog.Logger
 }
 
-func NewWriter(inputConnectionName string, writeQuery string, cfg config.Connection, uniqueId string) *Writer {
+func NewWriter(truckName string, inputConnectionName string, writeQuery string, cfg config.Connection, uniqueId string) (*Writer, error) {
 	tmpl, err := template.New("outputSql").Parse(writeQuery)
 	if err != nil {
-		panic(err)
+		return nil, &db.Error{Op: "parse output SQL", Query: writeQuery, Err: err}
 	}
 
-	conn := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	conn, err := NewConnection(cfg.User, cfg.Pass, cfg.Host, cfg.Port, cfg.Ssl, cfg.Database, false)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Writer{
-		currentLsnTable: fmt.Sprintf("trucker_current_lsn__%s%s", inputConnectionName, uniqueId),
+		currentLsnTable: fmt.Sprintf(`"trucker_truck_lsn__%s%s"`, truckName, uniqueId),
+		legacyLsnTable:  fmt.Sprintf(`"trucker_current_lsn__%s%s"`, inputConnectionName, uniqueId),
+		backfillTable:   fmt.Sprintf(`"trucker_backfill__%s%s"`, truckName, uniqueId),
 		queryTemplate:   tmpl,
 		conn:            conn,
-	}
+		logger:          logging.ForTruck(truckName).With("connection", cfg.Name),
+	}, nil
 }
 
-func (w *Writer) SetupPositionTracking() {
-	_, err := w.conn.Exec(
-		context.Background(),
+func (w *Writer) SetupPositionTracking() error {
+	ctx := context.Background()
+	alreadyExists, err := w.tableExists(ctx, w.currentLsnTable)
+	if err != nil {
+		return &db.Error{Op: "setup position tracking", Err: err}
+	}
+
+	_, err = w.conn.Exec(
+		ctx,
 		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
   id bool PRIMARY KEY DEFAULT true,
   lsn bigint NOT NULL,
@@ -47,43 +70,207 @@ func (w *Writer) SetupPositionTracking() {
 	)
 
 	if err != nil {
-		panic(err)
+		return &db.Error{Op: "setup position tracking", Err: err}
+	}
+
+	_, err = w.conn.Exec(
+		ctx,
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+  input_table text PRIMARY KEY,
+  snapshot_lsn bigint NOT NULL,
+  last_key text[],
+  done bool NOT NULL DEFAULT false
+)`, w.backfillTable),
+	)
+	if err != nil {
+		return &db.Error{Op: "setup position tracking", Err: err}
+	}
+
+	if !alreadyExists {
+		if err := w.migrateLegacyPosition(ctx); err != nil {
+			return &db.Error{Op: "setup position tracking", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Stream positions used to be tracked per input connection instead of per
+// truck. Pick up from wherever the old table left off, so upgrading doesn't
+// cause a replay. The old table is left alone since other trucks reading from
+// the same connection may still need to migrate from it.
+func (w *Writer) migrateLegacyPosition(ctx context.Context) error {
+	legacyExists, err := w.tableExists(ctx, w.legacyLsnTable)
+	if err != nil || !legacyExists {
+		return err
 	}
+
+	w.logger.Info("Migrating stream position", "from", w.legacyLsnTable, "to", w.currentLsnTable)
+	_, err = w.conn.Exec(ctx, fmt.Sprintf(
+		"INSERT INTO %s (lsn) SELECT lsn FROM %s ON CONFLICT (id) DO NOTHING",
+		w.currentLsnTable,
+		w.legacyLsnTable,
+	))
+
+	return err
 }
 
-func (w *Writer) SetCurrentPosition(lsn uint64) {
-	sql := fmt.Sprintf(`INSERT INTO %s (lsn) VALUES ($1)
+func (w *Writer) tableExists(ctx context.Context, table string) (bool, error) {
+	var exists bool
+	err := w.conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+	return exists, err
+}
+
+func (w *Writer) SetCurrentPosition(lsn uint64) error {
+	_, err := w.conn.Exec(context.Background(), w.setCurrentPositionSql(), lsn)
+
+	if err != nil {
+		return &db.Error{Op: "set position", Err: err}
+	}
+
+	return nil
+}
+
+func (w *Writer) setCurrentPositionSql() string {
+	return fmt.Sprintf(`INSERT INTO %s (lsn) VALUES ($1)
 ON CONFLICT (id) DO UPDATE SET lsn = $1`, w.currentLsnTable)
-	_, err := w.conn.Exec(context.Background(), sql, lsn)
+}
 
+// GetCurrentPosition returns the truck's stream position, or 0 if it has none.
+// Until SetupPositionTracking has run, the position is read from the legacy
+// per input connection table, if there is one. Nothing is ever created here.
+func (w *Writer) GetCurrentPosition() (uint64, error) {
+	lsn, found, err := w.readPosition(w.currentLsnTable)
+	if err == nil && !found {
+		lsn, _, err = w.readPosition(w.legacyLsnTable)
+	}
 	if err != nil {
-		panic(err)
+		return 0, &db.Error{Op: "get position", Err: err}
 	}
+
+	return lsn, nil
 }
 
-func (w *Writer) GetCurrentPosition() uint64 {
+// readPosition returns the lsn stored in table, and whether the table exists.
+func (w *Writer) readPosition(table string) (uint64, bool, error) {
 	var lsn uint64
-	sql := fmt.Sprintf("SELECT lsn FROM %s", w.currentLsnTable)
-	row := w.conn.QueryRow(context.Background(), sql)
-	row.Scan(&lsn)
-	return lsn
+	sql := fmt.Sprintf("SELECT lsn FROM %s", table)
+	err := w.conn.QueryRow(context.Background(), sql).Scan(&lsn)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42P01" { // undefined_table
+		return 0, false, nil
+	} else if errors.Is(err, pgx.ErrNoRows) {
+		return 0, true, nil
+	} else if err != nil {
+		return 0, true, err
+	}
+
+	return lsn, true, nil
+}
+
+// SetDeadLetterSink makes WriteTransaction send changesets whose output query
+// fails to sink, and carry on with the rest of the transaction.
+func (w *Writer) SetDeadLetterSink(sink db.DeadLetterSink) {
+	w.deadLetters = sink
+}
+
+// SetTruncate makes WriteTransaction handle truncate changesets by truncating
+// tables and then running sql (a template like output.sql, without rows), in
+// the same transaction as the rest of the changes.
+func (w *Writer) SetTruncate(sql string, tables []string) {
+	w.truncateTables = tables
+	w.truncateTemplate = nil
+	if sql == "" {
+		return
+	}
+
+	tmpl, err := template.New("truncateSql").Parse(sql)
+	if err != nil {
+		panic(err)
+	}
+	w.truncateTemplate = tmpl
+}
+
+func (w *Writer) Write(changeset *db.ChanChangeset) (bool, error) {
+	return w.WriteTransaction(0, func(yield func(*db.ChanChangeset, error) bool) {
+		yield(changeset, nil)
+	})
 }
 
-func (w *Writer) Write(changeset *db.ChanChangeset) bool {
-	// We need to hold on to a specific connection to be able to create and
-	// access the temporary table until we're done (in case we're not using a
-	// VALUES list)
+// WriteTransaction writes all changesets inside a single database transaction,
+// so a source transaction is either fully applied to the output or not at all.
+// Unless position is 0, the stream position is updated in that same
+// transaction, so a crash can never cause a transaction to be applied twice.
+func (w *Writer) WriteTransaction(position uint64, changesets iter.Seq2[*db.ChanChangeset, error]) (bool, error) {
 	ctx := context.Background()
 	tx, err := w.conn.Begin(ctx)
 	if err != nil {
-		panic(err)
+		return false, &db.Error{Op: "write", Err: err}
+	}
+	// Does nothing once the transaction is committed
+	defer tx.Rollback(ctx)
+
+	wroteRows := false
+	for changeset, err := range changesets {
+		if err != nil {
+			return false, err
+		}
+
+		var wrote bool
+		if changeset.Operation == db.Truncate {
+			wrote, err = w.writeTruncate(ctx, tx, changeset.Table)
+		} else if w.deadLetters != nil && position != 0 {
+			wrote, err = w.writeOrDeadLetter(ctx, tx, position, changeset)
+		} else {
+			wrote, err = w.writeChangeset(ctx, tx, changeset)
+		}
+		if err != nil {
+			changeset.Discard()
+			return false, err
+		}
+		wroteRows = wroteRows || wrote
 	}
-	defer func() {
-		if err := tx.Commit(ctx); err != nil {
-			panic(err)
+
+	if position != 0 {
+		_, err = tx.Exec(ctx, w.setCurrentPositionSql(), position)
+		if err != nil {
+			return false, &db.Error{Op: "set position", Err: err}
 		}
-	}()
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, &db.Error{Op: "write", Err: err}
+	}
 
+	return wroteRows, nil
+}
+
+// writeOrDeadLetter writes the changeset inside a savepoint. If the output
+// query fails, the changeset is rolled back and sent to the dead letter sink
+// instead, so the rest of the transaction can still be committed.
+func (w *Writer) writeOrDeadLetter(ctx context.Context, tx pgx.Tx, position uint64, changeset *db.ChanChangeset) (bool, error) {
+	recorded, recordedRows := changeset.RecordRows()
+
+	if _, err := tx.Exec(ctx, "SAVEPOINT trucker_changeset"); err != nil {
+		return false, &db.Error{Op: "write", Table: changeset.Table, Err: err}
+	}
+
+	wrote, err := w.writeChangeset(ctx, tx, recorded)
+	var dbErr *db.Error
+	if err == nil || !errors.As(err, &dbErr) || dbErr.Query == "" {
+		return wrote, err
+	}
+
+	recorded.Discard()
+	if _, err := tx.Exec(ctx, "ROLLBACK TO SAVEPOINT trucker_changeset"); err != nil {
+		return false, &db.Error{Op: "write", Table: changeset.Table, Err: err}
+	}
+
+	w.logger.Warn("Sending changeset to the dead letter sink", "operation", db.OperationStr(changeset.Operation), "table", changeset.Table, logging.LSN(position), logging.Err(dbErr.Err))
+	return false, w.deadLetters.Send(db.NewDeadLetter(position, recorded, recordedRows(), err))
+}
+
+func (w *Writer) writeChangeset(ctx context.Context, tx pgx.Tx, changeset *db.ChanChangeset) (bool, error) {
 	tmplVars := map[string]string{
 		"operation":   db.OperationStr(changeset.Operation),
 		"input_table": changeset.Table,
@@ -91,15 +278,19 @@ func (w *Writer) Write(changeset *db.ChanChangeset) bool {
 
 	columnsLiteral := makeColumnsList(changeset.Columns).String()
 	valuesList, flatValues, excessRows := makeValuesListFromRowChan(changeset.Columns, changeset.Rows, [][]any{}, true)
+	usingTempTable := len(excessRows) > 0
 
-	if len(excessRows) > 0 {
-		log.Println("[Postgres Writer] Writing changeset with more than 32k parameters. Using temporary table...")
-		populateTempTable(ctx, tx, changeset, columnsLiteral, flatValues, excessRows)
-		defer tx.Exec(context.Background(), "DROP TABLE r")
+	if usingTempTable {
+		// We need to hold on to the temporary table until the output query
+		// runs, and then get rid of it so that the next changeset in the
+		// transaction can create its own.
+		w.logger.Debug("Writing changeset with more than 32k parameters. Using temporary table...", "operation", db.OperationStr(changeset.Operation), "table", changeset.Table)
+		if err := w.populateTempTable(ctx, tx, changeset, columnsLiteral, flatValues, excessRows); err != nil {
+			return false, &db.Error{Op: "write", Table: changeset.Table, Err: err}
+		}
+		defer tx.Exec(ctx, "DROP TABLE r")
 		flatValues = nil
 		tmplVars["rows"] = "r"
-	} else if len(flatValues) == 0 {
-		return false
 	} else {
 		sb := strings.Builder{}
 		sb.WriteString("(VALUES ")
@@ -110,33 +301,77 @@ func (w *Writer) Write(changeset *db.ChanChangeset) bool {
 		tmplVars["rows"] = sb.String()
 	}
 
+	// The rows are all in by now. Make sure we got all of them before writing
+	// anything.
+	changeset.Discard()
+	if changeset.Err != nil {
+		return false, changeset.Err
+	}
+
+	if !usingTempTable && len(flatValues) == 0 {
+		return false, nil
+	}
+
 	sql := new(bytes.Buffer)
-	err = w.queryTemplate.Execute(sql, tmplVars)
+	err := w.queryTemplate.Execute(sql, tmplVars)
 	if err != nil {
-		panic(err)
+		return false, &db.Error{Op: "write", Table: changeset.Table, Err: err}
 	}
 
 	_, err = tx.Exec(ctx, sql.String(), flatValues...)
 	if err != nil {
-		log.Printf("[Postgres Writer] Error running query:\n%s\n", sql.String())
-		panic(err)
+		w.logger.Error("Error running output query", "operation", db.OperationStr(changeset.Operation), "table", changeset.Table, "sql", sql.String(), logging.Err(err))
+		return false, &db.Error{Op: "write", Table: changeset.Table, Query: sql.String(), Err: err}
 	}
 
-	return true
+	return true, nil
 }
 
-func (w *Writer) TruncateTable(table string) {
+// writeTruncate does what SetTruncate asked for when an input table is
+// truncated. Failures aren't sent to the dead letter sink, since there are no
+// rows to send and the output wouldn't match the input without them.
+func (w *Writer) writeTruncate(ctx context.Context, tx pgx.Tx, table string) (bool, error) {
+	for _, outputTable := range w.truncateTables {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("TRUNCATE TABLE %s", outputTable)); err != nil {
+			return false, &db.Error{Op: "truncate", Table: outputTable, Err: err}
+		}
+	}
+
+	if w.truncateTemplate == nil {
+		return len(w.truncateTables) > 0, nil
+	}
+
+	sql := new(bytes.Buffer)
+	err := w.truncateTemplate.Execute(sql, map[string]string{
+		"operation":   db.OperationStr(db.Truncate),
+		"input_table": table,
+	})
+	if err != nil {
+		return false, &db.Error{Op: "write", Table: table, Err: err}
+	}
+
+	if _, err := tx.Exec(ctx, sql.String()); err != nil {
+		w.logger.Error("Error running truncate query", "table", table, "sql", sql.String(), logging.Err(err))
+		return false, &db.Error{Op: "write", Table: table, Query: sql.String(), Err: err}
+	}
+
+	return true, nil
+}
+
+func (w *Writer) TruncateTable(table string) error {
 	_, err := w.conn.Exec(context.Background(), fmt.Sprintf("TRUNCATE TABLE %s", table))
 	if err != nil {
-		panic(err)
+		return &db.Error{Op: "truncate", Table: table, Err: err}
 	}
+
+	return nil
 }
 
 func (w *Writer) Close() {
 	w.conn.Close()
 }
 
-func populateTempTable(ctx context.Context, tx pgx.Tx, changeset *db.ChanChangeset, columnsLiteral string, params []any, extraRows [][]any) {
+func (w *Writer) populateTempTable(ctx context.Context, tx pgx.Tx, changeset *db.ChanChangeset, columnsLiteral string, params []any, extraRows [][]any) error {
 	// Create a temporary table to store the rows
 	sb := strings.Builder{}
 	sb.WriteString("CREATE TEMPORARY TABLE r (")
@@ -150,8 +385,8 @@ func populateTempTable(ctx context.Context, tx pgx.Tx, changeset *db.ChanChanges
 
 	_, err := tx.Exec(ctx, sb.String())
 	if err != nil {
-		log.Printf("[Postgres Reader] Error executing SQL:\n%s", sb.String())
-		panic(err)
+		w.logger.Error("Error creating temporary table", "table", changeset.Table, "sql", sb.String(), logging.Err(err))
+		return err
 	}
 
 	baseSql := fmt.Sprintf("INSERT INTO r (%s) VALUES ", columnsLiteral)
@@ -184,9 +419,9 @@ func populateTempTable(ctx context.Context, tx pgx.Tx, changeset *db.ChanChanges
 			previousValuesLen = len(params)
 			_, err = tx.Exec(ctx, sb.String(), params...)
 			if err != nil {
-				log.Printf("[Postgres Writer] Error inserting into temporary table:\n%s", sb.String())
-				log.Printf("[Postgres Writer] Values:\n%v", params)
-				panic(err)
+				w.logger.Error("Error inserting into temporary table", "table", changeset.Table, "sql", sb.String(), logging.Err(err))
+				w.logger.Debug("Temporary table values", "table", changeset.Table, "values", params)
+				return err
 			}
 		}
 
@@ -197,4 +432,6 @@ func populateTempTable(ctx context.Context, tx pgx.Tx, changeset *db.ChanChanges
 			break
 		}
 	}
+
+	return nil
 }
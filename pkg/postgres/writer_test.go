@@ -2,7 +2,9 @@ package postgres
 
 import (
 	"context"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/tonyfg/trucker/pkg/db"
 	"github.com/tonyfg/trucker/test/helpers"
@@ -16,7 +18,7 @@ func TestSetupPositionTracking(t *testing.T) {
 	w.SetupPositionTracking()
 	_, err := w.conn.Exec(
 		context.Background(),
-		"SELECT * FROM trucker_current_lsn__test2")
+		"SELECT * FROM trucker_truck_lsn__test2")
 	if err != nil {
 		t.Error(err)
 	}
@@ -25,7 +27,7 @@ func TestSetupPositionTracking(t *testing.T) {
 	w.SetupPositionTracking()
 	_, err = w.conn.Exec(
 		context.Background(),
-		"SELECT * FROM trucker_current_lsn__test2")
+		"SELECT * FROM trucker_truck_lsn__test2")
 	if err != nil {
 		t.Error(err)
 	}
@@ -33,7 +35,7 @@ func TestSetupPositionTracking(t *testing.T) {
 	// - We can write LSNs to the table
 	_, err = w.conn.Exec(
 		context.Background(),
-		"INSERT INTO trucker_current_lsn__test2 (lsn) VALUES (123)")
+		"INSERT INTO trucker_truck_lsn__test2 (lsn) VALUES (123)")
 	if err != nil {
 		t.Error(err)
 	}
@@ -41,14 +43,14 @@ func TestSetupPositionTracking(t *testing.T) {
 	// - We can't add more than 1 row to the table
 	_, err = w.conn.Exec(
 		context.Background(),
-		"INSERT INTO trucker_current_lsn__test2 (lsn) VALUES (234)")
+		"INSERT INTO trucker_truck_lsn__test2 (lsn) VALUES (234)")
 	if err == nil {
 		t.Error("Expected an error when adding more than 1 row to the LSN tracking table")
 	}
 
 	row := w.conn.QueryRow(
 		context.Background(),
-		"SELECT COUNT(*) FROM trucker_current_lsn__test2")
+		"SELECT COUNT(*) FROM trucker_truck_lsn__test2")
 	var count int64
 	row.Scan(&count)
 
@@ -57,30 +59,61 @@ func TestSetupPositionTracking(t *testing.T) {
 	}
 }
 
+func TestSetupPositionTrackingMigratesLegacyTable(t *testing.T) {
+	w := writerTestSetup()
+	defer w.Close()
+
+	_, err := w.conn.Exec(
+		context.Background(),
+		`CREATE TABLE trucker_current_lsn__legacy2 (
+  id bool PRIMARY KEY DEFAULT true,
+  lsn bigint NOT NULL
+);
+INSERT INTO trucker_current_lsn__legacy2 (lsn) VALUES (777)`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	w.SetupPositionTracking()
+
+	lsn := currentPosition(t, w)
+	if lsn != 777 {
+		t.Errorf("LSN should have been migrated from the legacy table as 777, got %d", lsn)
+	}
+
+	// Once the truck has its own table, the legacy one is no longer used
+	w.SetCurrentPosition(888)
+	w.SetupPositionTracking()
+
+	lsn = currentPosition(t, w)
+	if lsn != 888 {
+		t.Errorf("LSN should be 888, got %d", lsn)
+	}
+}
+
 func TestGetCurrentPosition(t *testing.T) {
 	w := writerTestSetup()
 	defer w.Close()
 
-	lsn := w.GetCurrentPosition()
-	if lsn != 0 {
-		t.Errorf("Expected empty LSN, got %d", lsn)
+	if _, err := w.GetCurrentPosition(); err == nil {
+		t.Error("Expected an error before position tracking is set up")
 	}
 
 	w.SetupPositionTracking()
 
-	lsn = w.GetCurrentPosition()
+	lsn := currentPosition(t, w)
 	if lsn != 0 {
 		t.Errorf("Expected empty LSN, got %d", lsn)
 	}
 
 	_, err := w.conn.Exec(
 		context.Background(),
-		"INSERT INTO trucker_current_lsn__test2 (lsn) VALUES (123)")
+		"INSERT INTO trucker_truck_lsn__test2 (lsn) VALUES (123)")
 	if err != nil {
 		t.Error(err)
 	}
 
-	lsn = w.GetCurrentPosition()
+	lsn = currentPosition(t, w)
 	if lsn != 123 {
 		t.Errorf("LSN should be 123, got %d", lsn)
 	}
@@ -92,7 +125,7 @@ func TestSetCurrentPosition(t *testing.T) {
 	w.SetupPositionTracking()
 	w.SetCurrentPosition(8234)
 
-	lsn := w.GetCurrentPosition()
+	lsn := currentPosition(t, w)
 	if lsn != 8234 {
 		t.Errorf("LSN should be 8234, got %d", lsn)
 	}
@@ -107,7 +140,7 @@ func TestWrite(t *testing.T) {
 	rows <- [][]any{{"Green Spot", 10, 1}}
 	close(rows)
 
-	w.Write(
+	_, err := w.Write(
 		&db.ChanChangeset{
 			Operation: db.Insert,
 			Columns: []db.Column{
@@ -118,6 +151,10 @@ func TestWrite(t *testing.T) {
 			Rows: rows,
 		},
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	row := w.conn.QueryRow(
 		context.Background(),
 		"SELECT name, age, whisky_type_id FROM whiskies WHERE name = 'Green Spot'")
@@ -138,6 +175,82 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteTransaction(t *testing.T) {
+	w := writerTestSetup()
+	defer w.Close()
+	w.SetupPositionTracking()
+
+	columns := []db.Column{
+		{Name: "name", Type: db.String},
+		{Name: "age", Type: db.Int32},
+		{Name: "whisky_type_id", Type: db.Int32},
+	}
+
+	rows1 := make(chan [][]any, 1)
+	rows1 <- [][]any{{"Green Spot", 10, 1}}
+	close(rows1)
+
+	rows2 := make(chan [][]any, 1)
+	rows2 <- [][]any{{"Redbreast", 12, 1}}
+	close(rows2)
+
+	result, err := w.WriteTransaction(4321, helpers.Changesets(
+		&db.ChanChangeset{Operation: db.Insert, Columns: columns, Rows: rows1},
+		&db.ChanChangeset{Operation: db.Insert, Columns: columns, Rows: rows2},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != true {
+		t.Error("Expected WriteTransaction to return true when rows are written")
+	}
+
+	row := w.conn.QueryRow(
+		context.Background(),
+		"SELECT count(*) FROM whiskies WHERE name IN ('Green Spot', 'Redbreast')")
+	var cnt int
+	row.Scan(&cnt)
+
+	if cnt != 2 {
+		t.Error("Expected 2 rows to have been written, got", cnt)
+	}
+
+	lsn := currentPosition(t, w)
+	if lsn != 4321 {
+		t.Errorf("LSN should be 4321, got %d", lsn)
+	}
+}
+
+func TestWriteTransactionRollsBackPosition(t *testing.T) {
+	w := writerTestSetup()
+	defer w.Close()
+	w.SetupPositionTracking()
+	w.SetCurrentPosition(1234)
+
+	rows := make(chan [][]any, 1)
+	rows <- [][]any{{"Green Spot", 10, 999}} // whisky_type_id doesn't exist
+	close(rows)
+
+	_, err := w.WriteTransaction(4321, helpers.Changesets(&db.ChanChangeset{
+		Operation: db.Insert,
+		Columns: []db.Column{
+			{Name: "name", Type: db.String},
+			{Name: "age", Type: db.Int32},
+			{Name: "whisky_type_id", Type: db.Int32},
+		},
+		Rows: rows,
+	}))
+	if err == nil {
+		t.Error("Expected WriteTransaction to return an error")
+	}
+
+	lsn := currentPosition(t, w)
+	if lsn != 1234 {
+		t.Errorf("LSN should still be 1234 after a failed write, got %d", lsn)
+	}
+}
+
 func TestWriteZeroRows(t *testing.T) {
 	w := writerTestSetup()
 	defer w.Close()
@@ -146,7 +259,7 @@ func TestWriteZeroRows(t *testing.T) {
 	rows := make(chan [][]any, 1)
 	close(rows)
 
-	result := w.Write(
+	result, err := w.Write(
 		&db.ChanChangeset{
 			Operation: db.Insert,
 			Columns: []db.Column{
@@ -157,6 +270,9 @@ func TestWriteZeroRows(t *testing.T) {
 			Rows: rows,
 		},
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if result != false {
 		t.Error("Expected Write to return false when no rows are written")
@@ -172,13 +288,107 @@ func TestWriteZeroRows(t *testing.T) {
 	}
 }
 
+func TestWriteBackfillChunk(t *testing.T) {
+	w := writerTestSetup()
+	defer w.Close()
+	if err := w.SetupPositionTracking(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.SetBackfillProgress(db.BackfillProgress{Table: "public.whiskies", SnapshotLSN: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := make(chan [][]any, 1)
+	rows <- [][]any{{"Green Spot", 10, 1}}
+	close(rows)
+	changeset := &db.ChanChangeset{
+		Operation: db.Insert,
+		Columns: []db.Column{
+			{Name: "name", Type: db.String},
+			{Name: "age", Type: db.Int32},
+			{Name: "whisky_type_id", Type: db.Int32},
+		},
+		Rows: rows,
+	}
+	tracker := db.NewBackfillTracker(db.BackfillProgress{Table: "public.whiskies", SnapshotLSN: 100})
+	first := tracker.Next([]string{"7"})
+	second := tracker.Next(nil)
+
+	// The second chunk isn't written until the first one is
+	empty := make(chan [][]any)
+	close(empty)
+	secondDone := make(chan error)
+	go func() {
+		_, err := w.WriteBackfillChunk(&db.ChanChangeset{Operation: db.Insert, Columns: changeset.Columns, Rows: empty}, second)
+		secondDone <- err
+	}()
+	select {
+	case err := <-secondDone:
+		t.Fatal("Expected the second chunk to wait for the first one, got", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	progress, err := w.GetBackfillProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []db.BackfillProgress{{Table: "public.whiskies", SnapshotLSN: 100}}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Errorf("Expected backfill progress %v, got %v", expected, progress)
+	}
+
+	if _, err := w.WriteBackfillChunk(changeset, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-secondDone; err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err = w.GetBackfillProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []db.BackfillProgress{{Table: "public.whiskies", SnapshotLSN: 100, Done: true}}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Errorf("Expected backfill progress %v, got %v", expected, progress)
+	}
+
+	var cnt int
+	w.conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM whiskies WHERE name = 'Green Spot'").Scan(&cnt)
+	if cnt != 1 {
+		t.Error("Expected the chunk to be written, got", cnt, "rows")
+	}
+
+	if err := w.ClearBackfillProgress(); err != nil {
+		t.Fatal(err)
+	}
+	if progress, err := w.GetBackfillProgress(); err != nil || len(progress) > 0 {
+		t.Error("Expected no backfill progress after clearing it, got", progress, err)
+	}
+}
+
 func writerTestSetup() *Writer {
 	helpers.PreparePostgresTestDb().Close(context.Background())
 
-	return NewWriter(
+	w, err := NewWriter(
 		"test",
+		"legacy",
 		"INSERT INTO whiskies (name, age, whisky_type_id) SELECT name, age, whisky_type_id FROM {{.rows}}",
 		helpers.PostgresCfg,
 		"2",
 	)
+	if err != nil {
+		panic(err)
+	}
+
+	return w
+}
+
+func currentPosition(t *testing.T, w *Writer) uint64 {
+	lsn, err := w.GetCurrentPosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lsn
 }
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/tonyfg/trucker/pkg/logging"
+)
+
+var (
+	mu      sync.Mutex
+	muxes   = make(map[string]*http.ServeMux)
+	handled = make(map[string]bool)
+)
+
+// Handle serves handler on path at addr, starting an HTTP server for addr in
+// the background if there isn't one yet. Metrics and health checks can share a
+// server by using the same address. Handling the same path on the same address
+// again does nothing.
+func Handle(addr string, path string, handler http.Handler) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if handled[addr+path] {
+		return nil
+	}
+
+	mux, ok := muxes[addr]
+	if !ok {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		mux = http.NewServeMux()
+		muxes[addr] = mux
+
+		go func() {
+			if err := http.Serve(listener, mux); err != nil {
+				slog.Error("HTTP server stopped", "listen", addr, logging.Err(err))
+			}
+		}()
+	}
+
+	mux.Handle(path, handler)
+	handled[addr+path] = true
+	slog.Info("Serving HTTP endpoint", "url", fmt.Sprintf("http://%s%s", addr, path))
+
+	return nil
+}
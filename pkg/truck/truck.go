@@ -1,19 +1,66 @@
 package truck
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tonyfg/trucker/pkg/clickhouse"
 	"github.com/tonyfg/trucker/pkg/config"
 	"github.com/tonyfg/trucker/pkg/db"
+	"github.com/tonyfg/trucker/pkg/deadletter"
+	"github.com/tonyfg/trucker/pkg/logging"
+	"github.com/tonyfg/trucker/pkg/metrics"
 	"github.com/tonyfg/trucker/pkg/postgres"
 )
 
 type ExitMsg struct {
 	TruckName string
 	Msg       string
+	Err       error
+}
+
+type Status int32
+
+const (
+	Running     Status = iota
+	Restarting         // failed, waiting to be restarted
+	Degraded           // failed, won't be restarted
+	Paused             // an input table's schema changed, won't be restarted
+	Backfilling        // an input table was truncated, being backfilled again
+)
+
+func (s Status) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Restarting:
+		return "restarting"
+	case Degraded:
+		return "degraded"
+	case Paused:
+		return "paused"
+	case Backfilling:
+		return "backfilling"
+	default:
+		return fmt.Sprintf("unknown (%d)", s)
+	}
+}
+
+var errStopped = errors.New("truck stopped")
+
+// transactionStats collects what happened while processing a transaction, so
+// it can be added to the metrics once the transaction has been written.
+type transactionStats struct {
+	inputTime  time.Duration
+	changesets map[uint8]int
+	rows       map[uint8]int
 }
 
 type Truck struct {
@@ -22,103 +69,637 @@ type Truck struct {
 	readQuery            string
 	Reader               db.Reader
 	InputTables          []string
+	InputColumns         db.ColumnFilter
+	InputWhere           map[string]string
+	RowFilter            *postgres.RowFilter // nil without where conditions
 	Writer               db.Writer
+	DeadLetters          db.DeadLetterSink // nil without a dead letter sink
 	OutputSql            string
 	SlowQueryThresholdMs int64
-	ChangesChan          chan *db.Changeset
+	OnError              string
+	MaxRestarts          int
+	RestartBackoffMs     int64 // before the first restart, doubling up to RestartMaxBackoffMs
+	RestartMaxBackoffMs  int64
+	OnSchemaChange       string
+	OnTruncate           string
+	BackfillChunkSize    int
+	BackfillParallelism  int
+	TransactionsChan     chan *db.Transaction
 	KillChan             chan any
 	DoneChan             chan ExitMsg
+	resultsChan          chan error
+	position             atomic.Uint64
+	status               atomic.Int32
+	started              bool
+	alive                atomic.Bool
+	busySince            atomic.Int64 // unix nanoseconds, 0 when idle
+	lastProcessedAt      atomic.Int64 // unix nanoseconds
+	logger               *slog.Logger
+	// What Connect connects with
+	cfg       config.Truck
+	inputCfg  config.Connection
+	outputCfg config.Connection
+	uniqueId  string
 }
 
-func NewTruck(cfg config.Truck, rc *postgres.ReplicationClient, connCfgs map[string]config.Connection, doneChan chan ExitMsg, uniqueId string) Truck {
-	return Truck{
+// NewTruck returns a truck reading from the replication client. It doesn't
+// connect to its databases until Connect is called.
+func NewTruck(cfg config.Truck, rc *postgres.ReplicationClient, connCfgs map[string]config.Connection, doneChan chan ExitMsg, uniqueId string) *Truck {
+	return &Truck{
 		Name:                 cfg.Name,
 		ReplicationClient:    rc,
 		readQuery:            cfg.Input.Sql,
-		Reader:               NewReader(cfg.Input.Sql, connCfgs[cfg.Input.Connection]),
 		InputTables:          cfg.Input.Tables,
-		Writer:               NewWriter(cfg.Input.Connection, cfg.Output.Sql, connCfgs[cfg.Output.Connection], uniqueId),
+		InputColumns:         db.ColumnFilter{Only: cfg.Input.OnlyColumns, Except: cfg.Input.ExceptColumns},
+		InputWhere:           cfg.Input.Where,
 		SlowQueryThresholdMs: cfg.SlowQueryThresholdMs,
-		ChangesChan:          make(chan *db.Changeset),
+		OnError:              cfg.OnError,
+		MaxRestarts:          cfg.MaxRestarts,
+		RestartBackoffMs:     cfg.Restart.InitialBackoffMs,
+		RestartMaxBackoffMs:  cfg.Restart.MaxBackoffMs,
+		OnSchemaChange:       cfg.OnSchemaChange,
+		OnTruncate:           cfg.OnTruncate,
+		BackfillChunkSize:    cfg.Backfill.ChunkSize,
+		BackfillParallelism:  cfg.Backfill.Parallelism,
+		TransactionsChan:     make(chan *db.Transaction),
 		KillChan:             make(chan any),
 		DoneChan:             doneChan,
+		resultsChan:          make(chan error),
+		cfg:                  cfg,
+		inputCfg:             connCfgs[cfg.Input.Connection],
+		outputCfg:            connCfgs[cfg.Output.Connection],
+		uniqueId:             uniqueId,
+		logger:               logging.ForTruck(cfg.Name),
 	}
 }
 
-func (t *Truck) Backfill(snapshotName string, targetLSN uint64, allTables []string) {
-	tables := make([]string, 0)
-	for _, table := range allTables {
-		if slices.Contains(t.InputTables, table) {
-			tables = append(tables, table)
+// Connect connects the truck to its input and output databases, and sets up
+// the tables its stream position and dead letters are kept in. Whatever it
+// connected to is closed again if it fails.
+func (t *Truck) Connect() (err error) {
+	defer func() {
+		if err != nil {
+			t.disconnect()
 		}
+	}()
+
+	writer, err := NewWriter(t.Name, t.cfg.Input.Connection, t.cfg.Output.Sql, t.outputCfg, t.uniqueId)
+	if err != nil {
+		return err
 	}
+	t.Writer = writer
 
-	if len(tables) == 0 {
-		return
+	switch t.OnTruncate {
+	case config.OnTruncateSql:
+		writer.SetTruncate(t.cfg.Output.TruncateSql, nil)
+	case config.OnTruncateTruncate, config.OnTruncateBackfill:
+		writer.SetTruncate("", t.cfg.Output.Tables)
+	}
+
+	deadLetters, err := NewDeadLetterSink(t.cfg, t.outputCfg, t.uniqueId)
+	if err != nil {
+		return err
+	}
+	if deadLetters != nil {
+		t.DeadLetters = deadLetters
+		writer.SetDeadLetterSink(deadLetters)
+	}
+
+	reader, err := NewReader(t.Name, t.readQuery, t.inputCfg, t.cfg.Input.RefetchUnchangedToast)
+	if err != nil {
+		return err
+	}
+	t.Reader = reader
+
+	if len(t.InputWhere) > 0 {
+		rowFilter, err := postgres.NewRowFilter(t.Name, t.InputWhere, t.ReplicationClient, t.inputCfg)
+		if err != nil {
+			return err
+		}
+		t.RowFilter = rowFilter
+	}
+
+	if err := writer.SetupPositionTracking(); err != nil {
+		return err
+	}
+
+	if t.DeadLetters != nil {
+		if err := t.DeadLetters.Setup(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// disconnect closes whatever connections the truck has to its databases. The
+// replication client is shared with the other trucks on the input connection,
+// so it's left alone.
+func (t *Truck) disconnect() {
+	if t.Reader != nil {
+		t.Reader.Close()
+	}
+	if t.Writer != nil {
+		t.Writer.Close()
+	}
+	if t.RowFilter != nil {
+		t.RowFilter.Close()
+	}
+	if t.DeadLetters != nil {
+		t.DeadLetters.Close()
+	}
+}
+
+// InputFilter returns what a truck reads of one of its input tables. The old__
+// columns used by input.sql and output.sql count as read for every input
+// table, since the same queries handle all of them.
+func InputFilter(cfg config.Truck, table string) db.TableFilter {
+	oldColumns := db.OldColumnReferences(cfg.Input.Sql)
+	for _, col := range db.OldColumnReferences(cfg.Output.Sql) {
+		if !slices.Contains(oldColumns, col) {
+			oldColumns = append(oldColumns, col)
+		}
+	}
+
+	return db.TableFilter{
+		Columns:                db.ColumnFilter{Only: cfg.Input.OnlyColumns, Except: cfg.Input.ExceptColumns},
+		Where:                  cfg.Input.Where[table],
+		OldColumns:             oldColumns,
+		SetReplicaIdentityFull: cfg.Input.SetReplicaIdentityFull,
+	}
+}
+
+// Backfill backfills the truck's input tables among tables from the snapshot,
+// which has every change before targetLSN, and resumes the interrupted
+// backfills of the ones among resume (see UnfinishedBackfill). Tables are read
+// and written in chunks, and the progress made is kept in the output database
+// as they're written. Resumed backfills carry on from the last chunk written,
+// reading the rest of the table from this snapshot.
+//
+// Once every table is backfilled, a truck that has never run starts streaming
+// from where the earliest of the backfills started. For resumed backfills
+// that's before this snapshot, so changes to the chunks written from the
+// earlier one aren't missed. When every one of the truck's input tables is
+// backfilled from scratch (like after a truncate with on_truncate: backfill),
+// its output has every change before targetLSN, so a truck that has run moves
+// its position up to targetLSN. It's stored before the backfill progress is
+// cleared, so the truck never writes those changes again.
+func (t *Truck) Backfill(snapshotName string, targetLSN uint64, tables []string, resume []string) error {
+	progress, err := t.Writer.GetBackfillProgress()
+	if err != nil {
+		return err
+	}
+
+	backfills := make([]db.BackfillProgress, 0)
+	fresh := make([]db.BackfillProgress, 0)
+	for _, table := range t.InputTables {
+		if slices.Contains(tables, table) {
+			// A backfill from scratch leaves behind whatever an earlier one
+			// got up to
+			fresh = append(fresh, db.BackfillProgress{Table: table, SnapshotLSN: targetLSN})
+			backfills = append(backfills, fresh[len(fresh)-1])
+			continue
+		}
+
+		i := slices.IndexFunc(progress, func(p db.BackfillProgress) bool { return p.Table == table })
+		if i >= 0 && slices.Contains(resume, table) {
+			backfills = append(backfills, progress[i])
+		}
+	}
+
+	if len(backfills) == 0 {
+		return nil
 	}
 
 	start := time.Now()
-	log.Printf("[Truck %s] Running backfill for tables: %v\n", t.Name, tables)
+	t.logger.Info("Running backfill", "tables", len(backfills), "chunk_size", t.BackfillChunkSize, "parallelism", t.BackfillParallelism)
+	metrics.BackfillTables.WithLabelValues(t.Name).Set(float64(len(backfills)))
+	metrics.BackfillTablesDone.WithLabelValues(t.Name).Set(0)
+
+	// Recorded before anything's written, so an interrupted backfill is
+	// resumed even if it didn't get to write any chunk
+	for _, backfill := range fresh {
+		if err := t.Writer.SetBackfillProgress(backfill); err != nil {
+			return err
+		}
+	}
+
+	startLSN := targetLSN
+	for _, backfill := range backfills {
+		startLSN = min(startLSN, backfill.SnapshotLSN)
+	}
+
+	if err := t.backfillTables(snapshotName, backfills); err != nil {
+		return err
+	}
 
-	for _, table := range tables {
-		changeset := t.ReplicationClient.ReadBackfillData(table, snapshotName, t.readQuery)
-		t.Writer.Write(changeset)
+	curPos, err := t.Writer.GetCurrentPosition()
+	if err != nil {
+		return err
 	}
 
-	curPos := t.Writer.GetCurrentPosition()
 	if curPos == 0 {
-		log.Printf("[Truck %s] Setting up stream position tracking in output database...\n", t.Name)
-		t.Writer.SetupPositionTracking()
-		t.Writer.SetCurrentPosition(targetLSN)
+		t.logger.Info("Setting up stream position tracking in output database...")
+		if err := t.Writer.SetupPositionTracking(); err != nil {
+			return err
+		}
+		if err := t.Writer.SetCurrentPosition(startLSN); err != nil {
+			return err
+		}
+		t.position.Store(startLSN)
+	} else if len(fresh) == len(t.InputTables) && curPos < targetLSN {
+		if err := t.Writer.SetCurrentPosition(targetLSN); err != nil {
+			return err
+		}
+		t.position.Store(targetLSN)
+	}
+
+	if err := t.Writer.ClearBackfillProgress(); err != nil {
+		return err
+	}
+	t.logger.Info("Backfill complete", logging.Duration(time.Since(start)), logging.LSN(startLSN))
+
+	return nil
+}
+
+// backfillTables writes the chunks of the tables after the last ones written,
+// until every table is done. The tables are split into chunks one after the
+// other, and BackfillParallelism workers read and write them as they come, so
+// several chunks of the same table, or of consecutive tables, are in flight at
+// once. Each worker reads from the snapshot on a connection of its own. The
+// first error stops the backfill, once the chunks in flight are done.
+func (t *Truck) backfillTables(snapshotName string, backfills []db.BackfillProgress) error {
+	var once sync.Once
+	var firstErr error
+	stop := make(chan any)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+	// Set for each table once its last chunk is recorded
+	done := make(map[string]*atomic.Bool, len(backfills))
+	for _, backfill := range backfills {
+		done[backfill.Table] = &atomic.Bool{}
+		if backfill.Done {
+			done[backfill.Table].Store(true)
+			metrics.BackfillTablesDone.WithLabelValues(t.Name).Inc()
+		}
+	}
+
+	chunks := make(chan *db.BackfillChunk)
+	var wg sync.WaitGroup
+	for range max(1, t.BackfillParallelism) {
+		reader, err := t.ReplicationClient.NewSnapshotReader(snapshotName)
+		if err != nil {
+			fail(err)
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer reader.Close()
+
+			for chunk := range chunks {
+				if err := t.backfillChunk(reader, chunk); err != nil {
+					fail(err)
+					return
+				}
+				if chunk.Progress().Done && !done[chunk.Table].Swap(true) {
+					metrics.BackfillTablesDone.WithLabelValues(t.Name).Inc()
+				}
+			}
+		}()
+	}
+
+	reader, err := t.ReplicationClient.NewSnapshotReader(snapshotName)
+	if err != nil {
+		fail(err)
+	} else {
+		for _, backfill := range backfills {
+			if err := t.splitTable(reader, backfill, chunks, stop); err != nil {
+				fail(err)
+				break
+			}
+		}
+		reader.Close()
+	}
+
+	close(chunks)
+	wg.Wait()
+
+	return firstErr
+}
+
+// splitTable sends the table's chunks after the last one written to chunks,
+// until it gets to the end of the table or stop is closed.
+func (t *Truck) splitTable(reader *postgres.SnapshotReader, progress db.BackfillProgress, chunks chan<- *db.BackfillChunk, stop <-chan any) error {
+	if progress.Done {
+		return nil
+	}
+	if progress.LastKey != nil {
+		t.logger.Info("Resuming backfill", "table", progress.Table, "after", progress.LastKey, logging.LSN(progress.SnapshotLSN))
+	}
+
+	tracker := db.NewBackfillTracker(progress)
+	after := progress.LastKey
+	for {
+		end, err := reader.ChunkEnd(progress.Table, t.backfillFilter(progress.Table), after, t.BackfillChunkSize)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case chunks <- tracker.Next(end):
+		case <-stop:
+			return nil
+		}
+
+		if end == nil {
+			return nil
+		}
+		after = end
+	}
+}
+
+// backfillChunk reads a chunk of a table from the snapshot and writes it. If
+// it fails, the chunks after it are aborted, since they can't be committed
+// without it.
+func (t *Truck) backfillChunk(reader *postgres.SnapshotReader, chunk *db.BackfillChunk) error {
+	changeset, err := reader.ReadChunk(chunk.Table, t.readQuery, t.backfillFilter(chunk.Table), chunk.After, chunk.End)
+	if err != nil {
+		chunk.Abort(err)
+		return err
+	}
+
+	if _, err := t.Writer.WriteBackfillChunk(changeset, chunk); err != nil {
+		chunk.Abort(err)
+		return err
+	}
+	t.logger.Debug("Backfilled chunk", "table", chunk.Table, "after", chunk.After, "until", chunk.End)
+
+	return nil
+}
+
+func (t *Truck) backfillFilter(table string) db.TableFilter {
+	return db.TableFilter{Columns: t.InputColumns, Where: t.InputWhere[table]}
+}
+
+// UnfinishedBackfill returns the input tables whose backfill was interrupted,
+// like when trucker was stopped midway through, so it can be resumed.
+func (t *Truck) UnfinishedBackfill() ([]string, error) {
+	progress, err := t.Writer.GetBackfillProgress()
+	if err != nil {
+		return nil, err
 	}
-	log.Printf("[Truck %s] Backfill complete in %f seconds!\n", t.Name, time.Since(start).Seconds())
+
+	tables := make([]string, 0, len(progress))
+	for _, p := range progress {
+		if slices.Contains(t.InputTables, p.Table) {
+			tables = append(tables, p.Table)
+		}
+	}
+
+	return tables, nil
 }
 
-func (t *Truck) Start() {
-	log.Printf("[Truck %s] Starting to read from replication stream...\n", t.Name)
+// Start launches the goroutine that processes transactions for this truck.
+// Transactions at or before the truck's own stream position have already been
+// written, so they're skipped. This lets trucks that are ahead share a
+// replication stream with trucks that are behind.
+//
+// The result of every transaction sent with ProcessTransaction has to be
+// collected with TransactionResult before sending the next one.
+func (t *Truck) Start() error {
+	if t.started {
+		return nil
+	}
+
+	position, err := t.Writer.GetCurrentPosition()
+	if err != nil {
+		return err
+	}
+	t.position.Store(position)
+	t.started = true
+
+	t.logger.Info("Starting to read from replication stream", logging.LSN(position))
 
+	t.alive.Store(true)
 	go func() {
 		defer func() {
-			t.DoneChan <- ExitMsg{t.Name, "Exited!"}
+			t.alive.Store(false)
+			t.DoneChan <- ExitMsg{TruckName: t.Name, Msg: "Exited!"}
 		}()
 
 		for {
 			select {
-			case changeset := <-t.ChangesChan:
-				if changeset == nil {
-					log.Printf("[Truck %s] Changeset channel closed. Exiting...\n", t.Name)
+			case transaction := <-t.TransactionsChan:
+				if transaction == nil {
+					t.logger.Info("Transaction channel closed. Exiting...")
 					return
 				}
 
+				t.busySince.Store(time.Now().UnixNano())
+				err := t.processTransaction(transaction)
+				t.busySince.Store(0)
+
+				select {
+				case t.resultsChan <- err:
+				case <-t.KillChan:
+				}
+			case <-t.KillChan:
+				t.logger.Info("Received kill msg. Exiting...")
+				t.disconnect()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *Truck) processTransaction(transaction *db.Transaction) error {
+	if transaction.StreamPosition != 0 && transaction.StreamPosition <= t.position.Load() {
+		return nil
+	}
+
+	stats := &transactionStats{changesets: make(map[uint8]int), rows: make(map[uint8]int)}
+	now := time.Now()
+	_, err := t.Writer.WriteTransaction(transaction.StreamPosition, t.readTransaction(transaction, stats))
+	if err != nil {
+		return err
+	}
+
+	outputTime := time.Since(now) - stats.inputTime
+	metrics.OutputQueryDuration.WithLabelValues(t.Name).Observe(outputTime.Seconds())
+	for operation, count := range stats.changesets {
+		metrics.Changesets.WithLabelValues(t.Name, db.OperationStr(operation)).Add(float64(count))
+		metrics.Rows.WithLabelValues(t.Name, db.OperationStr(operation)).Add(float64(stats.rows[operation]))
+	}
+	if outputTime.Milliseconds() > t.SlowQueryThresholdMs {
+		t.logger.Warn("Slow output query", logging.Duration(outputTime), logging.LSN(transaction.StreamPosition))
+	}
+
+	if transaction.StreamPosition != 0 {
+		t.position.Store(transaction.StreamPosition)
+	}
+	t.lastProcessedAt.Store(time.Now().UnixNano())
+
+	return nil
+}
+
+// readTransaction runs the input query for each changeset in the transaction
+// as the writer asks for it, so that only one changeset's rows are in flight at
+// any given time. Changesets are narrowed down to the rows and columns the
+// truck reads first, since other trucks on the same table may replicate more
+// of them. Time spent on input queries and the changesets read are added to
+// stats. Truncates don't go through the input query, the writer deals with
+// them as the truck's on_truncate says (backfilling the input tables again is
+// up to the supervisor).
+func (t *Truck) readTransaction(transaction *db.Transaction, stats *transactionStats) iter.Seq2[*db.ChanChangeset, error] {
+	return func(yield func(*db.ChanChangeset, error) bool) {
+		for changeset := range transaction.Changesets {
+			if changeset.Operation == db.Truncate {
+				stats.changesets[db.Truncate]++
+				if t.OnTruncate == config.OnTruncateIgnore {
+					t.logger.Warn("Input table truncated, leaving the output as it is", "table", changeset.Table, logging.LSN(transaction.StreamPosition))
+					continue
+				}
+
+				if !yield(db.NewTruncateChangeset(changeset.Table), nil) {
+					return
+				}
+				continue
+			}
+
+			changesets := []*db.Changeset{changeset}
+			if t.RowFilter != nil {
 				now := time.Now()
-				resultChangeset := t.Reader.Read(changeset)
-				if time.Since(now).Milliseconds() > t.SlowQueryThresholdMs {
-					log.Printf("[Truck %s] Slow input query: took %dms for %d columns x %d rows.\n", t.Name, time.Since(now).Milliseconds(), len(changeset.Columns), len(changeset.Rows))
+				var err error
+				changesets, err = t.RowFilter.Filter(changeset)
+				stats.inputTime += time.Since(now)
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+			}
+
+			for _, changeset := range changesets {
+				changeset = t.InputColumns.Project(changeset)
+
+				now := time.Now()
+				resultChangeset, err := t.Reader.Read(changeset)
+				stats.inputTime += time.Since(now)
+				metrics.InputQueryDuration.WithLabelValues(t.Name).Observe(time.Since(now).Seconds())
+				if err != nil {
+					yield(nil, err)
+					return
 				}
 
-				now = time.Now()
-				t.Writer.Write(resultChangeset)
+				stats.changesets[changeset.Operation]++
+				stats.rows[changeset.Operation] += len(changeset.Rows)
+
 				if time.Since(now).Milliseconds() > t.SlowQueryThresholdMs {
-					log.Printf("[Truck %s] Slow output query: took %dms for %d columns x %d rows.\n", t.Name, time.Since(now).Milliseconds(), len(resultChangeset.Columns), len(resultChangeset.Rows))
+					t.logger.Warn("Slow input query", logging.Duration(time.Since(now)), "table", changeset.Table, "operation", db.OperationStr(changeset.Operation), "columns", len(changeset.Columns), "rows", len(changeset.Rows), logging.LSN(transaction.StreamPosition))
 				}
 
-				if changeset.StreamPosition != 0 {
-					t.Writer.SetCurrentPosition(changeset.StreamPosition)
+				if resultChangeset == nil {
+					continue
+				}
+
+				if !yield(resultChangeset, nil) {
+					return
 				}
-			case <-t.KillChan:
-				log.Printf("[Truck %s] Received kill msg. Exiting...\n", t.Name)
-				t.ReplicationClient.Close()
-				t.Reader.Close()
-				t.Writer.Close()
-				close(t.ChangesChan)
-				return
 			}
 		}
-	}()
+	}
+}
+
+// ProcessTransaction hands a transaction over to the truck's goroutine. It
+// returns false if the truck has been stopped.
+func (t *Truck) ProcessTransaction(transaction *db.Transaction) bool {
+	select {
+	case t.TransactionsChan <- transaction:
+		return true
+	case <-t.KillChan:
+		return false
+	}
+}
+
+// TransactionResult waits for the truck to finish writing the transaction
+// last sent with ProcessTransaction.
+func (t *Truck) TransactionResult() error {
+	select {
+	case err := <-t.resultsChan:
+		return err
+	case <-t.KillChan:
+		return errStopped
+	}
+}
+
+// Logger returns the logger for everything done on behalf of the truck.
+func (t *Truck) Logger() *slog.Logger {
+	return t.logger
 }
 
-func (t *Truck) ProcessChangeset(changeset *db.Changeset) {
-	t.ChangesChan <- changeset
+// Position is the stream position the truck has written up to.
+func (t *Truck) Position() uint64 {
+	return t.position.Load()
+}
+
+// Alive tells whether the truck's goroutine is running.
+func (t *Truck) Alive() bool {
+	return t.alive.Load()
+}
+
+// BusySince returns when the truck started writing the transaction it's
+// working on, or the zero time if it's idle.
+func (t *Truck) BusySince() time.Time {
+	return unixNanoToTime(t.busySince.Load())
+}
+
+// LastProcessedAt returns when the truck last wrote a transaction, or the zero
+// time if it hasn't written any yet.
+func (t *Truck) LastProcessedAt() time.Time {
+	return unixNanoToTime(t.lastProcessedAt.Load())
+}
+
+func unixNanoToTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
+
+func (t *Truck) Status() Status {
+	return Status(t.status.Load())
+}
+
+func (t *Truck) SetStatus(status Status) {
+	t.status.Store(int32(status))
+}
+
+// Restart picks up from wherever the truck's output says it has written up to,
+// and marks it as running again. The truck is started if it never was.
+func (t *Truck) Restart() error {
+	if err := t.Start(); err != nil {
+		return err
+	}
+
+	position, err := t.Writer.GetCurrentPosition()
+	if err != nil {
+		return err
+	}
+
+	t.position.Store(position)
+	t.SetStatus(Running)
+	t.logger.Info("Restarted", logging.LSN(position))
+
+	return nil
 }
 
 func (t *Truck) Stop() {
@@ -129,28 +710,74 @@ func (t *Truck) Stop() {
 	}
 }
 
-func NewReader(inputSql string, cfg config.Connection) db.Reader {
+// NewReader returns the reader for the truck's input.sql, or a reader that
+// passes changes through untouched if the truck doesn't have one. Refetching
+// unchanged TOASTed values takes a connection to the input database, so
+// changes go through it even without input.sql then.
+func NewReader(truckName string, inputSql string, cfg config.Connection, refetchUnchanged bool) (db.Reader, error) {
 	switch cfg.Adapter {
 	case "postgres":
-		return postgres.NewReader(inputSql, cfg)
+		if strings.TrimSpace(inputSql) == "" && !refetchUnchanged {
+			return postgres.NewPassThroughReader(truckName), nil
+		}
+		reader, err := postgres.NewReader(truckName, inputSql, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if refetchUnchanged {
+			reader.RefetchUnchanged()
+		}
+		return reader, nil
 	case "clickhouse":
-		log.Fatalf("Clickhouse is not supported as an input source")
+		return nil, fmt.Errorf("connection %s: clickhouse is not supported as an input source", cfg.Name)
 	default:
-		log.Fatalf("Unsupported adapter: %s", cfg.Adapter)
+		return nil, fmt.Errorf("connection %s: unsupported adapter %q", cfg.Name, cfg.Adapter)
 	}
-
-	return nil
 }
 
-func NewWriter(inputConnectionName string, outputSql string, cfg config.Connection, uniqueId string) db.Writer {
+func NewWriter(truckName string, inputConnectionName string, outputSql string, cfg config.Connection, uniqueId string) (db.Writer, error) {
 	switch cfg.Adapter {
 	case "postgres":
-		return postgres.NewWriter(inputConnectionName, outputSql, cfg, uniqueId)
+		writer, err := postgres.NewWriter(truckName, inputConnectionName, outputSql, cfg, uniqueId)
+		if err != nil {
+			return nil, err
+		}
+		return writer, nil
 	case "clickhouse":
-		return clickhouse.NewWriter(inputConnectionName, outputSql, cfg, uniqueId)
+		writer, err := clickhouse.NewWriter(truckName, inputConnectionName, outputSql, cfg, uniqueId)
+		if err != nil {
+			return nil, err
+		}
+		return writer, nil
 	default:
-		log.Fatalf("Unsupported adapter: %s", cfg.Adapter)
+		return nil, fmt.Errorf("connection %s: unsupported adapter %q", cfg.Name, cfg.Adapter)
 	}
+}
 
-	return nil
+// NewDeadLetterSink returns the truck's dead letter sink, or nil if it doesn't
+// have one.
+func NewDeadLetterSink(truckCfg config.Truck, outputCfg config.Connection, uniqueId string) (db.DeadLetterSink, error) {
+	switch truckCfg.DeadLetter.Type {
+	case "":
+		return nil, nil
+	case config.DeadLetterFile:
+		return deadletter.NewFileSink(truckCfg.DeadLetter.Path), nil
+	}
+
+	switch outputCfg.Adapter {
+	case "postgres":
+		sink, err := postgres.NewDeadLetterTable(truckCfg.Name, outputCfg, uniqueId)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	case "clickhouse":
+		sink, err := clickhouse.NewDeadLetterTable(truckCfg.Name, outputCfg, uniqueId)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	default:
+		return nil, fmt.Errorf("connection %s: unsupported adapter %q", outputCfg.Name, outputCfg.Adapter)
+	}
 }
@@ -0,0 +1,118 @@
+package trucktest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Print writes a line for each result to w, followed by the details of the
+// tests that didn't pass and a summary.
+func Print(w io.Writer, results []Result) {
+	failed := 0
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed() {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "%s %s/%s (%.2fs)\n", status, r.Case.Truck, r.Case.Name, r.Duration.Seconds())
+
+		if r.Error != nil {
+			fmt.Fprintf(w, "    error: %v\n", r.Error)
+		}
+		if r.Failure != "" {
+			fmt.Fprintf(w, "    %s\n", strings.ReplaceAll(r.Failure, "\n", "\n    "))
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d tests, %d passed, %d failed\n", len(results), len(results)-failed, failed)
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the results to w as JUnit XML, with a test suite for each
+// truck.
+func WriteJUnit(w io.Writer, results []Result) error {
+	report := junitTestSuites{}
+	suiteIndex := make(map[string]int)
+	suiteSeconds := make(map[string]float64)
+
+	for _, r := range results {
+		i, ok := suiteIndex[r.Case.Truck]
+		if !ok {
+			i = len(report.Suites)
+			suiteIndex[r.Case.Truck] = i
+			report.Suites = append(report.Suites, junitTestSuite{Name: r.Case.Truck})
+		}
+		suite := &report.Suites[i]
+
+		testCase := junitTestCase{
+			Name:      r.Case.Name,
+			Classname: r.Case.Truck,
+			Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+		}
+
+		if r.Error != nil {
+			testCase.Error = &junitProblem{Message: r.Error.Error(), Text: r.Error.Error()}
+			suite.Errors++
+			report.Errors++
+		} else if r.Failure != "" {
+			message, _, _ := strings.Cut(r.Failure, "\n")
+			testCase.Failure = &junitProblem{Message: message, Text: r.Failure}
+			suite.Failures++
+			report.Failures++
+		}
+
+		suite.Cases = append(suite.Cases, testCase)
+		suite.Tests++
+		report.Tests++
+		suiteSeconds[r.Case.Truck] += r.Duration.Seconds()
+	}
+
+	for i := range report.Suites {
+		report.Suites[i].Time = fmt.Sprintf("%.3f", suiteSeconds[report.Suites[i].Name])
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,146 @@
+package trucktest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Case is a test inside a truck's test directory. BackfillSql runs on the
+// input database before the truck starts, StreamSql runs once it's streaming
+// changes, and TestSql runs on the output database once the truck has caught
+// up. BackfillSql and StreamSql are optional.
+type Case struct {
+	Truck       string
+	Name        string
+	BackfillSql string
+	StreamSql   string
+	TestSql     string
+}
+
+// Result is the outcome of running a Case. Failure is set when test.sql found
+// something wrong, and Error when the test couldn't be run at all.
+type Result struct {
+	Case     Case
+	Duration time.Duration
+	Failure  string
+	Error    error
+}
+
+func (r Result) Passed() bool {
+	return r.Failure == "" && r.Error == nil
+}
+
+// Load returns the tests in <truckPath>/test, sorted by name. A truck without
+// a test directory has no tests.
+func Load(truckName string, truckPath string) ([]Case, error) {
+	testsPath := filepath.Join(truckPath, "test")
+	entries, err := os.ReadDir(testsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cases := make([]Case, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		c := Case{Truck: truckName, Name: entry.Name()}
+		dir := filepath.Join(testsPath, entry.Name())
+
+		if c.TestSql, err = readSql(dir, "test.sql"); err != nil {
+			return nil, err
+		} else if c.TestSql == "" {
+			return nil, fmt.Errorf("%s: test.sql is missing or empty", dir)
+		}
+
+		if c.BackfillSql, err = readSql(dir, "backfill.sql"); err != nil {
+			return nil, err
+		}
+
+		if c.StreamSql, err = readSql(dir, "stream.sql"); err != nil {
+			return nil, err
+		}
+
+		cases = append(cases, c)
+	}
+
+	return cases, nil
+}
+
+// Evaluate checks the rows returned by test.sql. The first column of every row
+// has to be true (or 1, since ClickHouse comparisons return a UInt8), and there
+// has to be at least one row. The failure describes each row that isn't true
+// with the rest of its columns, so test.sql can return expected and actual
+// values to show what went wrong.
+func Evaluate(columns []string, rows [][]any) string {
+	if len(columns) == 0 {
+		return "test.sql returned no columns"
+	}
+	if len(rows) == 0 {
+		return "test.sql returned no rows"
+	}
+
+	var failures []string
+	for i, row := range rows {
+		if len(row) == 0 {
+			failures = append(failures, fmt.Sprintf("row %d has no columns", i+1))
+			continue
+		}
+		if isTrue(row[0]) {
+			continue
+		}
+
+		values := make([]string, 0, len(row))
+		for j := 1; j < len(row) && j < len(columns); j++ {
+			values = append(values, fmt.Sprintf("%s=%v", columns[j], formatValue(row[j])))
+		}
+
+		failure := fmt.Sprintf("row %d: %s is %v", i+1, columns[0], formatValue(row[0]))
+		if len(values) > 0 {
+			failure += " (" + strings.Join(values, ", ") + ")"
+		}
+		failures = append(failures, failure)
+	}
+
+	return strings.Join(failures, "\n")
+}
+
+func isTrue(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case uint8:
+		return v == 1
+	case int64:
+		return v == 1
+	case int32:
+		return v == 1
+	default:
+		return false
+	}
+}
+
+func formatValue(value any) string {
+	if value == nil {
+		return "NULL"
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+func readSql(dir string, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
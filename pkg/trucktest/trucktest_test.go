@@ -0,0 +1,126 @@
+package trucktest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTest(t *testing.T, truckPath string, name string, files map[string]string) {
+	dir := filepath.Join(truckPath, "test", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, sql := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(sql), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	truckPath := t.TempDir()
+	writeTest(t, truckPath, "updates", map[string]string{
+		"backfill.sql": "INSERT INTO whiskies VALUES (1, 'Talisker')",
+		"stream.sql":   "UPDATE whiskies SET name = 'Talisker 10'",
+		"test.sql":     "SELECT name = 'Talisker 10' FROM whiskies_flat\n",
+	})
+	writeTest(t, truckPath, "backfill_only", map[string]string{
+		"test.sql": "SELECT count(*) = 0 FROM whiskies_flat",
+	})
+
+	cases, err := Load("whiskies", truckPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Case{
+		{Truck: "whiskies", Name: "backfill_only", TestSql: "SELECT count(*) = 0 FROM whiskies_flat"},
+		{
+			Truck:       "whiskies",
+			Name:        "updates",
+			BackfillSql: "INSERT INTO whiskies VALUES (1, 'Talisker')",
+			StreamSql:   "UPDATE whiskies SET name = 'Talisker 10'",
+			TestSql:     "SELECT name = 'Talisker 10' FROM whiskies_flat",
+		},
+	}
+	if len(cases) != len(expected) || cases[0] != expected[0] || cases[1] != expected[1] {
+		t.Errorf("Expected %+v, got %+v", expected, cases)
+	}
+}
+
+func TestLoadRequiresTestSql(t *testing.T) {
+	truckPath := t.TempDir()
+	writeTest(t, truckPath, "no_test", map[string]string{"stream.sql": "DELETE FROM whiskies"})
+
+	if _, err := Load("whiskies", truckPath); err == nil {
+		t.Error("Expected an error for a test without test.sql")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	columns := []string{"ok", "expected", "actual"}
+
+	if failure := Evaluate(columns, [][]any{{true, 4, 4}}); failure != "" {
+		t.Error("Expected a pass, got", failure)
+	}
+
+	if failure := Evaluate(columns, [][]any{{uint8(1), 4, 4}}); failure != "" {
+		t.Error("Expected a UInt8 1 to pass, got", failure)
+	}
+
+	if failure := Evaluate(columns, nil); failure != "test.sql returned no rows" {
+		t.Error("Expected a failure for no rows, got", failure)
+	}
+
+	if failure := Evaluate(nil, [][]any{{}}); failure != "test.sql returned no columns" {
+		t.Error("Expected a failure for no columns, got", failure)
+	}
+
+	if failure := Evaluate(columns, [][]any{{true, 4, 4}, {}}); failure != "row 2 has no columns" {
+		t.Error("Expected a failure for a row without columns, got", failure)
+	}
+
+	failure := Evaluate(columns, [][]any{{true, 4, 4}, {false, 5, nil}})
+	if failure != "row 2: ok is false (expected=5, actual=NULL)" {
+		t.Error("Expected the failing row to be described, got", failure)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	results := []Result{
+		{Case: Case{Truck: "whiskies", Name: "inserts"}, Duration: 1500 * time.Millisecond},
+		{Case: Case{Truck: "whiskies", Name: "updates"}, Failure: "row 1: ok is false\nrow 2: ok is false"},
+		{Case: Case{Truck: "countries", Name: "deletes"}, Error: errors.New("timed out")},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteJUnit(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+
+	var report junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Tests != 3 || report.Failures != 1 || report.Errors != 1 || len(report.Suites) != 2 {
+		t.Errorf("Expected 3 tests with 1 failure and 1 error in 2 suites, got %+v", report)
+	}
+
+	whiskies := report.Suites[0]
+	if whiskies.Name != "whiskies" || whiskies.Time != "1.500" || len(whiskies.Cases) != 2 {
+		t.Errorf("Unexpected whiskies suite %+v", whiskies)
+	}
+
+	failure := whiskies.Cases[1].Failure
+	if failure == nil || failure.Message != "row 1: ok is false" || !strings.Contains(failure.Text, "row 2") {
+		t.Errorf("Expected the failure's first line as message and every line as text, got %+v", failure)
+	}
+}
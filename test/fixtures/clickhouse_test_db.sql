@@ -9,7 +9,8 @@ CREATE TABLE whiskies_flat (
   deleted AggregateFunction(argMax, Boolean, DateTime64)
 )
 ENGINE = AggregatingMergeTree
-ORDER BY id;
+ORDER BY id
+SETTINGS non_replicated_deduplication_window = 100;
 
 CREATE VIEW v_whiskies_flat AS
 SELECT * FROM (
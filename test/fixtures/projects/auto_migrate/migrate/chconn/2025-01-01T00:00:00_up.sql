@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS trucker.whisky_notes (
+  whisky_id Int32,
+  note String
+)
+ENGINE = MergeTree
+ORDER BY whisky_id;
@@ -3,6 +3,7 @@ package helpers
 import (
 	"context"
 	"fmt"
+	"iter"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -13,6 +14,7 @@ import (
 	"github.com/jackc/pgx/v5"
 
 	"github.com/tonyfg/trucker/pkg/config"
+	"github.com/tonyfg/trucker/pkg/db"
 )
 
 var (
@@ -36,8 +38,24 @@ var (
 		User:     "trucker",
 		Pass:     "trucker",
 	}
+	ReconnectCfg = config.Reconnect{
+		MaxAttempts:      3,
+		InitialBackoffMs: 100,
+		MaxBackoffMs:     1000,
+	}
 )
 
+// Changesets turns changesets into what Writer.WriteTransaction expects.
+func Changesets(changesets ...*db.ChanChangeset) iter.Seq2[*db.ChanChangeset, error] {
+	return func(yield func(*db.ChanChangeset, error) bool) {
+		for _, changeset := range changesets {
+			if !yield(changeset, nil) {
+				return
+			}
+		}
+	}
+}
+
 func PreparePostgresTestDb() *pgx.Conn {
 	conn := Connect(PostgresCfg)
 
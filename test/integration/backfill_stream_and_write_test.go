@@ -26,14 +26,23 @@ func TestBackfillReplicationReadAndWrite(t *testing.T) {
 	defer pgConn.Close(context.Background())
 	chConn := helpers.PrepareClickhouseTestDb()
 	defer chConn.Close()
-	rc := postgres.NewReplicationClient([]string{"public.whiskies"}, helpers.PostgresCfg, "2")
+	rc, err := postgres.NewReplicationClient([]string{"public.whiskies"}, nil, helpers.PostgresCfg, helpers.ReconnectCfg, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	r := truck.NewReader(
+	r, err := truck.NewReader(
+		"test",
 		readQuery,
 		helpers.PostgresCfg,
+		false,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	w := truck.NewWriter(
+	w, err := truck.NewWriter(
+		"test",
 		"test",
 		`INSERT INTO trucker.whiskies_flat (id, name, age, type, country)
 SELECT id,
@@ -46,12 +55,18 @@ GROUP BY id`,
 		helpers.ClickhouseCfg,
 		"2",
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	_, snapshotLsn, snapshotName := rc.Setup()
+	_, snapshotLsn, snapshotName, err := rc.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Jack Daniels isn't supposed to show up in the backfill, since it was
 	// added after the snapshot was created. It should be streamed later on...
-	_, err := pgConn.Exec(
+	_, err = pgConn.Exec(
 		context.Background(),
 		"INSERT INTO public.whiskies (name, age, whisky_type_id) VALUES ('Jack Daniels', 7, 1)",
 	)
@@ -59,7 +74,16 @@ GROUP BY id`,
 		t.Error(err)
 	}
 
-	changeset := rc.ReadBackfillData("public.whiskies", snapshotName, readQuery)
+	reader, err := rc.NewSnapshotReader(snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	changeset, err := reader.ReadChunk("public.whiskies", readQuery, db.TableFilter{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	cols := changeset.Columns
 
 	for {
@@ -78,7 +102,9 @@ GROUP BY id`,
 			Columns:   cols,
 			Rows:      rowChan,
 		}
-		w.Write(changeset)
+		if _, err := w.Write(changeset); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	expectedColumns := []string{"id", "name", "age", "type", "country"}
@@ -105,7 +131,10 @@ got %T %v`, expectedRows, expectedRows, rows, rows)
 	// TODO: Check that LSN moved forward
 
 	// Now let's stream Jack Daniels
-	streamChan := rc.Start(snapshotLsn, 0)
+	streamChan, err := rc.Start(snapshotLsn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 	processedChangeset := false
 
 	select {
@@ -116,8 +145,14 @@ got %T %v`, expectedRows, expectedRows, rows, rows)
 				t.Error("Expected insert operation, got", db.OperationStr(changeset.Operation))
 			}
 
-			result := r.Read(changeset)
-			w.Write(result)
+			result, err := r.Read(changeset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := w.Write(result); err != nil {
+				t.Fatal(err)
+			}
 		}
 	case <-time.After(3 * time.Second):
 		t.Error("Reading from channel took too long...")
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ClickHouse/ch-go"
+	"github.com/ClickHouse/ch-go/proto"
+
+	"github.com/tonyfg/trucker/test/helpers"
+)
+
+func TestAutoMigrate(t *testing.T) {
+	pgConn := helpers.PreparePostgresTestDb()
+	defer pgConn.Close(context.Background())
+	chConn := helpers.PrepareClickhouseTestDb()
+	defer chConn.Close()
+
+	exitChan := startTrucker("auto_migrate")
+	defer close(exitChan)
+
+	// Migrations are applied before the trucks start
+	var cnt proto.ColUInt64
+	if err := chConn.Do(context.Background(), ch.Query{
+		Body:   "SELECT count(*) cnt FROM system.tables WHERE database = 'trucker' AND name = 'whisky_notes'",
+		Result: proto.Results{{Name: "cnt", Data: &cnt}},
+	}); err != nil {
+		t.Error("Failed to query system.tables", err)
+	}
+	if cnt.Row(0) != 1 {
+		t.Error("Expected the migration to have created whisky_notes")
+	}
+
+	waitForClickhouseWhiskies(t, chConn, 4)
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/ch-go"
+	"github.com/ClickHouse/ch-go/proto"
 
 	"github.com/tonyfg/trucker/pkg/mainroutines"
 	"io"
@@ -17,17 +23,12 @@ var (
 )
 
 func startTrucker(project string) chan struct{} {
-	_, _, trucksByInputConnection := mainroutines.Start(Basepath + "/../fixtures/projects/" + project)
+	_, _, trucksByInputConnection := mainroutines.Start(mainroutines.Options{ProjectPath: Basepath + "/../fixtures/projects/" + project})
 	exitChan := make(chan struct{})
 
 	go func() {
 		<-exitChan
-
-		for _, trucks := range trucksByInputConnection {
-			for _, truck := range trucks {
-				truck.Stop()
-			}
-		}
+		mainroutines.Stop(trucksByInputConnection)
 	}()
 
 	return exitChan
@@ -42,22 +43,40 @@ func cloneProjectAndStart(project string) chan struct{} {
 		panic(err)
 	}
 
-	_, _, trucksByInputConnection := mainroutines.Start(tmpPath + project)
+	_, _, trucksByInputConnection := mainroutines.Start(mainroutines.Options{ProjectPath: tmpPath + project})
 	exitChan := make(chan struct{})
 
 	go func() {
 		<-exitChan
-
-		for _, trucks := range trucksByInputConnection {
-			for _, truck := range trucks {
-				truck.Stop()
-			}
-		}
+		mainroutines.Stop(trucksByInputConnection)
 	}()
 
 	return exitChan
 }
 
+// waitForClickhouseWhiskies waits for v_whiskies_flat to have count rows,
+// and fails the test if it doesn't get there in a few seconds.
+func waitForClickhouseWhiskies(t *testing.T, chConn *ch.Client, count uint64) {
+	for i := 0; ; i++ {
+		var cnt proto.ColUInt64
+		if err := chConn.Do(context.Background(), ch.Query{
+			Body:   "SELECT count(*) cnt FROM trucker.v_whiskies_flat",
+			Result: proto.Results{{Name: "cnt", Data: &cnt}},
+		}); err != nil {
+			t.Error("Failed to query v_whiskies_flat", err)
+		}
+
+		if cnt.Row(0) == count {
+			return
+		} else if i > 10 {
+			t.Error("Expected ", count, " rows in whiskies_flat but found ", cnt.Row(0))
+			return
+		}
+
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
 func copyFile(src, dst string) error {
 	var err error
 	var srcfd *os.File
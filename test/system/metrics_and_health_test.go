@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonyfg/trucker/test/helpers"
+)
+
+func TestMetricsAndHealth(t *testing.T) {
+	pgConn := helpers.PreparePostgresTestDb()
+	defer pgConn.Close(context.Background())
+	chConn := helpers.PrepareClickhouseTestDb()
+	defer chConn.Close()
+
+	exitChan := startTrucker("metrics_and_health")
+	defer close(exitChan)
+
+	waitForClickhouseWhiskies(t, chConn, 4)
+	pgConn.Exec(context.Background(), "INSERT INTO public.whiskies (name, age, whisky_type_id) VALUES ('Jack Daniels', 5, 1)")
+	waitForClickhouseWhiskies(t, chConn, 5)
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://127.0.0.1:9090" + path)
+		if err != nil {
+			t.Error("Failed to get", path, err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Metrics and health checks share the listen address
+	if status, body := get("/metrics"); status != http.StatusOK || !strings.Contains(body, `trucker_rows_total{operation="insert",truck="truck"}`) {
+		t.Error("Expected metrics for the row inserted, got ", status, body)
+	}
+
+	if status, body := get("/healthz"); status != http.StatusOK {
+		t.Error("Expected trucker to be healthy, got ", status, body)
+	}
+
+	for i := 0; ; i++ {
+		status, body := get("/readyz")
+		if status == http.StatusOK {
+			break
+		} else if i > 10 {
+			t.Error("Expected trucker to be ready once it's streaming, got ", status, body)
+			break
+		}
+
+		time.Sleep(300 * time.Millisecond)
+	}
+}
@@ -17,7 +17,7 @@ func TestPostgresToPostgres(t *testing.T) {
 
 	currentPosition := func() uint64 {
 		var lsn uint64
-		row := conn.QueryRow(context.Background(), "SELECT lsn FROM trucker_current_lsn__pg_input_conn")
+		row := conn.QueryRow(context.Background(), "SELECT lsn FROM trucker_truck_lsn__truck")
 		row.Scan(&lsn)
 		return lsn
 	}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tonyfg/trucker/test/helpers"
+)
+
+func TestReconnect(t *testing.T) {
+	pgConn := helpers.PreparePostgresTestDb()
+	defer pgConn.Close(context.Background())
+	chConn := helpers.PrepareClickhouseTestDb()
+	defer chConn.Close()
+
+	exitChan := startTrucker("reconnect")
+	defer close(exitChan)
+
+	waitForClickhouseWhiskies(t, chConn, 4)
+
+	// Drop the replication connection, which trucker should reconnect
+	_, err := pgConn.Exec(context.Background(), "SELECT pg_terminate_backend(active_pid) FROM pg_replication_slots WHERE slot_name = 'trucker_trucker2' AND active")
+	if err != nil {
+		t.Fatal("Couldn't terminate the replication connection", err)
+	}
+
+	pgConn.Exec(context.Background(), "INSERT INTO public.whiskies (name, age, whisky_type_id) VALUES ('Jack Daniels', 5, 1)")
+	waitForClickhouseWhiskies(t, chConn, 5)
+}